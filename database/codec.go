@@ -0,0 +1,118 @@
+package database
+
+import (
+	"sync"
+
+	"github.com/dchaykin/mygolib/log"
+	"go.mongodb.org/mongo-driver/bson"
+)
+
+// FieldCodec transforms the fields of domain entities on their way into and out of the database, e.g. to encrypt
+// them. EncodeFields is called before an entity is written, DecodeFields after it has been read. Both change the
+// fields of the entity in place, DecodeFields must accept fields which have not been encoded.
+type FieldCodec interface {
+	EncodeFields(entity DomainEntity) error
+	DecodeFields(entity DomainEntity) error
+}
+
+var (
+	codecMu    sync.RWMutex
+	fieldCodec FieldCodec
+)
+
+// SetFieldCodec sets the codec applied to all domain entities, nil removes it
+func SetFieldCodec(codec FieldCodec) {
+	codecMu.Lock()
+	defer codecMu.Unlock()
+	fieldCodec = codec
+}
+
+// GetFieldCodec returns the codec set by SetFieldCodec, nil if none is set
+func GetFieldCodec() FieldCodec {
+	return getFieldCodec()
+}
+
+func getFieldCodec() FieldCodec {
+	codecMu.RLock()
+	defer codecMu.RUnlock()
+	return fieldCodec
+}
+
+func decodeFields(entity DomainEntity) error {
+	if codec := getFieldCodec(); codec != nil {
+		return codec.DecodeFields(entity)
+	}
+	return nil
+}
+
+// WithEncodedFields calls f with the fields of the entity encoded by the codec set by SetFieldCodec and decodes
+// them afterwards, e.g. to write the entity with RewriteEntity
+func WithEncodedFields(entity DomainEntity, f func() error) error {
+	return withEncodedFields(entity, f)
+}
+
+// withEncodedFields calls f with the fields of the entity encoded and decodes them afterwards, so that
+// the caller keeps the plain values
+func withEncodedFields(entity DomainEntity, f func() error) error {
+	codec := getFieldCodec()
+	if codec == nil {
+		return f()
+	}
+
+	// an encoding failing halfway must not leave the caller with partly encoded fields
+	original := copyFields(entity.Entity())
+	if err := codec.EncodeFields(entity); err != nil {
+		restoreFields(entity.Entity(), original)
+		return err
+	}
+	err := f()
+	if decodeErr := codec.DecodeFields(entity); decodeErr != nil {
+		log.Errorf("could not decode the fields of %s after writing: %v", entity.UUID(), decodeErr)
+		if err == nil {
+			err = decodeErr
+		}
+	}
+	return err
+}
+
+// copyFields copies the maps and lists of the fields, keeping their types
+func copyFields(fields map[string]any) map[string]any {
+	if fields == nil {
+		return nil
+	}
+	result := make(map[string]any, len(fields))
+	for key, value := range fields {
+		result[key] = copyFieldValue(value)
+	}
+	return result
+}
+
+func copyFieldValue(value any) any {
+	switch v := value.(type) {
+	case map[string]any:
+		return copyFields(v)
+	case bson.M:
+		return bson.M(copyFields(v))
+	case []any:
+		result := make([]any, len(v))
+		for i, item := range v {
+			result[i] = copyFieldValue(item)
+		}
+		return result
+	case bson.A:
+		result := make(bson.A, len(v))
+		for i, item := range v {
+			result[i] = copyFieldValue(item)
+		}
+		return result
+	}
+	return value
+}
+
+// restoreFields puts the original fields back into the map of the entity
+func restoreFields(fields, original map[string]any) {
+	clear(fields)
+	for key, value := range original {
+		fields[key] = value
+	}
+}
@@ -0,0 +1,41 @@
+package database
+
+import (
+	"fmt"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+// failingCodec encodes the fields one after another and fails on the field "broken"
+type failingCodec struct{}
+
+func (c failingCodec) EncodeFields(entity DomainEntity) error {
+	fields := entity.Entity()
+	fields["name"] = "encoded"
+	nested := fields["address"].(map[string]any)
+	nested["city"] = "encoded"
+	if _, ok := fields["broken"]; ok {
+		return fmt.Errorf("cannot encode broken")
+	}
+	return nil
+}
+
+func (c failingCodec) DecodeFields(entity DomainEntity) error {
+	return nil
+}
+
+func TestEncodeFieldsFailure(t *testing.T) {
+	session := openMemorySession(t)
+	defer session.Close()
+	SetFieldCodec(failingCodec{})
+	t.Cleanup(func() { SetFieldCodec(nil) })
+
+	entity := newTestEntity("a1", map[string]any{"name": "Alpha", "address": map[string]any{"city": "Berlin"}, "broken": true})
+	require.ErrorContains(t, session.InsertEntity(t.Context(), entity), "cannot encode broken")
+	require.Equal(t, map[string]any{"uuid": "a1", "name": "Alpha", "address": map[string]any{"city": "Berlin"}, "broken": true}, entity.Fields)
+
+	found, err := session.GetEntityByUUID(t.Context(), "a1", &testEntity{})
+	require.NoError(t, err)
+	require.False(t, found)
+}
@@ -0,0 +1,230 @@
+package database
+
+import (
+	"crypto/tls"
+	"encoding/json"
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"go.mongodb.org/mongo-driver/mongo/options"
+	"go.mongodb.org/mongo-driver/mongo/readpref"
+)
+
+const (
+	DefaultClientName = "default"
+
+	defaultAuthMechanism  = "SCRAM-SHA-1"
+	defaultConnectTimeout = 15 * time.Second
+
+	defaultHealthCheckInterval = 10 * time.Second
+)
+
+// Config describes the connection to a mongo cluster. Either URI, a complete mongodb:// or mongodb+srv://
+// connection string, or Host must be set. The other options override the ones given in the URI.
+type Config struct {
+	// Name of the client, see WithClient. Empty means DefaultClientName.
+	Name string `json:"name,omitempty"`
+
+	URI string `json:"uri,omitempty"`
+	// Host is a host[:port] or a comma separated list of them, or the DNS name of the cluster if SRV is set
+	Host string `json:"host,omitempty"`
+	SRV  bool   `json:"srv,omitempty"`
+	TLS  bool   `json:"tls,omitempty"`
+
+	Username      string `json:"username,omitempty"`
+	Password      string `json:"password,omitempty"`
+	AuthMechanism string `json:"authMechanism,omitempty"`
+	AuthSource    string `json:"authSource,omitempty"`
+
+	ReplicaSet string `json:"replicaSet,omitempty"`
+	// ReadPreference is one of primary, primaryPreferred, secondary, secondaryPreferred or nearest
+	ReadPreference string `json:"readPreference,omitempty"`
+	MinPoolSize    uint64 `json:"minPoolSize,omitempty"`
+	MaxPoolSize    uint64 `json:"maxPoolSize,omitempty"`
+	// ConnectTimeout is a duration like "15s", the default is 15 seconds
+	ConnectTimeout string `json:"connectTimeout,omitempty"`
+	// HealthCheckInterval is the duration between two pings of the server, the default is 10 seconds
+	HealthCheckInterval string `json:"healthCheckInterval,omitempty"`
+	// PreImages makes change streams deliver deleted entities, see ChangeEvent. It needs MongoDB 6.0 or later,
+	// older servers reject the watch.
+	PreImages bool `json:"preImages,omitempty"`
+}
+
+// ConfigFromEnv reads the configuration of the named client from the environment variables MONGOHOST,
+// MONGO_URI, MONGO_SRV, MONGO_WITH_TLS, MONGO_USERNAME, MONGO_PASSWORD, MONGO_AUTH_MECHANISM,
+// MONGO_AUTH_SOURCE, MONGO_REPLICA_SET, MONGO_READ_PREFERENCE, MONGO_MIN_POOL_SIZE, MONGO_MAX_POOL_SIZE,
+// MONGO_CONNECT_TIMEOUT, MONGO_HEALTH_CHECK_INTERVAL and MONGO_PRE_IMAGES. For other clients than the default one the variables are prefixed with
+// the upper case name, e.g. REPORTING_MONGOHOST.
+func ConfigFromEnv(name string) (Config, error) {
+	prefix := ""
+	if name != "" && name != DefaultClientName {
+		prefix = strings.ToUpper(name) + "_"
+	}
+	env := func(key string) string {
+		return os.Getenv(prefix + key)
+	}
+
+	result := Config{
+		Name:           name,
+		URI:            env("MONGO_URI"),
+		Host:           env("MONGOHOST"),
+		SRV:            env("MONGO_SRV") == "true",
+		TLS:            env("MONGO_WITH_TLS") == "true",
+		Username:       env("MONGO_USERNAME"),
+		Password:       env("MONGO_PASSWORD"),
+		AuthMechanism:  env("MONGO_AUTH_MECHANISM"),
+		AuthSource:     env("MONGO_AUTH_SOURCE"),
+		ReplicaSet:     env("MONGO_REPLICA_SET"),
+		ReadPreference: env("MONGO_READ_PREFERENCE"),
+		ConnectTimeout: env("MONGO_CONNECT_TIMEOUT"),
+
+		HealthCheckInterval: env("MONGO_HEALTH_CHECK_INTERVAL"),
+		PreImages:           env("MONGO_PRE_IMAGES") == "true",
+	}
+
+	var err error
+	if result.MinPoolSize, err = parsePoolSize(prefix+"MONGO_MIN_POOL_SIZE", env("MONGO_MIN_POOL_SIZE")); err != nil {
+		return result, err
+	}
+	if result.MaxPoolSize, err = parsePoolSize(prefix+"MONGO_MAX_POOL_SIZE", env("MONGO_MAX_POOL_SIZE")); err != nil {
+		return result, err
+	}
+	return result, result.Validate()
+}
+
+func parsePoolSize(key, value string) (uint64, error) {
+	if value == "" {
+		return 0, nil
+	}
+	result, err := strconv.ParseUint(value, 10, 64)
+	if err != nil {
+		return 0, fmt.Errorf("invalid value of %s: %s", key, value)
+	}
+	return result, nil
+}
+
+// ConfigFromFile reads the configuration from a json file
+func ConfigFromFile(fileName string) (Config, error) {
+	result := Config{}
+	data, err := os.ReadFile(fileName)
+	if err != nil {
+		return result, err
+	}
+	if err = json.Unmarshal(data, &result); err != nil {
+		return result, fmt.Errorf("could not parse the mongo configuration %s: %w", fileName, err)
+	}
+	return result, result.Validate()
+}
+
+func (cfg Config) clientName() string {
+	if cfg.Name == "" {
+		return DefaultClientName
+	}
+	return cfg.Name
+}
+
+func (cfg Config) Validate() error {
+	if cfg.URI == "" && cfg.Host == "" {
+		return fmt.Errorf("neither an URI nor a host is configured for the mongo client %s", cfg.clientName())
+	}
+	if cfg.MaxPoolSize > 0 && cfg.MinPoolSize > cfg.MaxPoolSize {
+		return fmt.Errorf("the min pool size %d exceeds the max pool size %d", cfg.MinPoolSize, cfg.MaxPoolSize)
+	}
+	if _, err := cfg.connectTimeout(); err != nil {
+		return err
+	}
+	if _, err := cfg.healthCheckInterval(); err != nil {
+		return err
+	}
+	if _, err := cfg.readPreference(); err != nil {
+		return err
+	}
+	return nil
+}
+
+func (cfg Config) connectTimeout() (time.Duration, error) {
+	return parseDuration("connect timeout", cfg.ConnectTimeout, defaultConnectTimeout)
+}
+
+func (cfg Config) healthCheckInterval() (time.Duration, error) {
+	return parseDuration("health check interval", cfg.HealthCheckInterval, defaultHealthCheckInterval)
+}
+
+func parseDuration(name, value string, defaultValue time.Duration) (time.Duration, error) {
+	if value == "" {
+		return defaultValue, nil
+	}
+	result, err := time.ParseDuration(value)
+	if err != nil || result <= 0 {
+		return 0, fmt.Errorf("invalid %s %s", name, value)
+	}
+	return result, nil
+}
+
+func (cfg Config) readPreference() (*readpref.ReadPref, error) {
+	if cfg.ReadPreference == "" {
+		return nil, nil
+	}
+	mode, err := readpref.ModeFromString(cfg.ReadPreference)
+	if err != nil {
+		return nil, fmt.Errorf("invalid read preference %s", cfg.ReadPreference)
+	}
+	return readpref.New(mode)
+}
+
+func (cfg Config) uri() string {
+	if cfg.URI != "" {
+		return cfg.URI
+	}
+	scheme := "mongodb"
+	if cfg.SRV {
+		scheme = "mongodb+srv"
+	}
+	return fmt.Sprintf("%s://%s/", scheme, cfg.Host)
+}
+
+// ClientOptions returns the options passed to mongo.Connect
+func (cfg Config) ClientOptions() (*options.ClientOptions, error) {
+	if err := cfg.Validate(); err != nil {
+		return nil, err
+	}
+
+	result := options.Client().ApplyURI(cfg.uri())
+
+	if cfg.Username != "" {
+		mechanism := cfg.AuthMechanism
+		if mechanism == "" {
+			mechanism = defaultAuthMechanism
+		}
+		result.SetAuth(options.Credential{
+			AuthMechanism: mechanism,
+			AuthSource:    cfg.AuthSource,
+			Username:      cfg.Username,
+			Password:      cfg.Password,
+		})
+	}
+	if cfg.TLS {
+		result.SetTLSConfig(&tls.Config{})
+	}
+	if cfg.ReplicaSet != "" {
+		result.SetReplicaSet(cfg.ReplicaSet)
+	}
+	if cfg.MinPoolSize > 0 {
+		result.SetMinPoolSize(cfg.MinPoolSize)
+	}
+	if cfg.MaxPoolSize > 0 {
+		result.SetMaxPoolSize(cfg.MaxPoolSize)
+	}
+
+	rp, _ := cfg.readPreference()
+	if rp != nil {
+		result.SetReadPreference(rp)
+	}
+	timeout, _ := cfg.connectTimeout()
+	result.SetConnectTimeout(timeout)
+
+	return result, result.Validate()
+}
@@ -0,0 +1,93 @@
+package database
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+	"go.mongodb.org/mongo-driver/mongo/readpref"
+)
+
+func TestConfigFromEnv(t *testing.T) {
+	t.Setenv("MONGOHOST", "db1:27017,db2:27017")
+	t.Setenv("MONGO_USERNAME", "admin")
+	t.Setenv("MONGO_PASSWORD", "secret")
+	t.Setenv("MONGO_AUTH_SOURCE", "admin")
+	t.Setenv("MONGO_REPLICA_SET", "rs0")
+	t.Setenv("MONGO_READ_PREFERENCE", "secondaryPreferred")
+	t.Setenv("MONGO_MAX_POOL_SIZE", "50")
+	t.Setenv("MONGO_CONNECT_TIMEOUT", "5s")
+	t.Setenv("MONGO_PRE_IMAGES", "true")
+	t.Setenv("REPORTING_MONGO_URI", "mongodb://reporting:27017/?replicaSet=rs1")
+
+	cfg, err := ConfigFromEnv(DefaultClientName)
+	require.NoError(t, err)
+	require.True(t, cfg.PreImages)
+
+	opts, err := cfg.ClientOptions()
+	require.NoError(t, err)
+	require.Equal(t, []string{"db1:27017", "db2:27017"}, opts.Hosts)
+	require.Equal(t, "rs0", *opts.ReplicaSet)
+	require.Equal(t, "admin", opts.Auth.Username)
+	require.Equal(t, "admin", opts.Auth.AuthSource)
+	require.Equal(t, defaultAuthMechanism, opts.Auth.AuthMechanism)
+	require.Equal(t, readpref.SecondaryPreferredMode, opts.ReadPreference.Mode())
+	require.EqualValues(t, 50, *opts.MaxPoolSize)
+	require.Equal(t, 5*time.Second, *opts.ConnectTimeout)
+	require.Nil(t, opts.TLSConfig)
+
+	cfg, err = ConfigFromEnv("reporting")
+	require.NoError(t, err)
+	require.Equal(t, "reporting", cfg.clientName())
+	require.False(t, cfg.PreImages)
+
+	opts, err = cfg.ClientOptions()
+	require.NoError(t, err)
+	require.Equal(t, []string{"reporting:27017"}, opts.Hosts)
+	require.Equal(t, "rs1", *opts.ReplicaSet)
+	require.Nil(t, opts.Auth)
+	require.Equal(t, defaultConnectTimeout, *opts.ConnectTimeout)
+
+	t.Setenv("MONGO_MAX_POOL_SIZE", "many")
+	_, err = ConfigFromEnv("")
+	require.ErrorContains(t, err, "invalid value of MONGO_MAX_POOL_SIZE")
+}
+
+func TestConfigFromFile(t *testing.T) {
+	fileName := filepath.Join(t.TempDir(), "mongo.json")
+	require.NoError(t, os.WriteFile(fileName, []byte(`{
+		"name": "archive",
+		"host": "archive:27017",
+		"tls": true,
+		"minPoolSize": 2,
+		"readPreference": "nearest"
+	}`), 0o600))
+
+	cfg, err := ConfigFromFile(fileName)
+	require.NoError(t, err)
+	require.Equal(t, "mongodb://archive:27017/", cfg.uri())
+
+	opts, err := cfg.ClientOptions()
+	require.NoError(t, err)
+	require.NotNil(t, opts.TLSConfig)
+	require.EqualValues(t, 2, *opts.MinPoolSize)
+	require.Equal(t, readpref.NearestMode, opts.ReadPreference.Mode())
+}
+
+func TestConfigValidate(t *testing.T) {
+	require.ErrorContains(t, Config{}.Validate(), "neither an URI nor a host is configured for the mongo client default")
+	require.ErrorContains(t, Config{Host: "db", ReadPreference: "anywhere"}.Validate(), "invalid read preference anywhere")
+	require.ErrorContains(t, Config{Host: "db", ConnectTimeout: "soon"}.Validate(), "invalid connect timeout soon")
+	require.ErrorContains(t, Config{Host: "db", MinPoolSize: 10, MaxPoolSize: 5}.Validate(), "the min pool size 10 exceeds the max pool size 5")
+	require.Equal(t, "mongodb+srv://cluster.example.com/", Config{Host: "cluster.example.com", SRV: true}.uri())
+
+	_, err := Config{URI: "http://db"}.ClientOptions()
+	require.Error(t, err)
+}
+
+func TestOpenSessionWithUnknownClient(t *testing.T) {
+	_, err := OpenSession(WithClient("unknown"))
+	require.ErrorContains(t, err, "no mongo client unknown connected")
+}
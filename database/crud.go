@@ -10,19 +10,23 @@ import (
 	"go.mongodb.org/mongo-driver/mongo/options"
 )
 
+// namespaceNotFound is returned by mongo for operations on a collection which does not exist
+const namespaceNotFound = 26
+
 type Collection interface {
 	insertOne(ctx context.Context, record any) error
-	replaceOne(ctx context.Context, filter bson.M, replacement any, allowInsert bool) error
+	replaceOne(ctx context.Context, filter bson.M, replacement any, allowInsert bool) (bool, error)
 
-	updateEntity(ctx context.Context, doc DomainEntity) error
+	updateEntity(ctx context.Context, doc DomainEntity) (bool, error)
 	updateOne(ctx context.Context, filter bson.M, doc any) error
 
-	aggregate(ctx context.Context, match, group bson.M, result any) error
+	aggregate(ctx context.Context, pipeline Pipeline, result any) error
 
 	findOne(ctx context.Context, filter bson.M, doc any) (bool, error)
 	findEntity(ctx context.Context, filter bson.M, doc DomainEntity) (bool, error)
 	findMany(ctx context.Context, filter bson.M, docList any) error
-	findWithOptions(ctx context.Context, filter bson.M, result any, sort bson.D, offset, limit int64) error
+	findWithOptions(ctx context.Context, filter bson.M, result any, sort bson.D, projection bson.M, offset, limit int64) error
+	iterate(ctx context.Context, filter bson.M, sort bson.D, projection bson.M, f func(raw bson.Raw) error) error
 
 	get() *mongo.Collection
 
@@ -30,6 +34,8 @@ type Collection interface {
 	removeMany(ctx context.Context, filter bson.M) error
 
 	createIndex(ctx context.Context, mod mongo.IndexModel, opts ...*options.CreateIndexesOptions) error
+	listIndexes(ctx context.Context) ([]IndexSpec, error)
+	dropIndex(ctx context.Context, name string) error
 }
 
 func (c mongoCollection) get() *mongo.Collection {
@@ -41,14 +47,34 @@ func (c mongoCollection) createIndex(ctx context.Context, mod mongo.IndexModel,
 	return err
 }
 
-func (c mongoCollection) aggregate(ctx context.Context, match, group bson.M, result any) error {
-	pipeline := []bson.M{
-		{
-			"$match": match,
-		},
-		{
-			"$group": group,
-		}}
+func (c mongoCollection) listIndexes(ctx context.Context) ([]IndexSpec, error) {
+	cursor, err := c.collection.Indexes().List(ctx)
+	if err != nil {
+		var cmdErr mongo.CommandError
+		if errors.As(err, &cmdErr) && cmdErr.Code == namespaceNotFound {
+			return []IndexSpec{}, nil
+		}
+		return nil, err
+	}
+
+	indexes := []storedIndex{}
+	if err = cursor.All(ctx, &indexes); err != nil {
+		return nil, err
+	}
+
+	result := make([]IndexSpec, 0, len(indexes))
+	for _, index := range indexes {
+		result = append(result, index.spec())
+	}
+	return result, nil
+}
+
+func (c mongoCollection) dropIndex(ctx context.Context, name string) error {
+	_, err := c.collection.Indexes().DropOne(ctx, name)
+	return err
+}
+
+func (c mongoCollection) aggregate(ctx context.Context, pipeline Pipeline, result any) error {
 	cursor, err := c.collection.Aggregate(ctx, pipeline)
 	if err != nil {
 		return err
@@ -69,17 +95,19 @@ func (c mongoCollection) updateOne(ctx context.Context, filter bson.M, record an
 	return nil
 }
 
-func (c mongoCollection) replaceOne(ctx context.Context, filter bson.M, replacement any, allowInsert bool) error {
+// replaceOne returns true if a document has been replaced or inserted
+func (c mongoCollection) replaceOne(ctx context.Context, filter bson.M, replacement any, allowInsert bool) (bool, error) {
 	var opts *options.ReplaceOptions = nil
 	if allowInsert {
 		opts = &options.ReplaceOptions{}
 		opts.SetUpsert(true)
 	}
 
-	if _, err := c.collection.ReplaceOne(ctx, filter, replacement, opts); err != nil {
-		return err
+	result, err := c.collection.ReplaceOne(ctx, filter, replacement, opts)
+	if err != nil {
+		return false, err
 	}
-	return nil
+	return result.MatchedCount+result.UpsertedCount > 0, nil
 }
 
 func (c mongoCollection) insertOne(ctx context.Context, record any) error {
@@ -89,13 +117,13 @@ func (c mongoCollection) insertOne(ctx context.Context, record any) error {
 	return nil
 }
 
-func (c mongoCollection) updateEntity(ctx context.Context, doc DomainEntity) error {
-	_, err := c.collection.UpdateOne(ctx, bson.M{"entity.uuid": doc.UUID()}, bson.M{"$set": doc})
+func (c mongoCollection) updateEntity(ctx context.Context, doc DomainEntity) (bool, error) {
+	result, err := c.collection.UpdateOne(ctx, byUUID(doc.UUID()), bson.M{"$set": doc})
 	if err != nil {
-		return err
+		return false, err
 	}
 
-	return nil
+	return result.MatchedCount > 0, nil
 }
 
 func (c mongoCollection) removeOne(ctx context.Context, filter bson.M) error {
@@ -144,7 +172,10 @@ func (c mongoCollection) findOne(ctx context.Context, filter bson.M, doc any) (f
 	return true, err
 }
 
-func (c mongoCollection) findWithOptions(ctx context.Context, filter bson.M, result any, sort bson.D, offset, limit int64) error {
+func (c mongoCollection) findWithOptions(ctx context.Context, filter bson.M, result any, sort bson.D, projection bson.M, offset, limit int64) error {
+	if filter == nil {
+		filter = bson.M{}
+	}
 	findOpt := options.Find()
 	if offset != 0 {
 		findOpt.SetSkip(offset)
@@ -158,6 +189,9 @@ func (c mongoCollection) findWithOptions(ctx context.Context, filter bson.M, res
 		}
 		findOpt.SetSort(sort)
 	}
+	if len(projection) > 0 {
+		findOpt.SetProjection(projection)
+	}
 
 	cursor, err := c.collection.Find(ctx, filter, findOpt)
 	if err != nil {
@@ -171,7 +205,34 @@ func (c mongoCollection) findWithOptions(ctx context.Context, filter bson.M, res
 	return nil
 }
 
+// iterate passes the matching documents one by one to f, reading them batch by batch from the cursor
+func (c mongoCollection) iterate(ctx context.Context, filter bson.M, sort bson.D, projection bson.M, f func(raw bson.Raw) error) error {
+	findOpt := options.Find()
+	if sort != nil {
+		findOpt.SetSort(sort)
+	}
+	if len(projection) > 0 {
+		findOpt.SetProjection(projection)
+	}
+
+	cursor, err := c.collection.Find(ctx, filter, findOpt)
+	if err != nil {
+		return err
+	}
+	defer cursor.Close(ctx)
+
+	for cursor.Next(ctx) {
+		if err = f(cursor.Current); err != nil {
+			return err
+		}
+	}
+	return cursor.Err()
+}
+
 func (c mongoCollection) findMany(ctx context.Context, filter bson.M, result any) error {
+	if filter == nil {
+		filter = bson.M{}
+	}
 	cursor, err := c.collection.Find(ctx, filter)
 	if err != nil {
 		return err
@@ -192,79 +253,145 @@ func (c mongoCollection) findMany(ctx context.Context, filter bson.M, result any
 	return nil
 }
 
-func (ms mongoSession) Extract(coll Collection, filter bson.M, result *[]any, sort bson.D, offset, limit int64) (totalCount int64, err error) {
-	err = mongo.WithSession(context.Background(), ms.session, func(sc mongo.SessionContext) error {
-		totalCount, err = coll.get().CountDocuments(context.Background(), filter)
-		if err != nil {
-			return err
+func (ms mongoSession) Extract(ctx context.Context, coll Collection, filter bson.M, result *[]any, sort bson.D, offset, limit int64) (totalCount int64, err error) {
+	return ms.FindByQuery(ctx, coll, Query{filter: FilterFromBson(filter), sort: sort, total: true}, result, offset, limit)
+}
+
+// FindByQuery returns the total number of matching documents only if requested by Query.WithTotal, otherwise -1
+func (ms mongoSession) FindByQuery(ctx context.Context, coll Collection, query Query, result *[]any, offset, limit int64) (totalCount int64, err error) {
+	ctx, cancel := ms.operationContext(ctx)
+	defer cancel()
+
+	totalCount = -1
+	filter := query.Filter().Bson()
+	err = mongo.WithSession(ctx, ms.session, func(sc mongo.SessionContext) error {
+		if query.total {
+			if totalCount, err = coll.get().CountDocuments(sc, filter); err != nil {
+				return err
+			}
 		}
-		return coll.findWithOptions(sc, filter, result, sort, offset, limit)
+		return coll.findWithOptions(sc, filter, result, query.Sort(), query.Projection(), offset, limit)
 	})
 	return totalCount, err
 }
 
-func (ms mongoSession) ReplaceOne(coll Collection, filter bson.M, replacement any, allowInsert bool) (err error) {
-	return mongo.WithSession(context.Background(), ms.session, func(sc mongo.SessionContext) error {
-		return coll.replaceOne(sc, filter, replacement, allowInsert)
+// Iterate passes the documents matching the query one by one to f and stops at the first error returned by f.
+// The timeout of the session does not apply, since reading a large collection may take arbitrarily long.
+func (ms mongoSession) Iterate(ctx context.Context, coll Collection, query Query, f func(raw bson.Raw) error) error {
+	filter := query.Filter().Bson()
+	return mongo.WithSession(ctx, ms.session, func(sc mongo.SessionContext) error {
+		return coll.iterate(sc, filter, query.Sort(), query.Projection(), f)
 	})
+}
 
+func (ms mongoSession) CountDocuments(ctx context.Context, coll Collection, filter bson.M) (count int64, err error) {
+	ctx, cancel := ms.operationContext(ctx)
+	defer cancel()
+
+	err = mongo.WithSession(ctx, ms.session, func(sc mongo.SessionContext) error {
+		count, err = coll.get().CountDocuments(sc, filter)
+		return err
+	})
+	return count, err
 }
 
-func (ms mongoSession) UpdateOne(coll Collection, filter bson.M, doc any) (err error) {
-	return mongo.WithSession(context.Background(), ms.session, func(sc mongo.SessionContext) error {
+func (ms mongoSession) ReplaceOne(ctx context.Context, coll Collection, filter bson.M, replacement any, allowInsert bool) (err error) {
+	ctx, cancel := ms.operationContext(ctx)
+	defer cancel()
+
+	return mongo.WithSession(ctx, ms.session, func(sc mongo.SessionContext) error {
+		_, err := coll.replaceOne(sc, filter, replacement, allowInsert)
+		return err
+	})
+
+}
+
+func (ms mongoSession) UpdateOne(ctx context.Context, coll Collection, filter bson.M, doc any) (err error) {
+	ctx, cancel := ms.operationContext(ctx)
+	defer cancel()
+
+	return mongo.WithSession(ctx, ms.session, func(sc mongo.SessionContext) error {
 		return coll.updateOne(sc, filter, doc)
 	})
 
 }
 
-func (ms mongoSession) GetDatabaseNames() ([]string, error) {
-	cli, err := getMongoClient()
-	if err != nil {
-		return nil, err
-	}
-	return cli.client.ListDatabaseNames(context.Background(), bson.D{})
+func (ms mongoSession) GetDatabaseNames(ctx context.Context) ([]string, error) {
+	ctx, cancel := ms.operationContext(ctx)
+	defer cancel()
+
+	return ms.client.mongo().ListDatabaseNames(ctx, bson.D{})
 }
 
 func (ms mongoSession) GetCollection(databaseName, collectionName string) Collection {
 	return mongoCollection{
-		collection: client.client.Database(databaseName).Collection(collectionName),
+		collection: ms.client.DB(databaseName).Collection(collectionName),
 	}
 }
 
-func (ms mongoSession) InsertOne(coll Collection, record any) error {
-	return mongo.WithSession(context.Background(), ms.session, func(sc mongo.SessionContext) error {
+func (ms mongoSession) InsertOne(ctx context.Context, coll Collection, record any) error {
+	ctx, cancel := ms.operationContext(ctx)
+	defer cancel()
+
+	return mongo.WithSession(ctx, ms.session, func(sc mongo.SessionContext) error {
 		return coll.insertOne(sc, record)
 	})
 }
 
 func (ms mongoSession) GetDatabase(name string) *mongo.Database {
-	cli, err := getMongoClient()
-	if err != nil {
-		return nil
-	}
-	return cli.DB(name)
+	return ms.client.DB(name)
 }
 
-func (ms mongoSession) ReplaceEntityByUUID(doc DomainEntity, allowInsert bool) error {
+func (ms mongoSession) ReplaceEntityByUUID(ctx context.Context, doc DomainEntity, allowInsert bool) error {
 	if doc.UUID() == "" {
 		return fmt.Errorf("could not upsert an entity: no uuid has been set")
 	}
-	coll := ms.GetCollection(doc.DatabaseName(), doc.CollectionName())
-	return mongo.WithSession(context.Background(), ms.session, func(sc mongo.SessionContext) error {
-		return coll.replaceOne(sc, bson.M{"entity.uuid": doc.UUID()}, doc, allowInsert)
+
+	return withEncodedFields(doc, func() error {
+		return ms.WithTransaction(ctx, func(ctx context.Context, tx DatabaseSession) error {
+			coll := tx.GetCollection(doc.DatabaseName(), doc.CollectionName())
+			changed, err := replaceEntity(ctx, tx, doc, allowInsert, func(ctx context.Context, filter bson.M, allowInsert bool) (bool, error) {
+				return ms.replaceOne(ctx, coll, filter, doc, allowInsert)
+			})
+			if err != nil || !changed {
+				return err
+			}
+			return appendRevision(ctx, tx, doc, RevisionActionSave)
+		})
+	})
+}
+
+func (ms mongoSession) replaceOne(ctx context.Context, coll Collection, filter bson.M, replacement any, allowInsert bool) (changed bool, err error) {
+	ctx, cancel := ms.operationContext(ctx)
+	defer cancel()
+
+	err = mongo.WithSession(ctx, ms.session, func(sc mongo.SessionContext) error {
+		changed, err = coll.replaceOne(sc, filter, replacement, allowInsert)
+		return err
 	})
+	return changed, err
 }
 
-func (ms mongoSession) FindEntity(coll Collection, filter bson.M, doc DomainEntity) (found bool, err error) {
-	err = mongo.WithSession(context.Background(), ms.session, func(sc mongo.SessionContext) error {
+func (ms mongoSession) FindEntity(ctx context.Context, coll Collection, filter bson.M, doc DomainEntity) (found bool, err error) {
+	ctx, cancel := ms.operationContext(ctx)
+	defer cancel()
+
+	filter = excludeDeleted(filter)
+	err = mongo.WithSession(ctx, ms.session, func(sc mongo.SessionContext) error {
 		found, err = coll.findEntity(sc, filter, doc)
 		return err
 	})
-	return found, err
+	if err != nil || !found {
+		return found, err
+	}
+	return true, decodeFields(doc)
 }
 
-func (ms mongoSession) FindOne(coll Collection, filter bson.M, doc any) (found bool, err error) {
-	err = mongo.WithSession(context.Background(), ms.session, func(sc mongo.SessionContext) error {
+func (ms mongoSession) FindOne(ctx context.Context, coll Collection, filter bson.M, doc any) (found bool, err error) {
+	ctx, cancel := ms.operationContext(ctx)
+	defer cancel()
+
+	err = mongo.WithSession(ctx, ms.session, func(sc mongo.SessionContext) error {
 		found, err = coll.findOne(sc, filter, doc)
 		if err != nil {
 			return err
@@ -275,8 +402,11 @@ func (ms mongoSession) FindOne(coll Collection, filter bson.M, doc any) (found b
 	return found, err
 }
 
-func (ms mongoSession) FindMany(coll Collection, filter bson.M, docList any) error {
-	err := mongo.WithSession(context.Background(), ms.session, func(sc mongo.SessionContext) error {
+func (ms mongoSession) FindMany(ctx context.Context, coll Collection, filter bson.M, docList any) error {
+	ctx, cancel := ms.operationContext(ctx)
+	defer cancel()
+
+	err := mongo.WithSession(ctx, ms.session, func(sc mongo.SessionContext) error {
 		return coll.findMany(sc, filter, docList)
 	})
 
@@ -4,6 +4,8 @@ import (
 	"context"
 	"fmt"
 	"os"
+	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/dchaykin/mygolib/log"
@@ -18,42 +20,114 @@ const MAX_CONNECT_ATTEMPTS = 3
 
 type OnReadDomainEntity func(object DomainEntity) error
 
-func getMongoHost() string {
-	return os.Getenv("MONGOHOST")
+type mongoClient struct {
+	name string
+	cfg  Config
+
+	mu        sync.RWMutex
+	client    *mongo.Client
+	lastCheck time.Time
+	lastError error
+	// retired is set when the client has been replaced by Connect
+	retired bool
+	// disconnected is set by Disconnect. The client is kept, so that sessions still open get
+	// mongo.ErrClientDisconnected from their operations.
+	disconnected bool
+
+	connectMu sync.Mutex
+	sessions  atomic.Int64
+	watchOnce sync.Once
+	stop      chan struct{}
 }
 
-type mongoClient struct {
-	client *mongo.Client
+func newMongoClient(cfg Config) *mongoClient {
+	return &mongoClient{name: cfg.clientName(), cfg: cfg, stop: make(chan struct{})}
 }
 
-var client mongoClient
+var (
+	clientsMu sync.Mutex
+	clients   = map[string]*mongoClient{}
+)
 
 type DatabaseSession interface {
 	GetDatabase(name string) *mongo.Database
-	InsertOne(coll Collection, record interface{}) error
-	ReplaceOne(coll Collection, filter bson.M, replacement interface{}, allowInsert bool) error
-	UpdateOne(coll Collection, filter bson.M, replacement interface{}) error
-	FindEntity(coll Collection, filter bson.M, doc DomainEntity) (bool, error)
-	FindOne(coll Collection, filter bson.M, doc interface{}) (bool, error)
-	FindMany(coll Collection, filter bson.M, list interface{}) error
-	Extract(coll Collection, filter bson.M, result *[]interface{}, sort bson.D, offset, limit int64) (int64, error)
-	Aggregate(databaseName, collectionName string, match, group bson.M, result interface{}) error
+	InsertOne(ctx context.Context, coll Collection, record interface{}) error
+	ReplaceOne(ctx context.Context, coll Collection, filter bson.M, replacement interface{}, allowInsert bool) error
+	UpdateOne(ctx context.Context, coll Collection, filter bson.M, replacement interface{}) error
+	FindEntity(ctx context.Context, coll Collection, filter bson.M, doc DomainEntity) (bool, error)
+	FindOne(ctx context.Context, coll Collection, filter bson.M, doc interface{}) (bool, error)
+	FindMany(ctx context.Context, coll Collection, filter bson.M, list interface{}) error
+	Extract(ctx context.Context, coll Collection, filter bson.M, result *[]interface{}, sort bson.D, offset, limit int64) (int64, error)
+	FindByQuery(ctx context.Context, coll Collection, query Query, result *[]interface{}, offset, limit int64) (int64, error)
+	CountDocuments(ctx context.Context, coll Collection, filter bson.M) (int64, error)
+	Iterate(ctx context.Context, coll Collection, query Query, f func(raw bson.Raw) error) error
+	Watch(ctx context.Context, coll Collection, pipeline Pipeline, resumeAfter bson.Raw) (ChangeStream, error)
+	Aggregate(ctx context.Context, databaseName, collectionName string, match, group bson.M, result interface{}) error
+	AggregatePipeline(ctx context.Context, coll Collection, pipeline Pipeline, result interface{}) error
 	GetCollection(databaseName, collectionName string) Collection
-	GetDatabaseNames() ([]string, error)
-	GetCollectionNames(dbName string) ([]string, error)
-	GetEntityByUUID(uuid string, requestedObject DomainEntity) (bool, error)
-	InsertEntity(entity DomainEntity) error
-	UpdateEntityByUUID(updatedObject DomainEntity) error
-	SaveEntityToHistory(entity DomainEntity) error
-	ReplaceEntityByUUID(entity DomainEntity, allowInsert bool) error
-	RemoveOne(collection Collection, selector bson.M) error
-	RemoveEntity(entity DomainEntity) error
-	CreateIndex(c Collection, mod mongo.IndexModel, opts ...*options.CreateIndexesOptions) error
+	GetDatabaseNames(ctx context.Context) ([]string, error)
+	GetCollectionNames(ctx context.Context, dbName string) ([]string, error)
+	GetEntityByUUID(ctx context.Context, uuid string, requestedObject DomainEntity) (bool, error)
+	InsertEntity(ctx context.Context, entity DomainEntity) error
+	UpdateEntityByUUID(ctx context.Context, updatedObject DomainEntity) error
+	SaveEntityToHistory(ctx context.Context, entity DomainEntity) error
+	ReplaceEntityByUUID(ctx context.Context, entity DomainEntity, allowInsert bool) error
+	WithTransaction(ctx context.Context, f TransactionFunc) error
+	RemoveOne(ctx context.Context, collection Collection, selector bson.M) error
+	RemoveMany(ctx context.Context, collection Collection, selector bson.M) error
+	RemoveEntity(ctx context.Context, entity DomainEntity) error
+	CreateIndex(ctx context.Context, c Collection, mod mongo.IndexModel, opts ...*options.CreateIndexesOptions) error
+	ListIndexes(ctx context.Context, c Collection) ([]IndexSpec, error)
+	DropIndex(ctx context.Context, c Collection, name string) error
 	Close() error
 }
 
+type sessionOptions struct {
+	timeout    time.Duration
+	clientName string
+}
+
+// SessionOption configures a session opened by OpenSession
+type SessionOption func(opts *sessionOptions)
+
+// WithTimeout limits every single operation of the session to the given duration.
+// The deadline of the context passed to an operation still applies if it is shorter.
+func WithTimeout(timeout time.Duration) SessionOption {
+	return func(opts *sessionOptions) {
+		opts.timeout = timeout
+	}
+}
+
+// WithClient opens the session on the named client instead of the default one, see Connect
+func WithClient(name string) SessionOption {
+	return func(opts *sessionOptions) {
+		opts.clientName = name
+	}
+}
+
+func newSessionOptions(opts []SessionOption) sessionOptions {
+	result := sessionOptions{clientName: DefaultClientName}
+	for _, opt := range opts {
+		opt(&result)
+	}
+	return result
+}
+
+func (so sessionOptions) operationContext(ctx context.Context) (context.Context, context.CancelFunc) {
+	if ctx == nil {
+		ctx = context.Background()
+	}
+	if so.timeout <= 0 {
+		return context.WithCancel(ctx)
+	}
+	return context.WithTimeout(ctx, so.timeout)
+}
+
 type mongoSession struct {
-	session mongo.Session
+	sessionOptions
+	client        *mongoClient
+	session       mongo.Session
+	inTransaction bool
 }
 
 func (ms mongoSession) Error() string {
@@ -64,84 +138,195 @@ type mongoCollection struct {
 	collection *mongo.Collection
 }
 
-func getMongoClient() (*mongoClient, error) {
-	var err error
-	if !client.isConnected() {
-		if getMongoHost() == "" {
+// Connect connects the client named in the configuration and registers it for OpenSession, see WithClient.
+// A client already registered under the name is disconnected as soon as its last session is closed. Without
+// a call of Connect the default client is configured from the environment, see ConfigFromEnv. Connect after
+// Shutdown reopens the database access.
+func Connect(cfg Config) error {
+	mc := newMongoClient(cfg)
+	if err := mc.ensureConnected(context.Background()); err != nil {
+		return fmt.Errorf("could not establish a connection to the mongo server: %w", err)
+	}
+	registerClient(mc)
+	return nil
+}
+
+func registerClient(mc *mongoClient) {
+	clientsMu.Lock()
+	previous := clients[mc.name]
+	clients[mc.name] = mc
+	shuttingDown.Store(false)
+	clientsMu.Unlock()
+
+	if previous != nil {
+		previous.retire()
+	}
+}
+
+// retire disconnects the client after its last session has been closed, new sessions are not opened on it
+func (mc *mongoClient) retire() {
+	mc.mu.Lock()
+	mc.retired = true
+	mc.mu.Unlock()
+
+	if mc.sessions.Load() == 0 {
+		mc.disconnectRetired()
+	}
+}
+
+// release is called whenever a session of the client is closed
+func (mc *mongoClient) release() {
+	if mc.sessions.Add(-1) > 0 {
+		return
+	}
+	mc.mu.RLock()
+	retired := mc.retired
+	mc.mu.RUnlock()
+	if retired {
+		mc.disconnectRetired()
+	}
+}
+
+func (mc *mongoClient) disconnectRetired() {
+	if err := mc.Disconnect(context.Background()); err != nil {
+		log.WrapError(err)
+	}
+}
+
+func getMongoClient(name string) (*mongoClient, error) {
+	clientsMu.Lock()
+	mc, ok := clients[name]
+	if !ok {
+		if name != DefaultClientName {
+			clientsMu.Unlock()
+			return nil, fmt.Errorf("no mongo client %s connected", name)
+		}
+		if os.Getenv("MONGOHOST") == "" && os.Getenv("MONGO_URI") == "" {
+			clientsMu.Unlock()
 			return nil, fmt.Errorf("environment variable MONGOHOST is not set. Could not establish a mongo connection")
 		}
-		err = client.connect()
+		cfg, err := ConfigFromEnv(name)
 		if err != nil {
-			return nil, fmt.Errorf("could not establish a connection to the mongo server: %v", err)
+			clientsMu.Unlock()
+			return nil, err
 		}
+		mc = newMongoClient(cfg)
+		clients[name] = mc
 	}
-	return &client, nil
+	clientsMu.Unlock()
+
+	if err := mc.ensureConnected(context.Background()); err != nil {
+		return nil, fmt.Errorf("could not establish a connection to the mongo server: %v", err)
+	}
+	return mc, nil
+}
+
+func (mc *mongoClient) mongo() *mongo.Client {
+	mc.mu.RLock()
+	defer mc.mu.RUnlock()
+	return mc.client
 }
 
-func (mc mongoClient) DB(name string) *mongo.Database {
-	return mc.client.Database(name)
+func (mc *mongoClient) DB(name string) *mongo.Database {
+	return mc.mongo().Database(name)
 }
 
+// connect replaces the mongo client by a new one, if the new one answers a ping
 func (mc *mongoClient) connect() error {
-	credential := options.Credential{
-		AuthMechanism: "SCRAM-SHA-1",
-		Username:      os.Getenv("MONGO_USERNAME"),
-		Password:      os.Getenv("MONGO_PASSWORD"),
-	}
-	params := ""
-	if os.Getenv("MONGO_WITH_TLS") == "true" {
-		params = "tls=true"
-	}
-	if params != "" {
-		params = "?" + params
+	clientOpts, err := mc.cfg.ClientOptions()
+	if err != nil {
+		return err
 	}
 
-	connString := fmt.Sprintf("mongodb://%s/%s", os.Getenv("MONGOHOST"), params)
-	clientOpts := options.Client().ApplyURI(connString).SetAuth(credential)
-
-	var err error
-	ctx, cancel := context.WithTimeout(context.Background(), 15*time.Second)
-	mc.client, err = mongo.Connect(ctx, clientOpts)
-	if cancel != nil {
-		defer cancel()
-	}
+	timeout, _ := mc.cfg.connectTimeout()
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
 
+	cli, err := mongo.Connect(ctx, clientOpts)
 	if err != nil {
 		return err
 	}
-	return mc.ping(ctx)
+	if err = cli.Ping(ctx, readpref.Primary()); err != nil {
+		cli.Disconnect(context.Background())
+		return err
+	}
+
+	mc.mu.Lock()
+	previous := mc.client
+	mc.client = cli
+	mc.lastCheck, mc.lastError = time.Now(), nil
+	mc.mu.Unlock()
+
+	if previous != nil {
+		// running operations of the previous client are not interrupted
+		go previous.Disconnect(context.Background())
+	}
+	return nil
 }
 
 func (mc *mongoClient) ping(ctx context.Context) error {
-	return mc.client.Ping(ctx, readpref.Primary())
+	return mc.mongo().Ping(ctx, readpref.Primary())
 }
 
+// isConnected returns the result of the last health check, the server is not pinged
 func (mc *mongoClient) isConnected() bool {
-	if mc.client != nil {
-		if err := mc.ping(context.Background()); err != nil {
-			log.WrapError(err)
-			return false
-		}
-		return true
+	mc.mu.RLock()
+	defer mc.mu.RUnlock()
+	return mc.client != nil && !mc.disconnected && mc.lastError == nil
+}
+
+func (mc *mongoClient) Disconnect(ctx context.Context) error {
+	select {
+	case <-mc.stop:
+	default:
+		close(mc.stop)
 	}
-	return false
+
+	mc.mu.Lock()
+	cli := mc.client
+	alreadyDisconnected := mc.disconnected
+	mc.disconnected = true
+	mc.mu.Unlock()
+
+	if cli == nil || alreadyDisconnected {
+		return nil
+	}
+	return cli.Disconnect(ctx)
+}
+
+// Backend opens sessions on a storage. The mongo client is used if no backend has been set.
+type Backend interface {
+	OpenSession(opts ...SessionOption) (DatabaseSession, error)
 }
 
-func (mc *mongoClient) Disconnect() error {
-	return mc.client.Disconnect(context.Background())
+var activeBackend Backend
+
+// SetBackend replaces the storage used by OpenSession, e.g. by a MemoryBackend in unit tests.
+// A nil backend switches back to mongo.
+func SetBackend(backend Backend) {
+	activeBackend = backend
 }
 
-func OpenSession() (DatabaseSession, error) {
-	cli, err := getMongoClient()
+func OpenSession(opts ...SessionOption) (DatabaseSession, error) {
+	if activeBackend != nil {
+		return activeBackend.OpenSession(opts...)
+	}
+	if shuttingDown.Load() {
+		return nil, fmt.Errorf("the database access has been shut down")
+	}
+
+	result := mongoSession{sessionOptions: newSessionOptions(opts)}
+	cli, err := getMongoClient(result.clientName)
 	if err != nil {
 		return nil, err
 	}
 
-	result := mongoSession{}
-	if result.session, err = cli.client.StartSession(); err != nil {
+	result.client = cli
+	if result.session, err = cli.mongo().StartSession(); err != nil {
 		return nil, err
 	}
 
+	cli.sessions.Add(1)
 	return &result, nil
 }
 
@@ -150,6 +335,8 @@ func (ms *mongoSession) Close() error {
 		return fmt.Errorf("could not close an empty session")
 	}
 	ms.session.EndSession(context.Background())
+	ms.session = nil
+	ms.client.release()
 	return nil
 }
 
@@ -170,7 +357,7 @@ func HasMongoAccess() bool {
 	return true
 }
 
-func (mc mongoClient) GetCollection(dbName string, collectionName string) (collection Collection, err error) {
+func (mc *mongoClient) GetCollection(dbName string, collectionName string) (collection Collection, err error) {
 	db := mc.DB(dbName)
 	if db == nil {
 		return nil, fmt.Errorf("could not connect to the database %s", dbName)
@@ -178,16 +365,7 @@ func (mc mongoClient) GetCollection(dbName string, collectionName string) (colle
 	return mc.getCollectionByName(db, collectionName)
 }
 
-func (mc mongoClient) getCollectionHistory(dataObject DomainEntity) (collection Collection, err error) {
-	dbName := dataObject.DatabaseName()
-	db := mc.DB(dbName)
-	if db == nil {
-		return nil, fmt.Errorf("could not connect to the database %s", dbName)
-	}
-	return mc.getCollectionByName(db, dataObject.CollectionName()+"-history")
-}
-
-func (mc mongoClient) getCollectionByName(db *mongo.Database, collectionName string) (result Collection, err error) {
+func (mc *mongoClient) getCollectionByName(db *mongo.Database, collectionName string) (result Collection, err error) {
 	collection := db.Collection(collectionName)
 	if collection == nil {
 		return nil, fmt.Errorf("could not connect to the collection %s.%s", db.Name(), collectionName)
@@ -195,101 +373,150 @@ func (mc mongoClient) getCollectionByName(db *mongo.Database, collectionName str
 	return mongoCollection{collection: collection}, nil
 }
 
-func (ms mongoSession) Aggregate(dbName, collName string, match, group bson.M, result interface{}) error {
-	collection, err := client.GetCollection(dbName, collName)
-	if err != nil {
-		return err
-	}
-	return collection.aggregate(context.Background(), match, group, result)
+func (ms mongoSession) Aggregate(ctx context.Context, dbName, collName string, match, group bson.M, result interface{}) error {
+	collection := ms.GetCollection(dbName, collName)
+
+	ctx, cancel := ms.operationContext(ctx)
+	defer cancel()
+
+	return mongo.WithSession(ctx, ms.session, func(sc mongo.SessionContext) error {
+		return collection.aggregate(sc, NewPipeline().Stage("$match", match).Stage("$group", group), result)
+	})
 }
 
-func (ms mongoSession) GetEntityByUUID(uuid string, requestedObject DomainEntity) (bool, error) {
+func (ms mongoSession) AggregatePipeline(ctx context.Context, coll Collection, pipeline Pipeline, result any) error {
+	ctx, cancel := ms.operationContext(ctx)
+	defer cancel()
+
+	return mongo.WithSession(ctx, ms.session, func(sc mongo.SessionContext) error {
+		return coll.aggregate(sc, pipeline, result)
+	})
+}
+
+func (ms mongoSession) GetEntityByUUID(ctx context.Context, uuid string, requestedObject DomainEntity) (bool, error) {
 	if uuid == "" {
 		return false, fmt.Errorf("GetObjectByUUID failed. Got an empty UID")
 	}
 
-	collection, err := client.GetCollection(requestedObject.DatabaseName(), requestedObject.CollectionName())
-	if err != nil {
-		return false, err
-	}
+	collection := ms.GetCollection(requestedObject.DatabaseName(), requestedObject.CollectionName())
 
-	found, err := collection.findOne(context.Background(), bson.M{"entity.uuid": uuid}, requestedObject)
+	found, err := ms.FindOne(ctx, collection, excludeDeleted(byUUID(uuid)), requestedObject)
 	if err != nil {
 		return false, fmt.Errorf("GetObjectByRefNo failed. Could not create a query for %v: %v", requestedObject, err)
 	}
+	if !found {
+		return false, nil
+	}
 
-	return found, err
+	return true, decodeFields(requestedObject)
 }
 
-func (ms mongoSession) UpdateEntityByUUID(updatedObject DomainEntity) error {
+func (ms mongoSession) UpdateEntityByUUID(ctx context.Context, updatedObject DomainEntity) error {
 	if updatedObject.UUID() == "" {
 		return fmt.Errorf("UpdateEntityByUID failed. Got an empty UID in %v", updatedObject)
 	}
 
-	collection, err := client.GetCollection(updatedObject.DatabaseName(), updatedObject.CollectionName())
-	if err != nil {
-		return err
-	}
-
-	err = collection.updateEntity(context.Background(), updatedObject)
-	return err
+	return withEncodedFields(updatedObject, func() error {
+		return ms.WithTransaction(ctx, func(ctx context.Context, tx DatabaseSession) error {
+			collection := tx.GetCollection(updatedObject.DatabaseName(), updatedObject.CollectionName())
+
+			opCtx, cancel := ms.operationContext(ctx)
+			defer cancel()
+
+			var changed bool
+			err := mongo.WithSession(opCtx, ms.session, func(sc mongo.SessionContext) (err error) {
+				changed, err = collection.updateEntity(sc, updatedObject)
+				return err
+			})
+			if err != nil || !changed {
+				return err
+			}
+			return appendRevision(ctx, tx, updatedObject, RevisionActionSave)
+		})
+	})
 }
 
-func (ms mongoSession) SaveEntityToHistory(entity DomainEntity) error {
-	collection, err := client.getCollectionHistory(entity)
-	if err != nil {
-		return err
-	}
+func (ms mongoSession) SaveEntityToHistory(ctx context.Context, entity DomainEntity) error {
+	return withEncodedFields(entity, func() error {
+		return appendRevision(ctx, &ms, entity, RevisionActionSave)
+	})
+}
 
-	err = collection.replaceOne(context.Background(), bson.M{"entity.uuid": entity.UUID()}, entity, true)
+func (ms mongoSession) CreateIndex(ctx context.Context, c Collection, mod mongo.IndexModel, opts ...*options.CreateIndexesOptions) error {
+	ctx, cancel := ms.operationContext(ctx)
+	defer cancel()
 
-	return err
+	return c.createIndex(ctx, mod, opts...)
 }
 
-func (ms mongoSession) CreateIndex(c Collection, mod mongo.IndexModel, opts ...*options.CreateIndexesOptions) error {
-	return c.createIndex(context.Background(), mod, opts...)
+func (ms mongoSession) ListIndexes(ctx context.Context, c Collection) ([]IndexSpec, error) {
+	ctx, cancel := ms.operationContext(ctx)
+	defer cancel()
+
+	return c.listIndexes(ctx)
 }
 
-func (ms mongoSession) RemoveOne(coll Collection, selector bson.M) error {
-	return coll.removeOne(context.Background(), selector)
+func (ms mongoSession) DropIndex(ctx context.Context, c Collection, name string) error {
+	ctx, cancel := ms.operationContext(ctx)
+	defer cancel()
+
+	return c.dropIndex(ctx, name)
 }
 
-func (ms mongoSession) RemoveEntity(entity DomainEntity) error {
-	err := ms.SaveEntityToHistory(entity)
-	if err != nil {
-		return err
-	}
+func (ms mongoSession) RemoveOne(ctx context.Context, coll Collection, selector bson.M) error {
+	ctx, cancel := ms.operationContext(ctx)
+	defer cancel()
 
-	collection, err := client.GetCollection(entity.DatabaseName(), entity.CollectionName())
-	if err != nil {
-		return err
-	}
+	return mongo.WithSession(ctx, ms.session, func(sc mongo.SessionContext) error {
+		return coll.removeOne(sc, selector)
+	})
+}
 
-	selector := bson.M{"entity.uuid": entity.UUID()}
+func (ms mongoSession) RemoveMany(ctx context.Context, coll Collection, selector bson.M) error {
+	ctx, cancel := ms.operationContext(ctx)
+	defer cancel()
 
-	err = collection.removeOne(context.Background(), selector)
+	return mongo.WithSession(ctx, ms.session, func(sc mongo.SessionContext) error {
+		return coll.removeMany(sc, selector)
+	})
+}
 
-	return err
+func (ms mongoSession) RemoveEntity(ctx context.Context, entity DomainEntity) error {
+	return withEncodedFields(entity, func() error {
+		return ms.WithTransaction(ctx, func(ctx context.Context, tx DatabaseSession) error {
+			err := appendRevision(ctx, tx, entity, RevisionActionRemove)
+			if err != nil {
+				return err
+			}
+
+			collection := tx.GetCollection(entity.DatabaseName(), entity.CollectionName())
+			return tx.RemoveOne(ctx, collection, byUUID(entity.UUID()))
+		})
+	})
 }
 
-func (ms mongoSession) InsertEntity(entity DomainEntity) error {
+func (ms mongoSession) InsertEntity(ctx context.Context, entity DomainEntity) error {
 	if entity.UUID() == "" {
 		return fmt.Errorf("cannot insert an entity with an empty UID. Entity: %v", entity)
 	}
-	collection, err := client.GetCollection(entity.DatabaseName(), entity.CollectionName())
-	if err != nil {
-		return err
-	}
-
-	err = collection.insertOne(context.Background(), entity)
-
-	return err
+	collection := ms.GetCollection(entity.DatabaseName(), entity.CollectionName())
+	return withEncodedFields(entity, func() error {
+		return ms.InsertOne(ctx, collection, entity)
+	})
 }
 
-func (ms mongoSession) GetCollectionNames(dbName string) ([]string, error) {
-	db := client.DB(dbName)
+func (ms mongoSession) GetCollectionNames(ctx context.Context, dbName string) ([]string, error) {
+	db := ms.client.DB(dbName)
 	if db == nil {
 		return nil, fmt.Errorf("could not connect to the database %s", dbName)
 	}
-	return db.ListCollectionNames(context.Background(), bson.D{})
+
+	ctx, cancel := ms.operationContext(ctx)
+	defer cancel()
+
+	return db.ListCollectionNames(ctx, bson.D{})
+}
+
+func historyCollectionName(entity DomainEntity) string {
+	return entity.CollectionName() + "-history"
 }
@@ -1,6 +1,7 @@
 package database
 
 import (
+	"context"
 	"fmt"
 	"slices"
 	"strconv"
@@ -28,7 +29,7 @@ type DomainEntity interface {
 	SetMetadata(appName string)
 	GetAccessConfig() []AccessConfig
 	CleanNil()
-	BeforeSave(session DatabaseSession) error
+	BeforeSave(ctx context.Context, session DatabaseSession) error
 	SetUserIdentity(userIdentity user.UserIdentity)
 	UserIdentity() user.UserIdentity
 
@@ -1,38 +1,55 @@
 package database
 
 import (
+	"context"
+	"errors"
 	"fmt"
+	"iter"
 
 	"github.com/dchaykin/mygolib/log"
 	"go.mongodb.org/mongo-driver/bson"
 )
 
-func FindDomainEntityByUUID(uuid string, domainEntity DomainEntity) (bool, error) {
+// NotFoundError reports that no entity with the given uuid exists
+type NotFoundError struct {
+	UUID string
+}
+
+func (e *NotFoundError) Error() string {
+	return fmt.Sprintf("no record with UUID %s found", e.UUID)
+}
+
+func IsNotFound(err error) bool {
+	notFound := &NotFoundError{}
+	return errors.As(err, &notFound)
+}
+
+func FindDomainEntityByUUID(ctx context.Context, uuid string, domainEntity DomainEntity) (bool, error) {
 	session, err := OpenSession()
 	if err != nil {
 		return false, err
 	}
 	defer session.Close()
 
-	return session.GetEntityByUUID(uuid, domainEntity)
+	return session.GetEntityByUUID(ctx, uuid, domainEntity)
 }
 
-func GetDomainEntityByUUID(uuid string, domainEntity DomainEntity) error {
-	bFound, err := FindDomainEntityByUUID(uuid, domainEntity)
+func GetDomainEntityByUUID(ctx context.Context, uuid string, domainEntity DomainEntity) error {
+	bFound, err := FindDomainEntityByUUID(ctx, uuid, domainEntity)
 	if err != nil {
 		return err
 	}
 	if !bFound {
-		return fmt.Errorf("no record with UUID %s found", uuid)
+		return &NotFoundError{UUID: uuid}
 	}
 	return nil
 }
 
-func ReadDomainEntities(session DatabaseSession, domainEntity DomainEntity, offset, limit int64) ([]DomainEntity, error) {
+func ReadDomainEntities(ctx context.Context, session DatabaseSession, domainEntity DomainEntity, offset, limit int64) ([]DomainEntity, error) {
 	coll := session.GetCollection(domainEntity.DatabaseName(), domainEntity.CollectionName())
 	dataList := []any{}
-	sortOpt := bson.D{{Key: "uuid", Value: 1}}
-	count, err := session.Extract(coll, nil, &dataList, sortOpt, offset, limit)
+	sortOpt := bson.D{{Key: "entity.uuid", Value: 1}}
+	count, err := session.Extract(ctx, coll, excludeDeleted(nil), &dataList, sortOpt, offset, limit)
 	if err != nil {
 		return nil, err
 	}
@@ -43,6 +60,59 @@ func ReadDomainEntities(session DatabaseSession, domainEntity DomainEntity, offs
 	return resultList, log.WrapError(err)
 }
 
+// FindDomainEntities returns the entities matching the query and, if requested by Query.WithTotal,
+// the total number of matching entities
+func FindDomainEntities(ctx context.Context, session DatabaseSession, domainEntity DomainEntity, query Query, offset, limit int64) ([]DomainEntity, int64, error) {
+	coll := session.GetCollection(domainEntity.DatabaseName(), domainEntity.CollectionName())
+	dataList := []any{}
+	count, err := session.FindByQuery(ctx, coll, query.entityQuery(), &dataList, offset, limit)
+	if err != nil {
+		return nil, 0, err
+	}
+	resultList, err := convertToDomainEntities(dataList, domainEntity)
+	return resultList, count, log.WrapError(err)
+}
+
+// errStopIteration ends an iteration stopped by the consumer of StreamDomainEntities
+var errStopIteration = errors.New("iteration stopped")
+
+// StreamDomainEntities decodes the entities matching the query one by one, so that only the current batch
+// of the cursor is held in memory. The iteration stops after the first error.
+func StreamDomainEntities(ctx context.Context, session DatabaseSession, domainEntity DomainEntity, query Query) iter.Seq2[DomainEntity, error] {
+	return func(yield func(DomainEntity, error) bool) {
+		coll := session.GetCollection(domainEntity.DatabaseName(), domainEntity.CollectionName())
+		err := session.Iterate(ctx, coll, query.entityQuery(), func(raw bson.Raw) error {
+			entity := domainEntity.CreateEmpty()
+			if err := bson.Unmarshal(raw, entity); err != nil {
+				return fmt.Errorf("failed to unmarshal an entity: %w", err)
+			}
+			if err := decodeFields(entity); err != nil {
+				return err
+			}
+			if !yield(entity, nil) {
+				return errStopIteration
+			}
+			return nil
+		})
+		if err != nil && !errors.Is(err, errStopIteration) {
+			yield(nil, err)
+		}
+	}
+}
+
+// ForEachDomainEntity calls f for every entity matching the query and stops at the first error
+func ForEachDomainEntity(ctx context.Context, session DatabaseSession, domainEntity DomainEntity, query Query, f OnReadDomainEntity) error {
+	for entity, err := range StreamDomainEntities(ctx, session, domainEntity, query) {
+		if err != nil {
+			return err
+		}
+		if err = f(entity); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
 func convertToDomainEntities(sourceList []any, domainEntity DomainEntity) (resultList []DomainEntity, err error) {
 	for i, item := range sourceList {
 		o, err := bson.Marshal(item)
@@ -55,6 +125,9 @@ func convertToDomainEntities(sourceList []any, domainEntity DomainEntity) (resul
 		if err != nil {
 			return nil, log.WrapError(fmt.Errorf("failed to unmarshal item %d: %w", i, err))
 		}
+		if err = decodeFields(entity); err != nil {
+			return nil, err
+		}
 		resultList = append(resultList, entity)
 	}
 
@@ -0,0 +1,46 @@
+package database
+
+import (
+	"context"
+	"fmt"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestStreamDomainEntities(t *testing.T) {
+	session := openMemorySession(t)
+	defer session.Close()
+
+	insertTestEntities(t, session)
+
+	uuids := []string{}
+	for entity, err := range StreamDomainEntities(t.Context(), session, &testEntity{}, NewQuery().SortBy("amount", false)) {
+		require.NoError(t, err)
+		uuids = append(uuids, entity.UUID())
+		if len(uuids) == 2 {
+			break
+		}
+	}
+	require.Equal(t, []string{"c3", "b2"}, uuids)
+
+	count := 0
+	err := ForEachDomainEntity(t.Context(), session, &testEntity{}, NewQuery(Gt("amount", 10)), func(entity DomainEntity) error {
+		count++
+		return nil
+	})
+	require.NoError(t, err)
+	require.Equal(t, 2, count)
+
+	err = ForEachDomainEntity(t.Context(), session, &testEntity{}, NewQuery(), func(entity DomainEntity) error {
+		return fmt.Errorf("failed on %s", entity.UUID())
+	})
+	require.EqualError(t, err, "failed on a1")
+
+	ctx, cancel := context.WithCancel(t.Context())
+	cancel()
+	err = ForEachDomainEntity(ctx, session, &testEntity{}, NewQuery(), func(entity DomainEntity) error {
+		return nil
+	})
+	require.ErrorIs(t, err, context.Canceled)
+}
@@ -0,0 +1,425 @@
+package database
+
+import (
+	"bytes"
+	"fmt"
+	"reflect"
+	"regexp"
+	"slices"
+	"strings"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+// toDocument converts any bson serializable value into a bson.M the same way the mongo driver would
+// store and return it (nested documents become bson.M, arrays primitive.A, times primitive.DateTime).
+func toDocument(value any) (bson.M, error) {
+	if value == nil {
+		return bson.M{}, nil
+	}
+	data, err := bson.Marshal(value)
+	if err != nil {
+		return nil, err
+	}
+	result := bson.M{}
+	if err = bson.Unmarshal(data, &result); err != nil {
+		return nil, err
+	}
+	return result, nil
+}
+
+// matchFilter evaluates the subset of the mongo query language used in this module against a document:
+// equality, dotted paths, $in, $nin, $ne, $gt, $gte, $lt, $lte, $exists, $regex, $and, $or, $nor and $not.
+func matchFilter(doc bson.M, filter bson.M) (bool, error) {
+	for key, condition := range filter {
+		var ok bool
+		var err error
+		switch key {
+		case "$and":
+			ok, err = matchLogical(doc, condition, true)
+		case "$or":
+			ok, err = matchLogical(doc, condition, false)
+		case "$nor":
+			ok, err = matchLogical(doc, condition, false)
+			ok = !ok
+		default:
+			if strings.HasPrefix(key, "$") {
+				return false, fmt.Errorf("unsupported top level operator %s", key)
+			}
+			ok, err = matchField(lookupPath(doc, key), condition)
+		}
+		if err != nil || !ok {
+			return false, err
+		}
+	}
+	return true, nil
+}
+
+func matchLogical(doc bson.M, condition any, all bool) (bool, error) {
+	list, ok := condition.(primitive.A)
+	if !ok {
+		return false, fmt.Errorf("logical operator expects an array, got %T", condition)
+	}
+	for _, item := range list {
+		subFilter, ok := item.(bson.M)
+		if !ok {
+			return false, fmt.Errorf("logical operator expects documents, got %T", item)
+		}
+		matched, err := matchFilter(doc, subFilter)
+		if err != nil {
+			return false, err
+		}
+		if all && !matched {
+			return false, nil
+		}
+		if !all && matched {
+			return true, nil
+		}
+	}
+	return all, nil
+}
+
+func isOperatorDocument(condition any) (bson.M, bool) {
+	m, ok := condition.(bson.M)
+	if !ok || len(m) == 0 {
+		return nil, false
+	}
+	for key := range m {
+		if !strings.HasPrefix(key, "$") {
+			return nil, false
+		}
+	}
+	return m, true
+}
+
+func matchField(values []any, condition any) (bool, error) {
+	operators, ok := isOperatorDocument(condition)
+	if !ok {
+		return anyValue(values, func(v any) bool { return valuesEqual(v, condition) }), nil
+	}
+	for op, operand := range operators {
+		var matched bool
+		switch op {
+		case "$eq":
+			matched = anyValue(values, func(v any) bool { return valuesEqual(v, operand) })
+		case "$ne":
+			matched = !anyValue(values, func(v any) bool { return valuesEqual(v, operand) })
+		case "$gt", "$gte", "$lt", "$lte":
+			matched = anyValue(values, func(v any) bool { return compareOperator(op, v, operand) })
+		case "$in", "$nin":
+			list, ok := operand.(primitive.A)
+			if !ok {
+				return false, fmt.Errorf("%s expects an array, got %T", op, operand)
+			}
+			matched = anyValue(values, func(v any) bool {
+				for _, item := range list {
+					if regex, ok := item.(primitive.Regex); ok {
+						if matchRegex(v, regex) {
+							return true
+						}
+						continue
+					}
+					if valuesEqual(v, item) {
+						return true
+					}
+				}
+				return false
+			})
+			if op == "$nin" {
+				matched = !matched
+			}
+		case "$exists":
+			exists := len(values) > 0
+			matched = exists == isTruthy(operand)
+		case "$regex":
+			regex, err := toRegex(operand, operators["$options"])
+			if err != nil {
+				return false, err
+			}
+			matched = anyValue(values, func(v any) bool { return matchRegex(v, regex) })
+		case "$options":
+			continue
+		case "$not":
+			m, err := matchField(values, operand)
+			if err != nil {
+				return false, err
+			}
+			matched = !m
+		default:
+			return false, fmt.Errorf("unsupported operator %s", op)
+		}
+		if !matched {
+			return false, nil
+		}
+	}
+	return true, nil
+}
+
+func anyValue(values []any, f func(v any) bool) bool {
+	if len(values) == 0 {
+		return f(nil)
+	}
+	for _, v := range values {
+		if f(v) {
+			return true
+		}
+	}
+	return false
+}
+
+// lookupPath resolves a dotted path. Arrays on the way are fanned out like mongo does,
+// an array found at the end of the path contributes both itself and its items.
+func lookupPath(doc any, path string) []any {
+	return lookupParts(doc, strings.Split(path, "."))
+}
+
+func lookupParts(value any, parts []string) []any {
+	if len(parts) == 0 {
+		if arr, ok := value.(primitive.A); ok {
+			return append([]any{value}, arr...)
+		}
+		return []any{value}
+	}
+	switch v := value.(type) {
+	case bson.M:
+		child, ok := v[parts[0]]
+		if !ok {
+			return nil
+		}
+		return lookupParts(child, parts[1:])
+	case primitive.A:
+		result := []any{}
+		for _, item := range v {
+			result = append(result, lookupParts(item, parts)...)
+		}
+		return result
+	}
+	return nil
+}
+
+func isTruthy(value any) bool {
+	switch v := value.(type) {
+	case bool:
+		return v
+	case nil:
+		return false
+	}
+	if f, ok := toFloat(value); ok {
+		return f != 0
+	}
+	return true
+}
+
+func toRegex(pattern any, options any) (primitive.Regex, error) {
+	switch p := pattern.(type) {
+	case primitive.Regex:
+		return p, nil
+	case string:
+		opts := ""
+		if options != nil {
+			opts = fmt.Sprintf("%v", options)
+		}
+		return primitive.Regex{Pattern: p, Options: opts}, nil
+	}
+	return primitive.Regex{}, fmt.Errorf("$regex expects a string, got %T", pattern)
+}
+
+func matchRegex(value any, regex primitive.Regex) bool {
+	text, ok := value.(string)
+	if !ok {
+		return false
+	}
+	pattern := regex.Pattern
+	if strings.Contains(regex.Options, "i") {
+		pattern = "(?i)" + pattern
+	}
+	re, err := regexp.Compile(pattern)
+	if err != nil {
+		return false
+	}
+	return re.MatchString(text)
+}
+
+func compareOperator(op string, value, operand any) bool {
+	if typeRank(value) != typeRank(operand) {
+		return false
+	}
+	c := compareValues(value, operand)
+	switch op {
+	case "$gt":
+		return c > 0
+	case "$gte":
+		return c >= 0
+	case "$lt":
+		return c < 0
+	case "$lte":
+		return c <= 0
+	}
+	return false
+}
+
+func valuesEqual(a, b any) bool {
+	if typeRank(a) != typeRank(b) {
+		return false
+	}
+	switch a.(type) {
+	case bson.M, primitive.A:
+		return reflect.DeepEqual(a, b)
+	}
+	return compareValues(a, b) == 0
+}
+
+func toFloat(value any) (float64, bool) {
+	switch v := value.(type) {
+	case int:
+		return float64(v), true
+	case int32:
+		return float64(v), true
+	case int64:
+		return float64(v), true
+	case float32:
+		return float64(v), true
+	case float64:
+		return v, true
+	}
+	return 0, false
+}
+
+func toTime(value any) (time.Time, bool) {
+	switch v := value.(type) {
+	case primitive.DateTime:
+		return v.Time(), true
+	case time.Time:
+		return v, true
+	}
+	return time.Time{}, false
+}
+
+// typeRank follows the mongo sort order of bson types
+func typeRank(value any) int {
+	switch value.(type) {
+	case nil, primitive.Null, primitive.Undefined:
+		return 1
+	case int, int32, int64, float32, float64:
+		return 2
+	case string, primitive.Symbol:
+		return 3
+	case bson.M, bson.D:
+		return 4
+	case primitive.A:
+		return 5
+	case primitive.Binary, []byte:
+		return 6
+	case primitive.ObjectID:
+		return 7
+	case bool:
+		return 8
+	case primitive.DateTime, time.Time:
+		return 9
+	case primitive.Timestamp:
+		return 10
+	case primitive.Regex:
+		return 11
+	}
+	return 12
+}
+
+func compareValues(a, b any) int {
+	ra, rb := typeRank(a), typeRank(b)
+	if ra != rb {
+		return compareInt(int64(ra), int64(rb))
+	}
+	switch ra {
+	case 2:
+		fa, _ := toFloat(a)
+		fb, _ := toFloat(b)
+		switch {
+		case fa < fb:
+			return -1
+		case fa > fb:
+			return 1
+		}
+		return 0
+	case 3:
+		return strings.Compare(fmt.Sprintf("%v", a), fmt.Sprintf("%v", b))
+	case 7:
+		oa, ob := a.(primitive.ObjectID), b.(primitive.ObjectID)
+		return bytes.Compare(oa[:], ob[:])
+	case 8:
+		ba, bb := a.(bool), b.(bool)
+		if ba == bb {
+			return 0
+		}
+		if !ba {
+			return -1
+		}
+		return 1
+	case 9:
+		ta, _ := toTime(a)
+		tb, _ := toTime(b)
+		return ta.Compare(tb)
+	case 5:
+		la, lb := a.(primitive.A), b.(primitive.A)
+		for i := 0; i < len(la) && i < len(lb); i++ {
+			if c := compareValues(la[i], lb[i]); c != 0 {
+				return c
+			}
+		}
+		return compareInt(int64(len(la)), int64(len(lb)))
+	}
+	if reflect.DeepEqual(a, b) {
+		return 0
+	}
+	return strings.Compare(fmt.Sprintf("%v", a), fmt.Sprintf("%v", b))
+}
+
+func compareInt(a, b int64) int {
+	switch {
+	case a < b:
+		return -1
+	case a > b:
+		return 1
+	}
+	return 0
+}
+
+// sortDocuments sorts the documents in place by a mongo sort specification
+func sortDocuments(docs []bson.M, sort bson.D) {
+	if len(sort) == 0 {
+		return
+	}
+	less := func(a, b bson.M) int {
+		for _, e := range sort {
+			direction := 1
+			if f, ok := toFloat(e.Value); ok && f < 0 {
+				direction = -1
+			}
+			c := compareValues(sortKey(a, e.Key, direction), sortKey(b, e.Key, direction))
+			if c != 0 {
+				return c * direction
+			}
+		}
+		return 0
+	}
+	slices.SortStableFunc(docs, less)
+}
+
+// sortKey picks the smallest (ascending) or largest (descending) value of a path like mongo does for arrays
+func sortKey(doc bson.M, path string, direction int) any {
+	values := lookupPath(doc, path)
+	if len(values) == 0 {
+		return nil
+	}
+	result := values[0]
+	for _, v := range values[1:] {
+		if _, isArray := v.(primitive.A); isArray {
+			continue
+		}
+		if compareValues(v, result)*direction < 0 {
+			result = v
+		}
+	}
+	return result
+}
@@ -0,0 +1,272 @@
+package database
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"slices"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/dchaykin/mygolib/httpcomm"
+	"github.com/dchaykin/mygolib/log"
+)
+
+// connectBackoff is the delay before the second connection attempt, it is doubled with every further attempt
+var connectBackoff = 500 * time.Millisecond
+
+var shuttingDown atomic.Bool
+
+// ClientStatus is the health of a mongo client as reported by the readiness probe
+type ClientStatus struct {
+	Name           string    `json:"name"`
+	Connected      bool      `json:"connected"`
+	LastCheck      time.Time `json:"lastCheck"`
+	Error          string    `json:"error,omitempty"`
+	ActiveSessions int64     `json:"activeSessions"`
+}
+
+// ensureConnected connects the client if it has never been connected or the last health check failed.
+// The health checks are started with the first successful connection.
+func (mc *mongoClient) ensureConnected(ctx context.Context) error {
+	if mc.isConnected() {
+		return nil
+	}
+	if mc.isDisconnected() {
+		return fmt.Errorf("the mongo client %s has been disconnected", mc.name)
+	}
+
+	mc.connectMu.Lock()
+	defer mc.connectMu.Unlock()
+	if mc.isConnected() {
+		return nil // connected by a concurrent call
+	}
+
+	if err := mc.connectWithRetry(ctx); err != nil {
+		return err
+	}
+	mc.watchOnce.Do(func() {
+		interval, _ := mc.cfg.healthCheckInterval()
+		go mc.watch(interval)
+	})
+	return nil
+}
+
+// connectWithRetry tries to connect MAX_CONNECT_ATTEMPTS times with an exponential backoff
+func (mc *mongoClient) connectWithRetry(ctx context.Context) error {
+	delay := connectBackoff
+	var err error
+	for attempt := 1; ; attempt++ {
+		if err = mc.connect(); err == nil {
+			return nil
+		}
+		log.Warn("attempt %d of %d to connect the mongo client %s failed: %v", attempt, MAX_CONNECT_ATTEMPTS, mc.name, err)
+		if attempt >= MAX_CONNECT_ATTEMPTS {
+			return err
+		}
+
+		select {
+		case <-time.After(delay):
+		case <-ctx.Done():
+			return fmt.Errorf("%w, last error: %v", ctx.Err(), err)
+		case <-mc.stop:
+			return fmt.Errorf("the mongo client %s has been disconnected", mc.name)
+		}
+		delay *= 2
+	}
+}
+
+// watch pings the server in the given interval until the client is disconnected.
+// After a failed ping the client is reconnected, OpenSession waits for the reconnect meanwhile.
+func (mc *mongoClient) watch(interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-mc.stop:
+			return
+		case <-ticker.C:
+			if err := mc.check(); err != nil {
+				log.Warn("health check of the mongo client %s failed: %v", mc.name, err)
+				if err = mc.ensureConnected(context.Background()); err != nil {
+					log.WrapError(err)
+				}
+			}
+		}
+	}
+}
+
+func (mc *mongoClient) isDisconnected() bool {
+	mc.mu.RLock()
+	defer mc.mu.RUnlock()
+	return mc.disconnected
+}
+
+func (mc *mongoClient) check() error {
+	if mc.mongo() == nil || mc.isDisconnected() {
+		return fmt.Errorf("not connected")
+	}
+
+	timeout, _ := mc.cfg.connectTimeout()
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+
+	err := mc.ping(ctx)
+
+	mc.mu.Lock()
+	defer mc.mu.Unlock()
+	mc.lastCheck, mc.lastError = time.Now(), err
+	return err
+}
+
+func (mc *mongoClient) status() ClientStatus {
+	mc.mu.RLock()
+	defer mc.mu.RUnlock()
+
+	result := ClientStatus{
+		Name:           mc.name,
+		Connected:      mc.client != nil && !mc.disconnected && mc.lastError == nil,
+		LastCheck:      mc.lastCheck,
+		ActiveSessions: mc.sessions.Load(),
+	}
+	if mc.lastError != nil {
+		result.Error = mc.lastError.Error()
+	} else if mc.disconnected {
+		result.Error = "disconnected"
+	} else if mc.client == nil {
+		result.Error = "not connected"
+	}
+	return result
+}
+
+func registeredClients() []*mongoClient {
+	clientsMu.Lock()
+	defer clientsMu.Unlock()
+
+	result := []*mongoClient{}
+	for _, mc := range clients {
+		result = append(result, mc)
+	}
+	slices.SortFunc(result, func(a, b *mongoClient) int {
+		return strings.Compare(a.name, b.name)
+	})
+	return result
+}
+
+// Health returns the status of all mongo clients, ordered by their names
+func Health() []ClientStatus {
+	result := []ClientStatus{}
+	for _, mc := range registeredClients() {
+		result = append(result, mc.status())
+	}
+	return result
+}
+
+// Readiness fails if the database access has been shut down or a mongo client has lost its connection.
+// The default client is connected if it is not yet.
+func Readiness() ([]ClientStatus, error) {
+	if activeBackend != nil {
+		return []ClientStatus{}, nil
+	}
+	if shuttingDown.Load() {
+		return nil, fmt.Errorf("the database access has been shut down")
+	}
+
+	clientsMu.Lock()
+	_, ok := clients[DefaultClientName]
+	clientsMu.Unlock()
+	if !ok {
+		if _, err := getMongoClient(DefaultClientName); err != nil {
+			return Health(), err
+		}
+	}
+
+	result := Health()
+	for _, status := range result {
+		if !status.Connected {
+			return result, fmt.Errorf("the mongo client %s is not connected: %s", status.Name, status.Error)
+		}
+	}
+	return result, nil
+}
+
+// Liveness fails only if the health checks of a mongo client stopped working. A lost connection makes the
+// service not ready, but keeps it alive, so that it is not restarted while the cluster is unavailable.
+func Liveness() error {
+	for _, mc := range registeredClients() {
+		interval, _ := mc.cfg.healthCheckInterval()
+		timeout, _ := mc.cfg.connectTimeout()
+		status := mc.status()
+		if !status.LastCheck.IsZero() && time.Since(status.LastCheck) > 3*interval+timeout {
+			return fmt.Errorf("no health check of the mongo client %s since %s", status.Name, status.LastCheck.Format(time.RFC3339))
+		}
+	}
+	return nil
+}
+
+// ReadinessHandler serves the readiness probe: 200 with the client status or 503
+func ReadinessHandler(w http.ResponseWriter, r *http.Request) {
+	status, err := Readiness()
+	if err != nil {
+		httpcomm.SetResponseError(&w, "", err, http.StatusServiceUnavailable)
+		return
+	}
+	httpcomm.ServiceResponse{
+		Data: status,
+	}.WriteData(w, httpcomm.PayloadFormatJSON)
+}
+
+// LivenessHandler serves the liveness probe: 200 or 503
+func LivenessHandler(w http.ResponseWriter, r *http.Request) {
+	if err := Liveness(); err != nil {
+		httpcomm.SetResponseError(&w, "", err, http.StatusServiceUnavailable)
+		return
+	}
+	httpcomm.ServiceResponse{
+		Data: "OK",
+	}.WriteData(w, httpcomm.PayloadFormatJSON)
+}
+
+// Shutdown rejects new sessions, waits until the open sessions are closed and disconnects all mongo clients.
+// If the context ends before all sessions are closed, the clients are disconnected anyway and an error is returned.
+// The operations of the sessions still open fail with mongo.ErrClientDisconnected then.
+func Shutdown(ctx context.Context) error {
+	shuttingDown.Store(true)
+
+	clientsMu.Lock()
+	list := []*mongoClient{}
+	for _, mc := range clients {
+		list = append(list, mc)
+	}
+	clients = map[string]*mongoClient{}
+	clientsMu.Unlock()
+
+	var result error
+	for _, mc := range list {
+		if err := mc.drain(ctx); err != nil && result == nil {
+			result = err
+		}
+	}
+	for _, mc := range list {
+		if err := mc.Disconnect(ctx); err != nil && result == nil {
+			result = err
+		}
+	}
+	return result
+}
+
+func (mc *mongoClient) drain(ctx context.Context) error {
+	ticker := time.NewTicker(20 * time.Millisecond)
+	defer ticker.Stop()
+
+	for mc.sessions.Load() > 0 {
+		select {
+		case <-ctx.Done():
+			return fmt.Errorf("%d sessions of the mongo client %s are still open: %w", mc.sessions.Load(), mc.name, ctx.Err())
+		case <-ticker.C:
+		}
+	}
+	return nil
+}
@@ -0,0 +1,149 @@
+package database
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+func registerTestClient(t *testing.T, mc *mongoClient) {
+	clientsMu.Lock()
+	previous := clients
+	clients = map[string]*mongoClient{mc.name: mc}
+	clientsMu.Unlock()
+
+	t.Cleanup(func() {
+		clientsMu.Lock()
+		clients = previous
+		clientsMu.Unlock()
+		shuttingDown.Store(false)
+	})
+}
+
+func TestConnectWithRetry(t *testing.T) {
+	backoff := connectBackoff
+	connectBackoff = time.Millisecond
+	t.Cleanup(func() { connectBackoff = backoff })
+
+	started := time.Now()
+	err := Connect(Config{Name: "unreachable", Host: "localhost:1", ConnectTimeout: "50ms"})
+	require.ErrorContains(t, err, "could not establish a connection to the mongo server")
+	require.GreaterOrEqual(t, time.Since(started), MAX_CONNECT_ATTEMPTS*50*time.Millisecond)
+
+	_, err = OpenSession(WithClient("unreachable"))
+	require.ErrorContains(t, err, "no mongo client unreachable connected")
+}
+
+func TestReadiness(t *testing.T) {
+	mc := newMongoClient(Config{Name: DefaultClientName, Host: "localhost:1"})
+	mc.lastCheck = time.Now()
+	mc.lastError = context.DeadlineExceeded
+	registerTestClient(t, mc)
+
+	status, err := Readiness()
+	require.ErrorContains(t, err, "the mongo client default is not connected: context deadline exceeded")
+	require.Len(t, status, 1)
+	require.False(t, status[0].Connected)
+
+	w := httptest.NewRecorder()
+	ReadinessHandler(w, httptest.NewRequest(http.MethodGet, "/ready", nil))
+	require.Equal(t, http.StatusServiceUnavailable, w.Code)
+
+	// a lost connection keeps the service alive
+	require.NoError(t, Liveness())
+	w = httptest.NewRecorder()
+	LivenessHandler(w, httptest.NewRequest(http.MethodGet, "/alive", nil))
+	require.Equal(t, http.StatusOK, w.Code)
+
+	mc.lastCheck = time.Now().Add(-time.Hour)
+	require.ErrorContains(t, Liveness(), "no health check of the mongo client default since")
+
+	UseMemoryBackend()
+	t.Cleanup(func() { SetBackend(nil) })
+	w = httptest.NewRecorder()
+	ReadinessHandler(w, httptest.NewRequest(http.MethodGet, "/ready", nil))
+	require.Equal(t, http.StatusOK, w.Code)
+}
+
+func TestShutdown(t *testing.T) {
+	mc := newMongoClient(Config{Name: "drain", Host: "localhost:1"})
+	mc.sessions.Add(1)
+	registerTestClient(t, mc)
+
+	go func() {
+		time.Sleep(50 * time.Millisecond)
+		mc.sessions.Add(-1)
+	}()
+	require.NoError(t, Shutdown(context.Background()))
+	require.Empty(t, Health())
+
+	_, err := OpenSession()
+	require.ErrorContains(t, err, "the database access has been shut down")
+	_, err = Readiness()
+	require.ErrorContains(t, err, "the database access has been shut down")
+
+	mc = newMongoClient(Config{Name: "drain", Host: "localhost:1"})
+	mc.sessions.Add(1)
+	registerTestClient(t, mc)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	require.ErrorContains(t, Shutdown(ctx), "1 sessions of the mongo client drain are still open")
+}
+
+func TestShutdownWithOpenSession(t *testing.T) {
+	mc := newMongoClient(Config{Name: "open", Host: "localhost:1"})
+	// the driver connects lazily, so the client is created without a server
+	cli, err := mongo.Connect(context.Background(), options.Client().ApplyURI("mongodb://localhost:1"))
+	require.NoError(t, err)
+	mc.client = cli
+	mc.sessions.Add(1)
+	registerTestClient(t, mc)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+	defer cancel()
+	require.Error(t, Shutdown(ctx))
+
+	// the open session fails instead of panicking
+	session := mongoSession{client: mc}
+	coll := session.GetCollection("test", "entities")
+	_, err = coll.(mongoCollection).collection.CountDocuments(context.Background(), bson.M{})
+	require.ErrorIs(t, err, mongo.ErrClientDisconnected)
+
+	require.False(t, mc.status().Connected)
+	require.Equal(t, "disconnected", mc.status().Error)
+	require.ErrorContains(t, mc.ensureConnected(context.Background()), "the mongo client open has been disconnected")
+}
+
+func TestReplaceClientWithOpenSession(t *testing.T) {
+	newClient := func() *mongoClient {
+		mc := newMongoClient(Config{Name: "replaced", Host: "localhost:1"})
+		cli, err := mongo.Connect(context.Background(), options.Client().ApplyURI("mongodb://localhost:1"))
+		require.NoError(t, err)
+		mc.client = cli
+		return mc
+	}
+	previous := newClient()
+	registerTestClient(t, previous)
+
+	session, err := OpenSession(WithClient("replaced"))
+	require.NoError(t, err)
+
+	// the replaced client serves its open session until it is closed
+	registerClient(newClient())
+	require.False(t, previous.isDisconnected())
+	require.NoError(t, session.Close())
+	require.True(t, previous.isDisconnected())
+
+	// a replaced client without sessions is disconnected at once
+	current := clients["replaced"]
+	registerClient(newClient())
+	require.True(t, current.isDisconnected())
+}
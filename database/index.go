@@ -0,0 +1,189 @@
+package database
+
+import (
+	"context"
+	"fmt"
+	"slices"
+	"strings"
+
+	"github.com/dchaykin/mygolib/log"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+const (
+	IndexAscending  = 1
+	IndexDescending = -1
+	IndexText       = "text"
+
+	uuidIndexName = "entity.uuid_1"
+	idIndexName   = "_id_"
+)
+
+// IndexSpec describes an index of a collection. The keys are absolute paths, the values IndexAscending,
+// IndexDescending or IndexText. TTL is the number of seconds after which documents expire.
+type IndexSpec struct {
+	Name   string `json:"name"`
+	Keys   bson.D `json:"keys"`
+	Unique bool   `json:"unique,omitempty"`
+	TTL    *int32 `json:"ttl,omitempty"`
+}
+
+// IndexName returns the name of the index, which is derived from its keys if not set, the way mongo does it
+func (spec IndexSpec) IndexName() string {
+	if spec.Name != "" {
+		return spec.Name
+	}
+	parts := []string{}
+	for _, e := range spec.Keys {
+		parts = append(parts, fmt.Sprintf("%s_%v", e.Key, e.Value))
+	}
+	return strings.Join(parts, "_")
+}
+
+func (spec IndexSpec) model() mongo.IndexModel {
+	opts := options.Index().SetName(spec.IndexName())
+	if spec.Unique {
+		opts.SetUnique(true)
+	}
+	if spec.TTL != nil {
+		opts.SetExpireAfterSeconds(*spec.TTL)
+	}
+	return mongo.IndexModel{Keys: spec.Keys, Options: opts}
+}
+
+func (spec IndexSpec) equals(other IndexSpec) bool {
+	if spec.Unique != other.Unique || !spec.sameKeys(other) {
+		return false
+	}
+	return (spec.TTL == nil) == (other.TTL == nil) && (spec.TTL == nil || *spec.TTL == *other.TTL)
+}
+
+// sameKeys reports whether both indexes are built on the same keys, mongo allows only one index per key spec
+func (spec IndexSpec) sameKeys(other IndexSpec) bool {
+	if len(spec.Keys) != len(other.Keys) {
+		return false
+	}
+	for i := range spec.Keys {
+		if spec.Keys[i].Key != other.Keys[i].Key || fmt.Sprint(spec.Keys[i].Value) != fmt.Sprint(other.Keys[i].Value) {
+			return false
+		}
+	}
+	return true
+}
+
+// UUIDIndex is the unique index on entity.uuid every entity collection must have
+func UUIDIndex() IndexSpec {
+	return IndexSpec{Name: uuidIndexName, Keys: bson.D{{Key: "entity.uuid", Value: IndexAscending}}, Unique: true}
+}
+
+// IndexReport lists the changes done by EnsureIndexes
+type IndexReport struct {
+	Created []string `json:"created"`
+	// Obsolete indexes exist in the collection, but are not declared. They are dropped only if requested.
+	Obsolete []string `json:"obsolete"`
+	Dropped  []string `json:"dropped"`
+}
+
+// EnsureIndexes makes the indexes of the entity's collection match the declared ones: missing indexes are created,
+// indexes with the same name but another definition are recreated and undeclared ones are reported as obsolete
+// and dropped if dropObsolete is set. An existing index with the keys of a declared one but another name is kept
+// under its name if the definitions are equal and recreated otherwise. The unique index on entity.uuid is always
+// ensured.
+func EnsureIndexes(ctx context.Context, session DatabaseSession, domainEntity DomainEntity, specs []IndexSpec, dropObsolete bool) (*IndexReport, error) {
+	coll := session.GetCollection(domainEntity.DatabaseName(), domainEntity.CollectionName())
+
+	declared := map[string]IndexSpec{uuidIndexName: UUIDIndex()}
+	for _, spec := range specs {
+		if existing, ok := declared[spec.IndexName()]; ok && !existing.equals(spec) {
+			return nil, fmt.Errorf("the index %s is declared twice with different definitions", spec.IndexName())
+		}
+		declared[spec.IndexName()] = spec
+	}
+
+	existing, err := session.ListIndexes(ctx, coll)
+	if err != nil {
+		return nil, err
+	}
+
+	report := &IndexReport{Created: []string{}, Obsolete: []string{}, Dropped: []string{}}
+	for _, index := range existing {
+		name := index.IndexName()
+		if name == idIndexName {
+			continue
+		}
+		declaredName := name
+		spec, ok := declared[name]
+		if !ok {
+			declaredName, spec, ok = declaredByKeys(declared, index)
+		}
+		if ok && spec.equals(index) {
+			delete(declared, declaredName)
+			continue
+		}
+		if ok {
+			log.Info("index %s of %s.%s has been changed and will be recreated", name, domainEntity.DatabaseName(), domainEntity.CollectionName())
+		} else {
+			report.Obsolete = append(report.Obsolete, name)
+			if !dropObsolete {
+				continue
+			}
+		}
+		if err = session.DropIndex(ctx, coll, name); err != nil {
+			return report, fmt.Errorf("could not drop the index %s: %w", name, err)
+		}
+		report.Dropped = append(report.Dropped, name)
+	}
+
+	names := []string{}
+	for name := range declared {
+		names = append(names, name)
+	}
+	slices.Sort(names)
+
+	for _, name := range names {
+		if err = session.CreateIndex(ctx, coll, declared[name].model()); err != nil {
+			return report, fmt.Errorf("could not create the index %s: %w", name, err)
+		}
+		report.Created = append(report.Created, name)
+	}
+
+	return report, nil
+}
+
+// declaredByKeys finds the declared index on the keys of an existing index with another name
+func declaredByKeys(declared map[string]IndexSpec, index IndexSpec) (string, IndexSpec, bool) {
+	for name, spec := range declared {
+		if spec.sameKeys(index) {
+			return name, spec, true
+		}
+	}
+	return "", IndexSpec{}, false
+}
+
+// storedIndex is an index as returned by listIndexes
+type storedIndex struct {
+	Name               string `bson:"name"`
+	Key                bson.D `bson:"key"`
+	Unique             bool   `bson:"unique"`
+	ExpireAfterSeconds *int32 `bson:"expireAfterSeconds"`
+	Weights            bson.D `bson:"weights"`
+}
+
+func (index storedIndex) spec() IndexSpec {
+	result := IndexSpec{Name: index.Name, Unique: index.Unique, TTL: index.ExpireAfterSeconds}
+	for _, e := range index.Key {
+		// mongo stores text indexes as {_fts: "text", _ftsx: 1} and the fields in the weights
+		switch e.Key {
+		case "_fts":
+			for _, w := range index.Weights {
+				result.Keys = append(result.Keys, bson.E{Key: w.Key, Value: IndexText})
+			}
+		case "_ftsx":
+		default:
+			result.Keys = append(result.Keys, e)
+		}
+	}
+	return result
+}
@@ -0,0 +1,87 @@
+package database
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/require"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+func TestEnsureIndexes(t *testing.T) {
+	session := openMemorySession(t)
+	defer session.Close()
+
+	insertTestEntities(t, session)
+	coll := session.GetCollection("test", "item")
+
+	err := session.CreateIndex(t.Context(), coll, mongo.IndexModel{Keys: bson.D{{Key: "entity.legacy", Value: 1}}})
+	require.NoError(t, err)
+	err = session.CreateIndex(t.Context(), coll, mongo.IndexModel{
+		Keys:    bson.D{{Key: "entity.name", Value: 1}},
+		Options: options.Index().SetName("name"),
+	})
+	require.NoError(t, err)
+
+	specs := []IndexSpec{
+		{Name: "name", Keys: bson.D{{Key: "entity.name", Value: IndexAscending}}, Unique: true},
+		{Keys: bson.D{{Key: "entity.amount", Value: IndexDescending}, {Key: "entity.uuid", Value: IndexAscending}}},
+	}
+
+	report, err := EnsureIndexes(t.Context(), session, &testEntity{}, specs, false)
+	require.NoError(t, err)
+	require.Equal(t, []string{"entity.amount_-1_entity.uuid_1", "entity.uuid_1", "name"}, report.Created)
+	require.Equal(t, []string{"entity.legacy_1"}, report.Obsolete)
+	require.Equal(t, []string{"name"}, report.Dropped)
+
+	err = session.InsertEntity(t.Context(), newTestEntity("a1", nil))
+	require.True(t, mongo.IsDuplicateKeyError(err))
+
+	report, err = EnsureIndexes(t.Context(), session, &testEntity{}, specs, true)
+	require.NoError(t, err)
+	require.Empty(t, report.Created)
+	require.Equal(t, []string{"entity.legacy_1"}, report.Dropped)
+
+	indexes, err := session.ListIndexes(t.Context(), coll)
+	require.NoError(t, err)
+	require.Len(t, indexes, 3)
+
+	_, err = EnsureIndexes(t.Context(), session, &testEntity{}, append(specs, IndexSpec{Name: "name", Keys: bson.D{{Key: "entity.name", Value: 1}}}), false)
+	require.EqualError(t, err, "the index name is declared twice with different definitions")
+}
+
+func TestEnsureIndexesByKeys(t *testing.T) {
+	session := openMemorySession(t)
+	defer session.Close()
+
+	insertTestEntities(t, session)
+	coll := session.GetCollection("test", "item")
+
+	// indexes created by hand under other names
+	err := session.CreateIndex(t.Context(), coll, mongo.IndexModel{
+		Keys:    bson.D{{Key: "entity.uuid", Value: 1}},
+		Options: options.Index().SetName("uuid").SetUnique(true),
+	})
+	require.NoError(t, err)
+	err = session.CreateIndex(t.Context(), coll, mongo.IndexModel{
+		Keys:    bson.D{{Key: "entity.name", Value: 1}},
+		Options: options.Index().SetName("byName"),
+	})
+	require.NoError(t, err)
+
+	specs := []IndexSpec{{Keys: bson.D{{Key: "entity.name", Value: IndexAscending}}, Unique: true}}
+	report, err := EnsureIndexes(t.Context(), session, &testEntity{}, specs, false)
+	require.NoError(t, err)
+	require.Equal(t, []string{"entity.name_1"}, report.Created)
+	require.Empty(t, report.Obsolete)
+	require.Equal(t, []string{"byName"}, report.Dropped)
+
+	indexes, err := session.ListIndexes(t.Context(), coll)
+	require.NoError(t, err)
+	names := []string{}
+	for _, index := range indexes {
+		names = append(names, index.IndexName())
+	}
+	require.ElementsMatch(t, []string{"uuid", "entity.name_1"}, names)
+}
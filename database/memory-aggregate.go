@@ -0,0 +1,715 @@
+package database
+
+import (
+	"fmt"
+	"maps"
+	"strings"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+)
+
+// collectionLookup returns the documents of a collection of the same database, used by $lookup
+type collectionLookup func(collName string) []bson.M
+
+// runPipeline evaluates an aggregation pipeline for the memory backend. Supported stages: $match, $group,
+// $project, $addFields, $sort, $skip, $limit, $unwind, $lookup, $facet and $count. The input documents are not changed.
+func runPipeline(docs []bson.M, pipeline Pipeline, lookup collectionLookup) ([]bson.M, error) {
+	for _, stage := range pipeline {
+		if len(stage) != 1 {
+			return nil, fmt.Errorf("a pipeline stage must have exactly one operator, got %v", stage)
+		}
+		op, raw := stage[0].Key, stage[0].Value
+
+		var err error
+		switch op {
+		case "$sort":
+			docs, err = stageSort(docs, raw)
+		case "$facet":
+			docs, err = stageFacet(docs, raw, lookup)
+		default:
+			var spec any
+			if spec, err = normalizeValue(raw); err != nil {
+				return nil, err
+			}
+			switch op {
+			case "$match":
+				docs, err = stageMatch(docs, spec)
+			case "$group":
+				docs, err = stageGroup(docs, spec)
+			case "$project":
+				docs, err = stageProject(docs, spec)
+			case "$addFields", "$set":
+				docs, err = stageAddFields(docs, spec)
+			case "$skip", "$limit":
+				docs, err = stageSlice(docs, op, spec)
+			case "$unwind":
+				docs, err = stageUnwind(docs, spec)
+			case "$lookup":
+				docs, err = stageLookup(docs, spec, lookup)
+			case "$count":
+				docs, err = stageCount(docs, spec)
+			default:
+				err = fmt.Errorf("unsupported pipeline stage %s", op)
+			}
+		}
+		if err != nil {
+			return nil, err
+		}
+	}
+	return docs, nil
+}
+
+// normalizeValue converts a value the way the mongo driver would store it, see toDocument
+func normalizeValue(value any) (any, error) {
+	doc, err := toDocument(bson.D{{Key: "v", Value: value}})
+	if err != nil {
+		return nil, err
+	}
+	return doc["v"], nil
+}
+
+func stageMatch(docs []bson.M, spec any) ([]bson.M, error) {
+	if spec == nil {
+		return docs, nil
+	}
+	filter, ok := spec.(bson.M)
+	if !ok {
+		return nil, fmt.Errorf("$match expects a document, got %T", spec)
+	}
+	result := []bson.M{}
+	for _, doc := range docs {
+		ok, err := matchFilter(doc, filter)
+		if err != nil {
+			return nil, err
+		}
+		if ok {
+			result = append(result, doc)
+		}
+	}
+	return result, nil
+}
+
+type memoryGroup struct {
+	id     any
+	values map[string][]any
+}
+
+func stageGroup(docs []bson.M, spec any) ([]bson.M, error) {
+	groupSpec, ok := spec.(bson.M)
+	if !ok {
+		return nil, fmt.Errorf("$group expects a document, got %T", spec)
+	}
+	idExpr, ok := groupSpec["_id"]
+	if !ok {
+		return nil, fmt.Errorf("$group requires an _id expression")
+	}
+
+	groups := []*memoryGroup{}
+	for _, doc := range docs {
+		id, err := evalExpression(doc, idExpr)
+		if err != nil {
+			return nil, err
+		}
+		var group *memoryGroup
+		for _, g := range groups {
+			if valuesEqual(g.id, id) {
+				group = g
+				break
+			}
+		}
+		if group == nil {
+			group = &memoryGroup{id: id, values: map[string][]any{}}
+			groups = append(groups, group)
+		}
+		for field, accumulator := range groupSpec {
+			if field == "_id" {
+				continue
+			}
+			acc, ok := accumulator.(bson.M)
+			if !ok || len(acc) != 1 {
+				return nil, fmt.Errorf("invalid accumulator for %s: %v", field, accumulator)
+			}
+			for _, expr := range acc {
+				value, err := evalExpression(doc, expr)
+				if err != nil {
+					return nil, err
+				}
+				group.values[field] = append(group.values[field], value)
+			}
+		}
+	}
+
+	result := make([]bson.M, 0, len(groups))
+	for _, group := range groups {
+		doc := bson.M{"_id": group.id}
+		for field, accumulator := range groupSpec {
+			if field == "_id" {
+				continue
+			}
+			for op := range accumulator.(bson.M) {
+				value, err := accumulate(op, group.values[field])
+				if err != nil {
+					return nil, err
+				}
+				doc[field] = value
+			}
+		}
+		result = append(result, doc)
+	}
+	return result, nil
+}
+
+func accumulate(op string, values []any) (any, error) {
+	switch op {
+	case "$sum", "$avg":
+		sum, count := 0.0, 0
+		allInt := true
+		for _, v := range values {
+			f, ok := toFloat(v)
+			if !ok {
+				continue
+			}
+			if _, isFloat := v.(float64); isFloat {
+				allInt = false
+			}
+			sum += f
+			count++
+		}
+		if op == "$avg" {
+			if count == 0 {
+				return nil, nil
+			}
+			return sum / float64(count), nil
+		}
+		if allInt {
+			return int64(sum), nil
+		}
+		return sum, nil
+	case "$min", "$max":
+		var result any
+		for _, v := range values {
+			if v == nil {
+				continue
+			}
+			if result == nil {
+				result = v
+				continue
+			}
+			c := compareValues(v, result)
+			if (op == "$min" && c < 0) || (op == "$max" && c > 0) {
+				result = v
+			}
+		}
+		return result, nil
+	case "$first":
+		if len(values) == 0 {
+			return nil, nil
+		}
+		return values[0], nil
+	case "$last":
+		if len(values) == 0 {
+			return nil, nil
+		}
+		return values[len(values)-1], nil
+	case "$push":
+		return primitive.A(values), nil
+	case "$addToSet":
+		result := primitive.A{}
+		for _, v := range values {
+			found := false
+			for _, r := range result {
+				if valuesEqual(r, v) {
+					found = true
+					break
+				}
+			}
+			if !found {
+				result = append(result, v)
+			}
+		}
+		return result, nil
+	}
+	return nil, fmt.Errorf("unsupported accumulator %s", op)
+}
+
+// stageProject supports inclusion and exclusion of paths and computed fields
+func stageProject(docs []bson.M, spec any) ([]bson.M, error) {
+	projection, ok := spec.(bson.M)
+	if !ok {
+		return nil, fmt.Errorf("$project expects a document, got %T", spec)
+	}
+
+	paths, computed := bson.M{}, bson.M{}
+	for path, value := range projection {
+		switch value.(type) {
+		case bool, int32, int64, float64:
+			paths[path] = value
+		default:
+			computed[path] = value
+		}
+	}
+	if len(computed) == 0 {
+		result := make([]bson.M, 0, len(docs))
+		for _, doc := range docs {
+			result = append(result, projectDocument(doc, paths))
+		}
+		return result, nil
+	}
+
+	// computed fields imply an inclusion projection
+	for path, value := range paths {
+		if path != "_id" && !isIncluded(value) {
+			return nil, fmt.Errorf("$project cannot exclude %s and compute fields at the same time", path)
+		}
+	}
+	result := make([]bson.M, 0, len(docs))
+	for _, doc := range docs {
+		projected := bson.M{}
+		if value, ok := paths["_id"]; (!ok || isIncluded(value)) && doc["_id"] != nil {
+			projected["_id"] = doc["_id"]
+		}
+		for path := range paths {
+			if path != "_id" {
+				copyPath(doc, projected, strings.Split(path, "."))
+			}
+		}
+		for path, expr := range computed {
+			value, err := evalExpression(doc, expr)
+			if err != nil {
+				return nil, err
+			}
+			projected = withPath(projected, path, value)
+		}
+		result = append(result, projected)
+	}
+	return result, nil
+}
+
+func stageAddFields(docs []bson.M, spec any) ([]bson.M, error) {
+	fields, ok := spec.(bson.M)
+	if !ok {
+		return nil, fmt.Errorf("$addFields expects a document, got %T", spec)
+	}
+	result := make([]bson.M, 0, len(docs))
+	for _, doc := range docs {
+		extended := doc
+		for path, expr := range fields {
+			value, err := evalExpression(doc, expr)
+			if err != nil {
+				return nil, err
+			}
+			extended = withPath(extended, path, value)
+		}
+		result = append(result, extended)
+	}
+	return result, nil
+}
+
+func stageSort(docs []bson.M, spec any) ([]bson.M, error) {
+	var sort bson.D
+	switch s := spec.(type) {
+	case bson.D:
+		sort = s
+	case bson.M:
+		if len(s) > 1 {
+			return nil, fmt.Errorf("$sort by several fields needs an ordered bson.D")
+		}
+		for key, value := range s {
+			sort = bson.D{{Key: key, Value: value}}
+		}
+	default:
+		return nil, fmt.Errorf("$sort expects a document, got %T", spec)
+	}
+	result := append([]bson.M{}, docs...)
+	sortDocuments(result, sort)
+	return result, nil
+}
+
+func stageSlice(docs []bson.M, op string, spec any) ([]bson.M, error) {
+	f, ok := toFloat(spec)
+	if !ok || f < 0 {
+		return nil, fmt.Errorf("%s expects a non negative number, got %v", op, spec)
+	}
+	n := min(int(f), len(docs))
+	if op == "$skip" {
+		return docs[n:], nil
+	}
+	return docs[:n], nil
+}
+
+func stageUnwind(docs []bson.M, spec any) ([]bson.M, error) {
+	path, preserveEmpty := "", false
+	switch s := spec.(type) {
+	case string:
+		path = s
+	case bson.M:
+		path, _ = s["path"].(string)
+		preserveEmpty, _ = s["preserveNullAndEmptyArrays"].(bool)
+	}
+	if !strings.HasPrefix(path, "$") {
+		return nil, fmt.Errorf("$unwind expects a field path starting with $, got %v", spec)
+	}
+	path = path[1:]
+
+	result := []bson.M{}
+	for _, doc := range docs {
+		value := fieldValue(doc, path)
+		list, isArray := value.(primitive.A)
+		switch {
+		case isArray && len(list) > 0:
+			for _, item := range list {
+				result = append(result, withPath(doc, path, item))
+			}
+		case !isArray && value != nil:
+			result = append(result, doc)
+		case preserveEmpty:
+			result = append(result, removePath(doc, strings.Split(path, ".")))
+		}
+	}
+	return result, nil
+}
+
+func stageLookup(docs []bson.M, spec any, lookup collectionLookup) ([]bson.M, error) {
+	s, ok := spec.(bson.M)
+	if !ok {
+		return nil, fmt.Errorf("$lookup expects a document, got %T", spec)
+	}
+	from, _ := s["from"].(string)
+	localField, _ := s["localField"].(string)
+	foreignField, _ := s["foreignField"].(string)
+	as, _ := s["as"].(string)
+	if from == "" || localField == "" || foreignField == "" || as == "" {
+		return nil, fmt.Errorf("$lookup requires from, localField, foreignField and as")
+	}
+
+	foreignDocs := lookup(from)
+	result := make([]bson.M, 0, len(docs))
+	for _, doc := range docs {
+		localValues := flattenValues(lookupPath(doc, localField))
+		if len(localValues) == 0 {
+			localValues = []any{nil}
+		}
+		matches := primitive.A{}
+		for _, foreign := range foreignDocs {
+			foreignValues := flattenValues(lookupPath(foreign, foreignField))
+			if len(foreignValues) == 0 {
+				foreignValues = []any{nil}
+			}
+			if anyEqual(localValues, foreignValues) {
+				matches = append(matches, foreign)
+			}
+		}
+		result = append(result, withPath(doc, as, matches))
+	}
+	return result, nil
+}
+
+func flattenValues(values []any) []any {
+	result := []any{}
+	for _, v := range values {
+		if list, ok := v.(primitive.A); ok {
+			result = append(result, list...)
+		} else {
+			result = append(result, v)
+		}
+	}
+	return result
+}
+
+func anyEqual(a, b []any) bool {
+	for _, x := range a {
+		for _, y := range b {
+			if valuesEqual(x, y) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+func stageFacet(docs []bson.M, spec any, lookup collectionLookup) ([]bson.M, error) {
+	facets := map[string]Pipeline{}
+	switch s := spec.(type) {
+	case map[string]Pipeline:
+		facets = s
+	case bson.M:
+		for name, value := range s {
+			switch p := value.(type) {
+			case Pipeline:
+				facets[name] = p
+			case mongo.Pipeline:
+				facets[name] = Pipeline(p)
+			case []bson.D:
+				facets[name] = Pipeline(p)
+			default:
+				return nil, fmt.Errorf("the facet %s must be a pipeline, got %T", name, value)
+			}
+		}
+	default:
+		return nil, fmt.Errorf("$facet expects a map of pipelines, got %T", spec)
+	}
+
+	result := bson.M{}
+	for name, pipeline := range facets {
+		output, err := runPipeline(docs, pipeline, lookup)
+		if err != nil {
+			return nil, fmt.Errorf("facet %s: %w", name, err)
+		}
+		list := make(primitive.A, 0, len(output))
+		for _, doc := range output {
+			list = append(list, doc)
+		}
+		result[name] = list
+	}
+	return []bson.M{result}, nil
+}
+
+func stageCount(docs []bson.M, spec any) ([]bson.M, error) {
+	field, ok := spec.(string)
+	if !ok || field == "" || strings.HasPrefix(field, "$") {
+		return nil, fmt.Errorf("$count expects a field name, got %v", spec)
+	}
+	if len(docs) == 0 {
+		return []bson.M{}, nil
+	}
+	return []bson.M{{field: int32(len(docs))}}, nil
+}
+
+// withPath returns a copy of the document with the value set at the dotted path.
+// The documents on the path are copied, the original document is not changed.
+func withPath(doc bson.M, path string, value any) bson.M {
+	result := maps.Clone(doc)
+	if result == nil {
+		result = bson.M{}
+	}
+	head, rest, nested := strings.Cut(path, ".")
+	if !nested {
+		result[head] = value
+		return result
+	}
+	child, _ := result[head].(bson.M)
+	result[head] = withPath(child, rest, value)
+	return result
+}
+
+// fieldValue returns the value at the dotted path without mapping arrays on the way
+func fieldValue(doc bson.M, path string) any {
+	var value any = doc
+	for part := range strings.SplitSeq(path, ".") {
+		m, ok := value.(bson.M)
+		if !ok {
+			return nil
+		}
+		value = m[part]
+	}
+	return value
+}
+
+// evalExpression evaluates field paths ("$entity.name"), literals, documents of expressions and the operators
+// $dateTrunc, $convert, $toDate, $toDouble, $ifNull and $size
+func evalExpression(doc bson.M, expr any) (any, error) {
+	switch e := expr.(type) {
+	case string:
+		if strings.HasPrefix(e, "$") {
+			return resolveField(doc, e[1:]), nil
+		}
+		return e, nil
+	case bson.M:
+		if len(e) == 1 {
+			for op, arg := range e {
+				if strings.HasPrefix(op, "$") {
+					return evalOperator(doc, op, arg)
+				}
+			}
+		}
+		result := bson.M{}
+		for k, v := range e {
+			value, err := evalExpression(doc, v)
+			if err != nil {
+				return nil, err
+			}
+			result[k] = value
+		}
+		return result, nil
+	case primitive.A:
+		result := primitive.A{}
+		for _, v := range e {
+			value, err := evalExpression(doc, v)
+			if err != nil {
+				return nil, err
+			}
+			result = append(result, value)
+		}
+		return result, nil
+	}
+	return expr, nil
+}
+
+func evalOperator(doc bson.M, op string, arg any) (any, error) {
+	args := func() (bson.M, error) {
+		m, ok := arg.(bson.M)
+		if !ok {
+			return nil, fmt.Errorf("%s expects a document, got %T", op, arg)
+		}
+		result := bson.M{}
+		for k, v := range m {
+			value, err := evalExpression(doc, v)
+			if err != nil {
+				return nil, err
+			}
+			result[k] = value
+		}
+		return result, nil
+	}
+
+	switch op {
+	case "$dateTrunc":
+		a, err := args()
+		if err != nil {
+			return nil, err
+		}
+		t, ok := toTime(a["date"])
+		if !ok {
+			return nil, nil
+		}
+		unit, _ := a["unit"].(string)
+		truncated, err := truncateTime(t.UTC(), unit)
+		if err != nil {
+			return nil, err
+		}
+		return primitive.NewDateTimeFromTime(truncated), nil
+	case "$convert":
+		a, err := args()
+		if err != nil {
+			return nil, err
+		}
+		if a["input"] == nil {
+			return a["onNull"], nil
+		}
+		to, _ := a["to"].(string)
+		value, ok := convertValue(a["input"], to)
+		if !ok {
+			if onError, set := a["onError"]; set {
+				return onError, nil
+			}
+			return nil, fmt.Errorf("could not convert %v to %s", a["input"], to)
+		}
+		return value, nil
+	case "$toDate", "$toDouble":
+		input, err := evalExpression(doc, arg)
+		if err != nil || input == nil {
+			return nil, err
+		}
+		to := map[string]string{"$toDate": "date", "$toDouble": "double"}[op]
+		value, ok := convertValue(input, to)
+		if !ok {
+			return nil, fmt.Errorf("could not convert %v to %s", input, to)
+		}
+		return value, nil
+	case "$ifNull":
+		list, ok := arg.(primitive.A)
+		if !ok {
+			return nil, fmt.Errorf("$ifNull expects an array, got %T", arg)
+		}
+		for _, item := range list {
+			value, err := evalExpression(doc, item)
+			if err != nil || value != nil {
+				return value, err
+			}
+		}
+		return nil, nil
+	case "$size":
+		value, err := evalExpression(doc, arg)
+		if err != nil {
+			return nil, err
+		}
+		list, ok := value.(primitive.A)
+		if !ok {
+			return nil, fmt.Errorf("$size expects an array, got %T", value)
+		}
+		return int32(len(list)), nil
+	}
+	return nil, fmt.Errorf("unsupported expression operator %s", op)
+}
+
+var dateLayouts = []string{time.RFC3339Nano, "2006-01-02T15:04:05", "2006-01-02 15:04:05", time.DateOnly}
+
+func convertValue(value any, to string) (any, bool) {
+	switch to {
+	case "date":
+		if t, ok := toTime(value); ok {
+			return primitive.NewDateTimeFromTime(t), true
+		}
+		if s, ok := value.(string); ok {
+			for _, layout := range dateLayouts {
+				if t, err := time.Parse(layout, s); err == nil {
+					return primitive.NewDateTimeFromTime(t), true
+				}
+			}
+		}
+	case "double":
+		if f, ok := toFloat(value); ok {
+			return f, true
+		}
+		if s, ok := value.(string); ok {
+			var f float64
+			if _, err := fmt.Sscan(s, &f); err == nil {
+				return f, true
+			}
+		}
+	case "string":
+		return fmt.Sprint(value), true
+	}
+	return nil, false
+}
+
+// truncateTime truncates like $dateTrunc, weeks start on sunday
+func truncateTime(t time.Time, unit string) (time.Time, error) {
+	switch unit {
+	case "year":
+		return time.Date(t.Year(), 1, 1, 0, 0, 0, 0, time.UTC), nil
+	case "quarter":
+		return time.Date(t.Year(), t.Month()-(t.Month()-1)%3, 1, 0, 0, 0, 0, time.UTC), nil
+	case "month":
+		return time.Date(t.Year(), t.Month(), 1, 0, 0, 0, 0, time.UTC), nil
+	case "week":
+		day := time.Date(t.Year(), t.Month(), t.Day(), 0, 0, 0, 0, time.UTC)
+		return day.AddDate(0, 0, -int(day.Weekday())), nil
+	case "day":
+		return time.Date(t.Year(), t.Month(), t.Day(), 0, 0, 0, 0, time.UTC), nil
+	case "hour":
+		return t.Truncate(time.Hour), nil
+	case "minute":
+		return t.Truncate(time.Minute), nil
+	}
+	return t, fmt.Errorf("unsupported date unit %s", unit)
+}
+
+// resolveField returns the value of a path the way aggregation expressions do: arrays on the way
+// are mapped to arrays of values, a missing field results in nil.
+func resolveField(value any, path string) any {
+	if path == "" {
+		return value
+	}
+	head, rest, _ := strings.Cut(path, ".")
+	switch v := value.(type) {
+	case bson.M:
+		child, ok := v[head]
+		if !ok {
+			return nil
+		}
+		return resolveField(child, rest)
+	case primitive.A:
+		result := primitive.A{}
+		for _, item := range v {
+			if r := resolveField(item, path); r != nil {
+				result = append(result, r)
+			}
+		}
+		return result
+	}
+	return nil
+}
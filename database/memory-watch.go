@@ -0,0 +1,208 @@
+package database
+
+import (
+	"context"
+	"fmt"
+	"slices"
+	"strconv"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+// memoryChange is an entry of the change log of the memory backend
+type memoryChange struct {
+	dbName    string
+	collName  string
+	operation ChangeOperation
+	id        any
+	before    bson.M
+	after     bson.M
+	timestamp time.Time
+	tx        *memoryTransaction
+}
+
+// publishChange appends a change to the log and records it in the undo log of tx, the caller must hold the write lock.
+// Changes made while a transaction runs become visible to the streams with its end.
+func (mb *MemoryBackend) publishChange(tx *memoryTransaction, dbName, collName string, operation ChangeOperation, before, after bson.M) {
+	id := any(nil)
+	if after != nil {
+		id = after["_id"]
+	} else if before != nil {
+		id = before["_id"]
+	}
+	tx.record(dbName, collName, id, before)
+	mb.changes = append(mb.changes, memoryChange{
+		dbName: dbName, collName: collName, operation: operation, id: id, before: before, after: after, timestamp: time.Now(), tx: tx,
+	})
+	if !mb.inTransaction {
+		mb.notifyChanges()
+	}
+}
+
+func (mb *MemoryBackend) notifyChanges() {
+	close(mb.changed)
+	mb.changed = make(chan struct{})
+}
+
+func (mb *MemoryBackend) beginChanges() {
+	mb.mu.Lock()
+	defer mb.mu.Unlock()
+	mb.inTransaction, mb.txChangeStart = true, len(mb.changes)
+}
+
+// endChanges publishes the changes of a committed transaction, a rolled back transaction is undone
+// and only the changes of other sessions are kept
+func (mb *MemoryBackend) endChanges(tx *memoryTransaction, commit bool) {
+	mb.mu.Lock()
+	defer mb.mu.Unlock()
+	if !commit {
+		mb.rollback(tx)
+		mb.changes = slices.DeleteFunc(mb.changes, func(change memoryChange) bool {
+			return change.tx == tx
+		})
+	}
+	mb.inTransaction = false
+	mb.notifyChanges()
+}
+
+// visibleChanges returns the number of changes streams may read, the caller must hold the lock
+func (mb *MemoryBackend) visibleChanges() int {
+	if mb.inTransaction {
+		return mb.txChangeStart
+	}
+	return len(mb.changes)
+}
+
+type memoryChangeStream struct {
+	backend  *MemoryBackend
+	dbName   string
+	collName string
+	pipeline Pipeline
+	position int
+	current  bson.M
+	token    bson.Raw
+	err      error
+}
+
+func encodeMemoryToken(position int) bson.Raw {
+	data, _ := bson.Marshal(bson.M{"_data": strconv.Itoa(position)})
+	return data
+}
+
+func decodeMemoryToken(token bson.Raw) (int, error) {
+	data, ok := token.Lookup("_data").StringValueOK()
+	if !ok {
+		return 0, fmt.Errorf("invalid resume token %v", token)
+	}
+	return strconv.Atoi(data)
+}
+
+func (c memoryCollection) watch(ctx context.Context, pipeline Pipeline, resumeAfter bson.Raw) (ChangeStream, error) {
+	c.backend.mu.RLock()
+	defer c.backend.mu.RUnlock()
+
+	result := &memoryChangeStream{backend: c.backend, dbName: c.dbName, collName: c.name, pipeline: pipeline}
+	result.position = c.backend.visibleChanges()
+	if resumeAfter != nil {
+		position, err := decodeMemoryToken(resumeAfter)
+		if err != nil {
+			return nil, err
+		}
+		result.position = position
+	}
+	result.token = encodeMemoryToken(result.position)
+	return result, nil
+}
+
+func (cs *memoryChangeStream) event(position int, change memoryChange) bson.M {
+	result := bson.M{
+		"_id":           encodeMemoryToken(position + 1),
+		"operationType": string(change.operation),
+		"ns":            bson.M{"db": change.dbName, "coll": change.collName},
+		"documentKey":   bson.M{"_id": change.id},
+		"clusterTime":   primitive.Timestamp{T: uint32(change.timestamp.Unix())},
+	}
+	if change.after != nil {
+		result["fullDocument"] = change.after
+	}
+	if change.before != nil {
+		result["fullDocumentBeforeChange"] = change.before
+	}
+	return result
+}
+
+// Next blocks until the next change of the collection matching the pipeline or the end of the context
+func (cs *memoryChangeStream) Next(ctx context.Context) bool {
+	if cs.err != nil {
+		return false
+	}
+	for {
+		cs.backend.mu.RLock()
+		visible := cs.backend.visibleChanges()
+		for cs.position < visible {
+			change := cs.backend.changes[cs.position]
+			event := cs.event(cs.position, change)
+			cs.position++
+			cs.token = encodeMemoryToken(cs.position)
+			if change.dbName != cs.dbName || change.collName != cs.collName {
+				continue
+			}
+
+			output, err := cs.filter(event)
+			if err == nil && len(output) == 0 {
+				continue
+			}
+			cs.backend.mu.RUnlock()
+			if err != nil {
+				cs.err = err
+				return false
+			}
+			cs.current = output[0]
+			return true
+		}
+		changed := cs.backend.changed
+		cs.backend.mu.RUnlock()
+
+		select {
+		case <-ctx.Done():
+			cs.err = ctx.Err()
+			return false
+		case <-changed:
+		}
+	}
+}
+
+func (cs *memoryChangeStream) filter(event bson.M) ([]bson.M, error) {
+	normalized, err := toDocument(event)
+	if err != nil {
+		return nil, err
+	}
+	noLookup := func(collName string) []bson.M { return nil }
+	return runPipeline([]bson.M{normalized}, cs.pipeline, noLookup)
+}
+
+func (cs *memoryChangeStream) Decode(val any) error {
+	return decodeDocument(cs.current, val)
+}
+
+func (cs *memoryChangeStream) ResumeToken() bson.Raw {
+	return cs.token
+}
+
+func (cs *memoryChangeStream) Err() error {
+	return cs.err
+}
+
+func (cs *memoryChangeStream) Close(ctx context.Context) error {
+	return nil
+}
+
+func (ms memorySession) Watch(ctx context.Context, coll Collection, pipeline Pipeline, resumeAfter bson.Raw) (ChangeStream, error) {
+	mc, ok := coll.(memoryCollection)
+	if !ok {
+		return nil, fmt.Errorf("the collection %T does not belong to the memory backend", coll)
+	}
+	return mc.watch(ctx, pipeline, resumeAfter)
+}
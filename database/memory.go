@@ -0,0 +1,964 @@
+package database
+
+import (
+	"context"
+	"fmt"
+	"reflect"
+	"slices"
+	"strings"
+	"sync"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// MemoryBackend keeps all databases in memory. It implements the same semantics as the mongo backend
+// for the subset of the query language used in this module and is meant for unit tests and offline development.
+type MemoryBackend struct {
+	mu        sync.RWMutex
+	txMu      sync.Mutex
+	databases map[string]map[string]*memoryCollectionData
+
+	// change log read by the change streams, see memory-watch.go
+	changes       []memoryChange
+	changed       chan struct{}
+	inTransaction bool
+	txChangeStart int
+}
+
+type memoryIndex struct {
+	name   string
+	keys   bson.D
+	unique bool
+	ttl    *int32
+}
+
+type memoryCollectionData struct {
+	docs    []bson.M
+	indexes []memoryIndex
+}
+
+func NewMemoryBackend() *MemoryBackend {
+	return &MemoryBackend{
+		databases: make(map[string]map[string]*memoryCollectionData),
+		changed:   make(chan struct{}),
+	}
+}
+
+// UseMemoryBackend creates a new in-memory backend and activates it for OpenSession
+func UseMemoryBackend() *MemoryBackend {
+	result := NewMemoryBackend()
+	SetBackend(result)
+	return result
+}
+
+func (mb *MemoryBackend) OpenSession(opts ...SessionOption) (DatabaseSession, error) {
+	return &memorySession{sessionOptions: newSessionOptions(opts), backend: mb}, nil
+}
+
+// Reset drops all databases
+func (mb *MemoryBackend) Reset() {
+	mb.mu.Lock()
+	defer mb.mu.Unlock()
+	mb.databases = make(map[string]map[string]*memoryCollectionData)
+	mb.changes = nil
+}
+
+// memoryTxKey carries the running transaction in the context like mongo.SessionContext does
+type memoryTxKey struct{}
+
+// memoryTransaction is the undo log of a transaction of the memory backend
+type memoryTransaction struct {
+	docs    []memoryUndo
+	created [][2]string
+}
+
+// memoryUndo keeps the state of a document before a transaction wrote it first, before is nil for inserted documents
+type memoryUndo struct {
+	dbName   string
+	collName string
+	id       any
+	before   bson.M
+}
+
+func transactionFrom(ctx context.Context) *memoryTransaction {
+	tx, _ := ctx.Value(memoryTxKey{}).(*memoryTransaction)
+	return tx
+}
+
+// record remembers the original state of a written document, the caller must hold the write lock
+func (tx *memoryTransaction) record(dbName, collName string, id any, before bson.M) {
+	if tx == nil {
+		return
+	}
+	for _, undo := range tx.docs {
+		if undo.dbName == dbName && undo.collName == collName && reflect.DeepEqual(undo.id, id) {
+			return
+		}
+	}
+	tx.docs = append(tx.docs, memoryUndo{dbName: dbName, collName: collName, id: id, before: before})
+}
+
+// rollback restores the documents written by the transaction and drops the collections it created.
+// Documents written by other sessions are kept. The caller must hold the write lock.
+func (mb *MemoryBackend) rollback(tx *memoryTransaction) {
+	for _, undo := range slices.Backward(tx.docs) {
+		data := mb.collectionData(undo.dbName, undo.collName, undo.before != nil)
+		if data == nil {
+			continue
+		}
+		i := slices.IndexFunc(data.docs, func(doc bson.M) bool {
+			return reflect.DeepEqual(doc["_id"], undo.id)
+		})
+		switch {
+		case i >= 0 && undo.before == nil:
+			data.docs = slices.Delete(data.docs, i, i+1)
+		case i >= 0:
+			data.docs[i] = undo.before
+		case undo.before != nil:
+			data.docs = append(data.docs, undo.before)
+		}
+	}
+	for _, name := range tx.created {
+		data := mb.collectionData(name[0], name[1], false)
+		if data == nil || len(data.docs) > 0 || len(data.indexes) > 0 {
+			continue
+		}
+		delete(mb.databases[name[0]], name[1])
+		if len(mb.databases[name[0]]) == 0 {
+			delete(mb.databases, name[0])
+		}
+	}
+}
+
+// collectionData returns the data of a collection. The caller must hold the lock, create is only allowed with the write lock.
+func (mb *MemoryBackend) collectionData(dbName, collName string, create bool) *memoryCollectionData {
+	db, ok := mb.databases[dbName]
+	if !ok {
+		if !create {
+			return nil
+		}
+		db = make(map[string]*memoryCollectionData)
+		mb.databases[dbName] = db
+	}
+	data, ok := db[collName]
+	if !ok {
+		if !create {
+			return nil
+		}
+		data = &memoryCollectionData{}
+		db[collName] = data
+	}
+	return data
+}
+
+func (data *memoryCollectionData) find(filter bson.M) ([]int, error) {
+	result := []int{}
+	if data == nil {
+		return result, nil
+	}
+	for i, doc := range data.docs {
+		ok, err := matchFilter(doc, filter)
+		if err != nil {
+			return nil, err
+		}
+		if ok {
+			result = append(result, i)
+		}
+	}
+	return result, nil
+}
+
+func (data *memoryCollectionData) checkUnique(doc bson.M, skip int) error {
+	for _, index := range data.indexes {
+		if !index.unique {
+			continue
+		}
+		key := indexKey(doc, index.keys)
+		for i, other := range data.docs {
+			if i == skip {
+				continue
+			}
+			if reflect.DeepEqual(key, indexKey(other, index.keys)) {
+				return mongo.WriteException{
+					WriteErrors: []mongo.WriteError{{
+						Code:    11000,
+						Message: fmt.Sprintf("E11000 duplicate key error index: %s dup key: %v", index.name, key),
+					}},
+				}
+			}
+		}
+	}
+	return nil
+}
+
+func indexKey(doc bson.M, keys bson.D) []any {
+	result := make([]any, 0, len(keys))
+	for _, e := range keys {
+		values := lookupPath(doc, e.Key)
+		if len(values) == 0 {
+			result = append(result, nil)
+			continue
+		}
+		result = append(result, values[0])
+	}
+	return result
+}
+
+type memoryCollection struct {
+	backend *MemoryBackend
+	dbName  string
+	name    string
+}
+
+// data returns the data of the collection and remembers the collections created by a transaction.
+// The caller must hold the lock, create is only allowed with the write lock.
+func (c memoryCollection) data(tx *memoryTransaction, create bool) *memoryCollectionData {
+	if tx != nil && create && c.backend.collectionData(c.dbName, c.name, false) == nil {
+		tx.created = append(tx.created, [2]string{c.dbName, c.name})
+	}
+	return c.backend.collectionData(c.dbName, c.name, create)
+}
+
+func (c memoryCollection) get() *mongo.Collection {
+	return nil
+}
+
+func (c memoryCollection) createIndex(ctx context.Context, mod mongo.IndexModel, opts ...*options.CreateIndexesOptions) error {
+	keys := bson.D{}
+	data, err := bson.Marshal(mod.Keys)
+	if err != nil {
+		return err
+	}
+	if err = bson.Unmarshal(data, &keys); err != nil {
+		return err
+	}
+
+	index := memoryIndex{keys: keys}
+	if mod.Options != nil {
+		if mod.Options.Name != nil {
+			index.name = *mod.Options.Name
+		}
+		if mod.Options.Unique != nil {
+			index.unique = *mod.Options.Unique
+		}
+		index.ttl = mod.Options.ExpireAfterSeconds
+	}
+	if index.name == "" {
+		index.name = IndexSpec{Keys: keys}.IndexName()
+	}
+
+	c.backend.mu.Lock()
+	defer c.backend.mu.Unlock()
+
+	coll := c.backend.collectionData(c.dbName, c.name, true)
+	for i, existing := range coll.indexes {
+		if existing.name == index.name {
+			coll.indexes[i] = index
+			return nil
+		}
+	}
+	coll.indexes = append(coll.indexes, index)
+	for i, doc := range coll.docs {
+		if err := coll.checkUnique(doc, i); err != nil {
+			coll.indexes = coll.indexes[:len(coll.indexes)-1]
+			return err
+		}
+	}
+	return nil
+}
+
+func (c memoryCollection) listIndexes(ctx context.Context) ([]IndexSpec, error) {
+	c.backend.mu.RLock()
+	defer c.backend.mu.RUnlock()
+
+	result := []IndexSpec{}
+	if coll := c.backend.collectionData(c.dbName, c.name, false); coll != nil {
+		for _, index := range coll.indexes {
+			result = append(result, IndexSpec{Name: index.name, Keys: index.keys, Unique: index.unique, TTL: index.ttl})
+		}
+	}
+	return result, nil
+}
+
+func (c memoryCollection) dropIndex(ctx context.Context, name string) error {
+	c.backend.mu.Lock()
+	defer c.backend.mu.Unlock()
+
+	coll := c.backend.collectionData(c.dbName, c.name, false)
+	if coll != nil {
+		for i, index := range coll.indexes {
+			if index.name == name {
+				coll.indexes = slices.Delete(coll.indexes, i, i+1)
+				return nil
+			}
+		}
+	}
+	return fmt.Errorf("index not found with name [%s]", name)
+}
+
+func (c memoryCollection) aggregate(ctx context.Context, pipeline Pipeline, result any) error {
+	c.backend.mu.RLock()
+	defer c.backend.mu.RUnlock()
+
+	// $lookup reads the other collections of the same database
+	lookup := func(collName string) []bson.M {
+		if coll := c.backend.collectionData(c.dbName, collName, false); coll != nil {
+			return coll.docs
+		}
+		return nil
+	}
+
+	docs, err := runPipeline(lookup(c.name), pipeline, lookup)
+	if err != nil {
+		return err
+	}
+	return decodeAll(docs, result)
+}
+
+func (c memoryCollection) updateOne(ctx context.Context, filter bson.M, record any) error {
+	_, err := c.update(ctx, filter, bson.M{"$set": record})
+	return err
+}
+
+// update applies the update operators to the first matching document and returns true if a document matched
+func (c memoryCollection) update(ctx context.Context, filter bson.M, update bson.M) (bool, error) {
+	normFilter, err := toDocument(filter)
+	if err != nil {
+		return false, err
+	}
+	normUpdate, err := toDocument(update)
+	if err != nil {
+		return false, err
+	}
+
+	c.backend.mu.Lock()
+	defer c.backend.mu.Unlock()
+
+	coll := c.backend.collectionData(c.dbName, c.name, false)
+	found, err := coll.find(normFilter)
+	if err != nil || len(found) == 0 {
+		return false, err
+	}
+
+	updated, err := applyUpdate(copyDocument(coll.docs[found[0]]), normUpdate)
+	if err != nil {
+		return false, err
+	}
+	if err = coll.checkUnique(updated, found[0]); err != nil {
+		return false, err
+	}
+	c.backend.publishChange(transactionFrom(ctx), c.dbName, c.name, ChangeUpdate, coll.docs[found[0]], updated)
+	coll.docs[found[0]] = updated
+	return true, nil
+}
+
+func (c memoryCollection) replaceOne(ctx context.Context, filter bson.M, replacement any, allowInsert bool) (bool, error) {
+	normFilter, err := toDocument(filter)
+	if err != nil {
+		return false, err
+	}
+	doc, err := toDocument(replacement)
+	if err != nil {
+		return false, err
+	}
+
+	c.backend.mu.Lock()
+	defer c.backend.mu.Unlock()
+
+	tx := transactionFrom(ctx)
+	coll := c.data(tx, allowInsert)
+	found, err := coll.find(normFilter)
+	if err != nil {
+		return false, err
+	}
+
+	if len(found) == 0 {
+		if !allowInsert {
+			return false, nil
+		}
+		return true, c.insert(tx, coll, doc)
+	}
+
+	doc["_id"] = coll.docs[found[0]]["_id"]
+	if err = coll.checkUnique(doc, found[0]); err != nil {
+		return false, err
+	}
+	c.backend.publishChange(tx, c.dbName, c.name, ChangeReplace, coll.docs[found[0]], doc)
+	coll.docs[found[0]] = doc
+	return true, nil
+}
+
+func (data *memoryCollectionData) insert(doc bson.M) error {
+	if _, ok := doc["_id"]; !ok {
+		doc["_id"] = primitive.NewObjectID()
+	}
+	if err := data.checkUnique(doc, -1); err != nil {
+		return err
+	}
+	data.docs = append(data.docs, doc)
+	return nil
+}
+
+func (c memoryCollection) insert(tx *memoryTransaction, coll *memoryCollectionData, doc bson.M) error {
+	if err := coll.insert(doc); err != nil {
+		return err
+	}
+	c.backend.publishChange(tx, c.dbName, c.name, ChangeInsert, nil, doc)
+	return nil
+}
+
+func (c memoryCollection) insertOne(ctx context.Context, record any) error {
+	doc, err := toDocument(record)
+	if err != nil {
+		return err
+	}
+
+	c.backend.mu.Lock()
+	defer c.backend.mu.Unlock()
+
+	tx := transactionFrom(ctx)
+	return c.insert(tx, c.data(tx, true), doc)
+}
+
+func (c memoryCollection) updateEntity(ctx context.Context, doc DomainEntity) (bool, error) {
+	return c.update(ctx, byUUID(doc.UUID()), bson.M{"$set": doc})
+}
+
+func (c memoryCollection) removeOne(ctx context.Context, filter bson.M) error {
+	return c.remove(ctx, filter, false)
+}
+
+func (c memoryCollection) removeMany(ctx context.Context, filter bson.M) error {
+	return c.remove(ctx, filter, true)
+}
+
+func (c memoryCollection) remove(ctx context.Context, filter bson.M, many bool) error {
+	normFilter, err := toDocument(filter)
+	if err != nil {
+		return err
+	}
+
+	c.backend.mu.Lock()
+	defer c.backend.mu.Unlock()
+
+	coll := c.backend.collectionData(c.dbName, c.name, false)
+	found, err := coll.find(normFilter)
+	if err != nil || len(found) == 0 {
+		return err
+	}
+	if !many {
+		found = found[:1]
+	}
+	for _, i := range found {
+		c.backend.publishChange(transactionFrom(ctx), c.dbName, c.name, ChangeDelete, coll.docs[i], nil)
+	}
+	slices.Reverse(found)
+	for _, i := range found {
+		coll.docs = slices.Delete(coll.docs, i, i+1)
+	}
+	return nil
+}
+
+// query returns copies of the matching documents, sorted and paged
+func (c memoryCollection) query(filter bson.M, sort bson.D, offset, limit int64) ([]bson.M, error) {
+	normFilter, err := toDocument(filter)
+	if err != nil {
+		return nil, err
+	}
+
+	c.backend.mu.RLock()
+	defer c.backend.mu.RUnlock()
+
+	coll := c.backend.collectionData(c.dbName, c.name, false)
+	found, err := coll.find(normFilter)
+	if err != nil {
+		return nil, err
+	}
+
+	result := make([]bson.M, 0, len(found))
+	for _, i := range found {
+		result = append(result, copyDocument(coll.docs[i]))
+	}
+
+	sortDocuments(result, sort)
+
+	if offset > 0 {
+		if offset >= int64(len(result)) {
+			return []bson.M{}, nil
+		}
+		result = result[offset:]
+	}
+	if limit > 0 && limit < int64(len(result)) {
+		result = result[:limit]
+	}
+	return result, nil
+}
+
+func (c memoryCollection) count(filter bson.M) (int64, error) {
+	docs, err := c.query(filter, nil, 0, 0)
+	return int64(len(docs)), err
+}
+
+func (c memoryCollection) findEntity(ctx context.Context, filter bson.M, doc DomainEntity) (bool, error) {
+	return c.findOne(ctx, filter, doc)
+}
+
+func (c memoryCollection) findOne(ctx context.Context, filter bson.M, doc any) (bool, error) {
+	docs, err := c.query(filter, nil, 0, 1)
+	if err != nil || len(docs) == 0 {
+		return false, err
+	}
+	if err = decodeDocument(docs[0], doc); err != nil {
+		return false, err
+	}
+	return true, nil
+}
+
+func (c memoryCollection) findWithOptions(ctx context.Context, filter bson.M, result any, sort bson.D, projection bson.M, offset, limit int64) error {
+	docs, err := c.query(filter, sort, offset, limit)
+	if err != nil {
+		return err
+	}
+	for i, doc := range docs {
+		docs[i] = projectDocument(doc, projection)
+	}
+	return decodeAll(docs, result)
+}
+
+func (c memoryCollection) iterate(ctx context.Context, filter bson.M, sort bson.D, projection bson.M, f func(raw bson.Raw) error) error {
+	docs, err := c.query(filter, sort, 0, 0)
+	if err != nil {
+		return err
+	}
+	for _, doc := range docs {
+		if err = ctx.Err(); err != nil {
+			return err
+		}
+		raw, err := bson.Marshal(projectDocument(doc, projection))
+		if err != nil {
+			return err
+		}
+		if err = f(raw); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (c memoryCollection) findMany(ctx context.Context, filter bson.M, result any) error {
+	return c.findWithOptions(ctx, filter, result, nil, nil, 0, 0)
+}
+
+func copyDocument(doc bson.M) bson.M {
+	result, err := toDocument(doc)
+	if err != nil {
+		// a document read from the store has been marshalled before, so this should never happen
+		panic(err)
+	}
+	return result
+}
+
+func decodeDocument(doc bson.M, target any) error {
+	data, err := bson.Marshal(doc)
+	if err != nil {
+		return err
+	}
+	return bson.Unmarshal(data, target)
+}
+
+// decodeAll decodes documents into a pointer to a slice like cursor.All does
+func decodeAll(docs []bson.M, result any) error {
+	resultValue := reflect.ValueOf(result)
+	if resultValue.Kind() != reflect.Pointer || resultValue.Elem().Kind() != reflect.Slice {
+		return fmt.Errorf("result argument must be a pointer to a slice, got %T", result)
+	}
+	sliceValue := resultValue.Elem()
+	elemType := sliceValue.Type().Elem()
+	sliceValue.SetLen(0)
+
+	for _, doc := range docs {
+		data, err := bson.Marshal(doc)
+		if err != nil {
+			return err
+		}
+		var item reflect.Value
+		if elemType.Kind() == reflect.Interface {
+			d := bson.D{}
+			if err = bson.Unmarshal(data, &d); err != nil {
+				return err
+			}
+			item = reflect.ValueOf(d)
+		} else {
+			ptr := reflect.New(elemType)
+			if err = bson.Unmarshal(data, ptr.Interface()); err != nil {
+				return err
+			}
+			item = ptr.Elem()
+		}
+		sliceValue = reflect.Append(sliceValue, item)
+	}
+	resultValue.Elem().Set(sliceValue)
+	return nil
+}
+
+// applyUpdate supports the update operators $set, $unset and $inc
+func applyUpdate(doc bson.M, update bson.M) (bson.M, error) {
+	for op, value := range update {
+		fields, ok := value.(bson.M)
+		if !ok {
+			return nil, fmt.Errorf("update operator %s expects a document, got %T", op, value)
+		}
+		for path, v := range fields {
+			var err error
+			switch op {
+			case "$set":
+				_, err = lookupOrSet(doc, path, v, false)
+			case "$unset":
+				_, err = lookupOrSet(doc, path, nil, true)
+			case "$inc":
+				current := lookupPath(doc, path)
+				sum, _ := toFloat(v)
+				if len(current) > 0 {
+					f, ok := toFloat(current[0])
+					if !ok {
+						return nil, fmt.Errorf("cannot apply $inc to the non-numeric field %s", path)
+					}
+					sum += f
+				}
+				_, err = lookupOrSet(doc, path, sum, false)
+			default:
+				return nil, fmt.Errorf("unsupported update operator %s", op)
+			}
+			if err != nil {
+				return nil, err
+			}
+		}
+	}
+	return doc, nil
+}
+
+// lookupOrSet sets (or removes) the value of a dotted path, creating nested documents on the way
+func lookupOrSet(doc bson.M, path string, value any, remove bool) (bson.M, error) {
+	parts := strings.Split(path, ".")
+	node := doc
+	for _, part := range parts[:len(parts)-1] {
+		child, ok := node[part]
+		if !ok || child == nil {
+			if remove {
+				return doc, nil
+			}
+			child = bson.M{}
+			node[part] = child
+		}
+		childDoc, ok := child.(bson.M)
+		if !ok {
+			return nil, fmt.Errorf("cannot set %s: %s is not a document", path, part)
+		}
+		node = childDoc
+	}
+	last := parts[len(parts)-1]
+	if remove {
+		delete(node, last)
+	} else {
+		node[last] = value
+	}
+	return doc, nil
+}
+
+/***********************************************/
+/*                   Session                   */
+/***********************************************/
+
+type memorySession struct {
+	sessionOptions
+	backend       *MemoryBackend
+	inTransaction bool
+}
+
+func (ms memorySession) collection(dbName, collName string) memoryCollection {
+	return memoryCollection{backend: ms.backend, dbName: dbName, name: collName}
+}
+
+// run executes an operation of the memory backend honoring the cancellation of the context
+func (ms memorySession) run(ctx context.Context, f func(ctx context.Context) error) error {
+	ctx, cancel := ms.operationContext(ctx)
+	defer cancel()
+
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	return f(ctx)
+}
+
+func (ms memorySession) GetDatabase(name string) *mongo.Database {
+	return nil
+}
+
+func (ms memorySession) InsertOne(ctx context.Context, coll Collection, record any) error {
+	return ms.run(ctx, func(ctx context.Context) error {
+		return coll.insertOne(ctx, record)
+	})
+}
+
+func (ms memorySession) ReplaceOne(ctx context.Context, coll Collection, filter bson.M, replacement any, allowInsert bool) error {
+	return ms.run(ctx, func(ctx context.Context) error {
+		_, err := coll.replaceOne(ctx, filter, replacement, allowInsert)
+		return err
+	})
+}
+
+func (ms memorySession) UpdateOne(ctx context.Context, coll Collection, filter bson.M, doc any) error {
+	return ms.run(ctx, func(ctx context.Context) error {
+		return coll.updateOne(ctx, filter, doc)
+	})
+}
+
+func (ms memorySession) FindEntity(ctx context.Context, coll Collection, filter bson.M, doc DomainEntity) (found bool, err error) {
+	filter = excludeDeleted(filter)
+	err = ms.run(ctx, func(ctx context.Context) error {
+		found, err = coll.findEntity(ctx, filter, doc)
+		return err
+	})
+	if err != nil || !found {
+		return found, err
+	}
+	return true, decodeFields(doc)
+}
+
+func (ms memorySession) FindOne(ctx context.Context, coll Collection, filter bson.M, doc any) (found bool, err error) {
+	err = ms.run(ctx, func(ctx context.Context) error {
+		found, err = coll.findOne(ctx, filter, doc)
+		return err
+	})
+	return found, err
+}
+
+func (ms memorySession) FindMany(ctx context.Context, coll Collection, filter bson.M, docList any) error {
+	return ms.run(ctx, func(ctx context.Context) error {
+		return coll.findMany(ctx, filter, docList)
+	})
+}
+
+func (ms memorySession) Extract(ctx context.Context, coll Collection, filter bson.M, result *[]any, sort bson.D, offset, limit int64) (totalCount int64, err error) {
+	return ms.FindByQuery(ctx, coll, Query{filter: FilterFromBson(filter), sort: sort, total: true}, result, offset, limit)
+}
+
+func (ms memorySession) FindByQuery(ctx context.Context, coll Collection, query Query, result *[]any, offset, limit int64) (totalCount int64, err error) {
+	totalCount = -1
+	filter := query.Filter().Bson()
+	err = ms.run(ctx, func(ctx context.Context) error {
+		if query.total {
+			if totalCount, err = ms.CountDocuments(ctx, coll, filter); err != nil {
+				return err
+			}
+		}
+		return coll.findWithOptions(ctx, filter, result, query.Sort(), query.Projection(), offset, limit)
+	})
+	return totalCount, err
+}
+
+func (ms memorySession) Iterate(ctx context.Context, coll Collection, query Query, f func(raw bson.Raw) error) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	return coll.iterate(ctx, query.Filter().Bson(), query.Sort(), query.Projection(), f)
+}
+
+func (ms memorySession) CountDocuments(ctx context.Context, coll Collection, filter bson.M) (count int64, err error) {
+	mc, ok := coll.(memoryCollection)
+	if !ok {
+		return 0, fmt.Errorf("the collection %T does not belong to the memory backend", coll)
+	}
+	err = ms.run(ctx, func(ctx context.Context) error {
+		count, err = mc.count(filter)
+		return err
+	})
+	return count, err
+}
+
+func (ms memorySession) Aggregate(ctx context.Context, dbName, collName string, match, group bson.M, result any) error {
+	return ms.run(ctx, func(ctx context.Context) error {
+		return ms.collection(dbName, collName).aggregate(ctx, NewPipeline().Stage("$match", match).Stage("$group", group), result)
+	})
+}
+
+func (ms memorySession) AggregatePipeline(ctx context.Context, coll Collection, pipeline Pipeline, result any) error {
+	mc, ok := coll.(memoryCollection)
+	if !ok {
+		return fmt.Errorf("the collection %T does not belong to the memory backend", coll)
+	}
+	return ms.run(ctx, func(ctx context.Context) error {
+		return mc.aggregate(ctx, pipeline, result)
+	})
+}
+
+func (ms memorySession) GetCollection(databaseName, collectionName string) Collection {
+	return ms.collection(databaseName, collectionName)
+}
+
+func (ms memorySession) GetDatabaseNames(ctx context.Context) ([]string, error) {
+	ms.backend.mu.RLock()
+	defer ms.backend.mu.RUnlock()
+
+	result := []string{}
+	for name := range ms.backend.databases {
+		result = append(result, name)
+	}
+	slices.Sort(result)
+	return result, nil
+}
+
+func (ms memorySession) GetCollectionNames(ctx context.Context, dbName string) ([]string, error) {
+	ms.backend.mu.RLock()
+	defer ms.backend.mu.RUnlock()
+
+	result := []string{}
+	for name := range ms.backend.databases[dbName] {
+		result = append(result, name)
+	}
+	slices.Sort(result)
+	return result, nil
+}
+
+func (ms memorySession) GetEntityByUUID(ctx context.Context, uuid string, requestedObject DomainEntity) (bool, error) {
+	if uuid == "" {
+		return false, fmt.Errorf("GetObjectByUUID failed. Got an empty UID")
+	}
+	coll := ms.collection(requestedObject.DatabaseName(), requestedObject.CollectionName())
+	found, err := ms.FindOne(ctx, coll, excludeDeleted(byUUID(uuid)), requestedObject)
+	if err != nil || !found {
+		return found, err
+	}
+	return true, decodeFields(requestedObject)
+}
+
+func (ms memorySession) InsertEntity(ctx context.Context, entity DomainEntity) error {
+	if entity.UUID() == "" {
+		return fmt.Errorf("cannot insert an entity with an empty UID. Entity: %v", entity)
+	}
+	return withEncodedFields(entity, func() error {
+		return ms.InsertOne(ctx, ms.collection(entity.DatabaseName(), entity.CollectionName()), entity)
+	})
+}
+
+func (ms memorySession) UpdateEntityByUUID(ctx context.Context, updatedObject DomainEntity) error {
+	if updatedObject.UUID() == "" {
+		return fmt.Errorf("UpdateEntityByUID failed. Got an empty UID in %v", updatedObject)
+	}
+	coll := ms.collection(updatedObject.DatabaseName(), updatedObject.CollectionName())
+	return withEncodedFields(updatedObject, func() error {
+		return ms.WithTransaction(ctx, func(ctx context.Context, tx DatabaseSession) error {
+			var changed bool
+			err := ms.run(ctx, func(ctx context.Context) (err error) {
+				changed, err = coll.updateEntity(ctx, updatedObject)
+				return err
+			})
+			if err != nil || !changed {
+				return err
+			}
+			return appendRevision(ctx, tx, updatedObject, RevisionActionSave)
+		})
+	})
+}
+
+func (ms memorySession) SaveEntityToHistory(ctx context.Context, entity DomainEntity) error {
+	return withEncodedFields(entity, func() error {
+		return appendRevision(ctx, &ms, entity, RevisionActionSave)
+	})
+}
+
+func (ms memorySession) ReplaceEntityByUUID(ctx context.Context, doc DomainEntity, allowInsert bool) error {
+	if doc.UUID() == "" {
+		return fmt.Errorf("could not upsert an entity: no uuid has been set")
+	}
+	coll := ms.collection(doc.DatabaseName(), doc.CollectionName())
+	return withEncodedFields(doc, func() error {
+		return ms.WithTransaction(ctx, func(ctx context.Context, tx DatabaseSession) error {
+			changed, err := replaceEntity(ctx, tx, doc, allowInsert, func(ctx context.Context, filter bson.M, allowInsert bool) (changed bool, err error) {
+				err = ms.run(ctx, func(ctx context.Context) (err error) {
+					changed, err = coll.replaceOne(ctx, filter, doc, allowInsert)
+					return err
+				})
+				return changed, err
+			})
+			if err != nil || !changed {
+				return err
+			}
+			return appendRevision(ctx, tx, doc, RevisionActionSave)
+		})
+	})
+}
+
+func (ms memorySession) RemoveOne(ctx context.Context, coll Collection, selector bson.M) error {
+	return ms.run(ctx, func(ctx context.Context) error {
+		return coll.removeOne(ctx, selector)
+	})
+}
+
+func (ms memorySession) RemoveMany(ctx context.Context, coll Collection, selector bson.M) error {
+	return ms.run(ctx, func(ctx context.Context) error {
+		return coll.removeMany(ctx, selector)
+	})
+}
+
+func (ms memorySession) RemoveEntity(ctx context.Context, entity DomainEntity) error {
+	return withEncodedFields(entity, func() error {
+		return ms.WithTransaction(ctx, func(ctx context.Context, tx DatabaseSession) error {
+			if err := appendRevision(ctx, tx, entity, RevisionActionRemove); err != nil {
+				return err
+			}
+			coll := tx.GetCollection(entity.DatabaseName(), entity.CollectionName())
+			return tx.RemoveOne(ctx, coll, byUUID(entity.UUID()))
+		})
+	})
+}
+
+// WithTransaction serializes transactions and rolls back the writes made with the context of f if f fails.
+// Writes of other sessions running concurrently are kept, index changes are not rolled back.
+func (ms memorySession) WithTransaction(ctx context.Context, f TransactionFunc) error {
+	if ms.inTransaction {
+		return f(ctx, &ms)
+	}
+
+	ms.backend.txMu.Lock()
+	defer ms.backend.txMu.Unlock()
+
+	undo := &memoryTransaction{}
+	ms.backend.beginChanges()
+
+	tx := ms
+	tx.inTransaction = true
+	if err := f(context.WithValue(ctx, memoryTxKey{}, undo), &tx); err != nil {
+		ms.backend.endChanges(undo, false)
+		return err
+	}
+	ms.backend.endChanges(undo, true)
+	return nil
+}
+
+func (ms memorySession) CreateIndex(ctx context.Context, c Collection, mod mongo.IndexModel, opts ...*options.CreateIndexesOptions) error {
+	return ms.run(ctx, func(ctx context.Context) error {
+		return c.createIndex(ctx, mod, opts...)
+	})
+}
+
+func (ms memorySession) ListIndexes(ctx context.Context, coll Collection) (result []IndexSpec, err error) {
+	err = ms.run(ctx, func(ctx context.Context) error {
+		result, err = coll.listIndexes(ctx)
+		return err
+	})
+	return result, err
+}
+
+func (ms memorySession) DropIndex(ctx context.Context, coll Collection, name string) error {
+	return ms.run(ctx, func(ctx context.Context) error {
+		return coll.dropIndex(ctx, name)
+	})
+}
+
+func (ms *memorySession) Close() error {
+	return nil
+}
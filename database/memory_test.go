@@ -0,0 +1,304 @@
+package database
+
+import (
+	"context"
+	"fmt"
+	"testing"
+
+	"github.com/dchaykin/go-modules/user"
+	"github.com/stretchr/testify/require"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+type testEntity struct {
+	Fields map[string]any `bson:"entity"`
+}
+
+func newTestEntity(uuid string, fields map[string]any) *testEntity {
+	result := &testEntity{Fields: map[string]any{"uuid": uuid}}
+	for k, v := range fields {
+		result.Fields[k] = v
+	}
+	return result
+}
+
+func (e testEntity) UUID() string {
+	if uuid, ok := e.Fields["uuid"]; ok {
+		return fmt.Sprintf("%v", uuid)
+	}
+	return ""
+}
+
+func (e *testEntity) SetUUID(uuid string) {
+	e.SetValue("uuid", uuid)
+}
+
+func (e testEntity) CreateEmpty() DomainEntity {
+	return &testEntity{}
+}
+
+func (e *testEntity) SetValue(key string, value any) {
+	if e.Fields == nil {
+		e.Fields = map[string]any{}
+	}
+	e.Fields[key] = value
+}
+
+func (e testEntity) GetValue(key string) any {
+	return e.Fields[key]
+}
+
+func (e testEntity) DatabaseName() string {
+	return "test"
+}
+
+func (e testEntity) CollectionName() string {
+	return "item"
+}
+
+func (e testEntity) Entity() map[string]any {
+	return e.Fields
+}
+
+func (e testEntity) OverviewRow() map[string]any {
+	return e.Fields
+}
+
+func (e *testEntity) SetMetadata(appName string) {}
+
+func (e testEntity) GetAccessConfig() []AccessConfig {
+	return nil
+}
+
+func (e *testEntity) CleanNil() {}
+
+func (e testEntity) BeforeSave(ctx context.Context, session DatabaseSession) error {
+	return nil
+}
+
+func (e *testEntity) SetUserIdentity(userIdentity user.UserIdentity) {}
+
+func (e testEntity) UserIdentity() user.UserIdentity {
+	return nil
+}
+
+func (e *testEntity) NormalizePrimitives() {}
+
+func (e *testEntity) ApplyMapper() {}
+
+func openMemorySession(t *testing.T) DatabaseSession {
+	UseMemoryBackend()
+	t.Cleanup(func() { SetBackend(nil) })
+
+	session, err := OpenSession()
+	require.NoError(t, err)
+	return session
+}
+
+func insertTestEntities(t *testing.T, session DatabaseSession) {
+	entities := []*testEntity{
+		newTestEntity("a1", map[string]any{"name": "Alpha", "amount": 10, "tags": []any{"red", "blue"}}),
+		newTestEntity("b2", map[string]any{"name": "Bravo", "amount": 25.5, "address": map[string]any{"city": "Berlin"}}),
+		newTestEntity("c3", map[string]any{"name": "Charlie", "amount": 40, "address": map[string]any{"city": "Hamburg"}}),
+	}
+	for _, e := range entities {
+		require.NoError(t, session.InsertEntity(t.Context(), e))
+	}
+}
+
+func TestMemoryEntityCrud(t *testing.T) {
+	session := openMemorySession(t)
+	defer session.Close()
+
+	insertTestEntities(t, session)
+
+	doc := &testEntity{}
+	found, err := session.GetEntityByUUID(t.Context(), "b2", doc)
+	require.NoError(t, err)
+	require.True(t, found)
+	require.Equal(t, "Bravo", doc.GetValue("name"))
+
+	doc.SetValue("name", "Bravo 2")
+	require.NoError(t, session.ReplaceEntityByUUID(t.Context(), doc, false))
+
+	doc = &testEntity{}
+	found, err = session.GetEntityByUUID(t.Context(), "b2", doc)
+	require.NoError(t, err)
+	require.True(t, found)
+	require.Equal(t, "Bravo 2", doc.GetValue("name"))
+
+	require.NoError(t, session.RemoveEntity(t.Context(), doc))
+	found, err = session.GetEntityByUUID(t.Context(), "b2", &testEntity{})
+	require.NoError(t, err)
+	require.False(t, found)
+
+	revisions, err := ListRevisions(t.Context(), session, "b2", &testEntity{})
+	require.NoError(t, err)
+	require.Len(t, revisions, 2)
+	require.Equal(t, RevisionActionRemove, revisions[1].Action)
+
+	require.Error(t, session.ReplaceEntityByUUID(t.Context(), &testEntity{}, true))
+}
+
+func TestMemoryFilter(t *testing.T) {
+	session := openMemorySession(t)
+	defer session.Close()
+
+	insertTestEntities(t, session)
+	coll := session.GetCollection("test", "item")
+
+	tests := []struct {
+		filter   bson.M
+		expected []string
+	}{
+		{nil, []string{"a1", "b2", "c3"}},
+		{bson.M{"entity.uuid": "a1"}, []string{"a1"}},
+		{bson.M{"entity.address.city": "Berlin"}, []string{"b2"}},
+		{bson.M{"entity.tags": "blue"}, []string{"a1"}},
+		{bson.M{"entity.uuid": bson.M{"$in": []string{"a1", "c3"}}}, []string{"a1", "c3"}},
+		{bson.M{"entity.amount": bson.M{"$gt": 10, "$lt": 40}}, []string{"b2"}},
+		{bson.M{"entity.amount": bson.M{"$gte": 10}}, []string{"a1", "b2", "c3"}},
+		{bson.M{"entity.address": bson.M{"$exists": false}}, []string{"a1"}},
+		{bson.M{"entity.name": bson.M{"$regex": "^ch", "$options": "i"}}, []string{"c3"}},
+		{bson.M{"$or": []bson.M{{"entity.uuid": "a1"}, {"entity.amount": 40}}}, []string{"a1", "c3"}},
+		{bson.M{"entity.unknown": nil}, []string{"a1", "b2", "c3"}},
+	}
+
+	for _, test := range tests {
+		result := []testEntity{}
+		require.NoError(t, session.FindMany(t.Context(), coll, test.filter, &result), "filter %v", test.filter)
+		uuids := []string{}
+		for _, e := range result {
+			uuids = append(uuids, e.UUID())
+		}
+		require.ElementsMatch(t, test.expected, uuids, "filter %v", test.filter)
+	}
+}
+
+func TestMemoryExtract(t *testing.T) {
+	session := openMemorySession(t)
+	defer session.Close()
+
+	insertTestEntities(t, session)
+
+	entities, err := ReadDomainEntities(t.Context(), session, &testEntity{}, 0, 2)
+	require.NoError(t, err)
+	require.Len(t, entities, 2)
+	require.Equal(t, "a1", entities[0].UUID())
+
+	coll := session.GetCollection("test", "item")
+	result := []any{}
+	count, err := session.Extract(t.Context(), coll, nil, &result, bson.D{{Key: "entity.amount", Value: -1}}, 1, 1)
+	require.NoError(t, err)
+	require.EqualValues(t, 3, count)
+	require.Len(t, result, 1)
+
+	doc := result[0].(bson.D).Map()
+	require.Equal(t, "b2", doc["entity"].(bson.D).Map()["uuid"])
+}
+
+func TestMemoryAggregate(t *testing.T) {
+	session := openMemorySession(t)
+	defer session.Close()
+
+	insertTestEntities(t, session)
+
+	result := []struct {
+		ID    string  `bson:"_id"`
+		Total float64 `bson:"total"`
+		Count int     `bson:"count"`
+	}{}
+	err := session.Aggregate(t.Context(), "test", "item", bson.M{"entity.amount": bson.M{"$gt": 10}},
+		bson.M{"_id": "all", "total": bson.M{"$sum": "$entity.amount"}, "count": bson.M{"$sum": 1}}, &result)
+	require.NoError(t, err)
+	require.Len(t, result, 1)
+	require.Equal(t, 65.5, result[0].Total)
+	require.Equal(t, 2, result[0].Count)
+}
+
+func TestMemoryUniqueIndex(t *testing.T) {
+	session := openMemorySession(t)
+	defer session.Close()
+
+	insertTestEntities(t, session)
+
+	coll := session.GetCollection("test", "item")
+	err := session.CreateIndex(t.Context(), coll, mongo.IndexModel{
+		Keys:    bson.D{{Key: "entity.uuid", Value: 1}},
+		Options: options.Index().SetUnique(true),
+	})
+	require.NoError(t, err)
+
+	err = session.InsertEntity(t.Context(), newTestEntity("a1", nil))
+	require.True(t, mongo.IsDuplicateKeyError(err))
+}
+
+func TestMemoryBackendIsActive(t *testing.T) {
+	UseMemoryBackend()
+	defer SetBackend(nil)
+
+	require.True(t, HasMongoAccess())
+
+	err := GetDomainEntityByUUID(t.Context(), "a1", &testEntity{})
+	require.EqualError(t, err, "no record with UUID a1 found")
+}
+
+func TestMemorySessionContext(t *testing.T) {
+	session := openMemorySession(t)
+	defer session.Close()
+
+	ctx, cancel := context.WithCancel(t.Context())
+	cancel()
+
+	err := session.InsertEntity(ctx, newTestEntity("a1", nil))
+	require.ErrorIs(t, err, context.Canceled)
+
+	found, err := session.GetEntityByUUID(t.Context(), "a1", &testEntity{})
+	require.NoError(t, err)
+	require.False(t, found)
+}
+
+func TestMemoryTransaction(t *testing.T) {
+	session := openMemorySession(t)
+	defer session.Close()
+
+	insertTestEntities(t, session)
+
+	err := session.WithTransaction(t.Context(), func(ctx context.Context, tx DatabaseSession) error {
+		if err := tx.RemoveEntity(ctx, newTestEntity("a1", nil)); err != nil {
+			return err
+		}
+		if err := tx.InsertEntity(ctx, newTestEntity("d4", nil)); err != nil {
+			return err
+		}
+		// writes of other sessions are not part of the transaction and are kept
+		if err := session.InsertEntity(t.Context(), newTestEntity("e5", nil)); err != nil {
+			return err
+		}
+		return fmt.Errorf("abort")
+	})
+	require.EqualError(t, err, "abort")
+
+	found, err := session.GetEntityByUUID(t.Context(), "e5", &testEntity{})
+	require.NoError(t, err)
+	require.True(t, found)
+
+	found, err = session.GetEntityByUUID(t.Context(), "a1", &testEntity{})
+	require.NoError(t, err)
+	require.True(t, found)
+
+	found, err = session.GetEntityByUUID(t.Context(), "d4", &testEntity{})
+	require.NoError(t, err)
+	require.False(t, found)
+
+	err = session.WithTransaction(t.Context(), func(ctx context.Context, tx DatabaseSession) error {
+		return tx.InsertEntity(ctx, newTestEntity("d4", nil))
+	})
+	require.NoError(t, err)
+
+	found, err = session.GetEntityByUUID(t.Context(), "d4", &testEntity{})
+	require.NoError(t, err)
+	require.True(t, found)
+}
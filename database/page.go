@@ -0,0 +1,97 @@
+package database
+
+import (
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+
+	"github.com/dchaykin/mygolib/log"
+	"go.mongodb.org/mongo-driver/bson"
+)
+
+// Page is a chunk of entities read by ReadDomainEntityPage
+type Page struct {
+	Entities []DomainEntity
+	// NextToken continues the reading after the last entity of the page. It is empty on the last page.
+	NextToken string
+	// Total is the number of all entities matching the query, only set if requested
+	Total *int64
+}
+
+type pageToken struct {
+	After string `json:"after"`
+}
+
+func encodePageToken(token pageToken) (string, error) {
+	data, err := json.Marshal(token)
+	if err != nil {
+		return "", err
+	}
+	return base64.RawURLEncoding.EncodeToString(data), nil
+}
+
+func decodePageToken(value string) (pageToken, error) {
+	result := pageToken{}
+	if value == "" {
+		return result, nil
+	}
+	data, err := base64.RawURLEncoding.DecodeString(value)
+	if err == nil {
+		err = json.Unmarshal(data, &result)
+	}
+	if err != nil || result.After == "" {
+		return result, fmt.Errorf("invalid page token: %s", value)
+	}
+	return result, nil
+}
+
+// ReadDomainEntityPage reads the entities matching the query page by page, ordered by their uuid.
+// Since the uuids generated by datamodel.GenerateUUID start with a timestamp, the order is the order of creation
+// and entities inserted while paging do not shift the following pages. Pass an empty token for the first page
+// and Page.NextToken for the following ones. The sort order of the query is ignored.
+func ReadDomainEntityPage(ctx context.Context, session DatabaseSession, domainEntity DomainEntity, query Query, token string, limit int64, withTotal bool) (*Page, error) {
+	if limit <= 0 {
+		return nil, fmt.Errorf("the page size must be positive, got %d", limit)
+	}
+	after, err := decodePageToken(token)
+	if err != nil {
+		return nil, err
+	}
+
+	query = query.entityQuery()
+	coll := session.GetCollection(domainEntity.DatabaseName(), domainEntity.CollectionName())
+	result := &Page{}
+	if withTotal {
+		total, err := session.CountDocuments(ctx, coll, query.Filter().Bson())
+		if err != nil {
+			return nil, err
+		}
+		result.Total = &total
+	}
+
+	pageQuery := query
+	pageQuery.total = false
+	pageQuery.sort = bson.D{{Key: "entity.uuid", Value: 1}}
+	if after.After != "" {
+		pageQuery.filter = And(query.Filter(), Gt("uuid", after.After))
+	}
+
+	// one more entity than requested tells whether there is a next page
+	dataList := []any{}
+	if _, err = session.FindByQuery(ctx, coll, pageQuery, &dataList, 0, limit+1); err != nil {
+		return nil, err
+	}
+	hasNext := int64(len(dataList)) > limit
+	if hasNext {
+		dataList = dataList[:limit]
+	}
+
+	if result.Entities, err = convertToDomainEntities(dataList, domainEntity); err != nil {
+		return nil, log.WrapError(err)
+	}
+	if hasNext {
+		result.NextToken, err = encodePageToken(pageToken{After: result.Entities[len(result.Entities)-1].UUID()})
+	}
+	return result, err
+}
@@ -0,0 +1,36 @@
+package database
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestReadDomainEntityPage(t *testing.T) {
+	session := openMemorySession(t)
+	defer session.Close()
+
+	insertTestEntities(t, session)
+	require.NoError(t, session.InsertEntity(t.Context(), newTestEntity("d4", map[string]any{"amount": 5})))
+
+	query := NewQuery(Gte("amount", 10))
+	page, err := ReadDomainEntityPage(t.Context(), session, &testEntity{}, query, "", 2, true)
+	require.NoError(t, err)
+	require.EqualValues(t, 3, *page.Total)
+	require.Len(t, page.Entities, 2)
+	require.Equal(t, "a1", page.Entities[0].UUID())
+	require.NotEmpty(t, page.NextToken)
+
+	// an entity inserted before the current position does not shift the next page
+	require.NoError(t, session.InsertEntity(t.Context(), newTestEntity("a0", map[string]any{"amount": 50})))
+
+	page, err = ReadDomainEntityPage(t.Context(), session, &testEntity{}, query, page.NextToken, 2, false)
+	require.NoError(t, err)
+	require.Nil(t, page.Total)
+	require.Len(t, page.Entities, 1)
+	require.Equal(t, "c3", page.Entities[0].UUID())
+	require.Empty(t, page.NextToken)
+
+	_, err = ReadDomainEntityPage(t.Context(), session, &testEntity{}, query, "garbage", 2, false)
+	require.EqualError(t, err, "invalid page token: garbage")
+}
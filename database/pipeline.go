@@ -0,0 +1,105 @@
+package database
+
+import (
+	"context"
+	"slices"
+
+	"go.mongodb.org/mongo-driver/bson"
+)
+
+// Pipeline is an aggregation pipeline, one stage per element. It can be passed to the mongo driver as is.
+// The paths used in the stages are absolute, e.g. "$entity.partner".
+type Pipeline []bson.D
+
+func NewPipeline(stages ...bson.D) Pipeline {
+	return Pipeline(stages)
+}
+
+// Stage appends a stage with an operator not covered by the other methods
+func (p Pipeline) Stage(op string, spec any) Pipeline {
+	return append(slices.Clip(p), bson.D{{Key: op, Value: spec}})
+}
+
+func (p Pipeline) Match(filter Filter) Pipeline {
+	return p.Stage("$match", filter.Bson())
+}
+
+// Lookup joins the documents of another collection of the same database whose foreignField equals localField
+func (p Pipeline) Lookup(from, localField, foreignField, as string) Pipeline {
+	return p.Stage("$lookup", bson.M{"from": from, "localField": localField, "foreignField": foreignField, "as": as})
+}
+
+// Unwind outputs a document per element of the array at path. With preserveEmpty documents
+// without elements are kept.
+func (p Pipeline) Unwind(path string, preserveEmpty bool) Pipeline {
+	return p.Stage("$unwind", bson.M{"path": "$" + path, "preserveNullAndEmptyArrays": preserveEmpty})
+}
+
+func (p Pipeline) Project(projection bson.M) Pipeline {
+	return p.Stage("$project", projection)
+}
+
+func (p Pipeline) AddFields(fields bson.M) Pipeline {
+	return p.Stage("$addFields", fields)
+}
+
+// Group groups the documents by the id expression, accumulators maps the output fields to accumulators like {"$sum": 1}
+func (p Pipeline) Group(id any, accumulators bson.M) Pipeline {
+	spec := bson.M{"_id": id}
+	for field, accumulator := range accumulators {
+		spec[field] = accumulator
+	}
+	return p.Stage("$group", spec)
+}
+
+func (p Pipeline) Sort(sort bson.D) Pipeline {
+	return p.Stage("$sort", sort)
+}
+
+func (p Pipeline) Skip(n int64) Pipeline {
+	return p.Stage("$skip", n)
+}
+
+func (p Pipeline) Limit(n int64) Pipeline {
+	return p.Stage("$limit", n)
+}
+
+// Facet runs several pipelines on the same input, the result is a single document with a field per pipeline
+func (p Pipeline) Facet(facets map[string]Pipeline) Pipeline {
+	return p.Stage("$facet", facets)
+}
+
+// Count outputs a single document with the number of input documents in field, no document if there is no input
+func (p Pipeline) Count(field string) Pipeline {
+	return p.Stage("$count", field)
+}
+
+// AggregateEntities runs the pipeline on the collection of the domain entity and decodes the output documents into T.
+// Soft deleted entities are excluded unless the pipeline starts with a $match on metadata.deletedAt.
+func AggregateEntities[T any](ctx context.Context, session DatabaseSession, domainEntity DomainEntity, pipeline Pipeline) ([]T, error) {
+	coll := session.GetCollection(domainEntity.DatabaseName(), domainEntity.CollectionName())
+
+	if match, ok := leadingMatch(pipeline); ok {
+		pipeline = NewPipeline().Stage("$match", excludeDeleted(match)).append(pipeline[1:])
+	} else {
+		pipeline = NewPipeline().Stage("$match", excludeDeleted(bson.M{})).append(pipeline)
+	}
+
+	result := []T{}
+	if err := session.AggregatePipeline(ctx, coll, pipeline, &result); err != nil {
+		return nil, err
+	}
+	return result, nil
+}
+
+func (p Pipeline) append(stages Pipeline) Pipeline {
+	return append(slices.Clip(p), stages...)
+}
+
+func leadingMatch(pipeline Pipeline) (bson.M, bool) {
+	if len(pipeline) == 0 || len(pipeline[0]) != 1 || pipeline[0][0].Key != "$match" {
+		return nil, false
+	}
+	match, ok := pipeline[0][0].Value.(bson.M)
+	return match, ok
+}
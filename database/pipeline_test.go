@@ -0,0 +1,128 @@
+package database
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+func TestAggregateEntities(t *testing.T) {
+	session := openMemorySession(t)
+	defer session.Close()
+
+	insertTestEntities(t, session)
+
+	type cityAmount struct {
+		City   string  `bson:"_id"`
+		Amount float64 `bson:"amount"`
+		Count  int64   `bson:"count"`
+	}
+	result, err := AggregateEntities[cityAmount](t.Context(), session, &testEntity{}, NewPipeline().
+		Match(Exists("address.city", true)).
+		Group("$entity.address.city", bson.M{"amount": bson.M{"$sum": "$entity.amount"}, "count": bson.M{"$sum": 1}}).
+		Sort(bson.D{{Key: "amount", Value: -1}}))
+	require.NoError(t, err)
+	require.Equal(t, []cityAmount{{City: "Hamburg", Amount: 40, Count: 1}, {City: "Berlin", Amount: 25.5, Count: 1}}, result)
+
+	// soft deleted entities are excluded
+	require.NoError(t, SoftDeleteEntity(t.Context(), session, "c3", &testEntity{}))
+	type counter struct {
+		Total int64 `bson:"total"`
+	}
+	counts, err := AggregateEntities[counter](t.Context(), session, &testEntity{}, NewPipeline().Count("total"))
+	require.NoError(t, err)
+	require.Equal(t, []counter{{Total: 2}}, counts)
+
+	counts, err = AggregateEntities[counter](t.Context(), session, &testEntity{}, NewPipeline().Match(Eq("name", "nobody")).Count("total"))
+	require.NoError(t, err)
+	require.Empty(t, counts)
+}
+
+func TestPipelineStages(t *testing.T) {
+	session := openMemorySession(t)
+	defer session.Close()
+
+	insertTestEntities(t, session)
+	orders := session.GetCollection("test", "order")
+	require.NoError(t, session.InsertOne(t.Context(), orders, bson.M{"item": "a1", "quantity": 2}))
+	require.NoError(t, session.InsertOne(t.Context(), orders, bson.M{"item": "a1", "quantity": 3}))
+	require.NoError(t, session.InsertOne(t.Context(), orders, bson.M{"item": "c3", "quantity": 1}))
+
+	items := session.GetCollection("test", "item")
+
+	t.Run("unwind", func(t *testing.T) {
+		result := []bson.M{}
+		err := session.AggregatePipeline(t.Context(), items, NewPipeline().
+			Unwind("entity.tags", false).
+			Project(bson.M{"_id": 0, "tag": "$entity.tags"}).
+			Sort(bson.D{{Key: "tag", Value: 1}}), &result)
+		require.NoError(t, err)
+		require.Equal(t, []bson.M{{"tag": "blue"}, {"tag": "red"}}, result)
+
+		err = session.AggregatePipeline(t.Context(), items, NewPipeline().Unwind("entity.tags", true).Count("n"), &result)
+		require.NoError(t, err)
+		require.Equal(t, []bson.M{{"n": int32(4)}}, result)
+	})
+
+	t.Run("lookup", func(t *testing.T) {
+		result := []bson.M{}
+		err := session.AggregatePipeline(t.Context(), items, NewPipeline().
+			Lookup("order", "entity.uuid", "item", "orders").
+			AddFields(bson.M{"orderCount": bson.M{"$size": "$orders"}}).
+			Project(bson.M{"_id": 0, "entity.uuid": 1, "orderCount": 1}).
+			Sort(bson.D{{Key: "entity.uuid", Value: 1}}), &result)
+		require.NoError(t, err)
+		require.Equal(t, []bson.M{
+			{"entity": bson.M{"uuid": "a1"}, "orderCount": int32(2)},
+			{"entity": bson.M{"uuid": "b2"}, "orderCount": int32(0)},
+			{"entity": bson.M{"uuid": "c3"}, "orderCount": int32(1)},
+		}, result)
+	})
+
+	t.Run("facet", func(t *testing.T) {
+		type facets struct {
+			Top   []bson.M `bson:"top"`
+			Total []bson.M `bson:"total"`
+		}
+		result := []facets{}
+		err := session.AggregatePipeline(t.Context(), items, NewPipeline().Facet(map[string]Pipeline{
+			"top":   NewPipeline().Sort(bson.D{{Key: "entity.amount", Value: -1}}).Skip(1).Limit(1).Project(bson.M{"_id": 0, "name": "$entity.name"}),
+			"total": NewPipeline().Group(nil, bson.M{"amount": bson.M{"$sum": "$entity.amount"}}),
+		}), &result)
+		require.NoError(t, err)
+		require.Len(t, result, 1)
+		require.Equal(t, []bson.M{{"name": "Bravo"}}, result[0].Top)
+		require.Equal(t, 75.5, result[0].Total[0]["amount"])
+	})
+
+	t.Run("unsupported", func(t *testing.T) {
+		result := []bson.M{}
+		err := session.AggregatePipeline(t.Context(), items, NewPipeline().Stage("$bucketAuto", bson.M{}), &result)
+		require.ErrorContains(t, err, "unsupported pipeline stage $bucketAuto")
+	})
+}
+
+func TestDateExpressions(t *testing.T) {
+	doc := bson.M{"entity": bson.M{"created": "2024-05-15 10:30:00", "broken": "soon"}}
+
+	value, err := evalExpression(doc, bson.M{"$dateTrunc": bson.M{
+		"date": bson.M{"$convert": bson.M{"input": "$entity.created", "to": "date", "onError": nil}},
+		"unit": "week",
+	}})
+	require.NoError(t, err)
+	require.Equal(t, primitive.NewDateTimeFromTime(time.Date(2024, 5, 12, 0, 0, 0, 0, time.UTC)), value)
+
+	value, err = evalExpression(doc, bson.M{"$convert": bson.M{"input": "$entity.broken", "to": "date", "onError": nil}})
+	require.NoError(t, err)
+	require.Nil(t, value)
+
+	_, err = evalExpression(doc, bson.M{"$toDate": "$entity.broken"})
+	require.ErrorContains(t, err, "could not convert soon to date")
+
+	truncated, err := truncateTime(time.Date(2024, 8, 20, 13, 0, 0, 0, time.UTC), "quarter")
+	require.NoError(t, err)
+	require.Equal(t, time.Date(2024, 7, 1, 0, 0, 0, 0, time.UTC), truncated)
+}
@@ -0,0 +1,351 @@
+package database
+
+import (
+	"maps"
+	"slices"
+	"strings"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+const rootPrefix = "$root."
+
+// Root addresses a field outside of the entity, e.g. Root("metadata.user"). All other paths
+// passed to the filter functions are relative to the entity root: "address.city" means "entity.address.city".
+func Root(path string) string {
+	return rootPrefix + path
+}
+
+func documentPath(path string) string {
+	if after, ok := strings.CutPrefix(path, rootPrefix); ok {
+		return after
+	}
+	return "entity." + path
+}
+
+// Filter is a typed query condition. It compiles to a bson filter for mongo and can be evaluated
+// against a domain entity in Go with the same semantics. The zero value matches everything.
+type Filter struct {
+	doc bson.M
+}
+
+// FilterFromBson wraps a raw bson filter. The paths are not changed, so they must be absolute.
+func FilterFromBson(filter bson.M) Filter {
+	return Filter{doc: filter}
+}
+
+func fieldFilter(path string, condition any) Filter {
+	return Filter{doc: bson.M{documentPath(path): condition}}
+}
+
+func Eq(path string, value any) Filter {
+	return fieldFilter(path, value)
+}
+
+func Ne(path string, value any) Filter {
+	return fieldFilter(path, bson.M{"$ne": value})
+}
+
+func In(path string, values ...any) Filter {
+	return fieldFilter(path, bson.M{"$in": bson.A(values)})
+}
+
+func Nin(path string, values ...any) Filter {
+	return fieldFilter(path, bson.M{"$nin": bson.A(values)})
+}
+
+func Gt(path string, value any) Filter {
+	return fieldFilter(path, bson.M{"$gt": value})
+}
+
+func Gte(path string, value any) Filter {
+	return fieldFilter(path, bson.M{"$gte": value})
+}
+
+func Lt(path string, value any) Filter {
+	return fieldFilter(path, bson.M{"$lt": value})
+}
+
+func Lte(path string, value any) Filter {
+	return fieldFilter(path, bson.M{"$lte": value})
+}
+
+// Range matches values between min and max, both inclusive. A nil bound is open.
+func Range(path string, min, max any) Filter {
+	condition := bson.M{}
+	if min != nil {
+		condition["$gte"] = min
+	}
+	if max != nil {
+		condition["$lte"] = max
+	}
+	if len(condition) == 0 {
+		return Exists(path, true)
+	}
+	return fieldFilter(path, condition)
+}
+
+// Regex matches string values against pattern, options are the mongo regex options like "i"
+func Regex(path, pattern, options string) Filter {
+	condition := bson.M{"$regex": pattern}
+	if options != "" {
+		condition["$options"] = options
+	}
+	return fieldFilter(path, condition)
+}
+
+func Exists(path string, exists bool) Filter {
+	return fieldFilter(path, bson.M{"$exists": exists})
+}
+
+// And matches if all filters match. Empty filters are ignored.
+func And(filters ...Filter) Filter {
+	return combine("$and", filters)
+}
+
+// Or matches if any of the filters matches. Empty filters are ignored.
+func Or(filters ...Filter) Filter {
+	return combine("$or", filters)
+}
+
+func combine(op string, filters []Filter) Filter {
+	list := bson.A{}
+	for _, f := range filters {
+		if !f.IsEmpty() {
+			list = append(list, f.doc)
+		}
+	}
+	switch len(list) {
+	case 0:
+		return Filter{}
+	case 1:
+		return Filter{doc: list[0].(bson.M)}
+	}
+	return Filter{doc: bson.M{op: list}}
+}
+
+func (f Filter) IsEmpty() bool {
+	return len(f.doc) == 0
+}
+
+// Bson returns the filter as used by the mongo driver
+func (f Filter) Bson() bson.M {
+	if f.doc == nil {
+		return bson.M{}
+	}
+	return f.doc
+}
+
+// Matches evaluates the filter against the entity
+func (f Filter) Matches(entity DomainEntity) (bool, error) {
+	doc, err := toDocument(bson.M{"entity": entity.Entity()})
+	if err != nil {
+		return false, err
+	}
+	return f.MatchesDocument(doc)
+}
+
+// MatchesDocument evaluates the filter against a stored document
+func (f Filter) MatchesDocument(doc bson.M) (bool, error) {
+	filter, err := toDocument(f.doc)
+	if err != nil {
+		return false, err
+	}
+	doc, err = toDocument(doc)
+	if err != nil {
+		return false, err
+	}
+	return matchFilter(doc, filter)
+}
+
+// Query combines a filter with sort order and projection
+type Query struct {
+	filter      Filter
+	sort        bson.D
+	projection  bson.M
+	total       bool
+	withDeleted bool
+}
+
+// NewQuery creates a query matching all given filters
+func NewQuery(filters ...Filter) Query {
+	return Query{filter: And(filters...)}
+}
+
+// SortBy appends a sort key. Sort keys are applied in the order they have been added.
+func (q Query) SortBy(path string, ascending bool) Query {
+	direction := 1
+	if !ascending {
+		direction = -1
+	}
+	q.sort = append(slices.Clone(q.sort), bson.E{Key: documentPath(path), Value: direction})
+	return q
+}
+
+// Select restricts the returned fields to the given paths. The uuid of the entity is always returned.
+func (q Query) Select(paths ...string) Query {
+	projection := maps.Clone(q.projection)
+	if projection == nil {
+		projection = bson.M{"entity.uuid": 1}
+	}
+	for _, path := range paths {
+		projection[documentPath(path)] = 1
+	}
+	q.projection = projection
+	return q
+}
+
+// WithTotal requests the total number of matching documents from FindByQuery
+func (q Query) WithTotal() Query {
+	q.total = true
+	return q
+}
+
+// WithDeleted makes the entity read helpers return soft deleted entities as well, e.g. to rewrite all records
+// of a collection
+func (q Query) WithDeleted() Query {
+	q.withDeleted = true
+	return q
+}
+
+// entityQuery excludes the soft deleted entities from the query, unless requested by WithDeleted
+func (q Query) entityQuery() Query {
+	if !q.withDeleted {
+		q.filter = FilterFromBson(excludeDeleted(q.filter.Bson()))
+	}
+	return q
+}
+
+func (q Query) Filter() Filter {
+	return q.filter
+}
+
+func (q Query) Sort() bson.D {
+	return q.sort
+}
+
+func (q Query) Projection() bson.M {
+	return q.projection
+}
+
+// projectDocument applies an inclusion or exclusion projection to a document without modifying it
+func projectDocument(doc bson.M, projection bson.M) bson.M {
+	if len(projection) == 0 {
+		return doc
+	}
+
+	include := false
+	for path, value := range projection {
+		if path != "_id" && isIncluded(value) {
+			include = true
+		}
+	}
+
+	if !include {
+		result := doc
+		for path := range projection {
+			result = removePath(result, strings.Split(path, "."))
+		}
+		return result
+	}
+
+	result := bson.M{}
+	if value, ok := projection["_id"]; !ok || isIncluded(value) {
+		if id, ok := doc["_id"]; ok {
+			result["_id"] = id
+		}
+	}
+	for path, value := range projection {
+		if path != "_id" && isIncluded(value) {
+			copyPath(doc, result, strings.Split(path, "."))
+		}
+	}
+	return result
+}
+
+func isIncluded(value any) bool {
+	switch v := value.(type) {
+	case bool:
+		return v
+	case nil:
+		return false
+	}
+	if f, ok := toFloat(value); ok {
+		return f != 0
+	}
+	return true
+}
+
+func copyPath(src, dst bson.M, parts []string) {
+	value, ok := src[parts[0]]
+	if !ok {
+		return
+	}
+	if len(parts) == 1 {
+		dst[parts[0]] = value
+		return
+	}
+
+	switch v := value.(type) {
+	case bson.M:
+		sub, ok := dst[parts[0]].(bson.M)
+		if !ok {
+			sub = bson.M{}
+		}
+		copyPath(v, sub, parts[1:])
+		dst[parts[0]] = sub
+	case primitive.A:
+		// as mongo does, only documents are kept in projected arrays
+		list, ok := dst[parts[0]].(primitive.A)
+		if !ok {
+			list = primitive.A{}
+			for _, item := range v {
+				if _, ok := item.(bson.M); ok {
+					list = append(list, bson.M{})
+				}
+			}
+		}
+		i := 0
+		for _, item := range v {
+			if m, ok := item.(bson.M); ok {
+				copyPath(m, list[i].(bson.M), parts[1:])
+				i++
+			}
+		}
+		dst[parts[0]] = list
+	}
+}
+
+func removePath(doc bson.M, parts []string) bson.M {
+	value, ok := doc[parts[0]]
+	if !ok {
+		return doc
+	}
+
+	result := maps.Clone(doc)
+	if len(parts) == 1 {
+		delete(result, parts[0])
+		return result
+	}
+
+	switch v := value.(type) {
+	case bson.M:
+		result[parts[0]] = removePath(v, parts[1:])
+	case primitive.A:
+		list := make(primitive.A, len(v))
+		for i, item := range v {
+			if m, ok := item.(bson.M); ok {
+				list[i] = removePath(m, parts[1:])
+			} else {
+				list[i] = item
+			}
+		}
+		result[parts[0]] = list
+	}
+	return result
+}
+
+func byUUID(uuid string) bson.M {
+	return Eq("uuid", uuid).Bson()
+}
@@ -0,0 +1,91 @@
+package database
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/require"
+	"go.mongodb.org/mongo-driver/bson"
+)
+
+func TestFilterBson(t *testing.T) {
+	filter := And(
+		Eq("uuid", "a1"),
+		Or(In("tags", "red", "blue"), Range("amount", 10, nil)),
+		Regex("name", "^al", "i"),
+		Filter{},
+		Exists(Root("metadata.deletedAt"), false),
+	)
+	require.Equal(t, bson.M{"$and": bson.A{
+		bson.M{"entity.uuid": "a1"},
+		bson.M{"$or": bson.A{
+			bson.M{"entity.tags": bson.M{"$in": bson.A{"red", "blue"}}},
+			bson.M{"entity.amount": bson.M{"$gte": 10}},
+		}},
+		bson.M{"entity.name": bson.M{"$regex": "^al", "$options": "i"}},
+		bson.M{"metadata.deletedAt": bson.M{"$exists": false}},
+	}}, filter.Bson())
+
+	require.Equal(t, bson.M{}, And().Bson())
+	require.Equal(t, bson.M{"entity.uuid": "a1"}, And(Eq("uuid", "a1")).Bson())
+}
+
+func TestFilterMatches(t *testing.T) {
+	entity := newTestEntity("a1", map[string]any{
+		"name":    "Alpha",
+		"amount":  25.5,
+		"tags":    []any{"red", "blue"},
+		"address": map[string]any{"city": "Berlin"},
+		"roles":   []any{map[string]any{"uuid": "r1", "name": "admin"}},
+	})
+
+	tests := []struct {
+		filter   Filter
+		expected bool
+	}{
+		{Filter{}, true},
+		{Eq("uuid", "a1"), true},
+		{Eq("address.city", "Hamburg"), false},
+		{Eq("roles.name", "admin"), true},
+		{In("tags", "green", "blue"), true},
+		{Range("amount", 10, 25), false},
+		{Range("amount", 10, 30), true},
+		{Regex("name", "^AL", "i"), true},
+		{Exists("address", false), false},
+		{And(Eq("name", "Alpha"), Gt("amount", 30)), false},
+		{Or(Eq("name", "Bravo"), Lte("amount", 25.5)), true},
+	}
+	for _, test := range tests {
+		ok, err := test.filter.Matches(entity)
+		require.NoError(t, err)
+		require.Equal(t, test.expected, ok, "filter %v", test.filter.Bson())
+	}
+}
+
+func TestFindDomainEntities(t *testing.T) {
+	session := openMemorySession(t)
+	defer session.Close()
+
+	insertTestEntities(t, session)
+
+	query := NewQuery(Gte("amount", 20)).WithTotal().SortBy("amount", false).Select("name")
+	entities, count, err := FindDomainEntities(t.Context(), session, &testEntity{}, query, 0, 1)
+	require.NoError(t, err)
+	require.EqualValues(t, 2, count)
+	require.Len(t, entities, 1)
+	require.Equal(t, map[string]any{"uuid": "c3", "name": "Charlie"}, entities[0].Entity())
+
+	entities, count, err = FindDomainEntities(t.Context(), session, &testEntity{}, NewQuery().WithTotal(), 0, 0)
+	require.NoError(t, err)
+	require.EqualValues(t, 3, count)
+	require.Len(t, entities, 3)
+}
+
+func TestProjectDocument(t *testing.T) {
+	doc := bson.M{"_id": 1, "entity": bson.M{"uuid": "a1", "name": "Alpha", "roles": bson.A{bson.M{"uuid": "r1", "name": "admin"}, "x"}}}
+
+	require.Equal(t, bson.M{"entity": bson.M{"roles": bson.A{bson.M{"name": "admin"}}}},
+		projectDocument(doc, bson.M{"_id": 0, "entity.roles.name": 1}))
+	require.Equal(t, bson.M{"_id": 1, "entity": bson.M{"uuid": "a1", "roles": bson.A{bson.M{"uuid": "r1"}, "x"}}},
+		projectDocument(doc, bson.M{"entity.name": 0, "entity.roles.name": 0}))
+	require.Equal(t, "Alpha", doc["entity"].(bson.M)["name"])
+}
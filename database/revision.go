@@ -0,0 +1,195 @@
+package database
+
+import (
+	"context"
+	"fmt"
+	"slices"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+)
+
+const (
+	RevisionActionSave     = "save"
+	RevisionActionRemove   = "remove"
+	RevisionActionRestore  = "restore"
+	RevisionActionDelete   = "delete"
+	RevisionActionUndelete = "undelete"
+)
+
+type RevisionMetadata struct {
+	Timestamp time.Time `bson:"timestamp" json:"timestamp"`
+	User      string    `bson:"user" json:"user"`
+	Partner   string    `bson:"partner" json:"partner"`
+	Role      string    `bson:"role" json:"role"`
+}
+
+// Revision is a full copy of a domain entity, stored in the collection "<collection>-history"
+// every time the entity is saved, removed or restored.
+type Revision struct {
+	UUID      string           `bson:"uuid" json:"uuid"`
+	Revision  int64            `bson:"revision" json:"revision"`
+	Action    string           `bson:"action" json:"action"`
+	Metadata  RevisionMetadata `bson:"metadata" json:"metadata"`
+	CreatedAt time.Time        `bson:"createdAt" json:"createdAt"`
+	Document  bson.M           `bson:"document" json:"-"`
+}
+
+// Decode copies the stored entity into doc
+func (r Revision) Decode(doc DomainEntity) error {
+	if err := decodeDocument(r.Document, doc); err != nil {
+		return err
+	}
+	return decodeFields(doc)
+}
+
+func appendRevision(ctx context.Context, session DatabaseSession, entity DomainEntity, action string) error {
+	coll := session.GetCollection(entity.DatabaseName(), historyCollectionName(entity))
+
+	latest, err := findLatestRevision(ctx, session, coll, entity.UUID())
+	if err != nil {
+		return err
+	}
+
+	doc, err := toDocument(entity)
+	if err != nil {
+		return err
+	}
+	delete(doc, "_id")
+
+	revision := Revision{
+		UUID:      entity.UUID(),
+		Revision:  1,
+		Action:    action,
+		Metadata:  revisionMetadata(entity, doc),
+		CreatedAt: time.Now(),
+		Document:  doc,
+	}
+	if latest != nil {
+		revision.Revision = latest.Revision + 1
+	}
+
+	return session.InsertOne(ctx, coll, revision)
+}
+
+func findLatestRevision(ctx context.Context, session DatabaseSession, coll Collection, uuid string) (*Revision, error) {
+	list := []any{}
+	_, err := session.Extract(ctx, coll, bson.M{"uuid": uuid, "revision": bson.M{"$exists": true}}, &list, bson.D{{Key: "revision", Value: -1}}, 0, 1)
+	if err != nil || len(list) == 0 {
+		return nil, err
+	}
+
+	data, err := bson.Marshal(list[0])
+	if err != nil {
+		return nil, err
+	}
+	result := Revision{}
+	if err = bson.Unmarshal(data, &result); err != nil {
+		return nil, err
+	}
+	return &result, nil
+}
+
+// revisionMetadata takes the metadata stored in the entity. The user identity of the entity,
+// if set, wins over the stored one, since it's the identity of the user doing the change.
+func revisionMetadata(entity DomainEntity, doc bson.M) RevisionMetadata {
+	result := RevisionMetadata{}
+	if metadata, ok := doc["metadata"].(bson.M); ok {
+		_ = decodeDocument(metadata, &result)
+	}
+	if userIdentity := entity.UserIdentity(); userIdentity != nil {
+		result.User = userIdentity.Username()
+		result.Partner = userIdentity.Partner()
+	}
+	if result.Timestamp.IsZero() {
+		result.Timestamp = time.Now()
+	}
+	return result
+}
+
+// ListRevisions returns all revisions of an entity ordered by the revision number
+func ListRevisions(ctx context.Context, session DatabaseSession, uuid string, domainEntity DomainEntity) ([]Revision, error) {
+	if uuid == "" {
+		return nil, fmt.Errorf("could not list revisions: no uuid has been set")
+	}
+	coll := session.GetCollection(domainEntity.DatabaseName(), historyCollectionName(domainEntity))
+
+	result := []Revision{}
+	err := session.FindMany(ctx, coll, bson.M{"uuid": uuid, "revision": bson.M{"$exists": true}}, &result)
+	if err != nil {
+		return nil, err
+	}
+
+	slices.SortFunc(result, func(a, b Revision) int {
+		return compareInt(a.Revision, b.Revision)
+	})
+	return result, nil
+}
+
+// FindRevision returns nil if the revision does not exist
+func FindRevision(ctx context.Context, session DatabaseSession, uuid string, revision int64, domainEntity DomainEntity) (*Revision, error) {
+	coll := session.GetCollection(domainEntity.DatabaseName(), historyCollectionName(domainEntity))
+
+	result := Revision{}
+	found, err := session.FindOne(ctx, coll, bson.M{"uuid": uuid, "revision": revision}, &result)
+	if err != nil || !found {
+		return nil, err
+	}
+	return &result, nil
+}
+
+// GetRevision loads the given revision of an entity into the empty domainEntity
+func GetRevision(ctx context.Context, session DatabaseSession, uuid string, revision int64, domainEntity DomainEntity) (*Revision, error) {
+	result, err := FindRevision(ctx, session, uuid, revision, domainEntity)
+	if err != nil {
+		return nil, err
+	}
+	if result == nil {
+		return nil, fmt.Errorf("no revision %d of the record with UUID %s found", revision, uuid)
+	}
+	return result, result.Decode(domainEntity)
+}
+
+// RestoreRevision replaces the entity (or inserts it again if it has been removed) by the given revision.
+// The restored state is recorded as a new revision on behalf of the user identity of domainEntity, if set.
+// A soft deleted entity must be restored by RestoreDeletedEntity first, for it a *NotFoundError is returned.
+// A revision recording a soft deleted state cannot be restored.
+func RestoreRevision(ctx context.Context, session DatabaseSession, uuid string, revision int64, domainEntity DomainEntity) error {
+	found, err := GetRevision(ctx, session, uuid, revision, domainEntity)
+	if err != nil {
+		return err
+	}
+	if metadata, ok := found.Document["metadata"].(bson.M); ok && metadata["deletedAt"] != nil {
+		return fmt.Errorf("the revision %d of the record with UUID %s records a soft deleted state", revision, uuid)
+	}
+
+	versioned, isVersioned := domainEntity.(VersionedEntity)
+	revisionVersion := int64(0)
+	if isVersioned {
+		revisionVersion = versioned.Version()
+	}
+
+	return session.WithTransaction(ctx, func(ctx context.Context, tx DatabaseSession) error {
+		stored, _, err := findMetadata(ctx, tx, domainEntity)
+		if err != nil {
+			return err
+		}
+		if stored.DeletedAt != nil {
+			return &NotFoundError{UUID: uuid}
+		}
+
+		// the restored entity continues the version of the stored one, otherwise its version would go back
+		if isVersioned {
+			versioned.SetVersion(max(stored.Version, revisionVersion) + 1)
+		}
+
+		// the revision has been decoded, so the fields must be encoded again for both writes
+		return withEncodedFields(domainEntity, func() error {
+			coll := tx.GetCollection(domainEntity.DatabaseName(), domainEntity.CollectionName())
+			if err := tx.ReplaceOne(ctx, coll, byUUID(uuid), domainEntity, true); err != nil {
+				return err
+			}
+			return appendRevision(ctx, tx, domainEntity, RevisionActionRestore)
+		})
+	})
+}
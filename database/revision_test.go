@@ -0,0 +1,61 @@
+package database
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestRevisionHistory(t *testing.T) {
+	session := openMemorySession(t)
+	defer session.Close()
+
+	doc := newTestEntity("a1", map[string]any{"name": "first"})
+	require.NoError(t, session.ReplaceEntityByUUID(t.Context(), doc, true))
+
+	doc.SetValue("name", "second")
+	require.NoError(t, session.ReplaceEntityByUUID(t.Context(), doc, true))
+
+	doc.SetValue("name", "third")
+	require.NoError(t, session.UpdateEntityByUUID(t.Context(), doc))
+
+	// not existing entities are neither updated nor recorded
+	require.NoError(t, session.UpdateEntityByUUID(t.Context(), newTestEntity("x9", nil)))
+	require.NoError(t, session.ReplaceEntityByUUID(t.Context(), newTestEntity("x9", nil), false))
+
+	revisions, err := ListRevisions(t.Context(), session, "a1", &testEntity{})
+	require.NoError(t, err)
+	require.Len(t, revisions, 3)
+	for i, revision := range revisions {
+		require.EqualValues(t, i+1, revision.Revision)
+		require.Equal(t, RevisionActionSave, revision.Action)
+	}
+
+	revisions, err = ListRevisions(t.Context(), session, "x9", &testEntity{})
+	require.NoError(t, err)
+	require.Empty(t, revisions)
+
+	old := &testEntity{}
+	revision, err := GetRevision(t.Context(), session, "a1", 1, old)
+	require.NoError(t, err)
+	require.EqualValues(t, 1, revision.Revision)
+	require.Equal(t, "first", old.GetValue("name"))
+
+	_, err = GetRevision(t.Context(), session, "a1", 10, &testEntity{})
+	require.Error(t, err)
+
+	require.NoError(t, session.RemoveEntity(t.Context(), doc))
+	require.NoError(t, RestoreRevision(t.Context(), session, "a1", 2, &testEntity{}))
+
+	current := &testEntity{}
+	found, err := session.GetEntityByUUID(t.Context(), "a1", current)
+	require.NoError(t, err)
+	require.True(t, found)
+	require.Equal(t, "second", current.GetValue("name"))
+
+	revisions, err = ListRevisions(t.Context(), session, "a1", &testEntity{})
+	require.NoError(t, err)
+	require.Len(t, revisions, 5)
+	require.Equal(t, RevisionActionRemove, revisions[3].Action)
+	require.Equal(t, RevisionActionRestore, revisions[4].Action)
+}
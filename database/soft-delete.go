@@ -0,0 +1,167 @@
+package database
+
+import (
+	"context"
+	"fmt"
+	"maps"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+)
+
+const deletedAtField = "metadata.deletedAt"
+
+// excludeDeleted restricts the filter to entities which have not been soft deleted, unless the filter asks
+// for "metadata.deletedAt" by itself. It is applied by the entity read helpers only, e.g. GetEntityByUUID,
+// FindEntity and FindDomainEntities, the generic operations like FindOne or FindMany apply the filter as given.
+func excludeDeleted(filter bson.M) bson.M {
+	if mentionsField(filter, deletedAtField) {
+		return filter
+	}
+	result := bson.M{deletedAtField: bson.M{"$exists": false}}
+	maps.Copy(result, filter)
+	return result
+}
+
+func mentionsField(filter bson.M, field string) bool {
+	for key, value := range filter {
+		if key == field {
+			return true
+		}
+		if key != "$and" && key != "$or" && key != "$nor" {
+			continue
+		}
+		var list []any
+		switch v := value.(type) {
+		case bson.A:
+			list = v
+		case []any:
+			list = v
+		case []bson.M:
+			for _, item := range v {
+				list = append(list, item)
+			}
+		}
+		for _, item := range list {
+			if m, ok := item.(bson.M); ok && mentionsField(m, field) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// SoftDeleteEntity marks the entity as deleted by setting "metadata.deletedAt" and "metadata.deletedBy".
+// From now on the entity is ignored by the entity read helpers, see excludeDeleted. The deleted entity is
+// loaded into domainEntity, whose user identity, if set, is recorded as deletedBy.
+func SoftDeleteEntity(ctx context.Context, session DatabaseSession, uuid string, domainEntity DomainEntity) error {
+	if uuid == "" {
+		return fmt.Errorf("could not delete an entity: no uuid has been set")
+	}
+
+	deletedBy := ""
+	if userIdentity := domainEntity.UserIdentity(); userIdentity != nil {
+		deletedBy = userIdentity.Username()
+	}
+
+	return session.WithTransaction(ctx, func(ctx context.Context, tx DatabaseSession) error {
+		deletedAt := time.Now()
+		return changeDeletion(ctx, tx, excludeDeleted(byUUID(uuid)), domainEntity, RevisionActionDelete, func(metadata bson.M) {
+			metadata["deletedAt"] = deletedAt
+			metadata["deletedBy"] = deletedBy
+		})
+	})
+}
+
+// RestoreDeletedEntity reverts SoftDeleteEntity and loads the restored entity into domainEntity
+func RestoreDeletedEntity(ctx context.Context, session DatabaseSession, uuid string, domainEntity DomainEntity) error {
+	if uuid == "" {
+		return fmt.Errorf("could not restore an entity: no uuid has been set")
+	}
+
+	filter := bson.M{"entity.uuid": uuid, deletedAtField: bson.M{"$exists": true}}
+	return session.WithTransaction(ctx, func(ctx context.Context, tx DatabaseSession) error {
+		return changeDeletion(ctx, tx, filter, domainEntity, RevisionActionUndelete, func(metadata bson.M) {
+			delete(metadata, "deletedAt")
+			delete(metadata, "deletedBy")
+		})
+	})
+}
+
+func changeDeletion(ctx context.Context, tx DatabaseSession, filter bson.M, domainEntity DomainEntity, action string, change func(metadata bson.M)) error {
+	coll := tx.GetCollection(domainEntity.DatabaseName(), domainEntity.CollectionName())
+
+	doc := bson.M{}
+	found, err := tx.FindOne(ctx, coll, filter, &doc)
+	if err != nil {
+		return err
+	}
+	if !found {
+		return &NotFoundError{UUID: fmt.Sprintf("%v", filter["entity.uuid"])}
+	}
+	delete(doc, "_id")
+
+	metadata, ok := doc["metadata"].(bson.M)
+	if !ok {
+		metadata = bson.M{}
+		doc["metadata"] = metadata
+	}
+	change(metadata)
+	if _, ok := domainEntity.(VersionedEntity); ok {
+		metadata["version"] = versionOf(metadata["version"]) + 1
+	}
+
+	if err = tx.ReplaceOne(ctx, coll, bson.M{"entity.uuid": filter["entity.uuid"]}, doc, false); err != nil {
+		return err
+	}
+	if err = decodeDocument(doc, domainEntity); err != nil {
+		return err
+	}
+	if err = appendRevision(ctx, tx, domainEntity, action); err != nil {
+		return err
+	}
+	return decodeFields(domainEntity)
+}
+
+func versionOf(value any) int64 {
+	switch v := value.(type) {
+	case int32:
+		return int64(v)
+	case int64:
+		return v
+	case float64:
+		return int64(v)
+	}
+	return 0
+}
+
+// PurgeDeletedEntities removes the entities soft deleted before deletedBefore physically,
+// together with their history. It returns the number of removed entities.
+func PurgeDeletedEntities(ctx context.Context, session DatabaseSession, domainEntity DomainEntity, deletedBefore time.Time) (int, error) {
+	coll := session.GetCollection(domainEntity.DatabaseName(), domainEntity.CollectionName())
+	historyColl := session.GetCollection(domainEntity.DatabaseName(), historyCollectionName(domainEntity))
+
+	filter := bson.M{deletedAtField: bson.M{"$lt": deletedBefore}}
+	list := []struct {
+		Entity struct {
+			UUID string `bson:"uuid"`
+		} `bson:"entity"`
+	}{}
+	if err := session.FindMany(ctx, coll, filter, &list); err != nil {
+		return 0, err
+	}
+
+	for i, item := range list {
+		err := session.WithTransaction(ctx, func(ctx context.Context, tx DatabaseSession) error {
+			err := tx.RemoveOne(ctx, coll, bson.M{"entity.uuid": item.Entity.UUID, deletedAtField: filter[deletedAtField]})
+			if err != nil {
+				return err
+			}
+			return tx.RemoveMany(ctx, historyColl, bson.M{"uuid": item.Entity.UUID})
+		})
+		if err != nil {
+			return i, fmt.Errorf("could not purge the record with UUID %s: %w", item.Entity.UUID, err)
+		}
+	}
+	return len(list), nil
+}
@@ -0,0 +1,80 @@
+package database
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+	"go.mongodb.org/mongo-driver/bson"
+)
+
+func TestSoftDelete(t *testing.T) {
+	session := openMemorySession(t)
+	defer session.Close()
+
+	insertTestEntities(t, session)
+
+	require.NoError(t, SoftDeleteEntity(t.Context(), session, "b2", &testEntity{}))
+	require.True(t, IsNotFound(SoftDeleteEntity(t.Context(), session, "b2", &testEntity{})))
+
+	found, err := session.GetEntityByUUID(t.Context(), "b2", &testEntity{})
+	require.NoError(t, err)
+	require.False(t, found)
+
+	entities, err := ReadDomainEntities(t.Context(), session, &testEntity{}, 0, 10)
+	require.NoError(t, err)
+	require.Len(t, entities, 2)
+
+	coll := session.GetCollection("test", "item")
+	deleted := []testEntity{}
+	require.NoError(t, session.FindMany(t.Context(), coll, bson.M{deletedAtField: bson.M{"$exists": true}}, &deleted))
+	require.Len(t, deleted, 1)
+	require.Equal(t, "b2", deleted[0].UUID())
+
+	// the generic operations apply the filter as given, soft deleted entities included
+	total, err := session.CountDocuments(t.Context(), coll, bson.M{})
+	require.NoError(t, err)
+	require.EqualValues(t, 3, total)
+	found, err = session.FindOne(t.Context(), coll, byUUID("b2"), &testEntity{})
+	require.NoError(t, err)
+	require.True(t, found)
+
+	// a deleted entity is not restored to a revision
+	require.True(t, IsNotFound(RestoreRevision(t.Context(), session, "b2", 1, &testEntity{})))
+
+	// a deleted entity is neither replaced nor inserted a second time
+	require.True(t, IsNotFound(session.ReplaceEntityByUUID(t.Context(), &versionedTestEntity{TestEntity: *newTestEntity("b2", nil)}, true)))
+	require.True(t, IsNotFound(session.ReplaceEntityByUUID(t.Context(), newTestEntity("b2", map[string]any{"name": "Bravo 1"}), true)))
+	require.NoError(t, session.FindMany(t.Context(), coll, bson.M{deletedAtField: bson.M{"$exists": true}}, &deleted))
+	require.Len(t, deleted, 1)
+	require.Equal(t, "Bravo", deleted[0].GetValue("name"))
+
+	restored := &testEntity{}
+	require.NoError(t, RestoreDeletedEntity(t.Context(), session, "b2", restored))
+	require.Equal(t, "Bravo", restored.GetValue("name"))
+	require.True(t, IsNotFound(RestoreDeletedEntity(t.Context(), session, "b2", &testEntity{})))
+
+	found, err = session.GetEntityByUUID(t.Context(), "b2", &testEntity{})
+	require.NoError(t, err)
+	require.True(t, found)
+
+	revisions, err := ListRevisions(t.Context(), session, "b2", &testEntity{})
+	require.NoError(t, err)
+	require.Len(t, revisions, 2)
+	require.Equal(t, RevisionActionDelete, revisions[0].Action)
+	require.Equal(t, RevisionActionUndelete, revisions[1].Action)
+
+	require.NoError(t, SoftDeleteEntity(t.Context(), session, "a1", &testEntity{}))
+	count, err := PurgeDeletedEntities(t.Context(), session, &testEntity{}, time.Now().Add(-time.Hour))
+	require.NoError(t, err)
+	require.Zero(t, count)
+
+	count, err = PurgeDeletedEntities(t.Context(), session, &testEntity{}, time.Now().Add(time.Second))
+	require.NoError(t, err)
+	require.Equal(t, 1, count)
+
+	require.True(t, IsNotFound(RestoreDeletedEntity(t.Context(), session, "a1", &testEntity{})))
+	revisions, err = ListRevisions(t.Context(), session, "a1", &testEntity{})
+	require.NoError(t, err)
+	require.Empty(t, revisions)
+}
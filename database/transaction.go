@@ -0,0 +1,48 @@
+package database
+
+import (
+	"context"
+	"strings"
+	"sync/atomic"
+
+	"github.com/dchaykin/mygolib/log"
+	"go.mongodb.org/mongo-driver/mongo"
+)
+
+// TransactionFunc runs inside a transaction. All operations must be done through tx, which must not be closed.
+// The function may be called several times if the transaction is retried.
+type TransactionFunc func(ctx context.Context, tx DatabaseSession) error
+
+// transactionsUnsupported is set as soon as the server reports that it is a standalone instance
+var transactionsUnsupported atomic.Bool
+
+// WithTransaction runs f in a multi-document transaction. The mongo driver retries the whole
+// transaction on TransientTransactionError and the commit on UnknownTransactionCommitResult.
+// A nested call joins the running transaction. Transactions require a replica set, on a standalone
+// server f is executed without a transaction.
+func (ms mongoSession) WithTransaction(ctx context.Context, f TransactionFunc) error {
+	if ms.inTransaction {
+		return f(ctx, &ms)
+	}
+
+	if transactionsUnsupported.Load() {
+		return f(ctx, &ms)
+	}
+
+	tx := ms
+	tx.inTransaction = true
+
+	_, err := ms.session.WithTransaction(ctx, func(sc mongo.SessionContext) (any, error) {
+		return nil, f(sc, &tx)
+	})
+	if err != nil && isTransactionNotSupported(err) {
+		log.Warn("the mongo server does not support transactions, running without a transaction: %v", err)
+		transactionsUnsupported.Store(true)
+		return f(ctx, &ms)
+	}
+	return err
+}
+
+func isTransactionNotSupported(err error) bool {
+	return strings.Contains(err.Error(), "Transaction numbers are only allowed on a replica set member or mongos")
+}
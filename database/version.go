@@ -0,0 +1,154 @@
+package database
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+)
+
+// VersionedEntity is implemented by domain entities taking part in the optimistic concurrency control.
+// The version is stored in "metadata.version" and incremented on every save. An entity can only be
+// replaced if its version equals the stored one, otherwise a *ConflictError is returned.
+type VersionedEntity interface {
+	Version() int64
+	SetVersion(version int64)
+}
+
+// ConflictError reports that an entity has been changed by somebody else since it has been read
+type ConflictError struct {
+	UUID     string
+	Expected int64
+	Actual   int64
+}
+
+func (e *ConflictError) Error() string {
+	return fmt.Sprintf("the record with UUID %s has been changed in the meantime: expected version %d, found %d", e.UUID, e.Expected, e.Actual)
+}
+
+func IsConflict(err error) bool {
+	conflict := &ConflictError{}
+	return errors.As(err, &conflict)
+}
+
+type replaceFunc func(ctx context.Context, filter bson.M, allowInsert bool) (bool, error)
+
+// replaceEntity replaces the entity by its uuid. For a VersionedEntity the replacement is conditional on
+// the stored version and the version of doc is incremented on success. A soft deleted entity is not replaced,
+// a *NotFoundError is returned instead. Must be called within a transaction.
+func replaceEntity(ctx context.Context, tx DatabaseSession, doc DomainEntity, allowInsert bool, replace replaceFunc) (bool, error) {
+	stored, found, err := findMetadata(ctx, tx, doc)
+	if err != nil {
+		return false, err
+	}
+	if found && stored.DeletedAt != nil {
+		return false, &NotFoundError{UUID: doc.UUID()}
+	}
+	filter := excludeDeleted(byUUID(doc.UUID()))
+
+	versioned, ok := doc.(VersionedEntity)
+	if !ok {
+		return replace(ctx, filter, allowInsert)
+	}
+
+	expected := versioned.Version()
+	filter["metadata.version"] = versionFilter(expected)
+
+	versioned.SetVersion(expected + 1)
+	changed, err := replace(ctx, filter, false)
+	if err == nil && !changed {
+		// either the stored version differs or the entity does not exist yet
+		changed, err = insertIfMissing(ctx, tx, doc, expected, allowInsert)
+	}
+	if err != nil || !changed {
+		versioned.SetVersion(expected)
+	}
+	return changed, err
+}
+
+func insertIfMissing(ctx context.Context, tx DatabaseSession, doc DomainEntity, expected int64, allowInsert bool) (bool, error) {
+	actual, found, err := storedVersion(ctx, tx, doc)
+	if err != nil {
+		return false, err
+	}
+	if found || expected != 0 {
+		return false, &ConflictError{UUID: doc.UUID(), Expected: expected, Actual: actual}
+	}
+	if !allowInsert {
+		return false, nil
+	}
+
+	coll := tx.GetCollection(doc.DatabaseName(), doc.CollectionName())
+	return true, tx.InsertOne(ctx, coll, doc)
+}
+
+// StoredVersion returns the version of the stored entity, soft deleted or not, and whether it exists
+func StoredVersion(ctx context.Context, session DatabaseSession, doc DomainEntity) (int64, bool, error) {
+	return storedVersion(ctx, session, doc)
+}
+
+func storedVersion(ctx context.Context, session DatabaseSession, doc DomainEntity) (int64, bool, error) {
+	stored, found, err := findMetadata(ctx, session, doc)
+	return stored.Version, found, err
+}
+
+// storedMetadata is the part of the metadata needed to decide whether an entity may be replaced
+type storedMetadata struct {
+	Version   int64      `bson:"version"`
+	DeletedAt *time.Time `bson:"deletedAt"`
+}
+
+func findMetadata(ctx context.Context, session DatabaseSession, doc DomainEntity) (storedMetadata, bool, error) {
+	stored := struct {
+		Metadata storedMetadata `bson:"metadata"`
+	}{}
+
+	coll := session.GetCollection(doc.DatabaseName(), doc.CollectionName())
+	found, err := session.FindOne(ctx, coll, byUUID(doc.UUID()), &stored)
+	return stored.Metadata, found, err
+}
+
+// versionFilter matches the version 0 also for entities stored before the versioning has been introduced
+func versionFilter(version int64) any {
+	if version == 0 {
+		return bson.M{"$in": bson.A{0, nil}}
+	}
+	return version
+}
+
+// RewriteEntity replaces the fields of the stored entity, soft deleted or not, by the fields of doc without a new
+// version or revision, e.g. after a technical conversion of the fields. The fields are written as they are, see
+// WithEncodedFields, and the metadata is kept apart from the given metadata fields, e.g. {"schemaVersion": 2}.
+// For a VersionedEntity the fields are only replaced if the stored version still equals the version of doc,
+// otherwise nothing is written and false is returned.
+func RewriteEntity(ctx context.Context, session DatabaseSession, doc DomainEntity, metadata bson.M) (bool, error) {
+	changed := false
+	err := session.WithTransaction(ctx, func(ctx context.Context, tx DatabaseSession) error {
+		changed = false
+		version, found, err := storedVersion(ctx, tx, doc)
+		if err != nil || !found {
+			return err
+		}
+		filter := byUUID(doc.UUID())
+		if versioned, ok := doc.(VersionedEntity); ok {
+			if versioned.Version() != version {
+				return nil
+			}
+			filter["metadata.version"] = versionFilter(version)
+		}
+
+		update := bson.M{"entity": doc.Entity()}
+		for key, value := range metadata {
+			update["metadata."+key] = value
+		}
+		coll := tx.GetCollection(doc.DatabaseName(), doc.CollectionName())
+		if err = tx.UpdateOne(ctx, coll, filter, update); err != nil {
+			return err
+		}
+		changed = true
+		return nil
+	})
+	return changed, err
+}
@@ -0,0 +1,120 @@
+package database
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/require"
+	"go.mongodb.org/mongo-driver/bson"
+)
+
+// the bson codec ignores unexported embedded structs
+type TestEntity = testEntity
+
+type versionedTestEntity struct {
+	TestEntity `bson:",inline"`
+	Metadata   struct {
+		Version int64 `bson:"version"`
+	} `bson:"metadata"`
+}
+
+func (e versionedTestEntity) CreateEmpty() DomainEntity {
+	return &versionedTestEntity{}
+}
+
+func (e versionedTestEntity) Version() int64 {
+	return e.Metadata.Version
+}
+
+func (e *versionedTestEntity) SetVersion(version int64) {
+	e.Metadata.Version = version
+}
+
+func TestOptimisticConcurrency(t *testing.T) {
+	session := openMemorySession(t)
+	defer session.Close()
+
+	// entities stored before the versioning has been introduced have no version
+	require.NoError(t, session.InsertEntity(t.Context(), newTestEntity("a1", map[string]any{"name": "Alpha"})))
+
+	first := &versionedTestEntity{}
+	found, err := session.GetEntityByUUID(t.Context(), "a1", first)
+	require.NoError(t, err)
+	require.True(t, found)
+	require.EqualValues(t, 0, first.Version())
+
+	second := &versionedTestEntity{}
+	_, err = session.GetEntityByUUID(t.Context(), "a1", second)
+	require.NoError(t, err)
+
+	first.SetValue("name", "Alpha 1")
+	require.NoError(t, session.ReplaceEntityByUUID(t.Context(), first, true))
+	require.EqualValues(t, 1, first.Version())
+
+	second.SetValue("name", "Alpha 2")
+	err = session.ReplaceEntityByUUID(t.Context(), second, true)
+	require.True(t, IsConflict(err))
+	require.Equal(t, &ConflictError{UUID: "a1", Expected: 0, Actual: 1}, err)
+	require.EqualValues(t, 0, second.Version())
+
+	stored := &versionedTestEntity{}
+	_, err = session.GetEntityByUUID(t.Context(), "a1", stored)
+	require.NoError(t, err)
+	require.Equal(t, "Alpha 1", stored.GetValue("name"))
+	require.EqualValues(t, 1, stored.Version())
+
+	revisions, err := ListRevisions(t.Context(), session, "a1", stored)
+	require.NoError(t, err)
+	require.Len(t, revisions, 1)
+
+	// a new entity is inserted with the version 1, a stale version of a missing entity is a conflict
+	created := &versionedTestEntity{TestEntity: *newTestEntity("b2", nil)}
+	require.NoError(t, session.ReplaceEntityByUUID(t.Context(), created, true))
+	require.EqualValues(t, 1, created.Version())
+
+	missing := &versionedTestEntity{TestEntity: *newTestEntity("c3", nil)}
+	missing.SetVersion(4)
+	require.True(t, IsConflict(session.ReplaceEntityByUUID(t.Context(), missing, true)))
+
+	require.NoError(t, RestoreRevision(t.Context(), session, "b2", 1, &versionedTestEntity{}))
+	restored := &versionedTestEntity{}
+	_, err = session.GetEntityByUUID(t.Context(), "b2", restored)
+	require.NoError(t, err)
+	require.EqualValues(t, 2, restored.Version())
+}
+
+func TestRewriteEntity(t *testing.T) {
+	session := openMemorySession(t)
+	defer session.Close()
+
+	entity := &versionedTestEntity{TestEntity: *newTestEntity("a1", map[string]any{"name": "Alpha"})}
+	require.NoError(t, session.ReplaceEntityByUUID(t.Context(), entity, true))
+	require.NoError(t, SoftDeleteEntity(t.Context(), session, "a1", &versionedTestEntity{}))
+
+	// soft deleted entities are rewritten as well, their metadata is kept apart from the given fields
+	rewritten := &versionedTestEntity{TestEntity: *newTestEntity("a1", map[string]any{"name": "Alpha 1"})}
+	rewritten.SetVersion(2)
+	changed, err := RewriteEntity(t.Context(), session, rewritten, bson.M{"schemaVersion": 3})
+	require.NoError(t, err)
+	require.True(t, changed)
+
+	stored := bson.M{}
+	coll := session.GetCollection(rewritten.DatabaseName(), rewritten.CollectionName())
+	found, err := session.FindOne(t.Context(), coll, byUUID("a1"), &stored)
+	require.NoError(t, err)
+	require.True(t, found)
+	require.Equal(t, "Alpha 1", stored["entity"].(bson.M)["name"])
+	require.NotNil(t, stored["metadata"].(bson.M)["deletedAt"])
+	require.EqualValues(t, 2, stored["metadata"].(bson.M)["version"])
+	require.EqualValues(t, 3, stored["metadata"].(bson.M)["schemaVersion"])
+
+	revisions, err := ListRevisions(t.Context(), session, "a1", rewritten)
+	require.NoError(t, err)
+	require.Len(t, revisions, 2)
+
+	// a stale version is not written
+	rewritten.SetValue("name", "Alpha 2")
+	rewritten.SetVersion(1)
+	changed, err = RewriteEntity(t.Context(), session, rewritten, nil)
+	require.NoError(t, err)
+	require.False(t, changed)
+}
@@ -0,0 +1,222 @@
+package database
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/dchaykin/mygolib/log"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+type ChangeOperation string
+
+const (
+	ChangeInsert  ChangeOperation = "insert"
+	ChangeReplace ChangeOperation = "replace"
+	ChangeUpdate  ChangeOperation = "update"
+	ChangeDelete  ChangeOperation = "delete"
+
+	changeInvalidate = "invalidate"
+
+	resumeTokenCollection = "change-stream-tokens"
+)
+
+// ChangeStream is a stream of change events, as implemented by *mongo.ChangeStream
+type ChangeStream interface {
+	Next(ctx context.Context) bool
+	Decode(val any) error
+	ResumeToken() bson.Raw
+	Err() error
+	Close(ctx context.Context) error
+}
+
+// ChangeEvent is a change of an entity. Entity is the entity after the change. For deletions it is the entity
+// before the change, which mongo provides only if Config.PreImages is set and pre-images are enabled for the
+// collection; otherwise Entity is nil and only DocumentID identifies the deleted document.
+type ChangeEvent struct {
+	Operation   ChangeOperation
+	DocumentID  any
+	UUID        string
+	Entity      DomainEntity
+	ResumeToken bson.Raw
+	ClusterTime time.Time
+}
+
+type OnChangeEvent func(ctx context.Context, event ChangeEvent) error
+
+// ResumeTokenStore persists the position of a watcher in the change stream
+type ResumeTokenStore interface {
+	// LoadResumeToken returns nil if no token has been saved yet
+	LoadResumeToken(ctx context.Context, name string) (bson.Raw, error)
+	SaveResumeToken(ctx context.Context, name string, token bson.Raw) error
+}
+
+// CollectionTokenStore keeps the resume tokens in the collection "change-stream-tokens" of a database,
+// one document per watcher
+type CollectionTokenStore struct {
+	session      DatabaseSession
+	databaseName string
+}
+
+func NewCollectionTokenStore(session DatabaseSession, databaseName string) *CollectionTokenStore {
+	return &CollectionTokenStore{session: session, databaseName: databaseName}
+}
+
+type storedResumeToken struct {
+	Name      string    `bson:"name"`
+	Token     bson.Raw  `bson:"token"`
+	UpdatedAt time.Time `bson:"updatedAt"`
+}
+
+func (s CollectionTokenStore) LoadResumeToken(ctx context.Context, name string) (bson.Raw, error) {
+	coll := s.session.GetCollection(s.databaseName, resumeTokenCollection)
+	stored := storedResumeToken{}
+	found, err := s.session.FindOne(ctx, coll, bson.M{"name": name}, &stored)
+	if err != nil || !found {
+		return nil, err
+	}
+	return stored.Token, nil
+}
+
+func (s CollectionTokenStore) SaveResumeToken(ctx context.Context, name string, token bson.Raw) error {
+	coll := s.session.GetCollection(s.databaseName, resumeTokenCollection)
+	return s.session.ReplaceOne(ctx, coll, bson.M{"name": name}, storedResumeToken{Name: name, Token: token, UpdatedAt: time.Now()}, true)
+}
+
+// changeEventDocument is the part of a change event used by WatchDomainEntities
+type changeEventDocument struct {
+	OperationType string `bson:"operationType"`
+	DocumentKey   struct {
+		ID any `bson:"_id"`
+	} `bson:"documentKey"`
+	FullDocument             bson.Raw            `bson:"fullDocument"`
+	FullDocumentBeforeChange bson.Raw            `bson:"fullDocumentBeforeChange"`
+	ClusterTime              primitive.Timestamp `bson:"clusterTime"`
+}
+
+// WatchDomainEntities calls f for every change of an entity in the collection of domainEntity until the context
+// is canceled, which ends the watching without error. The watcher is identified by name: after each successfully
+// handled event its resume token is saved in the store, so that a restarted watcher continues after the last
+// handled event. An error returned by f stops the watching, the event is delivered again after the restart.
+// An event which cannot be decoded is logged and skipped, otherwise it would stop every restarted watcher
+// again. Without a store the watching starts with the current changes.
+func WatchDomainEntities(ctx context.Context, session DatabaseSession, domainEntity DomainEntity, name string, store ResumeTokenStore, f OnChangeEvent) error {
+	var token bson.Raw
+	var err error
+	if store != nil {
+		if token, err = store.LoadResumeToken(ctx, name); err != nil {
+			return fmt.Errorf("could not load the resume token of %s: %w", name, err)
+		}
+	}
+
+	operations := bson.A{string(ChangeInsert), string(ChangeReplace), string(ChangeUpdate), string(ChangeDelete), changeInvalidate}
+	pipeline := NewPipeline().Stage("$match", bson.M{"operationType": bson.M{"$in": operations}})
+
+	coll := session.GetCollection(domainEntity.DatabaseName(), domainEntity.CollectionName())
+	stream, err := session.Watch(ctx, coll, pipeline, token)
+	if err != nil {
+		return err
+	}
+	defer stream.Close(context.WithoutCancel(ctx))
+
+	saveToken := func(token bson.Raw) error {
+		if store == nil {
+			return nil
+		}
+		if err := store.SaveResumeToken(ctx, name, token); err != nil {
+			return fmt.Errorf("could not save the resume token of %s: %w", name, err)
+		}
+		return nil
+	}
+
+	for stream.Next(ctx) {
+		event, err := decodeChangeEvent(stream, domainEntity)
+		if errors.Is(err, errChangeStreamInvalidated) {
+			return fmt.Errorf("the change stream of %s.%s has been invalidated", domainEntity.DatabaseName(), domainEntity.CollectionName())
+		}
+		if err != nil {
+			log.Warn("the watcher %s skips a change event of %s.%s: %v", name, domainEntity.DatabaseName(), domainEntity.CollectionName(), err)
+			if err = saveToken(stream.ResumeToken()); err != nil {
+				return err
+			}
+			continue
+		}
+		if err = f(ctx, *event); err != nil {
+			return err
+		}
+		if err = saveToken(event.ResumeToken); err != nil {
+			return err
+		}
+	}
+
+	if err = stream.Err(); err != nil && !errors.Is(err, context.Canceled) {
+		return err
+	}
+	return nil
+}
+
+var errChangeStreamInvalidated = errors.New("the change stream has been invalidated")
+
+func decodeChangeEvent(stream ChangeStream, domainEntity DomainEntity) (*ChangeEvent, error) {
+	doc := changeEventDocument{}
+	if err := stream.Decode(&doc); err != nil {
+		return nil, fmt.Errorf("could not decode the change event: %w", err)
+	}
+	if doc.OperationType == changeInvalidate {
+		return nil, errChangeStreamInvalidated
+	}
+
+	result := &ChangeEvent{
+		Operation:   ChangeOperation(doc.OperationType),
+		DocumentID:  doc.DocumentKey.ID,
+		ResumeToken: stream.ResumeToken(),
+		ClusterTime: time.Unix(int64(doc.ClusterTime.T), 0),
+	}
+
+	raw := doc.FullDocument
+	if result.Operation == ChangeDelete {
+		raw = doc.FullDocumentBeforeChange
+	}
+	if len(raw) > 0 {
+		result.Entity = domainEntity.CreateEmpty()
+		if err := bson.Unmarshal(raw, result.Entity); err != nil {
+			return nil, fmt.Errorf("could not decode the changed document %v: %w", doc.DocumentKey.ID, err)
+		}
+		if err := decodeFields(result.Entity); err != nil {
+			return nil, err
+		}
+		result.UUID = result.Entity.UUID()
+	}
+	return result, nil
+}
+
+func changeStreamOptions(resumeAfter bson.Raw, preImages bool) *options.ChangeStreamOptions {
+	opts := options.ChangeStream().SetFullDocument(options.UpdateLookup)
+	if preImages {
+		opts.SetFullDocumentBeforeChange(options.WhenAvailable)
+	}
+	if resumeAfter != nil {
+		opts.SetStartAfter(resumeAfter)
+	}
+	return opts
+}
+
+func (c mongoCollection) watch(ctx context.Context, pipeline Pipeline, resumeAfter bson.Raw, preImages bool) (ChangeStream, error) {
+	if pipeline == nil {
+		pipeline = Pipeline{}
+	}
+	return c.collection.Watch(ctx, pipeline, changeStreamOptions(resumeAfter, preImages))
+}
+
+func (ms mongoSession) Watch(ctx context.Context, coll Collection, pipeline Pipeline, resumeAfter bson.Raw) (ChangeStream, error) {
+	mc, ok := coll.(mongoCollection)
+	if !ok {
+		return nil, fmt.Errorf("the collection %T does not belong to a mongo client", coll)
+	}
+	// the stream lives as long as the context, the timeout of the session does not apply
+	return mc.watch(ctx, pipeline, resumeAfter, ms.client.cfg.PreImages)
+}
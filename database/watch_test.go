@@ -0,0 +1,163 @@
+package database
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+type watchResult struct {
+	events chan ChangeEvent
+	done   chan error
+}
+
+func startWatching(ctx context.Context, session DatabaseSession, store ResumeTokenStore, f OnChangeEvent) watchResult {
+	result := watchResult{events: make(chan ChangeEvent, 10), done: make(chan error, 1)}
+	go func() {
+		result.done <- WatchDomainEntities(ctx, session, &testEntity{}, "test-watcher", store, func(ctx context.Context, event ChangeEvent) error {
+			if f != nil {
+				if err := f(ctx, event); err != nil {
+					return err
+				}
+			}
+			result.events <- event
+			return nil
+		})
+	}()
+	return result
+}
+
+func (wr watchResult) next(t *testing.T) ChangeEvent {
+	select {
+	case event := <-wr.events:
+		return event
+	case err := <-wr.done:
+		require.FailNow(t, "the watcher stopped", "%v", err)
+	case <-time.After(2 * time.Second):
+		require.FailNow(t, "no change event received")
+	}
+	return ChangeEvent{}
+}
+
+// waitForStream gives the watcher goroutine the time to open its stream
+func waitForStream() {
+	time.Sleep(20 * time.Millisecond)
+}
+
+func TestWatchDomainEntities(t *testing.T) {
+	session := openMemorySession(t)
+	defer session.Close()
+	store := NewCollectionTokenStore(session, "test")
+
+	ctx, cancel := context.WithCancel(t.Context())
+	watcher := startWatching(ctx, session, store, nil)
+	waitForStream()
+
+	require.NoError(t, session.ReplaceEntityByUUID(t.Context(), newTestEntity("a1", map[string]any{"name": "Alpha"}), true))
+	event := watcher.next(t)
+	require.Equal(t, ChangeInsert, event.Operation)
+	require.Equal(t, "a1", event.UUID)
+	require.Equal(t, "Alpha", event.Entity.GetValue("name"))
+
+	require.NoError(t, session.ReplaceEntityByUUID(t.Context(), newTestEntity("a1", map[string]any{"name": "Alpha 2"}), false))
+	event = watcher.next(t)
+	require.Equal(t, ChangeReplace, event.Operation)
+	require.Equal(t, "Alpha 2", event.Entity.GetValue("name"))
+
+	coll := session.GetCollection("test", "item")
+	require.NoError(t, session.UpdateOne(t.Context(), coll, byUUID("a1"), bson.M{"entity.amount": 5}))
+	event = watcher.next(t)
+	require.Equal(t, ChangeUpdate, event.Operation)
+	require.EqualValues(t, 5, event.Entity.GetValue("amount"))
+
+	// rolled back changes are not published
+	err := session.WithTransaction(t.Context(), func(ctx context.Context, tx DatabaseSession) error {
+		require.NoError(t, tx.InsertEntity(ctx, newTestEntity("x9", nil)))
+		require.NoError(t, session.InsertEntity(t.Context(), newTestEntity("y8", nil)))
+		return errors.New("rollback")
+	})
+	require.EqualError(t, err, "rollback")
+	event = watcher.next(t)
+	require.Equal(t, ChangeInsert, event.Operation)
+	require.Equal(t, "y8", event.UUID)
+
+	require.NoError(t, session.RemoveEntity(t.Context(), newTestEntity("a1", nil)))
+	event = watcher.next(t)
+	require.Equal(t, ChangeDelete, event.Operation)
+	require.Equal(t, "a1", event.UUID)
+	require.NotNil(t, event.DocumentID)
+
+	cancel()
+	require.NoError(t, <-watcher.done)
+
+	token, err := store.LoadResumeToken(t.Context(), "test-watcher")
+	require.NoError(t, err)
+	require.Equal(t, event.ResumeToken, token)
+}
+
+func TestWatchResume(t *testing.T) {
+	session := openMemorySession(t)
+	defer session.Close()
+	store := NewCollectionTokenStore(session, "test")
+
+	// the first watcher fails on b2
+	watcher := startWatching(t.Context(), session, store, func(ctx context.Context, event ChangeEvent) error {
+		if event.UUID == "b2" {
+			return errors.New("overview unavailable")
+		}
+		return nil
+	})
+	waitForStream()
+
+	require.NoError(t, session.InsertEntity(t.Context(), newTestEntity("a1", nil)))
+	require.Equal(t, "a1", watcher.next(t).UUID)
+	require.NoError(t, session.InsertEntity(t.Context(), newTestEntity("b2", nil)))
+	require.EqualError(t, <-watcher.done, "overview unavailable")
+
+	require.NoError(t, session.InsertEntity(t.Context(), newTestEntity("c3", nil)))
+
+	// the restarted watcher continues with b2
+	ctx, cancel := context.WithCancel(t.Context())
+	defer cancel()
+	watcher = startWatching(ctx, session, store, nil)
+	require.Equal(t, "b2", watcher.next(t).UUID)
+	require.Equal(t, "c3", watcher.next(t).UUID)
+}
+
+func TestWatchSkipsUndecodableEvents(t *testing.T) {
+	session := openMemorySession(t)
+	defer session.Close()
+	store := NewCollectionTokenStore(session, "test")
+
+	ctx, cancel := context.WithCancel(t.Context())
+	watcher := startWatching(ctx, session, store, nil)
+	waitForStream()
+
+	coll := session.GetCollection("test", "item")
+	require.NoError(t, session.InsertOne(t.Context(), coll, bson.M{"entity": "broken"}))
+	require.NoError(t, session.InsertEntity(t.Context(), newTestEntity("b2", nil)))
+	event := watcher.next(t)
+	require.Equal(t, "b2", event.UUID)
+
+	cancel()
+	require.NoError(t, <-watcher.done)
+	token, err := store.LoadResumeToken(t.Context(), "test-watcher")
+	require.NoError(t, err)
+	require.Equal(t, event.ResumeToken, token)
+}
+
+func TestChangeStreamOptions(t *testing.T) {
+	opts := changeStreamOptions(nil, false)
+	require.Nil(t, opts.FullDocumentBeforeChange)
+	require.Nil(t, opts.StartAfter)
+
+	token := encodeMemoryToken(3)
+	opts = changeStreamOptions(token, true)
+	require.Equal(t, options.WhenAvailable, *opts.FullDocumentBeforeChange)
+	require.Equal(t, token, opts.StartAfter)
+}
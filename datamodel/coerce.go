@@ -0,0 +1,145 @@
+package datamodel
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// CoerceRecord converts the fields of the record to the types of the subject of the tenant config, see CoerceEntity
+func (tc TenantConfig) CoerceRecord(r Record) error {
+	return tc.CoerceEntity(r.Fields)
+}
+
+// CoerceEntity converts the values of an entity of the subject in place to the canonical types of their
+// fields, see CustomField.Coerce. Nested records and the items of list fields are converted by the record
+// of the datamodel with the name of the field, fields missing in the datamodel are kept as they are.
+// Unconvertible values are kept too and reported as *ValidationError.
+func (tc TenantConfig) CoerceEntity(fields map[string]any) error {
+	v := validator{tc: tc}
+	v.coerceRecord("", tc.Subject, fields)
+	if len(v.errors) == 0 {
+		return nil
+	}
+	return &ValidationError{Fields: v.errors}
+}
+
+func (v *validator) coerceRecord(prefix, recordName string, fields map[string]any) {
+	config := v.tc.DataModel[recordName]
+	for _, fieldName := range sortedKeys(fields) {
+		field, ok := config[fieldName]
+		if !ok {
+			continue
+		}
+		path := prefix + fieldName
+		if _, isRecord := v.tc.DataModel[fieldName]; isRecord {
+			fields[fieldName] = v.coerceNested(path, fieldName, field, fields[fieldName])
+			continue
+		}
+
+		value, err := field.Coerce(fields[fieldName])
+		if err != nil {
+			v.add(path, FieldErrorType, "%v", err)
+			continue
+		}
+		fields[fieldName] = value
+	}
+}
+
+func (v *validator) coerceNested(path, recordName string, field CustomField, value any) any {
+	if isEmptyValue(value) {
+		return value
+	}
+	if m, ok := asMap(value); ok && field.Type() != FieldTypeList {
+		v.coerceRecord(path+".", recordName, m)
+		return m
+	}
+
+	list, ok := asList(value)
+	if !ok || field.Type() != FieldTypeList {
+		result, err := field.Coerce(value)
+		if err != nil {
+			v.add(path, FieldErrorType, "%v", err)
+		}
+		return result
+	}
+	_, byUUID := listByUUID(list)
+	result := make([]any, 0, len(list))
+	for i, item := range list {
+		if m, ok := asMap(item); ok {
+			v.coerceRecord(itemPath(path, list, i, byUUID)+".", recordName, m)
+			item = m
+		}
+		result = append(result, item)
+	}
+	return result
+}
+
+// Coerce converts a value, e.g. as decoded from json or sent by a form, to the canonical type of the field:
+// int64 for int and uint, float64 for float, bool, string for string and richtext, time.Time in UTC for
+// datetime and at midnight UTC for date, []any for list. Empty strings of the other types become nil.
+// Comboboxes, images and files are kept as they are.
+func (cf CustomField) Coerce(value any) (any, error) {
+	fieldType := cf.Type()
+	if value == nil {
+		return nil, nil
+	}
+	if text, ok := value.(string); ok && strings.TrimSpace(text) == "" {
+		switch fieldType {
+		case FieldTypeString, FieldTypeRichtext, FieldTypeCombobox, FieldTypeImage, FieldTypeFile:
+			return value, nil
+		}
+		return nil, nil
+	}
+
+	switch fieldType {
+	case FieldTypeString, FieldTypeRichtext:
+		switch v := value.(type) {
+		case string:
+			return v, nil
+		case bool:
+			return strconv.FormatBool(v), nil
+		}
+		if n, ok := integerValue(value); ok {
+			return strconv.FormatInt(n, 10), nil
+		}
+		if f, ok := floatValue(value); ok {
+			return strconv.FormatFloat(f, 'f', -1, 64), nil
+		}
+	case FieldTypeInt, FieldTypeUint:
+		// bson knows no unsigned integers, so uint fields are stored as int64 as well
+		if n, ok := integerValue(value); ok && (fieldType == FieldTypeInt || n >= 0) {
+			return n, nil
+		}
+	case FieldTypeFloat:
+		if f, ok := floatValue(value); ok {
+			return f, nil
+		}
+	case FieldTypeBool:
+		switch v := value.(type) {
+		case bool:
+			return v, nil
+		case string:
+			if b, err := strconv.ParseBool(strings.TrimSpace(v)); err == nil {
+				return b, nil
+			}
+		}
+	case FieldTypeDateTime:
+		if t, ok := timeValue(value); ok {
+			return t.UTC(), nil
+		}
+	case FieldTypeDate:
+		// the date is taken as written, regardless of a time zone
+		if t, ok := timeValue(value); ok {
+			return time.Date(t.Year(), t.Month(), t.Day(), 0, 0, 0, 0, time.UTC), nil
+		}
+	case FieldTypeList:
+		if list, ok := asList(value); ok {
+			return []any(list), nil
+		}
+	default:
+		return value, nil
+	}
+	return value, fmt.Errorf("the value %v cannot be converted to %s", value, fieldType)
+}
@@ -0,0 +1,93 @@
+package datamodel
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+	"go.mongodb.org/mongo-driver/bson"
+)
+
+func TestCoerceEntity(t *testing.T) {
+	tc := TenantConfig{
+		Subject: "order",
+		DataModel: map[string]CustomFields{
+			"order": {
+				"number":    {},
+				"amount":    {"type": FieldTypeInt},
+				"quantity":  {"type": FieldTypeUint},
+				"price":     {"type": FieldTypeFloat},
+				"paid":      {"type": FieldTypeBool},
+				"orderDate": {"type": FieldTypeDate},
+				"shipped":   {"type": FieldTypeDateTime},
+				"status":    {"type": FieldTypeCombobox},
+				"address":   {},
+				"items":     {"type": FieldTypeList},
+			},
+			"address": {
+				"city": {},
+				"zip":  {"type": FieldTypeInt},
+			},
+			"items": {
+				"article":  {},
+				"quantity": {"type": FieldTypeUint},
+				"due":      {"type": FieldTypeDate},
+			},
+		},
+	}
+
+	fields := map[string]any{
+		"number":    4711.0,
+		"amount":    "-3",
+		"quantity":  7.0,
+		"price":     "9.95",
+		"paid":      "true",
+		"orderDate": "2025-03-01T23:30:00+02:00",
+		"shipped":   "2025-03-01T10:15:00+01:00",
+		"status":    1.0,
+		"address":   bson.M{"city": "Berlin", "zip": "10115"},
+		"items": bson.A{
+			map[string]any{"article": "a1", "quantity": "2", "due": ""},
+			bson.D{{Key: "article", Value: "a2"}, {Key: "quantity", Value: int32(1)}, {Key: "due", Value: "2025-04-01"}},
+		},
+		"comment": 42.0,
+	}
+	require.NoError(t, tc.CoerceEntity(fields))
+	require.Equal(t, map[string]any{
+		"number":    "4711",
+		"amount":    int64(-3),
+		"quantity":  int64(7),
+		"price":     9.95,
+		"paid":      true,
+		"orderDate": time.Date(2025, 3, 1, 0, 0, 0, 0, time.UTC),
+		"shipped":   time.Date(2025, 3, 1, 9, 15, 0, 0, time.UTC),
+		"status":    1.0,
+		"address":   map[string]any{"city": "Berlin", "zip": int64(10115)},
+		"items": []any{
+			map[string]any{"article": "a1", "quantity": int64(2), "due": nil},
+			map[string]any{"article": "a2", "quantity": int64(1), "due": time.Date(2025, 4, 1, 0, 0, 0, 0, time.UTC)},
+		},
+		"comment": 42.0,
+	}, fields)
+	require.NoError(t, tc.ValidateEntity(map[string]any{"amount": fields["amount"], "orderDate": fields["orderDate"], "items": fields["items"]}))
+
+	fields = map[string]any{
+		"amount":    1.5,
+		"quantity":  "-1",
+		"paid":      "maybe",
+		"orderDate": "01.03.2025",
+		"address":   map[string]any{"zip": "D-10115"},
+		"items":     []any{map[string]any{"quantity": "two"}},
+	}
+	err := tc.CoerceRecord(Record{Fields: fields})
+	require.Equal(t, map[string]string{
+		"amount":            FieldErrorType,
+		"quantity":          FieldErrorType,
+		"paid":              FieldErrorType,
+		"orderDate":         FieldErrorType,
+		"address.zip":       FieldErrorType,
+		"items[0].quantity": FieldErrorType,
+	}, fieldErrorCodes(t, err))
+	require.ErrorContains(t, err, "amount: the value 1.5 cannot be converted to int")
+	require.Equal(t, "maybe", fields["paid"])
+}
@@ -44,6 +44,7 @@ type TenantConfig struct {
 	Cmbs      *TenantComboboxDatamodel `json:"cmbs,omitempty"`
 	Overviews *OverviewModel           `json:"overview,omitempty"`
 	Prefix    map[string]string        `json:"prefix"`
+	Indexes   []IndexDefinition        `json:"indexes,omitempty"`
 }
 
 func (tc TenantConfig) GetPrefix(key string) string {
@@ -214,19 +215,22 @@ func (cf *CustomField) setCommand(command string) {
 }
 
 func (cf CustomField) IsMandatory() bool {
-	result, ok := cf["mandatory"]
-	if !ok || result == nil {
-		return false
-	}
-	return *result.(*bool)
+	return cf.flag("mandatory")
 }
 
 func (cf CustomField) IsReadonly() bool {
-	result, ok := cf["readonly"]
-	if !ok || result == nil {
-		return false
+	return cf.flag("readonly")
+}
+
+// flag reads a boolean property, which is a bool if read from a datamodel file and a *bool if set for a role
+func (cf CustomField) flag(name string) bool {
+	switch v := cf[name].(type) {
+	case bool:
+		return v
+	case *bool:
+		return v != nil && *v
 	}
-	return *result.(*bool)
+	return false
 }
 
 func (cf CustomField) IsMasked() bool {
@@ -237,6 +241,22 @@ func (cf CustomField) IsMasked() bool {
 	return result.(bool)
 }
 
+// IsEncrypted is true for fields defined with "encrypted": true or "encrypted": "deterministic"
+func (cf CustomField) IsEncrypted() bool {
+	switch v := cf["encrypted"].(type) {
+	case bool:
+		return v
+	case string:
+		return v == EncryptionDeterministic
+	}
+	return false
+}
+
+// IsDeterministic is true for encrypted fields whose values can be searched by equality, see FieldEncryption
+func (cf CustomField) IsDeterministic() bool {
+	return cf["encrypted"] == EncryptionDeterministic
+}
+
 func loadDataModelFromFile(path string) (*TenantConfig, error) {
 	jsonData, err := os.ReadFile(path + "/datamodel.json")
 	if err != nil {
@@ -1,6 +1,7 @@
 package datamodel
 
 import (
+	"context"
 	"encoding/json"
 	"reflect"
 	"testing"
@@ -82,7 +83,7 @@ func (de testDomainEntity) OverviewRow() map[string]any {
 	return nil
 }
 
-func (de testDomainEntity) BeforeSave(session database.DatabaseSession) error {
+func (de testDomainEntity) BeforeSave(ctx context.Context, session database.DatabaseSession) error {
 	return nil
 }
 
@@ -0,0 +1,239 @@
+package datamodel
+
+import (
+	"fmt"
+	"reflect"
+	"slices"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+const (
+	ChangeAdded    = "added"
+	ChangeRemoved  = "removed"
+	ChangeModified = "modified"
+)
+
+// Change describes a single difference between two versions of a record. The path is relative to the
+// entity root, e.g. "roles[uuid=0a1b...].name" for items of list fields having a uuid or "tags[2]" otherwise.
+type Change struct {
+	Op       string `json:"op"`
+	Path     string `json:"path"`
+	OldValue any    `json:"oldValue,omitempty"`
+	NewValue any    `json:"newValue,omitempty"`
+}
+
+type ChangeSet []Change
+
+func (cs ChangeSet) IsEmpty() bool {
+	return len(cs) == 0
+}
+
+// Paths returns the paths of all changes
+func (cs ChangeSet) Paths() []string {
+	result := make([]string, 0, len(cs))
+	for _, change := range cs {
+		result = append(result, change.Path)
+	}
+	return result
+}
+
+// Diff returns the changes needed to get from r to newer
+func (r Record) Diff(newer Record) ChangeSet {
+	return DiffFields(r.Fields, newer.Fields)
+}
+
+// DiffFields compares two entity maps. Nested records are compared field by field, list items are matched
+// by their uuid (see database.EntityNode) if all of them have one, otherwise by their position.
+func DiffFields(oldFields, newFields map[string]any) ChangeSet {
+	result := ChangeSet{}
+	diffMaps("", oldFields, newFields, &result)
+	return result
+}
+
+func diffMaps(path string, oldMap, newMap map[string]any, result *ChangeSet) {
+	keys := []string{}
+	for k := range oldMap {
+		keys = append(keys, k)
+	}
+	for k := range newMap {
+		if _, ok := oldMap[k]; !ok {
+			keys = append(keys, k)
+		}
+	}
+	slices.Sort(keys)
+
+	for _, key := range keys {
+		oldValue, oldExists := oldMap[key]
+		newValue, newExists := newMap[key]
+		diffValues(joinPath(path, key), oldValue, oldExists && oldValue != nil, newValue, newExists && newValue != nil, result)
+	}
+}
+
+func diffValues(path string, oldValue any, oldExists bool, newValue any, newExists bool, result *ChangeSet) {
+	switch {
+	case !oldExists && !newExists:
+		return
+	case !oldExists:
+		*result = append(*result, Change{Op: ChangeAdded, Path: path, NewValue: newValue})
+		return
+	case !newExists:
+		*result = append(*result, Change{Op: ChangeRemoved, Path: path, OldValue: oldValue})
+		return
+	}
+
+	if oldMap, ok := asMap(oldValue); ok {
+		if newMap, ok := asMap(newValue); ok {
+			diffMaps(path, oldMap, newMap, result)
+			return
+		}
+	}
+	if oldList, ok := asList(oldValue); ok {
+		if newList, ok := asList(newValue); ok {
+			diffLists(path, oldList, newList, result)
+			return
+		}
+	}
+	if !equalValues(oldValue, newValue) {
+		*result = append(*result, Change{Op: ChangeModified, Path: path, OldValue: oldValue, NewValue: newValue})
+	}
+}
+
+func diffLists(path string, oldList, newList []any, result *ChangeSet) {
+	oldByUUID, oldOk := listByUUID(oldList)
+	newByUUID, newOk := listByUUID(newList)
+	if !oldOk || !newOk {
+		for i := 0; i < len(oldList) || i < len(newList); i++ {
+			var oldItem, newItem any
+			if i < len(oldList) {
+				oldItem = oldList[i]
+			}
+			if i < len(newList) {
+				newItem = newList[i]
+			}
+			diffValues(itemPath(path, nil, i, false), oldItem, i < len(oldList) && oldItem != nil, newItem, i < len(newList) && newItem != nil, result)
+		}
+		return
+	}
+
+	for i, item := range oldList {
+		newItem, ok := newByUUID[itemUUID(item)]
+		diffValues(itemPath(path, oldList, i, true), item, true, newItem, ok, result)
+	}
+	for i, item := range newList {
+		if _, ok := oldByUUID[itemUUID(item)]; !ok {
+			diffValues(itemPath(path, newList, i, true), nil, false, item, true, result)
+		}
+	}
+}
+
+func listByUUID(list []any) (map[string]any, bool) {
+	result := make(map[string]any, len(list))
+	for _, item := range list {
+		uuid := itemUUID(item)
+		if uuid == "" {
+			return nil, false
+		}
+		if _, duplicate := result[uuid]; duplicate {
+			return nil, false
+		}
+		result[uuid] = item
+	}
+	return result, true
+}
+
+func itemUUID(item any) string {
+	m, ok := asMap(item)
+	if !ok || m["uuid"] == nil {
+		return ""
+	}
+	return fmt.Sprintf("%v", m["uuid"])
+}
+
+// itemPath addresses the item i of a list the same way in changes, validation and readonly errors: by its
+// uuid if the items are matched by their uuids, e.g. "roles[uuid=0a1b...]", otherwise by its index, e.g. "tags[2]"
+func itemPath(path string, list []any, i int, byUUID bool) string {
+	if byUUID {
+		return fmt.Sprintf("%s[uuid=%s]", path, itemUUID(list[i]))
+	}
+	return fmt.Sprintf("%s[%d]", path, i)
+}
+
+func joinPath(path, key string) string {
+	if path == "" {
+		return key
+	}
+	return path + "." + key
+}
+
+func asMap(value any) (map[string]any, bool) {
+	switch v := value.(type) {
+	case map[string]any:
+		return v, true
+	case bson.M:
+		return v, true
+	case bson.D:
+		return v.Map(), true
+	}
+	return nil, false
+}
+
+func asList(value any) ([]any, bool) {
+	switch v := value.(type) {
+	case []any:
+		return v, true
+	case primitive.A:
+		return v, true
+	}
+	return nil, false
+}
+
+// equalValues compares scalars. Numbers are equal if their values are equal regardless of the type,
+// since the same value comes as float64 from json and as int32 from bson.
+func equalValues(a, b any) bool {
+	if fa, ok := toFloat64(a); ok {
+		if fb, ok := toFloat64(b); ok {
+			return fa == fb
+		}
+	}
+	if ta, ok := toTime(a); ok {
+		if tb, ok := toTime(b); ok {
+			return ta.Equal(tb)
+		}
+	}
+	return reflect.DeepEqual(a, b)
+}
+
+func toTime(value any) (time.Time, bool) {
+	switch v := value.(type) {
+	case time.Time:
+		return v, true
+	case primitive.DateTime:
+		return v.Time(), true
+	}
+	return time.Time{}, false
+}
+
+func toFloat64(value any) (float64, bool) {
+	switch v := value.(type) {
+	case int:
+		return float64(v), true
+	case int32:
+		return float64(v), true
+	case int64:
+		return float64(v), true
+	case uint:
+		return float64(v), true
+	case uint32:
+		return float64(v), true
+	case uint64:
+		return float64(v), true
+	case float32:
+		return float64(v), true
+	case float64:
+		return v, true
+	}
+	return 0, false
+}
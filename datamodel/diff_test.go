@@ -0,0 +1,61 @@
+package datamodel
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/require"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+func TestDiffFields(t *testing.T) {
+	oldFields := map[string]any{
+		"name":   "Alpha",
+		"amount": int32(10),
+		"note":   "obsolete",
+		"empty":  nil,
+		"address": bson.M{
+			"city": "Berlin",
+			"zip":  "10115",
+		},
+		"roles": primitive.A{
+			bson.M{"uuid": "r1", "name": "admin"},
+			bson.M{"uuid": "r2", "name": "guest"},
+		},
+		"tags": primitive.A{"red", "blue"},
+	}
+	newFields := map[string]any{
+		"name":   "Alpha",
+		"amount": 10.0,
+		"color":  "green",
+		"address": map[string]any{
+			"city": "Hamburg",
+			"zip":  "10115",
+		},
+		"roles": []any{
+			map[string]any{"uuid": "r2", "name": "user"},
+			map[string]any{"uuid": "r3", "name": "editor"},
+		},
+		"tags": []any{"red", "blue", "white"},
+	}
+
+	changes := DiffFields(oldFields, newFields)
+	require.Equal(t, ChangeSet{
+		{Op: ChangeModified, Path: "address.city", OldValue: "Berlin", NewValue: "Hamburg"},
+		{Op: ChangeAdded, Path: "color", NewValue: "green"},
+		{Op: ChangeRemoved, Path: "note", OldValue: "obsolete"},
+		{Op: ChangeRemoved, Path: "roles[uuid=r1]", OldValue: bson.M{"uuid": "r1", "name": "admin"}},
+		{Op: ChangeModified, Path: "roles[uuid=r2].name", OldValue: "guest", NewValue: "user"},
+		{Op: ChangeAdded, Path: "roles[uuid=r3]", NewValue: map[string]any{"uuid": "r3", "name": "editor"}},
+		{Op: ChangeAdded, Path: "tags[2]", NewValue: "white"},
+	}, changes)
+
+	require.True(t, DiffFields(oldFields, oldFields).IsEmpty())
+}
+
+func TestRecordDiff(t *testing.T) {
+	older := Record{Fields: map[string]any{"foo": map[string]any{"bar": []any{map[string]any{"baz": 1.0}}}}}
+	newer := Record{Fields: map[string]any{"foo": map[string]any{"bar": []any{map[string]any{"baz": 2.0}}}}}
+
+	require.Equal(t, []string{"foo.bar[0].baz"}, older.Diff(newer).Paths())
+}
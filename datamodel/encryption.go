@@ -0,0 +1,425 @@
+package datamodel
+
+import (
+	"context"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"os"
+	"strings"
+	"sync"
+
+	"github.com/dchaykin/go-modules/database"
+	"github.com/dchaykin/mygolib/log"
+)
+
+// EncryptionDeterministic as value of "encrypted" in a field definition encrypts equal values to equal
+// ciphertexts, so that the field can be searched by equality, see FieldEncryption.EncryptValue
+const EncryptionDeterministic = "deterministic"
+
+const (
+	encryptedPrefix     = "enc:"
+	encryptionRandom    = "r"
+	encryptionEqualable = "d"
+)
+
+// KeyProvider supplies the keys of the field encryption. Every encrypted value carries the id of its key,
+// so values encrypted before a key rotation are decrypted with the older key as long as it is provided.
+type KeyProvider interface {
+	// CurrentKey returns the key new values are encrypted with
+	CurrentKey() (id string, key []byte, err error)
+	Key(id string) ([]byte, error)
+}
+
+// StaticKeys is a KeyProvider holding AES keys of 16, 24 or 32 bytes
+type StaticKeys struct {
+	current string
+	keys    map[string][]byte
+}
+
+func NewStaticKeys(current string, keys map[string][]byte) (*StaticKeys, error) {
+	if _, ok := keys[current]; !ok {
+		return nil, fmt.Errorf("the current key %s is missing", current)
+	}
+	for id, key := range keys {
+		if id == "" || strings.Contains(id, ":") {
+			return nil, fmt.Errorf("invalid key id '%s'", id)
+		}
+		if _, err := aes.NewCipher(key); err != nil {
+			return nil, fmt.Errorf("invalid key %s: %w", id, err)
+		}
+	}
+	return &StaticKeys{current: current, keys: keys}, nil
+}
+
+// KeysFromEnv reads the keys from the environment variable as a comma separated list of "<id>:<base64 key>",
+// the first key is the current one, e.g. "2:q8Xr...,1:Yt4a..."
+func KeysFromEnv(name string) (*StaticKeys, error) {
+	value := os.Getenv(name)
+	if value == "" {
+		return nil, fmt.Errorf("no keys found in %s", name)
+	}
+
+	current := ""
+	keys := map[string][]byte{}
+	for _, entry := range strings.Split(value, ",") {
+		id, encodedKey, ok := strings.Cut(strings.TrimSpace(entry), ":")
+		if !ok {
+			return nil, fmt.Errorf("invalid key entry in %s, expected <id>:<base64 key>", name)
+		}
+		key, err := base64.StdEncoding.DecodeString(encodedKey)
+		if err != nil {
+			return nil, fmt.Errorf("invalid key %s in %s: %w", id, name, err)
+		}
+		if current == "" {
+			current = id
+		}
+		keys[id] = key
+	}
+	return NewStaticKeys(current, keys)
+}
+
+// KeysFromFile reads the keys from a json file like {"current": "2", "keys": {"1": "<base64 key>", "2": "<base64 key>"}}
+func KeysFromFile(fileName string) (*StaticKeys, error) {
+	data, err := os.ReadFile(fileName)
+	if err != nil {
+		return nil, err
+	}
+
+	keyFile := struct {
+		Current string            `json:"current"`
+		Keys    map[string]string `json:"keys"`
+	}{}
+	if err = json.Unmarshal(data, &keyFile); err != nil {
+		return nil, fmt.Errorf("invalid key file %s: %w", fileName, err)
+	}
+
+	keys := map[string][]byte{}
+	for id, encodedKey := range keyFile.Keys {
+		if keys[id], err = base64.StdEncoding.DecodeString(encodedKey); err != nil {
+			return nil, fmt.Errorf("invalid key %s in %s: %w", id, fileName, err)
+		}
+	}
+	return NewStaticKeys(keyFile.Current, keys)
+}
+
+func (k *StaticKeys) CurrentKey() (string, []byte, error) {
+	return k.current, k.keys[k.current], nil
+}
+
+func (k *StaticKeys) Key(id string) ([]byte, error) {
+	key, ok := k.keys[id]
+	if !ok {
+		return nil, fmt.Errorf("unknown key %s", id)
+	}
+	return key, nil
+}
+
+// FieldEncryption encrypts the fields defined as "encrypted" in the datamodels of the registered collections
+// with AES-GCM. It is a database.FieldCodec: set by database.SetFieldCodec the fields are encrypted whenever
+// an entity is written and decrypted whenever it is read. The values are json encoded before the encryption,
+// numbers are read back as float64 and dates as strings.
+type FieldEncryption struct {
+	keys KeyProvider
+
+	mu     sync.RWMutex
+	models map[string]TenantConfig
+}
+
+func NewFieldEncryption(keys KeyProvider) *FieldEncryption {
+	return &FieldEncryption{keys: keys, models: map[string]TenantConfig{}}
+}
+
+// Register sets the datamodel defining the encrypted fields of the records stored in the collection
+func (fe *FieldEncryption) Register(collectionName string, tc TenantConfig) {
+	fe.mu.Lock()
+	defer fe.mu.Unlock()
+	fe.models[collectionName] = tc
+}
+
+func (fe *FieldEncryption) model(collectionName string) (TenantConfig, bool) {
+	fe.mu.RLock()
+	defer fe.mu.RUnlock()
+	tc, ok := fe.models[collectionName]
+	return tc, ok
+}
+
+// EncodeFields encrypts the encrypted fields of the entity. Values already encrypted are kept if they decrypt
+// with a known key, any other value looking like an encrypted one, e.g. sent by a client, is encrypted as well.
+func (fe *FieldEncryption) EncodeFields(entity database.DomainEntity) error {
+	collectionName := entity.CollectionName()
+	tc, ok := fe.model(collectionName)
+	if !ok {
+		return nil
+	}
+	return tc.visitFields(tc.Subject, entity.Entity(), func(recordName, fieldName string, field CustomField, fields map[string]any) error {
+		value := fields[fieldName]
+		if !field.IsEncrypted() || isEmptyValue(value) {
+			return nil
+		}
+		additionalData := encryptionContext(collectionName, recordName, fieldName)
+		if isEncryptedValue(value) {
+			if _, err := fe.decrypt(additionalData, value.(string)); err == nil {
+				return nil
+			}
+		}
+		encrypted, err := fe.encrypt(additionalData, value, field.IsDeterministic())
+		if err != nil {
+			return fmt.Errorf("could not encrypt %s.%s of %s: %w", recordName, fieldName, entity.UUID(), err)
+		}
+		fields[fieldName] = encrypted
+		return nil
+	})
+}
+
+// DecodeFields decrypts the encrypted fields of the entity, values stored before the encryption has been
+// introduced are kept
+func (fe *FieldEncryption) DecodeFields(entity database.DomainEntity) error {
+	collectionName := entity.CollectionName()
+	tc, ok := fe.model(collectionName)
+	if !ok {
+		return nil
+	}
+	return tc.visitFields(tc.Subject, entity.Entity(), func(recordName, fieldName string, field CustomField, fields map[string]any) error {
+		value := fields[fieldName]
+		if !field.IsEncrypted() || !isEncryptedValue(value) {
+			return nil
+		}
+		decrypted, err := fe.decrypt(encryptionContext(collectionName, recordName, fieldName), value.(string))
+		if err != nil {
+			return fmt.Errorf("could not decrypt %s.%s of %s: %w", recordName, fieldName, entity.UUID(), err)
+		}
+		fields[fieldName] = decrypted
+		return nil
+	})
+}
+
+// ExportFields returns a copy of the fields of a record of the collection fit to be stored outside of it, e.g. as
+// overview row: the masked fields are redacted and the fields encrypted by the active field codec are removed.
+func ExportFields(collectionName string, fields map[string]any) map[string]any {
+	fields = RedactFields(collectionName, fields)
+	fe, ok := database.GetFieldCodec().(*FieldEncryption)
+	if !ok {
+		return fields
+	}
+	return fe.StripEncrypted(collectionName, fields)
+}
+
+// StripEncrypted returns a copy of the fields of a record of the collection without the encrypted fields
+func (fe *FieldEncryption) StripEncrypted(collectionName string, fields map[string]any) map[string]any {
+	tc, ok := fe.model(collectionName)
+	if !ok || fields == nil {
+		return fields
+	}
+	return tc.stripEncrypted(tc.Subject, fields)
+}
+
+func (tc TenantConfig) stripEncrypted(recordName string, fields map[string]any) map[string]any {
+	config := tc.DataModel[recordName]
+	result := make(map[string]any, len(fields))
+	for fieldName, value := range fields {
+		field, ok := config[fieldName]
+		if ok && field.IsEncrypted() {
+			continue
+		}
+		if _, isRecord := tc.DataModel[fieldName]; ok && isRecord {
+			if m, isMap := asMap(value); isMap {
+				value = tc.stripEncrypted(fieldName, m)
+			} else if list, isList := asList(value); isList {
+				items := make([]any, 0, len(list))
+				for _, item := range list {
+					if m, isMap := asMap(item); isMap {
+						item = tc.stripEncrypted(fieldName, m)
+					}
+					items = append(items, item)
+				}
+				value = items
+			}
+		}
+		result[fieldName] = value
+	}
+	return result
+}
+
+// EncryptValue returns the value of a deterministically encrypted field as stored with the current key, e.g. for
+// database.Eq("eMail", encrypted). Values encrypted with an older key are only found after RotateKeys.
+func (fe *FieldEncryption) EncryptValue(collectionName, recordName, fieldName string, value any) (string, error) {
+	tc, ok := fe.model(collectionName)
+	if !ok {
+		return "", fmt.Errorf("no encryption registered for %s", collectionName)
+	}
+	field, ok := tc.DataModel[recordName][fieldName]
+	if !ok || !field.IsDeterministic() {
+		return "", fmt.Errorf("the field %s.%s is not encrypted deterministically", recordName, fieldName)
+	}
+	return fe.encrypt(encryptionContext(collectionName, recordName, fieldName), value, true)
+}
+
+// RotateKeys encrypts the fields of all records of the domain entity's collection with the current key, batchSize
+// records at a time, soft deleted records included. The records are rewritten without a new version or revision.
+// A record changed in the meantime is skipped, since its save has already encrypted it with the current key.
+// It returns the number of rewritten records. Older keys must be kept as long as revisions encrypted with them exist.
+func (fe *FieldEncryption) RotateKeys(ctx context.Context, session database.DatabaseSession, domainEntity database.DomainEntity, batchSize int64) (int64, error) {
+	query := database.NewQuery().WithDeleted()
+	result := int64(0)
+	token := ""
+	for {
+		page, err := database.ReadDomainEntityPage(ctx, session, domainEntity, query, token, batchSize, false)
+		if err != nil {
+			return result, err
+		}
+		for _, entity := range page.Entities {
+			if err = fe.DecodeFields(entity); err != nil {
+				return result, err
+			}
+			if err = fe.EncodeFields(entity); err != nil {
+				return result, err
+			}
+			rewritten, err := database.RewriteEntity(ctx, session, entity, nil)
+			if err != nil {
+				return result, err
+			}
+			if !rewritten {
+				log.Info("The record %s has been changed during the key rotation and is skipped", entity.UUID())
+				continue
+			}
+			result++
+		}
+		if page.NextToken == "" {
+			log.Info("The encrypted fields of %d records of %s have been rotated", result, domainEntity.CollectionName())
+			return result, nil
+		}
+		token = page.NextToken
+	}
+}
+
+// encryptionContext binds an encrypted value to its field, it is authenticated but not stored
+func encryptionContext(collectionName, recordName, fieldName string) []byte {
+	return []byte(collectionName + "/" + recordName + "." + fieldName)
+}
+
+func (fe *FieldEncryption) encrypt(additionalData []byte, value any, deterministic bool) (string, error) {
+	id, key, err := fe.keys.CurrentKey()
+	if err != nil {
+		return "", err
+	}
+	plaintext, err := json.Marshal(value)
+	if err != nil {
+		return "", err
+	}
+	aead, err := newAEAD(key)
+	if err != nil {
+		return "", err
+	}
+
+	mode := encryptionRandom
+	nonce := make([]byte, aead.NonceSize())
+	if deterministic {
+		// the nonce is derived from the value, so that equal values of the field get equal ciphertexts
+		mode = encryptionEqualable
+		mac := hmac.New(sha256.New, deriveKey(key, "nonce"))
+		mac.Write(additionalData)
+		mac.Write(plaintext)
+		copy(nonce, mac.Sum(nil))
+	} else if _, err = rand.Read(nonce); err != nil {
+		return "", err
+	}
+
+	sealed := aead.Seal(nonce, nonce, plaintext, additionalData)
+	return encryptedPrefix + mode + ":" + id + ":" + base64.RawURLEncoding.EncodeToString(sealed), nil
+}
+
+func (fe *FieldEncryption) decrypt(additionalData []byte, value string) (any, error) {
+	_, id, data, err := parseEncryptedValue(value)
+	if err != nil {
+		return nil, err
+	}
+	key, err := fe.keys.Key(id)
+	if err != nil {
+		return nil, err
+	}
+	aead, err := newAEAD(key)
+	if err != nil {
+		return nil, err
+	}
+	if len(data) < aead.NonceSize() {
+		return nil, fmt.Errorf("the encrypted value is too short")
+	}
+
+	plaintext, err := aead.Open(nil, data[:aead.NonceSize()], data[aead.NonceSize():], additionalData)
+	if err != nil {
+		return nil, err
+	}
+	var result any
+	return result, json.Unmarshal(plaintext, &result)
+}
+
+func isEncryptedValue(value any) bool {
+	text, ok := value.(string)
+	if !ok || !strings.HasPrefix(text, encryptedPrefix) {
+		return false
+	}
+	_, _, _, err := parseEncryptedValue(text)
+	return err == nil
+}
+
+// parseEncryptedValue splits "enc:<mode>:<key id>:<nonce and ciphertext>"
+func parseEncryptedValue(value string) (mode, id string, data []byte, err error) {
+	parts := strings.SplitN(strings.TrimPrefix(value, encryptedPrefix), ":", 3)
+	if len(parts) != 3 || (parts[0] != encryptionRandom && parts[0] != encryptionEqualable) {
+		return "", "", nil, fmt.Errorf("invalid encrypted value")
+	}
+	data, err = base64.RawURLEncoding.DecodeString(parts[2])
+	return parts[0], parts[1], data, err
+}
+
+func newAEAD(key []byte) (cipher.AEAD, error) {
+	block, err := aes.NewCipher(deriveKey(key, "aes"))
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+// deriveKey derives separate keys of the same length for the encryption and the nonces
+func deriveKey(key []byte, purpose string) []byte {
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte(purpose))
+	return mac.Sum(nil)[:len(key)]
+}
+
+// visitFields calls f for every field of the record's datamodel present in fields, nested records and list items included
+func (tc TenantConfig) visitFields(recordName string, fields map[string]any, f func(recordName, fieldName string, field CustomField, fields map[string]any) error) error {
+	for fieldName, field := range tc.DataModel[recordName] {
+		value, ok := fields[fieldName]
+		if !ok {
+			continue
+		}
+		if err := f(recordName, fieldName, field, fields); err != nil {
+			return err
+		}
+
+		if _, isRecord := tc.DataModel[fieldName]; !isRecord {
+			continue
+		}
+		if m, ok := asMap(value); ok {
+			if err := tc.visitFields(fieldName, m, f); err != nil {
+				return err
+			}
+		} else if list, ok := asList(value); ok {
+			for _, item := range list {
+				if m, ok := asMap(item); ok {
+					if err := tc.visitFields(fieldName, m, f); err != nil {
+						return err
+					}
+				}
+			}
+		}
+	}
+	return nil
+}
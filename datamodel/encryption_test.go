@@ -0,0 +1,262 @@
+package datamodel
+
+import (
+	"bytes"
+	"context"
+	"encoding/base64"
+	"fmt"
+	"strings"
+	"testing"
+
+	"github.com/dchaykin/go-modules/database"
+	"github.com/stretchr/testify/require"
+	"go.mongodb.org/mongo-driver/bson"
+)
+
+func encryptedTenantConfig() TenantConfig {
+	return TenantConfig{
+		Subject: "contact",
+		DataModel: map[string]CustomFields{
+			"contact": {
+				"uuid":     {},
+				"name":     {},
+				"eMail":    {"encrypted": EncryptionDeterministic},
+				"birthday": {"type": FieldTypeDate, "encrypted": true},
+				"accounts": {"type": FieldTypeList},
+			},
+			"accounts": {
+				"iban": {"encrypted": true},
+			},
+		},
+	}
+}
+
+func useFieldEncryption(t *testing.T, keys KeyProvider) *FieldEncryption {
+	fe := NewFieldEncryption(keys)
+	fe.Register("contact", encryptedTenantConfig())
+	database.SetFieldCodec(fe)
+	t.Cleanup(func() { database.SetFieldCodec(nil) })
+	return fe
+}
+
+func storedFields(t *testing.T, session database.DatabaseSession, uuid string) bson.M {
+	doc := bson.M{}
+	found, err := session.FindOne(context.Background(), session.GetCollection("migrationTest", "contact"), bson.M{"entity.uuid": uuid}, &doc)
+	require.NoError(t, err)
+	require.True(t, found)
+	return doc["entity"].(bson.M)
+}
+
+func TestFieldEncryption(t *testing.T) {
+	database.UseMemoryBackend()
+	t.Cleanup(func() { database.SetBackend(nil) })
+
+	keys, err := NewStaticKeys("1", map[string][]byte{"1": bytes.Repeat([]byte{1}, 32)})
+	require.NoError(t, err)
+	fe := useFieldEncryption(t, keys)
+
+	ctx := context.Background()
+	session, err := database.OpenSession()
+	require.NoError(t, err)
+	defer session.Close()
+
+	c := newContact(testUUID(t), 0, map[string]any{
+		"name":     "John Doe",
+		"eMail":    "john@example.com",
+		"birthday": "1980-01-01",
+		"accounts": []any{map[string]any{"iban": "DE00123"}},
+	})
+	require.NoError(t, session.InsertEntity(ctx, c))
+	require.Equal(t, "john@example.com", c.Fields["eMail"])
+
+	stored := storedFields(t, session, c.UUID())
+	require.Equal(t, "John Doe", stored["name"])
+	for _, value := range []any{stored["eMail"], stored["birthday"], stored["accounts"].(bson.A)[0].(bson.M)["iban"]} {
+		require.True(t, strings.HasPrefix(value.(string), "enc:"))
+		require.NotContains(t, value, "john")
+	}
+
+	loaded := &contact{}
+	found, err := session.GetEntityByUUID(ctx, c.UUID(), loaded)
+	require.NoError(t, err)
+	require.True(t, found)
+	require.Equal(t, "john@example.com", loaded.Fields["eMail"])
+	require.Equal(t, "1980-01-01", loaded.Fields["birthday"])
+	item, _ := asMap(loaded.Fields["accounts"].(bson.A)[0])
+	require.Equal(t, "DE00123", item["iban"])
+
+	// deterministic fields can be searched by equality
+	other := newContact(testUUID(t), 0, map[string]any{"eMail": "john@example.com"})
+	require.NoError(t, session.InsertEntity(ctx, other))
+	require.Equal(t, stored["eMail"], storedFields(t, session, other.UUID())["eMail"])
+	require.NotEqual(t, stored["birthday"], storedFields(t, session, other.UUID())["birthday"])
+
+	eMail, err := fe.EncryptValue("contact", "contact", "eMail", "john@example.com")
+	require.NoError(t, err)
+	page, err := database.ReadDomainEntityPage(ctx, session, &contact{}, database.NewQuery(database.Eq("eMail", eMail)), "", 10, true)
+	require.NoError(t, err)
+	require.EqualValues(t, 2, *page.Total)
+	require.Equal(t, "john@example.com", page.Entities[0].Entity()["eMail"])
+
+	_, err = fe.EncryptValue("contact", "contact", "birthday", "1980-01-01")
+	require.Error(t, err)
+
+	// a value looking like an encrypted one is only kept if it decrypts, otherwise it is encrypted as any other value
+	fake := "enc:r:1:" + base64.RawURLEncoding.EncodeToString(bytes.Repeat([]byte{7}, 40))
+	forged := newContact(testUUID(t), 0, map[string]any{"eMail": eMail, "birthday": fake})
+	require.NoError(t, session.InsertEntity(ctx, forged))
+	require.Equal(t, stored["eMail"], storedFields(t, session, forged.UUID())["eMail"])
+	require.NotEqual(t, fake, storedFields(t, session, forged.UUID())["birthday"])
+
+	loaded = &contact{}
+	_, err = session.GetEntityByUUID(ctx, forged.UUID(), loaded)
+	require.NoError(t, err)
+	require.Equal(t, "john@example.com", loaded.Fields["eMail"])
+	require.Equal(t, fake, loaded.Fields["birthday"])
+}
+
+func TestRotateKeys(t *testing.T) {
+	database.UseMemoryBackend()
+	t.Cleanup(func() { database.SetBackend(nil) })
+
+	oldKey, newKey := bytes.Repeat([]byte{1}, 32), bytes.Repeat([]byte{2}, 16)
+	keys, err := NewStaticKeys("1", map[string][]byte{"1": oldKey})
+	require.NoError(t, err)
+	useFieldEncryption(t, keys)
+
+	ctx := context.Background()
+	session, err := database.OpenSession()
+	require.NoError(t, err)
+	defer session.Close()
+
+	uuids := []string{}
+	for range 3 {
+		c := newContact(testUUID(t), 0, map[string]any{"eMail": "jane@example.com"})
+		require.NoError(t, session.InsertEntity(ctx, c))
+		uuids = append(uuids, c.UUID())
+	}
+	require.True(t, strings.HasPrefix(storedFields(t, session, uuids[0])["eMail"].(string), "enc:d:1:"))
+	require.NoError(t, database.SoftDeleteEntity(ctx, session, uuids[2], &contact{}))
+
+	keys, err = NewStaticKeys("2", map[string][]byte{"1": oldKey, "2": newKey})
+	require.NoError(t, err)
+	fe := useFieldEncryption(t, keys)
+
+	count, err := fe.RotateKeys(ctx, session, &contact{}, 2)
+	require.NoError(t, err)
+	require.EqualValues(t, 3, count)
+
+	for _, uuid := range uuids[:2] {
+		require.True(t, strings.HasPrefix(storedFields(t, session, uuid)["eMail"].(string), "enc:d:2:"))
+		loaded := &contact{}
+		_, err = session.GetEntityByUUID(ctx, uuid, loaded)
+		require.NoError(t, err)
+		require.Equal(t, "jane@example.com", loaded.Fields["eMail"])
+	}
+
+	// after the rotation the old key is not needed anymore, soft deleted records included
+	keys, err = NewStaticKeys("2", map[string][]byte{"2": newKey})
+	require.NoError(t, err)
+	useFieldEncryption(t, keys)
+	loaded := &contact{}
+	_, err = session.GetEntityByUUID(ctx, uuids[0], loaded)
+	require.NoError(t, err)
+	require.Equal(t, "jane@example.com", loaded.Fields["eMail"])
+
+	restored := &contact{}
+	require.NoError(t, database.RestoreDeletedEntity(ctx, session, uuids[2], restored))
+	require.Equal(t, "jane@example.com", restored.Fields["eMail"])
+	require.True(t, strings.HasPrefix(storedFields(t, session, uuids[2])["eMail"].(string), "enc:d:2:"))
+}
+
+func TestKeysFromEnv(t *testing.T) {
+	key1 := base64.StdEncoding.EncodeToString(bytes.Repeat([]byte{1}, 32))
+	key2 := base64.StdEncoding.EncodeToString(bytes.Repeat([]byte{2}, 32))
+	t.Setenv("FIELD_KEYS", "2:"+key2+", 1:"+key1)
+
+	keys, err := KeysFromEnv("FIELD_KEYS")
+	require.NoError(t, err)
+	id, key, err := keys.CurrentKey()
+	require.NoError(t, err)
+	require.Equal(t, "2", id)
+	require.Equal(t, bytes.Repeat([]byte{2}, 32), key)
+	_, err = keys.Key("1")
+	require.NoError(t, err)
+	_, err = keys.Key("3")
+	require.Error(t, err)
+
+	t.Setenv("FIELD_KEYS", "1:"+base64.StdEncoding.EncodeToString([]byte("short")))
+	_, err = KeysFromEnv("FIELD_KEYS")
+	require.Error(t, err)
+
+	_, err = KeysFromEnv("NO_FIELD_KEYS")
+	require.Error(t, err)
+}
+
+func testUUID(t *testing.T) string {
+	uuid, err := GenerateUUID()
+	require.NoError(t, err)
+	return uuid
+}
+
+func TestRestoreRevisionEncrypted(t *testing.T) {
+	database.UseMemoryBackend()
+	t.Cleanup(func() { database.SetBackend(nil) })
+
+	keys, err := NewStaticKeys("1", map[string][]byte{"1": bytes.Repeat([]byte{1}, 32)})
+	require.NoError(t, err)
+	useFieldEncryption(t, keys)
+
+	ctx := context.Background()
+	session, err := database.OpenSession()
+	require.NoError(t, err)
+	defer session.Close()
+
+	c := newContact(testUUID(t), 0, map[string]any{"eMail": "john@example.com"})
+	require.NoError(t, session.ReplaceEntityByUUID(ctx, c, true))
+	c.Fields["eMail"] = "jdoe@example.com"
+	require.NoError(t, session.ReplaceEntityByUUID(ctx, c, false))
+
+	require.NoError(t, database.RestoreRevision(ctx, session, c.UUID(), 1, &contact{}))
+
+	stored := storedFields(t, session, c.UUID())
+	require.True(t, strings.HasPrefix(stored["eMail"].(string), "enc:"), "%v", stored["eMail"])
+
+	history := []bson.M{}
+	require.NoError(t, session.FindMany(ctx, session.GetCollection("migrationTest", "contact-history"), bson.M{"uuid": c.UUID()}, &history))
+	require.NotEmpty(t, history)
+	for _, revision := range history {
+		require.NotContains(t, fmt.Sprintf("%v", revision), "example.com")
+	}
+
+	loaded := &contact{}
+	_, err = session.GetEntityByUUID(ctx, c.UUID(), loaded)
+	require.NoError(t, err)
+	require.Equal(t, "john@example.com", loaded.Fields["eMail"])
+}
+
+func TestMigrateEncrypted(t *testing.T) {
+	database.UseMemoryBackend()
+	t.Cleanup(func() { database.SetBackend(nil) })
+	registerContactMigrations(t)
+
+	keys, err := NewStaticKeys("1", map[string][]byte{"1": bytes.Repeat([]byte{1}, 32)})
+	require.NoError(t, err)
+	useFieldEncryption(t, keys)
+
+	ctx := context.Background()
+	session, err := database.OpenSession()
+	require.NoError(t, err)
+	defer session.Close()
+
+	c := newContact(testUUID(t), 2, map[string]any{"eMail": "john@example.com", "phone": "123"})
+	require.NoError(t, session.ReplaceEntityByUUID(ctx, c, true))
+
+	progress, err := MigrateCollection(ctx, session, &contact{}, 10, nil, nil)
+	require.NoError(t, err)
+	require.EqualValues(t, 1, progress.Migrated)
+
+	stored := storedFields(t, session, c.UUID())
+	require.True(t, strings.HasPrefix(stored["eMail"].(string), "enc:"), "%v", stored["eMail"])
+	require.Equal(t, bson.A{"123"}, stored["phones"])
+}
@@ -1,6 +1,7 @@
 package datamodel
 
 import (
+	"context"
 	"testing"
 
 	"github.com/dchaykin/go-modules/database"
@@ -41,7 +42,7 @@ func TestReadDomainEntites(t *testing.T) {
 
 	offset := int64(0)
 
-	entities, err := database.ReadDomainEntities(session, &location{}, offset, 3)
+	entities, err := database.ReadDomainEntities(context.Background(), session, &location{}, offset, 3)
 	require.NoError(t, err)
 	require.EqualValues(t, 3, len(entities), "Expected to read 3 entities from the collection.")
 
@@ -49,14 +50,14 @@ func TestReadDomainEntites(t *testing.T) {
 
 	offset += int64(len(entities))
 
-	entities, err = database.ReadDomainEntities(session, &location{}, offset, 3)
+	entities, err = database.ReadDomainEntities(context.Background(), session, &location{}, offset, 3)
 	require.NoError(t, err)
 	require.Greater(t, len(entities), 0)
 	t.Logf("Found %d entities in the second transaction.", len(entities))
 
 	offset += int64(len(entities))
 
-	entities, err = database.ReadDomainEntities(session, &location{}, offset, 3)
+	entities, err = database.ReadDomainEntities(context.Background(), session, &location{}, offset, 3)
 	require.NoError(t, err)
 	require.EqualValues(t, 0, len(entities))
 	t.Logf("No records to read in the third transaction.")
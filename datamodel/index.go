@@ -0,0 +1,177 @@
+package datamodel
+
+import (
+	"context"
+	"fmt"
+	"slices"
+	"strings"
+
+	"github.com/dchaykin/go-modules/database"
+	"go.mongodb.org/mongo-driver/bson"
+)
+
+const textIndexName = "entity_text"
+
+// IndexDefinition declares an index over one or more fields in datamodel.json, e.g.
+//
+//	"indexes": [ { "fields": [ "partner", "-createdAt" ], "unique": true } ]
+//
+// The fields are paths relative to the entity root, a leading "-" sorts descending.
+type IndexDefinition struct {
+	Name   string   `json:"name,omitempty"`
+	Fields []string `json:"fields"`
+	Unique bool     `json:"unique,omitempty"`
+	TTL    *int32   `json:"ttl,omitempty"`
+}
+
+func (def IndexDefinition) spec() (database.IndexSpec, error) {
+	if len(def.Fields) == 0 {
+		return database.IndexSpec{}, fmt.Errorf("the index %s has no fields", def.Name)
+	}
+	result := database.IndexSpec{Name: def.Name, Unique: def.Unique, TTL: def.TTL}
+	for _, field := range def.Fields {
+		order := database.IndexAscending
+		if after, ok := strings.CutPrefix(field, "-"); ok {
+			field, order = after, database.IndexDescending
+		}
+		result.Keys = append(result.Keys, bson.E{Key: "entity." + field, Value: order})
+	}
+	return result, nil
+}
+
+// fieldIndex is the index declared by a single field. Allowed are
+//
+//	"index": true
+//	"index": "unique" | "text" | "desc"
+//	"index": { "unique": true, "order": -1, "ttl": 3600, "name": "..." }
+type fieldIndex struct {
+	name   string
+	order  int
+	unique bool
+	text   bool
+	ttl    *int32
+}
+
+func (cf CustomField) index() (*fieldIndex, error) {
+	value, ok := cf["index"]
+	if !ok || value == nil {
+		return nil, nil
+	}
+
+	result := &fieldIndex{order: database.IndexAscending}
+	switch v := value.(type) {
+	case bool:
+		if !v {
+			return nil, nil
+		}
+	case string:
+		switch v {
+		case "unique":
+			result.unique = true
+		case database.IndexText:
+			result.text = true
+		case "desc":
+			result.order = database.IndexDescending
+		default:
+			return nil, fmt.Errorf("unknown index type %s", v)
+		}
+	case map[string]any:
+		result.name, _ = v["name"].(string)
+		result.unique, _ = v["unique"].(bool)
+		result.text, _ = v["text"].(bool)
+		if order, ok := v["order"].(float64); ok && order < 0 {
+			result.order = database.IndexDescending
+		}
+		if ttl, ok := v["ttl"].(float64); ok {
+			seconds := int32(ttl)
+			result.ttl = &seconds
+		}
+	default:
+		return nil, fmt.Errorf("unexpected index declaration %T: %v", value, value)
+	}
+	return result, nil
+}
+
+// IndexSpecs returns the indexes declared in the datamodel: the indexes of the fields of the subject record,
+// including the records of its list fields, and the compound indexes. All text fields are combined into one
+// text index, since mongo supports only one per collection.
+func (tc TenantConfig) IndexSpecs() ([]database.IndexSpec, error) {
+	result := []database.IndexSpec{}
+	textKeys := []string{}
+
+	var walk func(recordName, prefix string, path []string) error
+	walk = func(recordName, prefix string, path []string) error {
+		record := tc.DataModel[recordName]
+		fieldNames := []string{}
+		for fieldName := range record {
+			fieldNames = append(fieldNames, fieldName)
+		}
+		slices.Sort(fieldNames)
+
+		for _, fieldName := range fieldNames {
+			field := record[fieldName]
+			fieldPath := prefix + fieldName
+
+			// list items are stored as records named like the list field
+			if _, ok := tc.DataModel[fieldName]; ok && field.Type() == FieldTypeList && !slices.Contains(path, fieldName) {
+				if err := walk(fieldName, fieldPath+".", append(path, fieldName)); err != nil {
+					return err
+				}
+			}
+
+			index, err := field.index()
+			if err != nil {
+				return fmt.Errorf("invalid index of the field %s.%s: %w", recordName, fieldName, err)
+			}
+			if index == nil {
+				continue
+			}
+			if index.text {
+				textKeys = append(textKeys, "entity."+fieldPath)
+				continue
+			}
+			result = append(result, database.IndexSpec{
+				Name:   index.name,
+				Keys:   bson.D{{Key: "entity." + fieldPath, Value: index.order}},
+				Unique: index.unique,
+				TTL:    index.ttl,
+			})
+		}
+		return nil
+	}
+
+	if _, ok := tc.DataModel[tc.Subject]; !ok {
+		return nil, fmt.Errorf("no record found for the subject %s", tc.Subject)
+	}
+	if err := walk(tc.Subject, "", []string{tc.Subject}); err != nil {
+		return nil, err
+	}
+
+	if len(textKeys) > 0 {
+		slices.Sort(textKeys)
+		spec := database.IndexSpec{Name: textIndexName}
+		for _, key := range textKeys {
+			spec.Keys = append(spec.Keys, bson.E{Key: key, Value: database.IndexText})
+		}
+		result = append(result, spec)
+	}
+
+	for _, def := range tc.Indexes {
+		spec, err := def.spec()
+		if err != nil {
+			return nil, err
+		}
+		result = append(result, spec)
+	}
+	return result, nil
+}
+
+// EnsureIndexes creates the indexes declared in the datamodel for the collection of domainEntity,
+// see database.EnsureIndexes
+func (tc TenantConfig) EnsureIndexes(ctx context.Context, session database.DatabaseSession, domainEntity database.DomainEntity, dropObsolete bool) (*database.IndexReport, error) {
+	specs, err := tc.IndexSpecs()
+	if err != nil {
+		return nil, err
+	}
+	return database.EnsureIndexes(ctx, session, domainEntity, specs, dropObsolete)
+}
@@ -0,0 +1,62 @@
+package datamodel
+
+import (
+	"encoding/json"
+	"testing"
+
+	"github.com/dchaykin/go-modules/database"
+	"github.com/stretchr/testify/require"
+	"go.mongodb.org/mongo-driver/bson"
+)
+
+const testIndexDatamodel = `{
+	"subject": "user",
+	"datamodel": {
+		"user": {
+			"uuid": {},
+			"username": { "index": "unique" },
+			"comment": { "index": "text" },
+			"createdAt": { "type": "datetime", "index": { "ttl": 3600, "order": -1 } },
+			"roles": { "type": "list" }
+		},
+		"roles": {
+			"name": { "index": true },
+			"description": { "index": "text" }
+		}
+	},
+	"indexes": [
+		{ "name": "partnerUser", "fields": [ "partner", "-username" ] }
+	]
+}`
+
+func TestIndexSpecs(t *testing.T) {
+	tc := TenantConfig{}
+	require.NoError(t, json.Unmarshal([]byte(testIndexDatamodel), &tc))
+
+	specs, err := tc.IndexSpecs()
+	require.NoError(t, err)
+
+	ttl := int32(3600)
+	require.Equal(t, []database.IndexSpec{
+		{Keys: bson.D{{Key: "entity.createdAt", Value: database.IndexDescending}}, TTL: &ttl},
+		{Keys: bson.D{{Key: "entity.roles.name", Value: database.IndexAscending}}},
+		{Keys: bson.D{{Key: "entity.username", Value: database.IndexAscending}}, Unique: true},
+		{Name: "entity_text", Keys: bson.D{{Key: "entity.comment", Value: "text"}, {Key: "entity.roles.description", Value: "text"}}},
+		{Name: "partnerUser", Keys: bson.D{{Key: "entity.partner", Value: 1}, {Key: "entity.username", Value: -1}}},
+	}, specs)
+
+	database.UseMemoryBackend()
+	defer database.SetBackend(nil)
+
+	session, err := database.OpenSession()
+	require.NoError(t, err)
+	defer session.Close()
+
+	report, err := tc.EnsureIndexes(t.Context(), session, &location{}, true)
+	require.NoError(t, err)
+	require.Len(t, report.Created, 6)
+
+	tc.DataModel["user"]["username"] = CustomField{"index": "bogus"}
+	_, err = tc.IndexSpecs()
+	require.EqualError(t, err, "invalid index of the field user.username: unknown index type bogus")
+}
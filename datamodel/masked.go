@@ -0,0 +1,337 @@
+package datamodel
+
+import (
+	"crypto/rand"
+	"crypto/subtle"
+	"encoding/base64"
+	"fmt"
+	"strings"
+	"sync"
+
+	"github.com/dchaykin/go-modules/database"
+	"golang.org/x/crypto/argon2"
+)
+
+// MaskedValue replaces the values of masked fields in everything sent to the clients. Sent back on save
+// it keeps the stored value, so the clients do not need to know the secrets.
+const MaskedValue = "********"
+
+// the argon2id parameters of new hashes, VerifyMaskedValue takes the parameters from the stored hash
+const (
+	hashPrefix  = "$argon2id$"
+	hashTime    = 2
+	hashMemory  = 19 * 1024
+	hashThreads = 1
+	hashLength  = 32
+)
+
+// MaskedStorage decides how the values of masked fields are stored
+type MaskedStorage int
+
+const (
+	// MaskedPlain stores the values as they are
+	MaskedPlain MaskedStorage = iota
+	// MaskedHashed stores an argon2id hash of the values, they can only be checked by VerifyMaskedValue
+	MaskedHashed
+)
+
+type masking struct {
+	tc      TenantConfig
+	storage MaskedStorage
+}
+
+var (
+	maskingMu       sync.RWMutex
+	maskingRegistry = map[string]masking{}
+)
+
+// RegisterMasking sets the datamodel defining the masked fields of the records stored in the collection
+func RegisterMasking(collectionName string, tc TenantConfig, storage MaskedStorage) {
+	maskingMu.Lock()
+	defer maskingMu.Unlock()
+	maskingRegistry[collectionName] = masking{tc: tc, storage: storage}
+}
+
+func getMasking(collectionName string) (masking, bool) {
+	maskingMu.RLock()
+	defer maskingMu.RUnlock()
+	result, ok := maskingRegistry[collectionName]
+	return result, ok
+}
+
+// RedactEntity returns a copy of the fields of the entity with the values of the masked fields replaced by MaskedValue
+func RedactEntity(domainEntity database.DomainEntity) map[string]any {
+	return RedactFields(domainEntity.CollectionName(), domainEntity.Entity())
+}
+
+// RedactFields returns a copy of the fields of a record of the collection, e.g. its overview row, with the values
+// of the masked fields replaced by MaskedValue. The fields are returned as they are if no masking is registered.
+func RedactFields(collectionName string, fields map[string]any) map[string]any {
+	m, ok := getMasking(collectionName)
+	if !ok {
+		return fields
+	}
+	return m.tc.RedactMasked(fields)
+}
+
+// RedactChanges replaces the values of masked fields in the changes of a record of the collection
+func RedactChanges(collectionName string, cs ChangeSet) ChangeSet {
+	m, ok := getMasking(collectionName)
+	if !ok {
+		return cs
+	}
+	return m.tc.RedactChanges(cs)
+}
+
+// KeepMaskedValues replaces MaskedValue in the masked fields of the incoming entity by the stored values.
+// stored is nil for new entities, then the fields are removed.
+func KeepMaskedValues(stored, incoming database.DomainEntity) {
+	m, ok := getMasking(incoming.CollectionName())
+	if !ok {
+		return
+	}
+	var storedFields map[string]any
+	if stored != nil {
+		storedFields = stored.Entity()
+	}
+	m.tc.KeepMasked(storedFields, incoming.Entity())
+}
+
+// ProtectMasked prepares the masked fields of the entity for storing as registered for its collection. The
+// stored entity, read within the save transaction, tells the kept hashes from new values, see HashMasked. It is
+// nil for new entities. hashed collects the hashes made by ProtectMasked, pass the same map to every attempt
+// of a retried transaction.
+func ProtectMasked(stored, domainEntity database.DomainEntity, hashed map[string]bool) error {
+	m, ok := getMasking(domainEntity.CollectionName())
+	if !ok || m.storage == MaskedPlain {
+		return nil
+	}
+
+	var storedFields map[string]any
+	if stored != nil {
+		storedFields = stored.Entity()
+	}
+	return m.tc.HashMasked(storedFields, domainEntity.Entity(), hashed)
+}
+
+// RedactMasked returns a copy of the fields of the subject with the values of the masked fields replaced by MaskedValue
+func (tc TenantConfig) RedactMasked(fields map[string]any) map[string]any {
+	if fields == nil {
+		return nil
+	}
+	result, _ := tc.mapMasked(tc.Subject, fields, redactMasked)
+	return result
+}
+
+// HashMasked replaces the values of the masked fields by hashes. Only the hashes found in the masked fields
+// of the stored entity, e.g. restored by KeepMasked, and in hashed are kept, every other value is hashed, even
+// if it looks like a hash. The new hashes are added to hashed unless it is nil, so that a retried save does
+// not hash them again.
+func (tc TenantConfig) HashMasked(stored, fields map[string]any, hashed map[string]bool) error {
+	storedHashes := map[string]bool{}
+	_, _ = tc.mapMasked(tc.Subject, stored, func(value any) (any, error) {
+		storedHashes[fmt.Sprintf("%v", value)] = true
+		return value, nil
+	})
+
+	result, err := tc.mapMasked(tc.Subject, fields, func(value any) (any, error) {
+		text := fmt.Sprintf("%v", value)
+		if storedHashes[text] || hashed[text] {
+			return text, nil
+		}
+		hash, err := hashMaskedValue(text)
+		if err == nil && hashed != nil {
+			hashed[hash] = true
+		}
+		return hash, err
+	})
+	if err != nil {
+		return fmt.Errorf("unable to hash the masked fields: %w", err)
+	}
+	for key, value := range result {
+		fields[key] = value
+	}
+	return nil
+}
+
+// KeepMasked replaces MaskedValue in the masked fields of the incoming entity by the stored values, fields
+// without a stored value are removed
+func (tc TenantConfig) KeepMasked(stored, incoming map[string]any) {
+	tc.walkPairs("", tc.Subject, stored, incoming, func(path, fieldName string, field CustomField, stored, incoming map[string]any) bool {
+		if !field.IsMasked() {
+			return true
+		}
+		if incoming[fieldName] == MaskedValue {
+			restoreValue(incoming, fieldName, stored[fieldName])
+		}
+		return false
+	})
+	tc.dropMaskedValues(tc.Subject, incoming)
+}
+
+// dropMaskedValues removes MaskedValue left in records which have not been stored before, e.g. new list items
+func (tc TenantConfig) dropMaskedValues(recordName string, fields map[string]any) {
+	for fieldName, field := range tc.DataModel[recordName] {
+		value := fields[fieldName]
+		if field.IsMasked() {
+			if value == MaskedValue {
+				delete(fields, fieldName)
+			}
+			continue
+		}
+		if _, isRecord := tc.DataModel[fieldName]; !isRecord {
+			continue
+		}
+		if m, ok := asMap(value); ok {
+			tc.dropMaskedValues(fieldName, m)
+		} else if list, ok := asList(value); ok {
+			for _, item := range list {
+				if m, ok := asMap(item); ok {
+					tc.dropMaskedValues(fieldName, m)
+				}
+			}
+		}
+	}
+}
+
+// RedactChanges returns the changes with the values of masked fields replaced by MaskedValue
+func (tc TenantConfig) RedactChanges(cs ChangeSet) ChangeSet {
+	result := make(ChangeSet, 0, len(cs))
+	for _, change := range cs {
+		recordName, masked := tc.Subject, false
+		for _, segment := range strings.Split(change.Path, ".") {
+			fieldName, _, _ := strings.Cut(segment, "[")
+			field, ok := tc.DataModel[recordName][fieldName]
+			if !ok {
+				break
+			}
+			if field.IsMasked() {
+				masked = true
+				break
+			}
+			recordName = fieldName
+		}
+
+		if masked {
+			change.OldValue = redactValue(change.OldValue)
+			change.NewValue = redactValue(change.NewValue)
+		} else if _, isRecord := tc.DataModel[recordName]; isRecord {
+			change.OldValue = tc.redactNested(recordName, change.OldValue)
+			change.NewValue = tc.redactNested(recordName, change.NewValue)
+		}
+		result = append(result, change)
+	}
+	return result
+}
+
+func (tc TenantConfig) redactNested(recordName string, value any) any {
+	if m, ok := asMap(value); ok {
+		result, _ := tc.mapMasked(recordName, m, redactMasked)
+		return result
+	}
+	if list, ok := asList(value); ok {
+		result := make([]any, 0, len(list))
+		for _, item := range list {
+			result = append(result, tc.redactNested(recordName, item))
+		}
+		return result
+	}
+	return value
+}
+
+func redactValue(value any) any {
+	if isEmptyValue(value) {
+		return value
+	}
+	return MaskedValue
+}
+
+// mapMasked returns a copy of the fields of the record with the non-empty values of the masked fields
+// replaced by f, nested records and list items included
+func (tc TenantConfig) mapMasked(recordName string, fields map[string]any, f func(value any) (any, error)) (map[string]any, error) {
+	config := tc.DataModel[recordName]
+	result := make(map[string]any, len(fields))
+	for fieldName, value := range fields {
+		field, ok := config[fieldName]
+		if !ok || isEmptyValue(value) {
+			result[fieldName] = value
+			continue
+		}
+
+		var err error
+		if field.IsMasked() {
+			if result[fieldName], err = f(value); err != nil {
+				return nil, err
+			}
+			continue
+		}
+
+		if _, isRecord := tc.DataModel[fieldName]; !isRecord {
+			result[fieldName] = value
+			continue
+		}
+		if m, ok := asMap(value); ok {
+			if value, err = tc.mapMasked(fieldName, m, f); err != nil {
+				return nil, err
+			}
+		} else if list, ok := asList(value); ok {
+			items := make([]any, 0, len(list))
+			for _, item := range list {
+				if m, ok := asMap(item); ok {
+					if item, err = tc.mapMasked(fieldName, m, f); err != nil {
+						return nil, err
+					}
+				}
+				items = append(items, item)
+			}
+			value = items
+		}
+		result[fieldName] = value
+	}
+	return result, nil
+}
+
+func redactMasked(value any) (any, error) {
+	return MaskedValue, nil
+}
+
+func hashMaskedValue(value string) (string, error) {
+	salt := make([]byte, 16)
+	if _, err := rand.Read(salt); err != nil {
+		return "", err
+	}
+	hash := argon2.IDKey([]byte(value), salt, hashTime, hashMemory, hashThreads, hashLength)
+	return fmt.Sprintf("%sv=%d$m=%d,t=%d,p=%d$%s$%s", hashPrefix, argon2.Version, hashMemory, hashTime, hashThreads,
+		base64.RawStdEncoding.EncodeToString(salt), base64.RawStdEncoding.EncodeToString(hash)), nil
+}
+
+func isMaskedHash(value string) bool {
+	return strings.HasPrefix(value, hashPrefix)
+}
+
+// VerifyMaskedValue reports whether value is the plain value of a masked field stored as hash
+func VerifyMaskedValue(stored, value string) bool {
+	parts := strings.Split(strings.TrimPrefix(stored, hashPrefix), "$")
+	if !isMaskedHash(stored) || len(parts) != 4 {
+		return false
+	}
+
+	var version int
+	var memory, time uint32
+	var threads uint8
+	if _, err := fmt.Sscanf(parts[0], "v=%d", &version); err != nil || version != argon2.Version {
+		return false
+	}
+	if _, err := fmt.Sscanf(parts[1], "m=%d,t=%d,p=%d", &memory, &time, &threads); err != nil || time == 0 || threads == 0 {
+		return false
+	}
+	salt, err := base64.RawStdEncoding.DecodeString(parts[2])
+	if err != nil {
+		return false
+	}
+	hash, err := base64.RawStdEncoding.DecodeString(parts[3])
+	if err != nil || len(hash) == 0 {
+		return false
+	}
+	return subtle.ConstantTimeCompare(hash, argon2.IDKey([]byte(value), salt, time, memory, threads, uint32(len(hash)))) == 1
+}
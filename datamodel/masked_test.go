@@ -0,0 +1,120 @@
+package datamodel
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func maskedTenantConfig() TenantConfig {
+	return TenantConfig{
+		Subject: "user",
+		DataModel: map[string]CustomFields{
+			"user": {
+				"uuid":     {},
+				"username": {},
+				"password": {"masked": true},
+				"roles":    {"type": FieldTypeList},
+			},
+			"roles": {
+				"name":   {},
+				"apiKey": {"masked": true},
+			},
+		},
+	}
+}
+
+func TestRedactMasked(t *testing.T) {
+	tc := maskedTenantConfig()
+	fields := map[string]any{
+		"username": "jdoe",
+		"password": "secret",
+		"roles": []any{
+			map[string]any{"name": "user", "apiKey": "k1"},
+			map[string]any{"name": "inquiry", "apiKey": ""},
+		},
+	}
+
+	redacted := tc.RedactMasked(fields)
+	require.Equal(t, map[string]any{
+		"username": "jdoe",
+		"password": MaskedValue,
+		"roles": []any{
+			map[string]any{"name": "user", "apiKey": MaskedValue},
+			map[string]any{"name": "inquiry", "apiKey": ""},
+		},
+	}, redacted)
+	require.Equal(t, "secret", fields["password"])
+	require.Equal(t, "k1", fields["roles"].([]any)[0].(map[string]any)["apiKey"])
+
+	changes := tc.RedactChanges(DiffFields(map[string]any{"password": "old", "roles": []any{}}, fields))
+	require.Equal(t, ChangeSet{
+		{Op: ChangeModified, Path: "password", OldValue: MaskedValue, NewValue: MaskedValue},
+		{Op: ChangeAdded, Path: "roles[0]", NewValue: map[string]any{"name": "user", "apiKey": MaskedValue}},
+		{Op: ChangeAdded, Path: "roles[1]", NewValue: map[string]any{"name": "inquiry", "apiKey": ""}},
+		{Op: ChangeAdded, Path: "username", NewValue: "jdoe"},
+	}, changes)
+}
+
+func TestKeepMasked(t *testing.T) {
+	tc := maskedTenantConfig()
+	stored := map[string]any{
+		"password": "secret",
+		"roles":    []any{map[string]any{"uuid": "r1", "name": "user", "apiKey": "k1"}},
+	}
+	incoming := map[string]any{
+		"password": MaskedValue,
+		"roles": []any{
+			map[string]any{"uuid": "r2", "name": "inquiry", "apiKey": MaskedValue},
+			map[string]any{"uuid": "r1", "name": "user", "apiKey": MaskedValue},
+		},
+	}
+
+	tc.KeepMasked(stored, incoming)
+	require.Equal(t, map[string]any{
+		"password": "secret",
+		"roles": []any{
+			map[string]any{"uuid": "r2", "name": "inquiry"},
+			map[string]any{"uuid": "r1", "name": "user", "apiKey": "k1"},
+		},
+	}, incoming)
+
+	incoming = map[string]any{"password": MaskedValue}
+	tc.KeepMasked(nil, incoming)
+	require.Empty(t, incoming)
+}
+
+func TestHashMasked(t *testing.T) {
+	tc := maskedTenantConfig()
+	fields := map[string]any{"username": "jdoe", "password": "secret"}
+
+	require.NoError(t, tc.HashMasked(nil, fields, nil))
+	hash := fields["password"].(string)
+	require.True(t, strings.HasPrefix(hash, "$argon2id$v=19$"))
+	require.True(t, VerifyMaskedValue(hash, "secret"))
+	require.False(t, VerifyMaskedValue(hash, "Secret"))
+	require.False(t, VerifyMaskedValue("secret", "secret"))
+	require.Equal(t, "jdoe", fields["username"])
+
+	// stored hashes are not hashed again
+	stored := map[string]any{"password": hash}
+	require.NoError(t, tc.HashMasked(stored, fields, nil))
+	require.Equal(t, hash, fields["password"])
+
+	// a hash chosen by the client is hashed like any other value
+	chosen := map[string]any{"password": hash}
+	require.NoError(t, tc.HashMasked(nil, chosen, nil))
+	require.NotEqual(t, hash, chosen["password"])
+	require.True(t, VerifyMaskedValue(chosen["password"].(string), hash))
+	require.False(t, VerifyMaskedValue(chosen["password"].(string), "secret"))
+
+	// the hashes made by an earlier attempt of the same save are kept
+	hashed := map[string]bool{}
+	retried := map[string]any{"password": "secret"}
+	require.NoError(t, tc.HashMasked(nil, retried, hashed))
+	first := retried["password"]
+	require.NoError(t, tc.HashMasked(nil, retried, hashed))
+	require.Equal(t, first, retried["password"])
+	require.True(t, VerifyMaskedValue(retried["password"].(string), "secret"))
+}
@@ -0,0 +1,276 @@
+package datamodel
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/dchaykin/go-modules/database"
+	"github.com/dchaykin/mygolib/log"
+	"go.mongodb.org/mongo-driver/bson"
+)
+
+// MigrationFunc upgrades the fields of a record from one datamodel version to the next one
+type MigrationFunc func(ctx context.Context, fields map[string]any) error
+
+// SchemaVersioned is implemented by entities stamped with the version of the datamodel they were written with
+type SchemaVersioned interface {
+	SchemaVersion() int
+	SetSchemaVersion(version int)
+}
+
+type schema struct {
+	version    int
+	migrations map[int]MigrationFunc
+}
+
+var (
+	schemaMu       sync.RWMutex
+	schemaRegistry = map[string]*schema{}
+)
+
+func getSchema(collectionName string) *schema {
+	result, ok := schemaRegistry[collectionName]
+	if !ok {
+		result = &schema{migrations: map[int]MigrationFunc{}}
+		schemaRegistry[collectionName] = result
+	}
+	return result
+}
+
+// RegisterSchemaVersion sets the current datamodel version of the records stored in the collection
+func RegisterSchemaVersion(collectionName string, version int) {
+	schemaMu.Lock()
+	defer schemaMu.Unlock()
+	getSchema(collectionName).version = version
+}
+
+// RegisterSchemaVersion sets the version of the datamodel as the current one of the domain entity's collection
+func (tc TenantConfig) RegisterSchemaVersion(domainEntity database.DomainEntity) {
+	RegisterSchemaVersion(domainEntity.CollectionName(), tc.Version)
+}
+
+// RegisterMigration registers the upgrade of the records of a collection from fromVersion to fromVersion+1
+func RegisterMigration(collectionName string, fromVersion int, f MigrationFunc) {
+	schemaMu.Lock()
+	defer schemaMu.Unlock()
+	getSchema(collectionName).migrations[fromVersion] = f
+}
+
+// CurrentSchemaVersion returns 0 if no version has been registered for the collection
+func CurrentSchemaVersion(collectionName string) int {
+	schemaMu.RLock()
+	defer schemaMu.RUnlock()
+	if s, ok := schemaRegistry[collectionName]; ok {
+		return s.version
+	}
+	return 0
+}
+
+// StampSchemaVersion sets the current datamodel version on the entity before it is saved
+func StampSchemaVersion(domainEntity database.DomainEntity) {
+	versioned, ok := domainEntity.(SchemaVersioned)
+	if !ok {
+		return
+	}
+	if version := CurrentSchemaVersion(domainEntity.CollectionName()); version > 0 {
+		versioned.SetSchemaVersion(version)
+	}
+}
+
+// migrationSteps returns the migrations needed to upgrade a record written with version to the current version.
+// Records stored before the stamping has been introduced have no version. They are assumed to be of the oldest
+// version a migration has been registered for.
+func migrationSteps(collectionName string, version int) ([]MigrationFunc, int, error) {
+	schemaMu.RLock()
+	defer schemaMu.RUnlock()
+
+	s, ok := schemaRegistry[collectionName]
+	if !ok || s.version == 0 || version >= s.version {
+		return nil, version, nil
+	}
+
+	if version == 0 {
+		version = s.version
+		for from := range s.migrations {
+			version = min(version, from)
+		}
+	}
+
+	result := []MigrationFunc{}
+	for v := version; v < s.version; v++ {
+		f, ok := s.migrations[v]
+		if !ok {
+			return nil, version, fmt.Errorf("no migration of %s from version %d to %d registered", collectionName, v, v+1)
+		}
+		result = append(result, f)
+	}
+	return result, s.version, nil
+}
+
+// UpgradeEntity migrates the fields of the entity to the current datamodel version.
+// It returns true if the entity has been changed and must be saved.
+func UpgradeEntity(ctx context.Context, domainEntity database.DomainEntity) (bool, error) {
+	versioned, ok := domainEntity.(SchemaVersioned)
+	if !ok {
+		return false, nil
+	}
+
+	steps, target, err := migrationSteps(domainEntity.CollectionName(), versioned.SchemaVersion())
+	if err != nil || target == versioned.SchemaVersion() {
+		return false, err
+	}
+
+	fields := domainEntity.Entity()
+	if fields == nil {
+		fields = map[string]any{}
+	}
+	for _, step := range steps {
+		if err = step(ctx, fields); err != nil {
+			return false, fmt.Errorf("could not migrate the record with UUID %s: %w", domainEntity.UUID(), err)
+		}
+	}
+	for key, value := range fields {
+		domainEntity.SetValue(key, value)
+	}
+	versioned.SetSchemaVersion(target)
+	return true, nil
+}
+
+// LoadEntity reads the entity and upgrades it to the current datamodel version, if it has not been migrated yet.
+// The upgraded entity is stored with the next save.
+func LoadEntity(ctx context.Context, session database.DatabaseSession, uuid string, domainEntity database.DomainEntity) (bool, error) {
+	found, err := session.GetEntityByUUID(ctx, uuid, domainEntity)
+	if err != nil || !found {
+		return found, err
+	}
+	_, err = UpgradeEntity(ctx, domainEntity)
+	return true, err
+}
+
+// maxListedFailures limits the uuids listed in MigrationProgress.Failed, the progress is stored after every batch
+const maxListedFailures = 100
+
+// MigrationProgress is stored in the collection "<collection>-migration" after every batch, so that
+// an interrupted migration continues where it stopped
+type MigrationProgress struct {
+	Collection    string `bson:"collection" json:"collection"`
+	TargetVersion int    `bson:"targetVersion" json:"targetVersion"`
+	Token         string `bson:"token" json:"-"`
+	Total         int64  `bson:"total" json:"total"`
+	Processed     int64  `bson:"processed" json:"processed"`
+	Migrated      int64  `bson:"migrated" json:"migrated"`
+	FailedCount   int64  `bson:"failedCount" json:"failedCount"`
+	// Failed lists the uuids of the first 100 failed records, the failures are logged as well
+	Failed    []string  `bson:"failed" json:"failed"`
+	Done      bool      `bson:"done" json:"done"`
+	UpdatedAt time.Time `bson:"updatedAt" json:"updatedAt"`
+}
+
+type OnMigrationProgress func(progress MigrationProgress)
+
+// OnMigratedEntity is called within the transaction storing a migrated entity, e.g. overview.EnqueueUpdate
+type OnMigratedEntity func(ctx context.Context, tx database.DatabaseSession, domainEntity database.DomainEntity) error
+
+// MigrateCollection rewrites all records of the domain entity's collection which have not been migrated to the
+// current datamodel version yet, batchSize records at a time. The records are rewritten without a new version or
+// revision and onMigrated, if set, is called for each of them. A record changed in the meantime is skipped, since
+// its save has already stamped it with the current version. Records failing to migrate or to save are counted in
+// MigrationProgress.FailedCount and skipped.
+func MigrateCollection(ctx context.Context, session database.DatabaseSession, domainEntity database.DomainEntity, batchSize int64, onProgress OnMigrationProgress, onMigrated OnMigratedEntity) (*MigrationProgress, error) {
+	collectionName := domainEntity.CollectionName()
+	target := CurrentSchemaVersion(collectionName)
+	if target == 0 {
+		return nil, fmt.Errorf("no datamodel version registered for %s", collectionName)
+	}
+
+	progressColl := session.GetCollection(domainEntity.DatabaseName(), collectionName+"-migration")
+	progress := &MigrationProgress{}
+	found, err := session.FindOne(ctx, progressColl, bson.M{"collection": collectionName}, progress)
+	if err != nil {
+		return nil, err
+	}
+	if !found || progress.TargetVersion != target || progress.Done {
+		progress = &MigrationProgress{Collection: collectionName, TargetVersion: target, Failed: []string{}}
+	}
+
+	query := database.NewQuery(database.Or(
+		database.Lt(database.Root("metadata.schemaVersion"), target),
+		database.Exists(database.Root("metadata.schemaVersion"), false),
+	))
+
+	for {
+		page, err := database.ReadDomainEntityPage(ctx, session, domainEntity, query, progress.Token, batchSize, progress.Token == "")
+		if err != nil {
+			return progress, err
+		}
+		if page.Total != nil {
+			progress.Total = *page.Total
+		}
+
+		for _, entity := range page.Entities {
+			progress.Processed++
+			migrated, err := migrateEntity(ctx, session, entity, onMigrated)
+			if err != nil {
+				log.Warn("%v", err)
+				progress.FailedCount++
+				if len(progress.Failed) < maxListedFailures {
+					progress.Failed = append(progress.Failed, entity.UUID())
+				}
+				continue
+			}
+			if migrated {
+				progress.Migrated++
+			}
+		}
+
+		progress.Token = page.NextToken
+		progress.Done = page.NextToken == ""
+		progress.UpdatedAt = time.Now()
+		if err = session.ReplaceOne(ctx, progressColl, bson.M{"collection": collectionName}, progress, true); err != nil {
+			return progress, err
+		}
+		if onProgress != nil {
+			onProgress(*progress)
+		}
+
+		if progress.Done {
+			return progress, nil
+		}
+	}
+}
+
+func migrateEntity(ctx context.Context, session database.DatabaseSession, entity database.DomainEntity, onMigrated OnMigratedEntity) (bool, error) {
+	changed, err := UpgradeEntity(ctx, entity)
+	if err != nil {
+		return false, err
+	}
+	if !changed {
+		// a record without version and without migrations is just stamped
+		StampSchemaVersion(entity)
+	}
+	var metadata bson.M
+	if versioned, ok := entity.(SchemaVersioned); ok {
+		metadata = bson.M{"schemaVersion": versioned.SchemaVersion()}
+	}
+
+	rewritten := false
+	err = session.WithTransaction(ctx, func(ctx context.Context, tx database.DatabaseSession) error {
+		err := database.WithEncodedFields(entity, func() (err error) {
+			rewritten, err = database.RewriteEntity(ctx, tx, entity, metadata)
+			return err
+		})
+		if err != nil || !rewritten || onMigrated == nil {
+			return err
+		}
+		return onMigrated(ctx, tx, entity)
+	})
+	if err != nil {
+		return false, fmt.Errorf("could not save the migrated record with UUID %s: %w", entity.UUID(), err)
+	}
+	if !rewritten {
+		log.Info("The record %s has been changed during the migration and is skipped", entity.UUID())
+	}
+	return rewritten, nil
+}
@@ -0,0 +1,197 @@
+package datamodel
+
+import (
+	"context"
+	"fmt"
+	"testing"
+
+	"github.com/dchaykin/go-modules/database"
+	"github.com/stretchr/testify/require"
+	"go.mongodb.org/mongo-driver/bson"
+)
+
+type contact struct {
+	Record `bson:",inline"`
+}
+
+func (c contact) CollectionName() string {
+	return "contact"
+}
+
+func (c contact) DatabaseName() string {
+	return "migrationTest"
+}
+
+func (c contact) CreateEmpty() database.DomainEntity {
+	return &contact{}
+}
+
+func (c *contact) GetAccessConfig() []database.AccessConfig {
+	return nil
+}
+
+func (c *contact) OverviewRow() map[string]any {
+	return c.Fields
+}
+
+func registerContactMigrations(t *testing.T) {
+	t.Cleanup(func() {
+		schemaMu.Lock()
+		defer schemaMu.Unlock()
+		delete(schemaRegistry, "contact")
+	})
+
+	TenantConfig{Version: 3}.RegisterSchemaVersion(&contact{})
+
+	// v1 -> v2: name is split into first and last name
+	RegisterMigration("contact", 1, func(ctx context.Context, fields map[string]any) error {
+		name, _ := fields["name"].(string)
+		if name == "broken" {
+			return fmt.Errorf("cannot split %s", name)
+		}
+		var first, last string
+		fmt.Sscanf(name, "%s %s", &first, &last)
+		fields["firstName"], fields["lastName"] = first, last
+		delete(fields, "name")
+		return nil
+	})
+	// v2 -> v3: phone becomes a list
+	RegisterMigration("contact", 2, func(ctx context.Context, fields map[string]any) error {
+		if phone, ok := fields["phone"]; ok {
+			fields["phones"] = []any{phone}
+			delete(fields, "phone")
+		}
+		return nil
+	})
+}
+
+func newContact(uuid string, schemaVersion int, fields map[string]any) *contact {
+	result := &contact{}
+	result.Fields = fields
+	result.Fields["uuid"] = uuid
+	result.Metadata.SchemaVersion = schemaVersion
+	return result
+}
+
+func TestUpgradeEntity(t *testing.T) {
+	registerContactMigrations(t)
+	ctx := context.Background()
+
+	c := newContact("1", 1, map[string]any{"name": "John Doe", "phone": "123"})
+	changed, err := UpgradeEntity(ctx, c)
+	require.NoError(t, err)
+	require.True(t, changed)
+	require.EqualValues(t, 3, c.SchemaVersion())
+	require.Equal(t, map[string]any{"uuid": "1", "firstName": "John", "lastName": "Doe", "phones": []any{"123"}}, c.Fields)
+
+	changed, err = UpgradeEntity(ctx, c)
+	require.NoError(t, err)
+	require.False(t, changed)
+
+	// records without version start with the oldest migration
+	c = newContact("2", 0, map[string]any{"name": "Jane Roe"})
+	changed, err = UpgradeEntity(ctx, c)
+	require.NoError(t, err)
+	require.True(t, changed)
+	require.Equal(t, "Jane", c.Fields["firstName"])
+
+	c = newContact("3", 2, map[string]any{"phone": "456"})
+	_, err = UpgradeEntity(ctx, c)
+	require.NoError(t, err)
+	require.Equal(t, []any{"456"}, c.Fields["phones"])
+
+	RegisterSchemaVersion("contact", 4)
+	c = newContact("4", 3, map[string]any{})
+	_, err = UpgradeEntity(ctx, c)
+	require.ErrorContains(t, err, "no migration of contact from version 3 to 4 registered")
+	require.EqualValues(t, 3, c.SchemaVersion())
+}
+
+func TestStampSchemaVersion(t *testing.T) {
+	c := newContact("1", 0, map[string]any{})
+	StampSchemaVersion(c)
+	require.EqualValues(t, 0, c.SchemaVersion())
+
+	registerContactMigrations(t)
+	StampSchemaVersion(c)
+	require.EqualValues(t, 3, c.SchemaVersion())
+}
+
+func TestMigrateCollection(t *testing.T) {
+	database.UseMemoryBackend()
+	t.Cleanup(func() { database.SetBackend(nil) })
+	registerContactMigrations(t)
+
+	ctx := context.Background()
+	session, err := database.OpenSession()
+	require.NoError(t, err)
+	defer session.Close()
+
+	contacts := []*contact{
+		newContact("1", 1, map[string]any{"name": "John Doe"}),
+		newContact("2", 0, map[string]any{"name": "broken"}),
+		newContact("3", 2, map[string]any{"phone": "123"}),
+		newContact("4", 3, map[string]any{"phones": []any{"456"}}),
+		newContact("5", 1, map[string]any{"name": "Jane Roe", "phone": "789"}),
+	}
+	for _, c := range contacts {
+		require.NoError(t, session.ReplaceEntityByUUID(ctx, c, true))
+	}
+
+	// the migration stops after the first batch and continues where it stopped
+	migrated := []string{}
+	onMigrated := func(ctx context.Context, tx database.DatabaseSession, domainEntity database.DomainEntity) error {
+		migrated = append(migrated, domainEntity.UUID())
+		return nil
+	}
+	canceled, cancel := context.WithCancel(ctx)
+	batches := 0
+	progress, err := MigrateCollection(canceled, session, &contact{}, 2, func(progress MigrationProgress) {
+		batches++
+		cancel()
+	}, onMigrated)
+	require.Error(t, err)
+	require.Equal(t, 1, batches)
+	require.EqualValues(t, 4, progress.Total)
+	require.EqualValues(t, 2, progress.Processed)
+	require.NotEmpty(t, progress.Token)
+
+	progressList := []MigrationProgress{}
+	progress, err = MigrateCollection(ctx, session, &contact{}, 2, func(progress MigrationProgress) {
+		progressList = append(progressList, progress)
+	}, onMigrated)
+	require.NoError(t, err)
+	require.Len(t, progressList, 1)
+	require.True(t, progress.Done)
+	require.EqualValues(t, 4, progress.Processed)
+	require.EqualValues(t, 3, progress.Migrated)
+	require.EqualValues(t, 1, progress.FailedCount)
+	require.Equal(t, []string{"2"}, progress.Failed)
+	require.ElementsMatch(t, []string{"1", "3", "5"}, migrated)
+
+	// the records are migrated without a new version or revision
+	c := &contact{}
+	found, err := session.GetEntityByUUID(ctx, "5", c)
+	require.NoError(t, err)
+	require.True(t, found)
+	require.EqualValues(t, 3, c.SchemaVersion())
+	require.Equal(t, "Roe", c.Fields["lastName"])
+	require.Equal(t, bson.A{"789"}, c.Fields["phones"])
+	require.EqualValues(t, 1, c.Version())
+	revisions, err := database.ListRevisions(ctx, session, "5", c)
+	require.NoError(t, err)
+	require.Len(t, revisions, 1)
+
+	// the failed record keeps its version and reading it reports the migration error
+	c = &contact{}
+	found, err = LoadEntity(ctx, session, "2", c)
+	require.Error(t, err)
+	require.True(t, found)
+	require.EqualValues(t, 0, c.SchemaVersion())
+
+	// a finished migration starts from scratch with the remaining records
+	progress, err = MigrateCollection(ctx, session, &contact{}, 10, nil, nil)
+	require.NoError(t, err)
+	require.EqualValues(t, 1, progress.Total)
+	require.Equal(t, []string{"2"}, progress.Failed)
+}
@@ -0,0 +1,190 @@
+package datamodel
+
+import "fmt"
+
+const FieldErrorReadonly = "readonly"
+
+// ReadonlyChanges returns the readonly fields whose values differ between the stored and the incoming
+// entity of the subject. The tenant config should be loaded for the role of the user.
+func (tc TenantConfig) ReadonlyChanges(stored, incoming map[string]any) []FieldError {
+	return tc.readonly(stored, incoming, false)
+}
+
+// RestoreReadonly sets the readonly fields of the incoming entity back to the stored values and returns
+// the fields which have been restored
+func (tc TenantConfig) RestoreReadonly(stored, incoming map[string]any) []FieldError {
+	return tc.readonly(stored, incoming, true)
+}
+
+func (tc TenantConfig) readonly(stored, incoming map[string]any, restore bool) []FieldError {
+	result := []FieldError{}
+	tc.walkPairs("", tc.Subject, stored, incoming, func(path, fieldName string, field CustomField, stored, incoming map[string]any) bool {
+		if !field.IsReadonly() {
+			if _, isRecord := tc.DataModel[fieldName]; isRecord && field.Type() == FieldTypeList {
+				result = append(result, tc.readonlyItems(path, fieldName, stored, incoming, restore)...)
+			}
+			return true
+		}
+		if isChanged(stored[fieldName], incoming[fieldName]) {
+			result = append(result, FieldError{Path: path, Code: FieldErrorReadonly, Message: fmt.Sprintf("the field %s is readonly", fieldName)})
+			if restore {
+				restoreValue(incoming, fieldName, stored[fieldName])
+			}
+		}
+		return false
+	})
+	return result
+}
+
+// readonlyItems reports list items with readonly values which have been added or removed. Restoring drops
+// the added items and appends the removed ones again.
+func (tc TenantConfig) readonlyItems(path, fieldName string, stored, incoming map[string]any, restore bool) []FieldError {
+	storedList, _ := asList(stored[fieldName])
+	incomingList, _ := asList(incoming[fieldName])
+	pairs, byUUID := pairItems(storedList, incomingList)
+
+	result := []FieldError{}
+	kept := make([]any, 0, len(incomingList))
+	paired := map[int]bool{}
+	for i, item := range incomingList {
+		if pairs[i] >= 0 {
+			paired[pairs[i]] = true
+		} else if tc.hasReadonlyValues(fieldName, item) {
+			result = append(result, FieldError{Path: itemPath(path, incomingList, i, byUUID), Code: FieldErrorReadonly, Message: fmt.Sprintf("the added item of %s has readonly fields", fieldName)})
+			continue
+		}
+		kept = append(kept, item)
+	}
+	for i, item := range storedList {
+		if !paired[i] && tc.hasReadonlyValues(fieldName, item) {
+			result = append(result, FieldError{Path: itemPath(path, storedList, i, byUUID), Code: FieldErrorReadonly, Message: fmt.Sprintf("the removed item of %s has readonly fields", fieldName)})
+			kept = append(kept, item)
+		}
+	}
+
+	if restore && len(result) > 0 {
+		incoming[fieldName] = kept
+	}
+	return result
+}
+
+// hasReadonlyValues reports whether a record has a non-empty readonly field, nested records included
+func (tc TenantConfig) hasReadonlyValues(recordName string, value any) bool {
+	fields, ok := asMap(value)
+	if !ok {
+		return false
+	}
+	for fieldName, field := range tc.DataModel[recordName] {
+		value := fields[fieldName]
+		if isEmptyValue(value) {
+			continue
+		}
+		if field.IsReadonly() {
+			return true
+		}
+		if _, isRecord := tc.DataModel[fieldName]; !isRecord {
+			continue
+		}
+		if tc.hasReadonlyValues(fieldName, value) {
+			return true
+		}
+		if list, ok := asList(value); ok {
+			for _, item := range list {
+				if tc.hasReadonlyValues(fieldName, item) {
+					return true
+				}
+			}
+		}
+	}
+	return false
+}
+
+// fieldPairVisitor is called for every field of a record with the stored and the incoming version of the
+// record, it returns false if nested records and list items of the field should be skipped
+type fieldPairVisitor func(path, fieldName string, field CustomField, stored, incoming map[string]any) bool
+
+// walkPairs visits the fields of the stored and the incoming entity. List items present in both are
+// matched by pairItems, added and removed items are not visited.
+func (tc TenantConfig) walkPairs(prefix, recordName string, stored, incoming map[string]any, visit fieldPairVisitor) {
+	config := tc.DataModel[recordName]
+	for _, fieldName := range sortedKeys(config) {
+		path := prefix + fieldName
+		if !visit(path, fieldName, config[fieldName], stored, incoming) {
+			continue
+		}
+
+		if _, isRecord := tc.DataModel[fieldName]; !isRecord {
+			continue
+		}
+		storedValue, incomingValue := stored[fieldName], incoming[fieldName]
+		if storedMap, ok := asMap(storedValue); ok {
+			if incomingMap, ok := asMap(incomingValue); ok {
+				tc.walkPairs(path+".", fieldName, storedMap, incomingMap, visit)
+				continue
+			}
+		}
+		if storedList, ok := asList(storedValue); ok {
+			if incomingList, ok := asList(incomingValue); ok {
+				tc.walkListPairs(path, fieldName, storedList, incomingList, visit)
+			}
+		}
+	}
+}
+
+func (tc TenantConfig) walkListPairs(path, recordName string, stored, incoming []any, visit fieldPairVisitor) {
+	pairs, byUUID := pairItems(stored, incoming)
+	for i, item := range incoming {
+		incomingItem, ok := asMap(item)
+		if !ok || pairs[i] < 0 {
+			continue
+		}
+		if storedMap, ok := asMap(stored[pairs[i]]); ok {
+			tc.walkPairs(itemPath(path, incoming, i, byUUID)+".", recordName, storedMap, incomingItem, visit)
+		}
+	}
+}
+
+// pairItems returns for every incoming list item the index of the stored item it is matched with, -1 for
+// added items. The items are matched by their uuids like in DiffFields, otherwise by their positions, byUUID
+// tells which.
+func pairItems(stored, incoming []any) (result []int, byUUID bool) {
+	result = make([]int, len(incoming))
+	_, storedOk := listByUUID(stored)
+	_, incomingOk := listByUUID(incoming)
+	byUUID = storedOk && incomingOk
+	storedIndex := map[string]int{}
+	if byUUID {
+		for i, item := range stored {
+			storedIndex[itemUUID(item)] = i
+		}
+	}
+
+	for i, item := range incoming {
+		result[i] = -1
+		if byUUID {
+			if j, ok := storedIndex[itemUUID(item)]; ok {
+				result[i] = j
+			}
+		} else if i < len(stored) {
+			result[i] = i
+		}
+	}
+	return result, byUUID
+}
+
+func isChanged(stored, incoming any) bool {
+	if isEmptyValue(stored) && isEmptyValue(incoming) {
+		return false
+	}
+	changes := ChangeSet{}
+	diffValues("", stored, stored != nil, incoming, incoming != nil, &changes)
+	return !changes.IsEmpty()
+}
+
+func restoreValue(fields map[string]any, fieldName string, value any) {
+	if value == nil {
+		delete(fields, fieldName)
+		return
+	}
+	fields[fieldName] = value
+}
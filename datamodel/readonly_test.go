@@ -0,0 +1,132 @@
+package datamodel
+
+import (
+	"encoding/json"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func readonlyTenantConfig() TenantConfig {
+	readonly := true
+	return TenantConfig{
+		Subject: "user",
+		DataModel: map[string]CustomFields{
+			"user": {
+				"uuid":     {"readonly": &readonly},
+				"username": {"readonly": &readonly},
+				"comment":  {},
+				"roles":    {"type": FieldTypeList},
+			},
+			"roles": {
+				"name":        {"type": FieldTypeCombobox, "readonly": &readonly},
+				"description": {},
+			},
+		},
+	}
+}
+
+func TestReadonlyChanges(t *testing.T) {
+	tc := readonlyTenantConfig()
+	stored := map[string]any{
+		"uuid":     "u1",
+		"username": "jdoe",
+		"roles": []any{
+			map[string]any{"uuid": "r1", "name": "user", "description": "old"},
+			map[string]any{"uuid": "r2", "name": "inquiry"},
+		},
+	}
+	incoming := map[string]any{
+		"uuid":     "u1",
+		"username": "admin",
+		"comment":  "changed",
+		"roles": []any{
+			map[string]any{"uuid": "r2", "name": "user"},
+			map[string]any{"uuid": "r1", "name": "user", "description": "new"},
+			map[string]any{"uuid": "r3", "description": "added"},
+		},
+	}
+
+	changes := tc.ReadonlyChanges(stored, incoming)
+	require.Equal(t, []string{"roles[uuid=r2].name", "username"}, fieldErrorPaths(changes))
+	require.Equal(t, FieldErrorReadonly, changes[0].Code)
+	require.Equal(t, "admin", incoming["username"])
+
+	restored := tc.RestoreReadonly(stored, incoming)
+	require.Equal(t, changes, restored)
+	require.Equal(t, "jdoe", incoming["username"])
+	require.Equal(t, "changed", incoming["comment"])
+	require.Equal(t, "inquiry", incoming["roles"].([]any)[0].(map[string]any)["name"])
+	require.Equal(t, "new", incoming["roles"].([]any)[1].(map[string]any)["description"])
+	require.Empty(t, tc.ReadonlyChanges(stored, incoming))
+}
+
+func TestReadonlyListItems(t *testing.T) {
+	tc := readonlyTenantConfig()
+	stored := map[string]any{
+		"roles": []any{
+			map[string]any{"uuid": "r1", "name": "user"},
+			map[string]any{"uuid": "r2", "description": "no readonly value"},
+		},
+	}
+	incoming := func() map[string]any {
+		return map[string]any{
+			"roles": []any{
+				map[string]any{"uuid": "r3", "name": "admin"},
+				map[string]any{"uuid": "r4", "description": "added"},
+			},
+		}
+	}
+
+	// r1 has been removed and r3 added with readonly values, r2 and r4 have none
+	changes := tc.ReadonlyChanges(stored, incoming())
+	require.Equal(t, []string{"roles[uuid=r3]", "roles[uuid=r1]"}, fieldErrorPaths(changes))
+	require.Equal(t, "the added item of roles has readonly fields", changes[0].Message)
+	require.Equal(t, "the removed item of roles has readonly fields", changes[1].Message)
+
+	restoredEntity := incoming()
+	restored := tc.RestoreReadonly(stored, restoredEntity)
+	require.Equal(t, changes, restored)
+	require.Equal(t, []any{
+		map[string]any{"uuid": "r4", "description": "added"},
+		map[string]any{"uuid": "r1", "name": "user"},
+	}, restoredEntity["roles"])
+	require.Empty(t, tc.ReadonlyChanges(stored, restoredEntity))
+
+	// removing the whole list removes the items as well
+	require.Len(t, tc.ReadonlyChanges(stored, map[string]any{}), 1)
+}
+
+func TestReadonlyUnset(t *testing.T) {
+	tc := readonlyTenantConfig()
+	stored := map[string]any{"uuid": "u1", "username": ""}
+
+	require.Empty(t, tc.ReadonlyChanges(stored, map[string]any{"uuid": "u1"}))
+
+	incoming := map[string]any{"uuid": "u1", "username": "jdoe"}
+	require.Len(t, tc.RestoreReadonly(stored, incoming), 1)
+	require.Equal(t, "", incoming["username"])
+
+	incoming = map[string]any{"uuid": "u1", "username": "jdoe"}
+	require.Len(t, tc.RestoreReadonly(map[string]any{"uuid": "u1"}, incoming), 1)
+	require.NotContains(t, incoming, "username")
+}
+
+func fieldErrorPaths(fieldErrors []FieldError) []string {
+	result := []string{}
+	for _, fieldError := range fieldErrors {
+		result = append(result, fieldError.Path)
+	}
+	return result
+}
+
+func TestReadonlyFromJson(t *testing.T) {
+	tc := TenantConfig{}
+	require.NoError(t, json.Unmarshal([]byte(`{
+		"subject": "user",
+		"datamodel": {"user": {"uuid": {}, "username": {"readonly": true}, "comment": {"readonly": false}}}
+	}`), &tc))
+
+	changes := tc.ReadonlyChanges(map[string]any{"username": "jdoe", "comment": "old"}, map[string]any{"username": "admin", "comment": "new"})
+	require.Equal(t, []string{"username"}, fieldErrorPaths(changes))
+}
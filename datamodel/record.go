@@ -1,6 +1,7 @@
 package datamodel
 
 import (
+	"context"
 	"fmt"
 	"strconv"
 	"time"
@@ -17,6 +18,12 @@ type Metadata struct {
 	User      string    `bson:"user"`
 	Partner   string    `bson:"partner"`
 	Role      string    `bson:"role"`
+	Version   int64     `bson:"version"`
+	// SchemaVersion is the version of the datamodel the record has been written with
+	SchemaVersion int `bson:"schemaVersion,omitempty"`
+
+	DeletedAt *time.Time `bson:"deletedAt,omitempty"`
+	DeletedBy string     `bson:"deletedBy,omitempty"`
 }
 
 type Mapper struct {
@@ -141,14 +148,35 @@ func (r *Record) cleanSlice(slice []any) []any {
 	return result
 }
 
+// SetMetadata sets the metadata of a save by the user. The deletion and the schema version are not taken from
+// the client, the deletion is changed by the soft delete only and the schema version is stamped on save.
 func (r *Record) SetMetadata(appName string) {
+	r.Metadata.DeletedAt, r.Metadata.DeletedBy, r.Metadata.SchemaVersion = nil, "", 0
 	r.Metadata.Timestamp = time.Now()
 	r.Metadata.Partner = r.userIdentity.Partner()
 	r.Metadata.Role = r.userIdentity.RoleByApp(appName)
 	r.Metadata.User = r.userIdentity.Username()
 }
 
-func (r *Record) BeforeSave(session database.DatabaseSession) error {
+// Version is the number of saves of the record, see database.VersionedEntity
+func (r Record) Version() int64 {
+	return r.Metadata.Version
+}
+
+func (r *Record) SetVersion(version int64) {
+	r.Metadata.Version = version
+}
+
+// SchemaVersion is the datamodel version of the record, see SchemaVersioned
+func (r Record) SchemaVersion() int {
+	return r.Metadata.SchemaVersion
+}
+
+func (r *Record) SetSchemaVersion(version int) {
+	r.Metadata.SchemaVersion = version
+}
+
+func (r *Record) BeforeSave(ctx context.Context, session database.DatabaseSession) error {
 	return nil
 }
 
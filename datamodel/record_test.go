@@ -5,6 +5,7 @@ import (
 	"reflect"
 	"testing"
 
+	"github.com/dchaykin/go-modules/database"
 	"github.com/stretchr/testify/require"
 )
 
@@ -107,3 +108,28 @@ func TestFindJsonField_NotFound(t *testing.T) {
 		require.EqualValues(t, called, false)
 	}
 }
+
+func TestRestoreRevisionOfDeletedRecord(t *testing.T) {
+	database.UseMemoryBackend()
+	t.Cleanup(func() { database.SetBackend(nil) })
+
+	session, err := database.OpenSession()
+	require.NoError(t, err)
+	defer session.Close()
+
+	c := newContact(testUUID(t), 0, map[string]any{"name": "John Doe"})
+	require.NoError(t, session.ReplaceEntityByUUID(t.Context(), c, true))
+	require.NoError(t, database.SoftDeleteEntity(t.Context(), session, c.UUID(), &contact{}))
+
+	// neither a deleted record is restored to a revision nor a revision recording the deletion is restored
+	require.True(t, database.IsNotFound(database.RestoreRevision(t.Context(), session, c.UUID(), 1, &contact{})))
+	require.NoError(t, database.RestoreDeletedEntity(t.Context(), session, c.UUID(), &contact{}))
+	require.ErrorContains(t, database.RestoreRevision(t.Context(), session, c.UUID(), 2, &contact{}), "soft deleted")
+
+	require.NoError(t, database.RestoreRevision(t.Context(), session, c.UUID(), 1, &contact{}))
+	restored := &contact{}
+	found, err := session.GetEntityByUUID(t.Context(), c.UUID(), restored)
+	require.NoError(t, err)
+	require.True(t, found)
+	require.Equal(t, "John Doe", restored.GetValue("name"))
+}
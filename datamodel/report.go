@@ -0,0 +1,111 @@
+package datamodel
+
+import (
+	"context"
+	"fmt"
+	"slices"
+	"time"
+
+	"github.com/dchaykin/go-modules/database"
+	"go.mongodb.org/mongo-driver/bson"
+)
+
+// GroupCount is the number of records having a value
+type GroupCount struct {
+	Value any   `bson:"_id" json:"value"`
+	Count int64 `bson:"count" json:"count"`
+}
+
+// HistogramBucket is the number of records with a date in the period starting at Start
+type HistogramBucket struct {
+	Start time.Time `bson:"_id" json:"start"`
+	Count int64     `bson:"count" json:"count"`
+}
+
+// HistogramUnits are the allowed periods of a date histogram
+var HistogramUnits = []string{"year", "quarter", "month", "week", "day", "hour"}
+
+// subjectField returns the field of the subject record after checking its type
+func (tc TenantConfig) subjectField(fieldName string, types ...string) (CustomField, error) {
+	field, ok := tc.DataModel[tc.Subject][fieldName]
+	if !ok {
+		return nil, fmt.Errorf("the field %s is not defined for %s", fieldName, tc.Subject)
+	}
+	if !slices.Contains(types, field.Type()) {
+		return nil, fmt.Errorf("the field %s is of type %s, expected %v", fieldName, field.Type(), types)
+	}
+	return field, nil
+}
+
+// CountByCombobox counts the records matching the filter per value of a combobox field, the most frequent first
+func (tc TenantConfig) CountByCombobox(ctx context.Context, session database.DatabaseSession, domainEntity database.DomainEntity, fieldName string, filter database.Filter) ([]GroupCount, error) {
+	if _, err := tc.subjectField(fieldName, FieldTypeCombobox); err != nil {
+		return nil, err
+	}
+
+	pipeline := database.NewPipeline().
+		Match(filter).
+		Group("$entity."+fieldName, bson.M{"count": bson.M{"$sum": 1}}).
+		Sort(bson.D{{Key: "count", Value: -1}, {Key: "_id", Value: 1}})
+
+	return database.AggregateEntities[GroupCount](ctx, session, domainEntity, pipeline)
+}
+
+// SumFields sums up numeric fields over the records matching the filter. The result contains every requested field.
+func (tc TenantConfig) SumFields(ctx context.Context, session database.DatabaseSession, domainEntity database.DomainEntity, fieldNames []string, filter database.Filter) (map[string]float64, error) {
+	accumulators := bson.M{}
+	for _, fieldName := range fieldNames {
+		if _, err := tc.subjectField(fieldName, FieldTypeInt, FieldTypeUint, FieldTypeFloat); err != nil {
+			return nil, err
+		}
+		accumulators[fieldName] = bson.M{"$sum": "$entity." + fieldName}
+	}
+
+	pipeline := database.NewPipeline().Match(filter).Group(nil, accumulators)
+	sums, err := database.AggregateEntities[bson.M](ctx, session, domainEntity, pipeline)
+	if err != nil {
+		return nil, err
+	}
+
+	result := map[string]float64{}
+	for _, fieldName := range fieldNames {
+		result[fieldName] = 0
+		if len(sums) > 0 {
+			result[fieldName] = numberValue(sums[0][fieldName])
+		}
+	}
+	return result, nil
+}
+
+func numberValue(value any) float64 {
+	switch v := value.(type) {
+	case int32:
+		return float64(v)
+	case int64:
+		return float64(v)
+	case float64:
+		return v
+	}
+	return 0
+}
+
+// DateHistogram counts the records matching the filter per period of a date or datetime field, ordered by time.
+// Records without a valid date are not counted.
+func (tc TenantConfig) DateHistogram(ctx context.Context, session database.DatabaseSession, domainEntity database.DomainEntity, fieldName, unit string, filter database.Filter) ([]HistogramBucket, error) {
+	if _, err := tc.subjectField(fieldName, FieldTypeDate, FieldTypeDateTime); err != nil {
+		return nil, err
+	}
+	if !slices.Contains(HistogramUnits, unit) {
+		return nil, fmt.Errorf("unsupported histogram unit %s, expected one of %v", unit, HistogramUnits)
+	}
+
+	// dates may be stored as strings
+	date := bson.M{"$convert": bson.M{"input": "$entity." + fieldName, "to": "date", "onError": nil, "onNull": nil}}
+	pipeline := database.NewPipeline().
+		Match(filter).
+		Group(bson.M{"$dateTrunc": bson.M{"date": date, "unit": unit}}, bson.M{"count": bson.M{"$sum": 1}}).
+		Stage("$match", bson.M{"_id": bson.M{"$ne": nil}}).
+		Sort(bson.D{{Key: "_id", Value: 1}})
+
+	return database.AggregateEntities[HistogramBucket](ctx, session, domainEntity, pipeline)
+}
@@ -0,0 +1,79 @@
+package datamodel
+
+import (
+	"context"
+	"encoding/json"
+	"testing"
+	"time"
+
+	"github.com/dchaykin/go-modules/database"
+	"github.com/stretchr/testify/require"
+)
+
+const testReportDatamodel = `{
+	"subject": "contact",
+	"datamodel": {
+		"contact": {
+			"uuid": {},
+			"status": { "type": "cmb" },
+			"revenue": { "type": "float" },
+			"visits": { "type": "int" },
+			"createdAt": { "type": "datetime" },
+			"name": {}
+		}
+	}
+}`
+
+func TestReports(t *testing.T) {
+	database.UseMemoryBackend()
+	t.Cleanup(func() { database.SetBackend(nil) })
+
+	tc := TenantConfig{}
+	require.NoError(t, json.Unmarshal([]byte(testReportDatamodel), &tc))
+
+	ctx := context.Background()
+	session, err := database.OpenSession()
+	require.NoError(t, err)
+	defer session.Close()
+
+	contacts := []*contact{
+		newContact("1", 0, map[string]any{"status": "active", "revenue": 100.5, "visits": 2, "createdAt": "2024-01-10 08:00:00"}),
+		newContact("2", 0, map[string]any{"status": "active", "revenue": 50.0, "visits": 1, "createdAt": "2024-01-28 17:45:00"}),
+		newContact("3", 0, map[string]any{"status": "lead", "visits": 4, "createdAt": "2024-03-02 09:00:00"}),
+		newContact("4", 0, map[string]any{"status": "active", "revenue": 10.0, "createdAt": "unknown"}),
+	}
+	for _, c := range contacts {
+		require.NoError(t, session.ReplaceEntityByUUID(ctx, c, true))
+	}
+
+	counts, err := tc.CountByCombobox(ctx, session, &contact{}, "status", database.Filter{})
+	require.NoError(t, err)
+	require.Equal(t, []GroupCount{{Value: "active", Count: 3}, {Value: "lead", Count: 1}}, counts)
+
+	counts, err = tc.CountByCombobox(ctx, session, &contact{}, "status", database.Gte("visits", 2))
+	require.NoError(t, err)
+	require.Equal(t, []GroupCount{{Value: "active", Count: 1}, {Value: "lead", Count: 1}}, counts)
+
+	sums, err := tc.SumFields(ctx, session, &contact{}, []string{"revenue", "visits"}, database.Filter{})
+	require.NoError(t, err)
+	require.Equal(t, map[string]float64{"revenue": 160.5, "visits": 7}, sums)
+
+	sums, err = tc.SumFields(ctx, session, &contact{}, []string{"revenue"}, database.Eq("status", "none"))
+	require.NoError(t, err)
+	require.Equal(t, map[string]float64{"revenue": 0}, sums)
+
+	histogram, err := tc.DateHistogram(ctx, session, &contact{}, "createdAt", "month", database.Filter{})
+	require.NoError(t, err)
+	require.Len(t, histogram, 2)
+	require.Equal(t, time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC), histogram[0].Start.UTC())
+	require.EqualValues(t, 2, histogram[0].Count)
+	require.Equal(t, time.Date(2024, 3, 1, 0, 0, 0, 0, time.UTC), histogram[1].Start.UTC())
+	require.EqualValues(t, 1, histogram[1].Count)
+
+	_, err = tc.CountByCombobox(ctx, session, &contact{}, "name", database.Filter{})
+	require.ErrorContains(t, err, "the field name is of type string")
+	_, err = tc.SumFields(ctx, session, &contact{}, []string{"missing"}, database.Filter{})
+	require.ErrorContains(t, err, "the field missing is not defined for contact")
+	_, err = tc.DateHistogram(ctx, session, &contact{}, "createdAt", "decade", database.Filter{})
+	require.ErrorContains(t, err, "unsupported histogram unit decade")
+}
@@ -0,0 +1,285 @@
+package datamodel
+
+import (
+	"errors"
+	"fmt"
+	"math"
+	"slices"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+	"unicode/utf8"
+
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+const (
+	FieldErrorMandatory = "mandatory"
+	FieldErrorType      = "type"
+	FieldErrorSize      = "size"
+	FieldErrorUnknown   = "unknown"
+	FieldErrorCombobox  = "combobox"
+)
+
+// dateTimeLayouts are the accepted string forms of date and datetime fields
+var dateTimeLayouts = []string{time.RFC3339Nano, "2006-01-02T15:04:05", "2006-01-02 15:04:05", "2006-01-02T15:04", "2006-01-02 15:04", time.DateOnly}
+
+// FieldError describes an invalid field. Path addresses the field from the entity root like the path of a
+// Change, e.g. "roles[uuid=0a1b...].name" for items of list fields having a uuid or "tags[2]" otherwise.
+type FieldError struct {
+	Path    string `json:"path"`
+	Code    string `json:"code"`
+	Message string `json:"message"`
+}
+
+type ValidationError struct {
+	Fields []FieldError
+}
+
+func (e *ValidationError) Error() string {
+	messages := []string{}
+	for _, field := range e.Fields {
+		messages = append(messages, field.Path+": "+field.Message)
+	}
+	return fmt.Sprintf("the entity is invalid: %s", strings.Join(messages, "; "))
+}
+
+func IsValidationError(err error) bool {
+	validationErr := &ValidationError{}
+	return errors.As(err, &validationErr)
+}
+
+// ValidateRecord checks the fields of the record against the subject of the tenant config, see ValidateEntity
+func (tc TenantConfig) ValidateRecord(r Record) error {
+	return tc.ValidateEntity(r.Fields)
+}
+
+// ValidateEntity checks the fields of an entity of the subject against the datamodel, which should be
+// loaded for the role of the user. Nested records and the items of list fields are checked against the
+// record of the datamodel with the name of the field. The result is a *ValidationError or nil.
+func (tc TenantConfig) ValidateEntity(fields map[string]any) error {
+	v := validator{tc: tc}
+	v.validateRecord("", tc.Subject, fields)
+	if len(v.errors) == 0 {
+		return nil
+	}
+	return &ValidationError{Fields: v.errors}
+}
+
+type validator struct {
+	tc     TenantConfig
+	errors []FieldError
+}
+
+func (v *validator) add(path, code, message string, args ...any) {
+	v.errors = append(v.errors, FieldError{Path: path, Code: code, Message: fmt.Sprintf(message, args...)})
+}
+
+func (v *validator) validateRecord(prefix, recordName string, fields map[string]any) {
+	config := v.tc.DataModel[recordName]
+
+	for _, fieldName := range sortedKeys(fields) {
+		if _, ok := config[fieldName]; !ok {
+			v.add(prefix+fieldName, FieldErrorUnknown, "the field %s is not defined for %s", fieldName, recordName)
+		}
+	}
+
+	for _, fieldName := range sortedKeys(config) {
+		field := config[fieldName]
+		path := prefix + fieldName
+		value := fields[fieldName]
+		if isEmptyValue(value) {
+			if field.IsMandatory() {
+				v.add(path, FieldErrorMandatory, "the field %s is mandatory", fieldName)
+			}
+			continue
+		}
+		v.validateField(path, recordName, fieldName, field, value)
+	}
+}
+
+func (v *validator) validateField(path, recordName, fieldName string, field CustomField, value any) {
+	_, isRecord := v.tc.DataModel[fieldName]
+
+	switch field.Type() {
+	case FieldTypeList:
+		items, ok := value.([]any)
+		if !ok {
+			v.add(path, FieldErrorType, "a list is expected, found %T", value)
+			return
+		}
+		_, byUUID := listByUUID(items)
+		for i, item := range items {
+			fields, ok := item.(map[string]any)
+			if !ok {
+				v.add(itemPath(path, items, i, byUUID), FieldErrorType, "a record is expected, found %T", item)
+				continue
+			}
+			if isRecord {
+				v.validateRecord(itemPath(path, items, i, byUUID)+".", fieldName, fields)
+			}
+		}
+		return
+	case FieldTypeImage, FieldTypeFile:
+		return
+	}
+
+	if fields, ok := value.(map[string]any); ok && isRecord {
+		v.validateRecord(path+".", fieldName, fields)
+		return
+	}
+
+	if err := checkType(field, value); err != nil {
+		v.add(path, FieldErrorType, "%v", err)
+		return
+	}
+
+	switch field.Type() {
+	case FieldTypeString:
+		// the stored hash of a masked value kept by KeepMasked is longer than the value itself
+		if field.IsMasked() && isMaskedHash(value.(string)) {
+			return
+		}
+		if length := utf8.RuneCountInString(value.(string)); int64(length) > field.Size() {
+			v.add(path, FieldErrorSize, "the value has %d characters, at most %d are allowed", length, field.Size())
+		}
+	case FieldTypeCombobox:
+		if content := v.comboboxContent(recordName, fieldName); content != nil {
+			key := toKeyString(value)
+			if !slices.ContainsFunc(content, func(cmb Combobox) bool { return cmb.ID == key }) {
+				v.add(path, FieldErrorCombobox, "the value %s is not in the combobox %s", key, fieldName)
+			}
+		}
+	}
+}
+
+// comboboxContent returns the entries of a static combobox, nil if they are not known in advance
+func (v *validator) comboboxContent(recordName, fieldName string) []Combobox {
+	if v.tc.Cmbs == nil {
+		return nil
+	}
+	cmb, ok := (*v.tc.Cmbs)[recordName][fieldName]
+	if !ok || cmb.GetType() != ComboboxTypeStatic {
+		return nil
+	}
+	return cmb.Content
+}
+
+// checkType reports whether the value can be read as the type of the field. Numbers and booleans
+// may also be sent as strings.
+func checkType(field CustomField, value any) error {
+	fieldType := field.Type()
+	switch fieldType {
+	case FieldTypeString, FieldTypeRichtext:
+		if _, ok := value.(string); ok {
+			return nil
+		}
+	case FieldTypeInt, FieldTypeUint:
+		if n, ok := integerValue(value); ok && (fieldType == FieldTypeInt || n >= 0) {
+			return nil
+		}
+	case FieldTypeFloat:
+		if _, ok := floatValue(value); ok {
+			return nil
+		}
+	case FieldTypeBool:
+		switch v := value.(type) {
+		case bool:
+			return nil
+		case string:
+			if _, err := strconv.ParseBool(v); err == nil {
+				return nil
+			}
+		}
+	case FieldTypeDate, FieldTypeDateTime:
+		if _, ok := timeValue(value); ok {
+			return nil
+		}
+	case FieldTypeCombobox:
+		switch value.(type) {
+		case string, float64, int, int32, int64, bool:
+			return nil
+		}
+	default:
+		return nil
+	}
+	return fmt.Errorf("the value %v is not of type %s", value, fieldType)
+}
+
+func integerValue(value any) (int64, bool) {
+	switch v := value.(type) {
+	case int:
+		return int64(v), true
+	case int32:
+		return int64(v), true
+	case int64:
+		return v, true
+	case float64:
+		if v == math.Trunc(v) && !math.IsInf(v, 0) {
+			return int64(v), true
+		}
+	case string:
+		if n, err := strconv.ParseInt(strings.TrimSpace(v), 10, 64); err == nil {
+			return n, true
+		}
+	}
+	return 0, false
+}
+
+func floatValue(value any) (float64, bool) {
+	switch v := value.(type) {
+	case int:
+		return float64(v), true
+	case int32:
+		return float64(v), true
+	case int64:
+		return float64(v), true
+	case float32:
+		return float64(v), true
+	case float64:
+		return v, true
+	case string:
+		if f, err := strconv.ParseFloat(strings.TrimSpace(v), 64); err == nil {
+			return f, true
+		}
+	}
+	return 0, false
+}
+
+func timeValue(value any) (time.Time, bool) {
+	switch v := value.(type) {
+	case time.Time:
+		return v, true
+	case primitive.DateTime:
+		return v.Time(), true
+	case string:
+		for _, layout := range dateTimeLayouts {
+			if t, err := time.Parse(layout, strings.TrimSpace(v)); err == nil {
+				return t, true
+			}
+		}
+	}
+	return time.Time{}, false
+}
+
+func isEmptyValue(value any) bool {
+	switch v := value.(type) {
+	case nil:
+		return true
+	case string:
+		return strings.TrimSpace(v) == ""
+	case []any:
+		return len(v) == 0
+	}
+	return false
+}
+
+func sortedKeys[V any](m map[string]V) []string {
+	result := make([]string, 0, len(m))
+	for key := range m {
+		result = append(result, key)
+	}
+	sort.Strings(result)
+	return result
+}
@@ -0,0 +1,139 @@
+package datamodel
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func fieldErrorCodes(t *testing.T, err error) map[string]string {
+	require.True(t, IsValidationError(err), "%v", err)
+	result := map[string]string{}
+	for _, field := range err.(*ValidationError).Fields {
+		result[field.Path] = field.Code
+	}
+	return result
+}
+
+func TestValidateEntity(t *testing.T) {
+	tc, err := LoadDataModelByRole("testdata-001", "customer")
+	require.NoError(t, err)
+
+	valid := map[string]any{
+		"uuid":      "u1",
+		"username":  "jdoe",
+		"password":  "secret",
+		"firstName": "John",
+		"surName":   "Doe",
+		"eMail":     "jdoe@example.com",
+		"partner":   "p1",
+		"admin":     "false",
+		"roles": []any{
+			map[string]any{"name": "user", "value": "customer"},
+		},
+	}
+	require.NoError(t, tc.ValidateEntity(valid))
+	require.NoError(t, tc.ValidateRecord(Record{Fields: valid}))
+
+	invalid := map[string]any{
+		"uuid":      "u1",
+		"username":  "",
+		"password":  "secret",
+		"firstName": strings.Repeat("ä", 257),
+		"surName":   42.0,
+		"eMail":     "jdoe@example.com",
+		"partner":   "p1",
+		"admin":     "maybe",
+		"nickname":  "johnny",
+		"roles": []any{
+			map[string]any{"name": "user", "value": "customer"},
+			map[string]any{"name": "billing", "value": "customer", "level": 1.0},
+			"admin",
+		},
+	}
+	err = tc.ValidateEntity(invalid)
+	require.Equal(t, map[string]string{
+		"username":       FieldErrorMandatory,
+		"firstName":      FieldErrorSize,
+		"surName":        FieldErrorType,
+		"admin":          FieldErrorType,
+		"nickname":       FieldErrorUnknown,
+		"roles[1].name":  FieldErrorCombobox,
+		"roles[1].level": FieldErrorUnknown,
+		"roles[2]":       FieldErrorType,
+	}, fieldErrorCodes(t, err))
+	require.ErrorContains(t, err, "username: the field username is mandatory")
+
+	// list items with a uuid are addressed like in the changes
+	stored := map[string]any{"roles": []any{map[string]any{"uuid": "r1", "name": "user", "value": "customer"}}}
+	invalid = map[string]any{"roles": []any{map[string]any{"uuid": "r1", "name": "billing", "value": "customer"}}}
+	err = tc.ValidateEntity(invalid)
+	require.Equal(t, FieldErrorCombobox, fieldErrorCodes(t, err)["roles[uuid=r1].name"])
+	require.Contains(t, DiffFields(stored, invalid).Paths(), "roles[uuid=r1].name")
+}
+
+func TestValidateFieldTypes(t *testing.T) {
+	tc := TenantConfig{
+		Subject: "order",
+		DataModel: map[string]CustomFields{
+			"order": {
+				"amount":    {"type": FieldTypeInt},
+				"quantity":  {"type": FieldTypeUint},
+				"price":     {"type": FieldTypeFloat},
+				"orderDate": {"type": FieldTypeDate},
+				"shipped":   {"type": FieldTypeDateTime},
+				"address":   {},
+			},
+			"address": {
+				"city": {},
+			},
+		},
+	}
+
+	require.NoError(t, tc.ValidateEntity(map[string]any{
+		"amount":    -3.0,
+		"quantity":  "7",
+		"price":     "9.95",
+		"orderDate": "2025-03-01",
+		"shipped":   "2025-03-01T10:15:00Z",
+		"address":   map[string]any{"city": "Berlin"},
+	}))
+
+	err := tc.ValidateEntity(map[string]any{
+		"amount":    1.5,
+		"quantity":  -1.0,
+		"price":     "cheap",
+		"orderDate": "01.03.2025",
+		"shipped":   true,
+		"address":   map[string]any{"city": "Berlin", "zip": "10115"},
+	})
+	require.Equal(t, map[string]string{
+		"amount":      FieldErrorType,
+		"quantity":    FieldErrorType,
+		"price":       FieldErrorType,
+		"orderDate":   FieldErrorType,
+		"shipped":     FieldErrorType,
+		"address.zip": FieldErrorUnknown,
+	}, fieldErrorCodes(t, err))
+}
+
+func TestValidateEntityFromFile(t *testing.T) {
+	t.Setenv("ASSETS_PATH", "")
+	path := t.TempDir()
+	require.NoError(t, os.WriteFile(filepath.Join(path, "datamodel.json"), []byte(`{
+		"subject": "article",
+		"datamodel": {"article": {"uuid": {}, "name": {"mandatory": true}, "stock": {"type": "int", "mandatory": false}}}
+	}`), 0644))
+
+	tc, err := LoadDataModelByRole(path, "")
+	require.NoError(t, err)
+	require.True(t, tc.DataModel["article"]["name"].IsMandatory())
+	require.False(t, tc.DataModel["article"]["stock"].IsMandatory())
+
+	err = tc.ValidateEntity(map[string]any{"uuid": "a1", "stock": 3.0})
+	require.Equal(t, map[string]string{"name": FieldErrorMandatory}, fieldErrorCodes(t, err))
+	require.NoError(t, tc.ValidateEntity(map[string]any{"uuid": "a1", "name": "Pencil"}))
+}
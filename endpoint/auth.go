@@ -4,8 +4,8 @@ import (
 	"encoding/json"
 	"fmt"
 	"net/http"
-	"os"
 
+	"github.com/dchaykin/go-modules/service"
 	"github.com/dchaykin/go-modules/user"
 	"github.com/dchaykin/mygolib/auth"
 	"github.com/dchaykin/mygolib/httpcomm"
@@ -18,7 +18,7 @@ type token struct {
 
 func CreateUserIdentityByCredentials(username, password, secret string) (user.UserIdentity, error) {
 	payload := fmt.Appendf(nil, `{"username":"%s","password":"%s"}`, username, password)
-	endpoint := fmt.Sprintf("https://%s/app-config/auth", os.Getenv("MYHOST"))
+	endpoint := serviceURL(service.Config, "auth")
 	resp := httpcomm.Post(endpoint, nil, nil, payload)
 	if resp.StatusCode != http.StatusOK {
 		return nil, log.WrapError(resp.GetError())
@@ -1,6 +1,7 @@
 package endpoint
 
 import (
+	"context"
 	"encoding/json"
 	"fmt"
 	"io"
@@ -72,19 +73,25 @@ func GetDomainEntityByUUID(w http.ResponseWriter, r *http.Request, domainEntity
 		return
 	}
 
-	err := database.GetDomainEntityByUUID(uuid, domainEntity)
+	err := database.GetDomainEntityByUUID(r.Context(), uuid, domainEntity)
+	if database.IsNotFound(err) {
+		httpcomm.SetResponseError(&w, "", err, http.StatusNotFound)
+		return
+	}
 	if err != nil {
 		httpcomm.SetResponseError(&w, "", err, http.StatusInternalServerError)
 		return
 	}
 
-	if domainEntity == nil {
-		httpcomm.SetResponseError(&w, "", fmt.Errorf("no record with UUID %s found", uuid), http.StatusNotFound)
+	// records written with an older datamodel are upgraded on read and stored with the next save
+	if _, err = datamodel.UpgradeEntity(r.Context(), domainEntity); err != nil {
+		httpcomm.SetResponseError(&w, "", err, http.StatusInternalServerError)
 		return
 	}
 
+	setETag(w, domainEntity)
 	httpcomm.ServiceResponse{
-		Data: domainEntity.Entity(),
+		Data: datamodel.RedactEntity(domainEntity),
 	}.WriteData(w, httpcomm.PayloadFormatJSON)
 }
 
@@ -96,8 +103,6 @@ func CreateEntity(w http.ResponseWriter, r *http.Request, domainEntity database.
 	}
 	defer r.Body.Close()
 
-	log.Debug("creating entity for app: %s, payload: %s", appName, string(body))
-
 	userIdentity, err := user.GetUserIdentityFromRequest(*r)
 	if err != nil {
 		httpcomm.SetResponseError(&w, "", err, http.StatusUnauthorized)
@@ -110,40 +115,67 @@ func CreateEntity(w http.ResponseWriter, r *http.Request, domainEntity database.
 		return
 	}
 
+	log.Debug("creating entity for app: %s, payload: %v", appName, datamodel.RedactEntity(domainEntity))
+
+	precondition, err := applyIfMatch(r, domainEntity)
+	if err != nil {
+		httpcomm.SetResponseError(&w, "", err, http.StatusBadRequest)
+		return
+	}
+
+	check, err := entityCheck(userIdentity, domainEntity, appName)
+	if err != nil {
+		httpcomm.SetResponseError(&w, "", err, http.StatusInternalServerError)
+		return
+	}
+
 	domainEntity.SetUserIdentity(userIdentity)
 	domainEntity.SetMetadata(appName)
 
-	err = ReplaceEntity(domainEntity)
+	err = replaceEntity(r.Context(), domainEntity, precondition, check)
+	if datamodel.IsValidationError(err) {
+		setValidationError(w, err)
+		return
+	}
 	if err != nil {
-		httpcomm.SetResponseError(&w, "", err, http.StatusInternalServerError)
+		httpcomm.SetResponseError(&w, "", err, saveStatus(err, precondition))
 		return
 	}
 
+	setETag(w, domainEntity)
 	w.WriteHeader(http.StatusCreated)
 }
 
-func ReplaceEntity(domainEntity database.DomainEntity) error {
+// ReplaceEntity saves the entity unconditionally, a versioned entity takes the stored version on save
+func ReplaceEntity(ctx context.Context, domainEntity database.DomainEntity) error {
+	return replaceEntity(ctx, domainEntity, ifMatchNone, nil)
+}
+
+// ReplaceEntityIfMatch saves the entity if its version equals the stored one, otherwise a *database.ConflictError
+// is returned
+func ReplaceEntityIfMatch(ctx context.Context, domainEntity database.DomainEntity) error {
+	return replaceEntity(ctx, domainEntity, ifMatchVersion, nil)
+}
+
+func replaceEntity(ctx context.Context, domainEntity database.DomainEntity, precondition ifMatch, check checkFunc) error {
 	if domainEntity.UserIdentity() == nil {
 		return fmt.Errorf("no user identity found for entity: %v", domainEntity)
 	}
 
-	err := saveEntity(domainEntity)
+	err := saveEntity(ctx, domainEntity, precondition, check)
 	if err != nil {
-		return fmt.Errorf("unable to save %s into the database. UUID: %s. Error: %v", domainEntity.CollectionName(), domainEntity.UUID(), err)
-	}
-	err = overview.UpdateOverviewRow(domainEntity)
-	if err != nil {
-		return fmt.Errorf("could not create or update an overview row. UUID: %s. Error: %v", domainEntity.UUID(), err)
+		return fmt.Errorf("unable to save %s into the database. UUID: %s. Error: %w", domainEntity.CollectionName(), domainEntity.UUID(), err)
 	}
 	return nil
 }
 
-func saveEntity(domainEntity database.DomainEntity) error {
+func saveEntity(ctx context.Context, domainEntity database.DomainEntity, precondition ifMatch, check checkFunc) error {
 	domainEntity.CleanNil()
 	err := datamodel.EnsureUUID(domainEntity)
 	if err != nil {
 		return fmt.Errorf("unable to generate a uuid: %v", err)
 	}
+	datamodel.StampSchemaVersion(domainEntity)
 
 	session, err := database.OpenSession()
 	if err != nil {
@@ -151,10 +183,126 @@ func saveEntity(domainEntity database.DomainEntity) error {
 	}
 	defer session.Close()
 
-	err = domainEntity.BeforeSave(session)
+	return session.WithTransaction(ctx, saveTransaction(domainEntity, precondition, check))
+}
+
+// saveTransaction returns the transaction saving the entity. The stored entity is read once, the version
+// taken by an unconditional save and the check of the entity both refer to it. The transaction is retried
+// on transient errors, the hashes of the masked values made by a failed attempt are kept by the next one.
+func saveTransaction(domainEntity database.DomainEntity, precondition ifMatch, check checkFunc) database.TransactionFunc {
+	hashed := map[string]bool{}
+	return func(ctx context.Context, tx database.DatabaseSession) error {
+		stored, err := findStoredEntity(ctx, tx, domainEntity)
+		if err != nil {
+			return err
+		}
+
+		err = takeStoredVersion(domainEntity, stored, precondition)
+		if err != nil {
+			return err
+		}
+
+		if check != nil {
+			if err = check(stored); err != nil {
+				return err
+			}
+		}
+
+		err = datamodel.ProtectMasked(stored, domainEntity, hashed)
+		if err != nil {
+			return err
+		}
+
+		err = domainEntity.BeforeSave(ctx, tx)
+		if err != nil {
+			return err
+		}
+
+		err = tx.ReplaceEntityByUUID(ctx, domainEntity, true)
+		if err != nil {
+			return err
+		}
+
+		// the overview row is delivered by the overview.Dispatcher
+		return overview.EnqueueUpdate(ctx, tx, domainEntity)
+	}
+}
+
+// DeleteEntity soft deletes the entity and removes its overview row
+func DeleteEntity(w http.ResponseWriter, r *http.Request, domainEntity database.DomainEntity) {
+	uuid := mux.Vars(r)["uuid"]
+	if uuid == "" {
+		httpcomm.SetResponseError(&w, "no uuid found in the request", nil, http.StatusBadRequest)
+		return
+	}
+
+	userIdentity, err := user.GetUserIdentityFromRequest(*r)
 	if err != nil {
-		return err
+		httpcomm.SetResponseError(&w, "", err, http.StatusUnauthorized)
+		return
 	}
+	domainEntity.SetUserIdentity(userIdentity)
+
+	err = changeDeletion(r.Context(), uuid, domainEntity, database.SoftDeleteEntity, overview.EnqueueRemove)
+	if database.IsNotFound(err) {
+		httpcomm.SetResponseError(&w, "", err, http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		httpcomm.SetResponseError(&w, "", err, http.StatusInternalServerError)
+		return
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// RestoreEntity restores a soft deleted entity and adds its overview row again
+func RestoreEntity(w http.ResponseWriter, r *http.Request, domainEntity database.DomainEntity) {
+	uuid := mux.Vars(r)["uuid"]
+	if uuid == "" {
+		httpcomm.SetResponseError(&w, "no uuid found in the request", nil, http.StatusBadRequest)
+		return
+	}
+
+	userIdentity, err := user.GetUserIdentityFromRequest(*r)
+	if err != nil {
+		httpcomm.SetResponseError(&w, "", err, http.StatusUnauthorized)
+		return
+	}
+	domainEntity.SetUserIdentity(userIdentity)
+
+	err = changeDeletion(r.Context(), uuid, domainEntity, database.RestoreDeletedEntity, overview.EnqueueUpdate)
+	if database.IsNotFound(err) {
+		httpcomm.SetResponseError(&w, "", err, http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		httpcomm.SetResponseError(&w, "", err, http.StatusInternalServerError)
+		return
+	}
+
+	setETag(w, domainEntity)
+	httpcomm.ServiceResponse{
+		Data: datamodel.RedactEntity(domainEntity),
+	}.WriteData(w, httpcomm.PayloadFormatJSON)
+}
+
+type deletionFunc func(ctx context.Context, session database.DatabaseSession, uuid string, domainEntity database.DomainEntity) error
+
+type enqueueFunc func(ctx context.Context, tx database.DatabaseSession, domainEntity database.DomainEntity) error
+
+// changeDeletion runs f and records the overview change in the same transaction
+func changeDeletion(ctx context.Context, uuid string, domainEntity database.DomainEntity, f deletionFunc, enqueue enqueueFunc) error {
+	session, err := database.OpenSession()
+	if err != nil {
+		return log.WrapError(err)
+	}
+	defer session.Close()
 
-	return session.ReplaceEntityByUUID(domainEntity, true)
+	return session.WithTransaction(ctx, func(ctx context.Context, tx database.DatabaseSession) error {
+		if err := f(ctx, tx, uuid, domainEntity); err != nil {
+			return err
+		}
+		return enqueue(ctx, tx, domainEntity)
+	})
 }
@@ -0,0 +1,85 @@
+package endpoint
+
+import (
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/dchaykin/go-modules/database"
+)
+
+// setETag sends the version of the entity as ETag, if the entity is versioned
+func setETag(w http.ResponseWriter, domainEntity database.DomainEntity) {
+	if versioned, ok := domainEntity.(database.VersionedEntity); ok {
+		w.Header().Set("ETag", strconv.Quote(strconv.FormatInt(versioned.Version(), 10)))
+	}
+}
+
+// ifMatch is the precondition of a save sent by the client
+type ifMatch int
+
+const (
+	// ifMatchNone saves unconditionally, no If-Match header has been sent
+	ifMatchNone ifMatch = iota
+	// ifMatchAny saves unconditionally if the entity exists, sent as "If-Match: *"
+	ifMatchAny
+	// ifMatchVersion saves if the stored version equals the version of the If-Match header
+	ifMatchVersion
+)
+
+// applyIfMatch takes the version expected by the client from the If-Match header. Without the header
+// or with "*" the save is unconditional and the stored version is taken on save, see saveEntity.
+func applyIfMatch(r *http.Request, domainEntity database.DomainEntity) (ifMatch, error) {
+	ifMatchHeader := strings.TrimSpace(r.Header.Get("If-Match"))
+	switch ifMatchHeader {
+	case "":
+		return ifMatchNone, nil
+	case "*":
+		return ifMatchAny, nil
+	}
+
+	versioned, ok := domainEntity.(database.VersionedEntity)
+	if !ok {
+		return ifMatchNone, nil
+	}
+	version, err := strconv.ParseInt(strings.Trim(strings.TrimPrefix(ifMatchHeader, "W/"), `"`), 10, 64)
+	if err != nil || version < 0 {
+		return ifMatchNone, fmt.Errorf("invalid If-Match header: %s", ifMatchHeader)
+	}
+	versioned.SetVersion(version)
+	return ifMatchVersion, nil
+}
+
+// takeStoredVersion prepares an unconditional save by setting the version of the stored entity read by
+// findStoredEntity, stored is nil for new entities
+func takeStoredVersion(domainEntity, stored database.DomainEntity, precondition ifMatch) error {
+	versioned, ok := domainEntity.(database.VersionedEntity)
+	if !ok || precondition == ifMatchVersion {
+		return nil
+	}
+	if stored == nil && precondition == ifMatchAny {
+		return &database.NotFoundError{UUID: domainEntity.UUID()}
+	}
+	version := int64(0)
+	if stored != nil {
+		version = stored.(database.VersionedEntity).Version()
+	}
+	versioned.SetVersion(version)
+	return nil
+}
+
+// saveStatus returns the status of a failed save: a failed If-Match is 412, a conflict during an
+// unconditional save 409 and a soft deleted entity 404
+func saveStatus(err error, precondition ifMatch) int {
+	if precondition != ifMatchNone && (database.IsConflict(err) || database.IsNotFound(err)) {
+		return http.StatusPreconditionFailed
+	}
+	if database.IsConflict(err) {
+		return http.StatusConflict
+	}
+	if database.IsNotFound(err) {
+		return http.StatusNotFound
+	}
+	return http.StatusInternalServerError
+}
@@ -0,0 +1,153 @@
+package endpoint
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/dchaykin/go-modules/database"
+	"github.com/dchaykin/go-modules/datamodel"
+	"github.com/gorilla/mux"
+	"github.com/stretchr/testify/require"
+)
+
+func TestETag(t *testing.T) {
+	database.UseMemoryBackend()
+	defer database.SetBackend(nil)
+
+	session, err := database.OpenSession()
+	require.NoError(t, err)
+	defer session.Close()
+
+	entity := &article{}
+	entity.SetUUID("a1")
+	require.NoError(t, session.ReplaceEntityByUUID(t.Context(), entity, true))
+	require.NoError(t, session.ReplaceEntityByUUID(t.Context(), entity, true))
+
+	req := mux.SetURLVars(httptest.NewRequest(http.MethodGet, "/entity/a1", nil), map[string]string{"uuid": "a1"})
+	w := httptest.NewRecorder()
+	GetDomainEntityByUUID(w, req, &article{})
+	require.Equal(t, http.StatusOK, w.Code)
+	require.Equal(t, `"2"`, w.Header().Get("ETag"))
+
+	req = mux.SetURLVars(httptest.NewRequest(http.MethodGet, "/entity/b2", nil), map[string]string{"uuid": "b2"})
+	w = httptest.NewRecorder()
+	GetDomainEntityByUUID(w, req, &article{})
+	require.Equal(t, http.StatusNotFound, w.Code)
+
+	req = httptest.NewRequest(http.MethodPost, "/entity", nil)
+	req.Header.Set("If-Match", `W/"2"`)
+	precondition, err := applyIfMatch(req, entity)
+	require.NoError(t, err)
+	require.Equal(t, ifMatchVersion, precondition)
+	require.EqualValues(t, 2, entity.Version())
+
+	req.Header.Set("If-Match", "*")
+	precondition, err = applyIfMatch(req, entity)
+	require.NoError(t, err)
+	require.Equal(t, ifMatchAny, precondition)
+
+	req.Header.Set("If-Match", "abc")
+	_, err = applyIfMatch(req, entity)
+	require.Error(t, err)
+}
+
+// racingArticle is saved by somebody else while its own save is running
+type racingArticle struct {
+	article
+}
+
+func (a *racingArticle) BeforeSave(ctx context.Context, tx database.DatabaseSession) error {
+	other := &article{}
+	if _, err := tx.GetEntityByUUID(ctx, a.UUID(), other); err != nil {
+		return err
+	}
+	return tx.ReplaceEntityByUUID(ctx, other, false)
+}
+
+func TestSaveEntityPreconditions(t *testing.T) {
+	database.UseMemoryBackend()
+	t.Cleanup(func() { database.SetBackend(nil) })
+	t.Setenv("AUTH_SECRET", "secret")
+
+	uuid, err := datamodel.GenerateUUID()
+	require.NoError(t, err)
+	save := func(domainEntity database.DomainEntity, ifMatch string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(http.MethodPost, "/entity", strings.NewReader(fmt.Sprintf(`{"entity":{"uuid":"%s","name":"Pencil"}}`, uuid)))
+		req.Header.Set("X-User-Info", rebuildUserInfo)
+		if ifMatch != "" {
+			req.Header.Set("If-Match", ifMatch)
+		}
+		w := httptest.NewRecorder()
+		CreateEntity(w, req, domainEntity, "shop")
+		return w
+	}
+
+	// without If-Match the entity is saved regardless of its version
+	w := save(&article{}, "*")
+	require.Equal(t, http.StatusPreconditionFailed, w.Code, w.Body.String())
+	w = save(&article{}, "")
+	require.Equal(t, http.StatusCreated, w.Code, w.Body.String())
+	require.Equal(t, `"1"`, w.Header().Get("ETag"))
+	w = save(&article{}, "")
+	require.Equal(t, http.StatusCreated, w.Code, w.Body.String())
+	require.Equal(t, `"2"`, w.Header().Get("ETag"))
+	w = save(&article{}, "*")
+	require.Equal(t, http.StatusCreated, w.Code, w.Body.String())
+	require.Equal(t, `"3"`, w.Header().Get("ETag"))
+
+	// a stale If-Match fails the precondition
+	w = save(&article{}, `"2"`)
+	require.Equal(t, http.StatusPreconditionFailed, w.Code, w.Body.String())
+	w = save(&article{}, `"3"`)
+	require.Equal(t, http.StatusCreated, w.Code, w.Body.String())
+	require.Equal(t, `"4"`, w.Header().Get("ETag"))
+
+	// a concurrent save during an unconditional one is a conflict
+	w = save(&racingArticle{}, "")
+	require.Equal(t, http.StatusConflict, w.Code, w.Body.String())
+
+	// a soft deleted entity is neither returned nor saved
+	session, err := database.OpenSession()
+	require.NoError(t, err)
+	defer session.Close()
+	require.NoError(t, database.SoftDeleteEntity(t.Context(), session, uuid, &article{}))
+	w = save(&article{}, "")
+	require.Equal(t, http.StatusNotFound, w.Code, w.Body.String())
+	w = save(&article{}, `"5"`)
+	require.Equal(t, http.StatusPreconditionFailed, w.Code, w.Body.String())
+
+	req := mux.SetURLVars(httptest.NewRequest(http.MethodGet, "/entity/"+uuid, nil), map[string]string{"uuid": uuid})
+	w = httptest.NewRecorder()
+	GetDomainEntityByUUID(w, req, &article{})
+	require.Equal(t, http.StatusNotFound, w.Code, w.Body.String())
+}
+
+func TestReplaceEntity(t *testing.T) {
+	database.UseMemoryBackend()
+	t.Cleanup(func() { database.SetBackend(nil) })
+
+	uuid, err := datamodel.GenerateUUID()
+	require.NoError(t, err)
+
+	// entities without a loaded version are saved unconditionally
+	for range 2 {
+		entity := &article{}
+		entity.SetUUID(uuid)
+		entity.SetUserIdentity(testUserIdentity(t))
+		require.NoError(t, ReplaceEntity(t.Context(), entity))
+	}
+
+	stale := &article{}
+	stale.SetUUID(uuid)
+	stale.SetUserIdentity(testUserIdentity(t))
+	stale.SetVersion(1)
+	require.True(t, database.IsConflict(ReplaceEntityIfMatch(t.Context(), stale)))
+
+	stale.SetVersion(2)
+	require.NoError(t, ReplaceEntityIfMatch(t.Context(), stale))
+	require.EqualValues(t, 3, stale.Version())
+}
@@ -6,9 +6,11 @@ import (
 	"fmt"
 	"io"
 	"mime/multipart"
+	"net/url"
 	"os"
 
 	"github.com/dchaykin/go-modules/datamodel"
+	"github.com/dchaykin/go-modules/service"
 	"github.com/dchaykin/go-modules/user"
 	"github.com/dchaykin/mygolib/httpcomm"
 	"github.com/dchaykin/mygolib/log"
@@ -17,7 +19,7 @@ import (
 func retrieveMetaData(fileUUID string, userIdentity user.UserIdentity) (*datamodel.MetaData, error) {
 	log.Debug("Downloading metadata for file %s", fileUUID)
 
-	ep := fmt.Sprintf("https://%s/app-cloudfile/api/metadata/%s", os.Getenv("MYHOST"), fileUUID)
+	ep := serviceURL(service.CloudFile, "api", "metadata", url.PathEscape(fileUUID))
 	hr := httpcomm.Get(ep, userIdentity, nil, nil)
 	if err := hr.GetError(); err != nil {
 		return nil, log.WrapError(err)
@@ -29,7 +31,7 @@ func retrieveMetaData(fileUUID string, userIdentity user.UserIdentity) (*datamod
 	}
 
 	if sr.Error != nil {
-		return nil, log.WrapError(fmt.Errorf(*sr.Error))
+		return nil, log.WrapError(fmt.Errorf("%s", *sr.Error))
 	}
 
 	data, err := sr.GetPayload()
@@ -55,7 +57,7 @@ func DownloadFile(fileUUID, path string, userIdentity user.UserIdentity) (*datam
 
 	log.Debug("Downloading file %s into %s", md.OriginalFileName, path)
 
-	ep := fmt.Sprintf("https://%s/app-cloudfile/api/file/%s", os.Getenv("MYHOST"), fileUUID)
+	ep := serviceURL(service.CloudFile, "api", "file", url.PathEscape(fileUUID))
 	hr := httpcomm.Get(ep, userIdentity, nil, nil)
 	if err := hr.GetError(); err != nil {
 		return nil, log.WrapError(err)
@@ -98,7 +100,7 @@ func UploadFile(pathToFile string, userIdentity user.UserIdentity) (string, *dat
 		return "", nil, log.WrapError(fmt.Errorf("error closing writer: %w", err))
 	}
 
-	ep := fmt.Sprintf("https://%s/app-cloudfile/api/upload", os.Getenv("MYHOST"))
+	ep := serviceURL(service.CloudFile, "api", "upload")
 	hr := httpcomm.PostBuffer(ep, userIdentity, map[string]string{
 		"Content-Type": writer.FormDataContentType(),
 	}, &body)
@@ -1,64 +1,69 @@
 package endpoint
 
 import (
+	"context"
 	"net/http"
+	"strconv"
 
 	"github.com/dchaykin/go-modules/database"
-	"github.com/dchaykin/go-modules/overview"
 	"github.com/dchaykin/go-modules/user"
 	"github.com/dchaykin/mygolib/httpcomm"
 )
 
-type OnNextBulkInsert func(session database.DatabaseSession, offset int64) ([]database.DomainEntity, error)
+type OnNextBulkInsert func(ctx context.Context, session database.DatabaseSession, offset int64) ([]database.DomainEntity, error)
 
-func RebuildOverview(w http.ResponseWriter, r *http.Request, subject, pathToDatamodel string, f OnNextBulkInsert) {
-	userIdentity, err := user.GetUserIdentityFromRequest(*r)
-	if err != nil {
-		httpcomm.SetResponseError(&w, "", err, http.StatusUnauthorized)
-		return
-	}
-
-	err = overview.CreateTemporaryOverview(userIdentity, pathToDatamodel)
-	if err != nil {
-		httpcomm.SetResponseError(&w, "", err, http.StatusInternalServerError)
-		return
-	}
-
-	session, err := database.OpenSession()
-	if err != nil {
-		httpcomm.SetResponseError(&w, "", err, http.StatusInternalServerError)
-		return
-	}
-	defer session.Close()
+// OnNextPage returns the entities following the continuation token (empty for the first page)
+// and the token of the next page, which is empty after the last page
+type OnNextPage func(ctx context.Context, session database.DatabaseSession, token string) ([]database.DomainEntity, string, error)
 
-	var offset int64 = 0
-	for {
-		recordList, err := f(session, offset)
+// ReadPages reads all entities of the domain entity's collection using keyset pagination
+func ReadPages(domainEntity database.DomainEntity, pageSize int64) OnNextPage {
+	return func(ctx context.Context, session database.DatabaseSession, token string) ([]database.DomainEntity, string, error) {
+		page, err := database.ReadDomainEntityPage(ctx, session, domainEntity, database.NewQuery(), token, pageSize, false)
 		if err != nil {
-			httpcomm.SetResponseError(&w, "", err, http.StatusInternalServerError)
-			return
+			return nil, "", err
 		}
+		return page.Entities, page.NextToken, nil
+	}
+}
 
-		if len(recordList) == 0 {
-			break // No more records to insert
+func RebuildOverview(w http.ResponseWriter, r *http.Request, subject, pathToDatamodel string, f OnNextBulkInsert) {
+	RebuildOverviewByPage(w, r, subject, pathToDatamodel, func(ctx context.Context, session database.DatabaseSession, token string) ([]database.DomainEntity, string, error) {
+		var offset int64
+		if token != "" {
+			offset, _ = strconv.ParseInt(token, 10, 64)
+		}
+		recordList, err := f(ctx, session, offset)
+		if err != nil || len(recordList) == 0 {
+			return nil, "", err // No more records to insert
 		}
+		return recordList, strconv.FormatInt(offset+int64(len(recordList)), 10), nil
+	})
+}
 
-		offset += int64(len(recordList))
+// RebuildOverviewByPage starts a rebuild job with the default options and responds with its status
+func RebuildOverviewByPage(w http.ResponseWriter, r *http.Request, subject, pathToDatamodel string, f OnNextPage) {
+	StartRebuildOverview(w, r, subject, pathToDatamodel, f, DefaultRebuildOptions())
+}
 
-		err = overview.BulkInsertIntoOverview(userIdentity, subject, recordList, true)
-		if err != nil {
-			httpcomm.SetResponseError(&w, "", err, http.StatusInternalServerError)
-			return
-		}
+// StartRebuildOverview starts a rebuild job and responds with 202 and its status. The progress can be
+// followed with GetRebuildStatus.
+func StartRebuildOverview(w http.ResponseWriter, r *http.Request, subject, pathToDatamodel string, f OnNextPage, opts RebuildOptions) {
+	userIdentity, err := user.GetUserIdentityFromRequest(*r)
+	if err != nil {
+		httpcomm.SetResponseError(&w, "", err, http.StatusUnauthorized)
+		return
 	}
 
-	err = overview.CommitOverview(userIdentity, subject)
+	job, err := StartRebuild(userIdentity, subject, pathToDatamodel, f, opts)
 	if err != nil {
 		httpcomm.SetResponseError(&w, "", err, http.StatusInternalServerError)
 		return
 	}
 
+	w.Header().Set("Content-Type", httpcomm.PayloadFormatJSON.String())
+	w.WriteHeader(http.StatusAccepted)
 	httpcomm.ServiceResponse{
-		Data: "OK",
+		Data: job.Status(),
 	}.WriteData(w, httpcomm.PayloadFormatJSON)
 }
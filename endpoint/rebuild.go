@@ -0,0 +1,353 @@
+package endpoint
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/dchaykin/go-modules/database"
+	"github.com/dchaykin/go-modules/datamodel"
+	"github.com/dchaykin/go-modules/overview"
+	"github.com/dchaykin/go-modules/user"
+	"github.com/dchaykin/mygolib/httpcomm"
+	"github.com/dchaykin/mygolib/log"
+	"github.com/gorilla/mux"
+)
+
+type RebuildState string
+
+const (
+	RebuildRunning   RebuildState = "running"
+	RebuildCompleted RebuildState = "completed"
+	RebuildFailed    RebuildState = "failed"
+	RebuildCanceled  RebuildState = "canceled"
+)
+
+// finished rebuild jobs are kept for status requests this long
+const rebuildRetention = time.Hour
+
+// OnCount returns the number of entities to insert, it is used to report the progress of a rebuild
+type OnCount func(ctx context.Context, session database.DatabaseSession) (int64, error)
+
+// OnRebuildFailure cleans up after a failed or canceled rebuild of the overview of the subject
+type OnRebuildFailure func(ctx context.Context, userIdentity user.UserIdentity, subject string) error
+
+type RebuildOptions struct {
+	// BatchSize is the number of entities sent per bulk insert
+	BatchSize int
+	// Workers is the number of bulk inserts running in parallel
+	Workers int
+	// Count is optional, without it the total is unknown until the rebuild has finished
+	Count  OnCount
+	Client *overview.Client
+	// Cleanup is optional. app-overview has no endpoint to drop a temporary overview, it is replaced by the
+	// temporary overview of the next rebuild. Set Cleanup to discard it right after a failed rebuild.
+	Cleanup OnRebuildFailure
+}
+
+func DefaultRebuildOptions() RebuildOptions {
+	return RebuildOptions{BatchSize: 500, Workers: 4}
+}
+
+type RebuildStatus struct {
+	JobID      string       `json:"jobId"`
+	Subject    string       `json:"subject"`
+	State      RebuildState `json:"state"`
+	Processed  int64        `json:"processed"`
+	Total      int64        `json:"total"` // -1 if unknown
+	Errors     []string     `json:"errors,omitempty"`
+	StartedAt  time.Time    `json:"startedAt"`
+	FinishedAt *time.Time   `json:"finishedAt,omitempty"`
+}
+
+// RebuildJob rebuilds the overview of a subject in the background: the entities are inserted into a temporary
+// overview, which replaces the current one after all entities have been inserted. If the rebuild fails or is
+// canceled the current overview is kept, see RebuildOptions.Cleanup for the temporary one.
+type RebuildJob struct {
+	tenant       string
+	userIdentity user.UserIdentity
+	opts         RebuildOptions
+	processed    atomic.Int64
+	cancel       context.CancelFunc
+	done         chan struct{}
+
+	mu     sync.Mutex
+	status RebuildStatus
+}
+
+var (
+	rebuildMu   sync.Mutex
+	rebuildJobs = map[string]*RebuildJob{}
+)
+
+// StartRebuild starts a rebuild job which reads the entities with f. The job runs independently of ctx.
+func StartRebuild(userIdentity user.UserIdentity, subject, pathToDatamodel string, f OnNextPage, opts RebuildOptions) (*RebuildJob, error) {
+	if opts.BatchSize <= 0 || opts.Workers <= 0 {
+		return nil, fmt.Errorf("invalid rebuild options: batch size %d, workers %d", opts.BatchSize, opts.Workers)
+	}
+	if opts.Client == nil {
+		opts.Client = overview.DefaultClient()
+	}
+
+	jobID, err := datamodel.GenerateUUID()
+	if err != nil {
+		return nil, err
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	job := &RebuildJob{
+		tenant:       userIdentity.Tenant(),
+		userIdentity: userIdentity,
+		opts:         opts,
+		cancel:       cancel,
+		done:         make(chan struct{}),
+		status: RebuildStatus{
+			JobID:     jobID,
+			Subject:   subject,
+			State:     RebuildRunning,
+			Total:     -1,
+			StartedAt: time.Now(),
+		},
+	}
+
+	rebuildMu.Lock()
+	for id, other := range rebuildJobs {
+		if finishedAt := other.Status().FinishedAt; finishedAt != nil && time.Since(*finishedAt) > rebuildRetention {
+			delete(rebuildJobs, id)
+		}
+	}
+	rebuildJobs[jobID] = job
+	rebuildMu.Unlock()
+
+	go job.run(ctx, pathToDatamodel, f)
+	return job, nil
+}
+
+// FindRebuildJob returns the job of the tenant, nil if there is none
+func FindRebuildJob(tenant, jobID string) *RebuildJob {
+	rebuildMu.Lock()
+	defer rebuildMu.Unlock()
+	job, ok := rebuildJobs[jobID]
+	if !ok || job.tenant != tenant {
+		return nil
+	}
+	return job
+}
+
+func (j *RebuildJob) Status() RebuildStatus {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	result := j.status
+	result.Processed = j.processed.Load()
+	result.Errors = append([]string(nil), j.status.Errors...)
+	return result
+}
+
+func (j *RebuildJob) Cancel() {
+	j.cancel()
+}
+
+// Wait blocks until the job has finished
+func (j *RebuildJob) Wait() {
+	<-j.done
+}
+
+func (j *RebuildJob) addError(err error) {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	j.status.Errors = append(j.status.Errors, err.Error())
+}
+
+func (j *RebuildJob) setTotal(total int64) {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	j.status.Total = total
+}
+
+func (j *RebuildJob) finish(state RebuildState) {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	now := time.Now()
+	j.status.State = state
+	j.status.FinishedAt = &now
+	if state == RebuildCompleted {
+		j.status.Total = j.processed.Load()
+	}
+}
+
+func (j *RebuildJob) run(ctx context.Context, pathToDatamodel string, f OnNextPage) {
+	defer close(j.done)
+	defer j.cancel()
+
+	subject := j.status.Subject
+	client := j.opts.Client
+	log.Info("Rebuild %s of the overview %s started", j.status.JobID, subject)
+
+	if err := client.CreateTemporaryOverview(ctx, j.userIdentity, pathToDatamodel); err != nil {
+		j.fail(ctx, err)
+		return
+	}
+
+	if err := j.insert(ctx, f); err != nil {
+		j.fail(ctx, err)
+		return
+	}
+
+	if err := client.CommitTemporaryOverview(ctx, j.userIdentity, subject); err != nil {
+		j.fail(ctx, err)
+		return
+	}
+
+	j.finish(RebuildCompleted)
+	log.Info("Rebuild %s of the overview %s completed, %d entities inserted", j.status.JobID, subject, j.processed.Load())
+}
+
+// fail records the error and runs the cleanup, if set
+func (j *RebuildJob) fail(ctx context.Context, err error) {
+	state := RebuildFailed
+	if errors.Is(ctx.Err(), context.Canceled) && errors.Is(err, context.Canceled) {
+		state = RebuildCanceled
+	} else {
+		j.addError(err)
+	}
+	log.Warn("Rebuild %s of the overview %s %s: %v", j.status.JobID, j.status.Subject, state, err)
+
+	if j.opts.Cleanup != nil {
+		cleanupCtx, cancel := context.WithTimeout(context.WithoutCancel(ctx), time.Minute)
+		defer cancel()
+		if err = j.opts.Cleanup(cleanupCtx, j.userIdentity, j.status.Subject); err != nil {
+			j.addError(fmt.Errorf("could not clean up after the failed rebuild: %w", err))
+		}
+	}
+	j.finish(state)
+}
+
+// insert reads the pages with f and inserts them in batches by the workers. The first failed batch
+// stops the reading and the other workers.
+func (j *RebuildJob) insert(ctx context.Context, f OnNextPage) error {
+	session, err := database.OpenSession()
+	if err != nil {
+		return err
+	}
+	defer session.Close()
+
+	if j.opts.Count != nil {
+		total, err := j.opts.Count(ctx, session)
+		if err != nil {
+			return err
+		}
+		j.setTotal(total)
+	}
+
+	ctx, cancel := context.WithCancelCause(ctx)
+	defer cancel(nil)
+
+	batches := make(chan []database.DomainEntity)
+	wg := sync.WaitGroup{}
+	for range j.opts.Workers {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for batch := range batches {
+				err := j.opts.Client.BulkInsertEntities(ctx, j.userIdentity, j.status.Subject, batch, true)
+				if err != nil {
+					cancel(err)
+					return
+				}
+				j.processed.Add(int64(len(batch)))
+			}
+		}()
+	}
+
+	err = j.readBatches(ctx, session, f, batches)
+	close(batches)
+	wg.Wait()
+
+	if cause := context.Cause(ctx); cause != nil {
+		return cause
+	}
+	return err
+}
+
+func (j *RebuildJob) readBatches(ctx context.Context, session database.DatabaseSession, f OnNextPage, batches chan<- []database.DomainEntity) error {
+	send := func(batch []database.DomainEntity) error {
+		select {
+		case batches <- batch:
+			return nil
+		case <-ctx.Done():
+			return context.Cause(ctx)
+		}
+	}
+
+	batch := []database.DomainEntity{}
+	token := ""
+	for {
+		entityList, nextToken, err := f(ctx, session, token)
+		if err != nil {
+			return err
+		}
+
+		for _, entity := range entityList {
+			batch = append(batch, entity)
+			if len(batch) == j.opts.BatchSize {
+				if err = send(batch); err != nil {
+					return err
+				}
+				batch = []database.DomainEntity{}
+			}
+		}
+
+		if nextToken == "" {
+			break // No more records to insert
+		}
+		token = nextToken
+	}
+
+	if len(batch) > 0 {
+		return send(batch)
+	}
+	return nil
+}
+
+// GetRebuildStatus writes the status of the rebuild job with the id in the path variable "jobId"
+func GetRebuildStatus(w http.ResponseWriter, r *http.Request) {
+	job := rebuildJobFromRequest(w, r)
+	if job == nil {
+		return
+	}
+
+	httpcomm.ServiceResponse{
+		Data: job.Status(),
+	}.WriteData(w, httpcomm.PayloadFormatJSON)
+}
+
+// CancelRebuild cancels the rebuild job with the id in the path variable "jobId"
+func CancelRebuild(w http.ResponseWriter, r *http.Request) {
+	job := rebuildJobFromRequest(w, r)
+	if job == nil {
+		return
+	}
+
+	job.Cancel()
+	w.WriteHeader(http.StatusAccepted)
+}
+
+func rebuildJobFromRequest(w http.ResponseWriter, r *http.Request) *RebuildJob {
+	userIdentity, err := user.GetUserIdentityFromRequest(*r)
+	if err != nil {
+		httpcomm.SetResponseError(&w, "", err, http.StatusUnauthorized)
+		return nil
+	}
+
+	jobID := mux.Vars(r)["jobId"]
+	job := FindRebuildJob(userIdentity.Tenant(), jobID)
+	if job == nil {
+		httpcomm.SetResponseError(&w, "", fmt.Errorf("no rebuild job %s found", jobID), http.StatusNotFound)
+		return nil
+	}
+	return job
+}
@@ -0,0 +1,204 @@
+package endpoint
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/dchaykin/go-modules/database"
+	"github.com/dchaykin/go-modules/overview"
+	"github.com/dchaykin/go-modules/service"
+	"github.com/dchaykin/go-modules/user"
+	"github.com/gorilla/mux"
+	"github.com/stretchr/testify/require"
+)
+
+const rebuildUserInfo = `{"claims":{"userName":"jdoe"},"currentTenant":"acme"}`
+
+// overviewStandIn records the calls to app-overview, bulk inserts are answered by bulkInsert
+type overviewStandIn struct {
+	mu         sync.Mutex
+	calls      []string
+	bulkInsert func(r *http.Request) int
+}
+
+func (s *overviewStandIn) called(prefix string) int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	result := 0
+	for _, call := range s.calls {
+		if strings.HasPrefix(call, prefix) {
+			result++
+		}
+	}
+	return result
+}
+
+func startRebuildTest(t *testing.T, bulkInsert func(r *http.Request) int) (*overviewStandIn, RebuildOptions, string) {
+	database.UseMemoryBackend()
+	t.Cleanup(func() { database.SetBackend(nil) })
+	t.Setenv("AUTH_SECRET", "secret")
+	t.Setenv("ASSETS_PATH", "")
+
+	standIn := &overviewStandIn{bulkInsert: bulkInsert}
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		io.Copy(io.Discard, r.Body) // lets the server notice when the client goes away
+		standIn.mu.Lock()
+		standIn.calls = append(standIn.calls, r.URL.Path)
+		standIn.mu.Unlock()
+		if strings.HasPrefix(r.URL.Path, "/api/bulk-insert/") && standIn.bulkInsert != nil {
+			w.WriteHeader(standIn.bulkInsert(r))
+		}
+	}))
+	t.Cleanup(server.Close)
+
+	pathToDatamodel := t.TempDir()
+	require.NoError(t, os.WriteFile(filepath.Join(pathToDatamodel, "datamodel.json"), []byte(`{"subject":"article","datamodel":{"article":{"uuid":{},"name":{}}}}`), 0644))
+
+	opts := DefaultRebuildOptions()
+	opts.BatchSize = 2
+	opts.Workers = 2
+	opts.Client = overview.NewClient(service.NewRegistry("").Set(service.Overview, server.URL))
+	opts.Client.RetryBackoff = time.Millisecond
+	opts.Cleanup = func(ctx context.Context, userIdentity user.UserIdentity, subject string) error {
+		standIn.mu.Lock()
+		defer standIn.mu.Unlock()
+		standIn.calls = append(standIn.calls, "cleanup/"+userIdentity.Tenant()+"/"+subject)
+		return nil
+	}
+	return standIn, opts, pathToDatamodel
+}
+
+// articlePages returns count articles in pages of three
+func articlePages(count int) OnNextPage {
+	return func(ctx context.Context, session database.DatabaseSession, token string) ([]database.DomainEntity, string, error) {
+		offset := 0
+		fmt.Sscan(token, &offset)
+		result := []database.DomainEntity{}
+		for i := offset; i < min(offset+3, count); i++ {
+			entity := &article{}
+			entity.SetUUID(fmt.Sprintf("a%d", i))
+			entity.SetValue("name", fmt.Sprintf("Article %d", i))
+			result = append(result, entity)
+		}
+		if offset+3 >= count {
+			return result, "", nil
+		}
+		return result, fmt.Sprint(offset + 3), nil
+	}
+}
+
+func rebuildStatusRequest(method, jobID, userInfo string) *http.Request {
+	req := httptest.NewRequest(method, "/rebuild/"+jobID, nil)
+	req.Header.Set("X-User-Info", userInfo)
+	return mux.SetURLVars(req, map[string]string{"jobId": jobID})
+}
+
+func TestRebuildOverview(t *testing.T) {
+	standIn, opts, pathToDatamodel := startRebuildTest(t, nil)
+	opts.Count = func(ctx context.Context, session database.DatabaseSession) (int64, error) {
+		return 7, nil
+	}
+
+	req := httptest.NewRequest(http.MethodPost, "/rebuild", nil)
+	req.Header.Set("X-User-Info", rebuildUserInfo)
+	w := httptest.NewRecorder()
+	StartRebuildOverview(w, req, "article", pathToDatamodel, articlePages(7), opts)
+	require.Equal(t, http.StatusAccepted, w.Code, w.Body.String())
+
+	response := struct {
+		Data RebuildStatus `json:"data"`
+	}{}
+	require.NoError(t, json.Unmarshal(w.Body.Bytes(), &response))
+	require.NotEmpty(t, response.Data.JobID)
+
+	job := FindRebuildJob("acme", response.Data.JobID)
+	require.NotNil(t, job)
+	job.Wait()
+
+	status := job.Status()
+	require.Equal(t, RebuildCompleted, status.State, status.Errors)
+	require.EqualValues(t, 7, status.Processed)
+	require.EqualValues(t, 7, status.Total)
+	require.NotNil(t, status.FinishedAt)
+	require.Equal(t, 1, standIn.called("/api/create/overview/acme"))
+	require.Equal(t, 4, standIn.called("/api/bulk-insert/article"))
+	require.Equal(t, 1, standIn.called("/api/commit/overview/acme/article"))
+	require.Zero(t, standIn.called("cleanup/"))
+
+	w = httptest.NewRecorder()
+	GetRebuildStatus(w, rebuildStatusRequest(http.MethodGet, status.JobID, rebuildUserInfo))
+	require.Equal(t, http.StatusOK, w.Code)
+	require.NoError(t, json.Unmarshal(w.Body.Bytes(), &response))
+	require.Equal(t, RebuildCompleted, response.Data.State)
+
+	// the jobs of other tenants are not visible
+	w = httptest.NewRecorder()
+	GetRebuildStatus(w, rebuildStatusRequest(http.MethodGet, status.JobID, `{"claims":{},"currentTenant":"other"}`))
+	require.Equal(t, http.StatusNotFound, w.Code)
+}
+
+func TestRebuildFailure(t *testing.T) {
+	standIn, opts, pathToDatamodel := startRebuildTest(t, func(r *http.Request) int {
+		return http.StatusInternalServerError
+	})
+
+	job, err := StartRebuild(testUserIdentity(t), "article", pathToDatamodel, articlePages(7), opts)
+	require.NoError(t, err)
+	job.Wait()
+
+	status := job.Status()
+	require.Equal(t, RebuildFailed, status.State)
+	require.NotEmpty(t, status.Errors)
+	require.Contains(t, status.Errors[0], "500")
+	require.Zero(t, standIn.called("/api/commit/"))
+	require.Equal(t, 1, standIn.called("cleanup/acme/article"))
+}
+
+func TestRebuildCancel(t *testing.T) {
+	started := make(chan struct{}, 10)
+	standIn, opts, pathToDatamodel := startRebuildTest(t, func(r *http.Request) int {
+		started <- struct{}{}
+		<-r.Context().Done()
+		return http.StatusServiceUnavailable
+	})
+
+	job, err := StartRebuild(testUserIdentity(t), "article", pathToDatamodel, articlePages(7), opts)
+	require.NoError(t, err)
+	select {
+	case <-started:
+	case <-job.done:
+		require.FailNow(t, "the job finished before the first bulk insert", "%v", job.Status())
+	}
+
+	w := httptest.NewRecorder()
+	CancelRebuild(w, rebuildStatusRequest(http.MethodDelete, job.Status().JobID, rebuildUserInfo))
+	require.Equal(t, http.StatusAccepted, w.Code)
+	job.Wait()
+
+	status := job.Status()
+	require.Equal(t, RebuildCanceled, status.State, status.Errors)
+	require.Zero(t, status.Processed)
+	require.Zero(t, standIn.called("/api/commit/"))
+	require.Equal(t, 1, standIn.called("cleanup/acme/article"))
+}
+
+func TestRebuildOptions(t *testing.T) {
+	_, err := StartRebuild(testUserIdentity(t), "article", "", articlePages(1), RebuildOptions{})
+	require.ErrorContains(t, err, "invalid rebuild options")
+}
+
+func testUserIdentity(t *testing.T) user.UserIdentity {
+	userIdentity, err := user.ParseUserIdentity([]byte(rebuildUserInfo))
+	require.NoError(t, err)
+	return userIdentity
+}
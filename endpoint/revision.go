@@ -0,0 +1,142 @@
+package endpoint
+
+import (
+	"fmt"
+	"net/http"
+	"strconv"
+
+	"github.com/dchaykin/go-modules/database"
+	"github.com/dchaykin/go-modules/datamodel"
+	"github.com/dchaykin/mygolib/httpcomm"
+	"github.com/dchaykin/mygolib/log"
+	"github.com/gorilla/mux"
+)
+
+type EntityDiff struct {
+	UUID    string              `json:"uuid"`
+	From    *database.Revision  `json:"from"`
+	To      *database.Revision  `json:"to"`
+	Changes datamodel.ChangeSet `json:"changes"`
+}
+
+func GetEntityRevisions(w http.ResponseWriter, r *http.Request, domainEntity database.DomainEntity) {
+	uuid := mux.Vars(r)["uuid"]
+	if uuid == "" {
+		httpcomm.SetResponseError(&w, "no uuid found in the request", nil, http.StatusBadRequest)
+		return
+	}
+
+	session, err := database.OpenSession()
+	if err != nil {
+		httpcomm.SetResponseError(&w, "", log.WrapError(err), http.StatusInternalServerError)
+		return
+	}
+	defer session.Close()
+
+	revisions, err := database.ListRevisions(r.Context(), session, uuid, domainEntity)
+	if err != nil {
+		httpcomm.SetResponseError(&w, "", err, http.StatusInternalServerError)
+		return
+	}
+
+	httpcomm.ServiceResponse{
+		Data: revisions,
+	}.WriteData(w, httpcomm.PayloadFormatJSON)
+}
+
+// GetEntityDiff compares two revisions of an entity, given by the query parameters "from" and "to".
+// Without "to" the latest revision is taken, without "from" the one before "to".
+func GetEntityDiff(w http.ResponseWriter, r *http.Request, domainEntity database.DomainEntity) {
+	uuid := mux.Vars(r)["uuid"]
+	if uuid == "" {
+		httpcomm.SetResponseError(&w, "no uuid found in the request", nil, http.StatusBadRequest)
+		return
+	}
+
+	from, to, err := revisionRange(r)
+	if err != nil {
+		httpcomm.SetResponseError(&w, "", err, http.StatusBadRequest)
+		return
+	}
+
+	session, err := database.OpenSession()
+	if err != nil {
+		httpcomm.SetResponseError(&w, "", log.WrapError(err), http.StatusInternalServerError)
+		return
+	}
+	defer session.Close()
+
+	if to == 0 {
+		revisions, err := database.ListRevisions(r.Context(), session, uuid, domainEntity)
+		if err != nil {
+			httpcomm.SetResponseError(&w, "", err, http.StatusInternalServerError)
+			return
+		}
+		if len(revisions) == 0 {
+			httpcomm.SetResponseError(&w, "", fmt.Errorf("no revisions of the record with UUID %s found", uuid), http.StatusNotFound)
+			return
+		}
+		to = revisions[len(revisions)-1].Revision
+	}
+	if from == 0 {
+		from = to - 1
+	}
+
+	result := EntityDiff{UUID: uuid}
+
+	newer := domainEntity.CreateEmpty()
+	if result.To, err = findRevision(r, session, uuid, to, newer); err != nil {
+		httpcomm.SetResponseError(&w, "", err, http.StatusInternalServerError)
+		return
+	}
+	if result.To == nil {
+		httpcomm.SetResponseError(&w, "", fmt.Errorf("no revision %d of the record with UUID %s found", to, uuid), http.StatusNotFound)
+		return
+	}
+
+	older := domainEntity.CreateEmpty()
+	var oldFields map[string]any
+	if from > 0 {
+		if result.From, err = findRevision(r, session, uuid, from, older); err != nil {
+			httpcomm.SetResponseError(&w, "", err, http.StatusInternalServerError)
+			return
+		}
+		if result.From == nil {
+			httpcomm.SetResponseError(&w, "", fmt.Errorf("no revision %d of the record with UUID %s found", from, uuid), http.StatusNotFound)
+			return
+		}
+		oldFields = older.Entity()
+	}
+
+	result.Changes = datamodel.RedactChanges(domainEntity.CollectionName(), datamodel.DiffFields(oldFields, newer.Entity()))
+
+	httpcomm.ServiceResponse{
+		Data: result,
+	}.WriteData(w, httpcomm.PayloadFormatJSON)
+}
+
+func findRevision(r *http.Request, session database.DatabaseSession, uuid string, revision int64, domainEntity database.DomainEntity) (*database.Revision, error) {
+	result, err := database.FindRevision(r.Context(), session, uuid, revision, domainEntity)
+	if err != nil || result == nil {
+		return nil, err
+	}
+	return result, result.Decode(domainEntity)
+}
+
+func revisionRange(r *http.Request) (from, to int64, err error) {
+	q := r.URL.Query()
+	if value := q.Get("to"); value != "" {
+		if to, err = strconv.ParseInt(value, 10, 64); err != nil || to < 1 {
+			return 0, 0, fmt.Errorf("invalid revision number: %s", value)
+		}
+	}
+	if value := q.Get("from"); value != "" {
+		if from, err = strconv.ParseInt(value, 10, 64); err != nil || from < 1 {
+			return 0, 0, fmt.Errorf("invalid revision number: %s", value)
+		}
+	}
+	if to > 0 && from >= to {
+		return 0, 0, fmt.Errorf("the revision %d is not older than %d", from, to)
+	}
+	return from, to, nil
+}
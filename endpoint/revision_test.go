@@ -0,0 +1,73 @@
+package endpoint
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/dchaykin/go-modules/database"
+	"github.com/dchaykin/go-modules/datamodel"
+	"github.com/gorilla/mux"
+	"github.com/stretchr/testify/require"
+)
+
+type article struct {
+	datamodel.Record `bson:",inline"`
+}
+
+func (a article) CollectionName() string {
+	return "article"
+}
+
+func (a article) DatabaseName() string {
+	return "test"
+}
+
+func (a article) CreateEmpty() database.DomainEntity {
+	return &article{}
+}
+
+func (a *article) GetAccessConfig() []database.AccessConfig {
+	return nil
+}
+
+func (a *article) OverviewRow() map[string]any {
+	return a.Fields
+}
+
+func TestGetEntityDiff(t *testing.T) {
+	database.UseMemoryBackend()
+	defer database.SetBackend(nil)
+
+	session, err := database.OpenSession()
+	require.NoError(t, err)
+	defer session.Close()
+
+	entity := &article{}
+	entity.SetUUID("a1")
+	entity.SetValue("name", "Alpha")
+	require.NoError(t, session.ReplaceEntityByUUID(t.Context(), entity, true))
+
+	entity.SetValue("name", "Alpha 2")
+	entity.SetValue("color", "green")
+	require.NoError(t, session.ReplaceEntityByUUID(t.Context(), entity, true))
+
+	req := mux.SetURLVars(httptest.NewRequest(http.MethodGet, "/entity/a1/diff", nil), map[string]string{"uuid": "a1"})
+	w := httptest.NewRecorder()
+	GetEntityDiff(w, req, &article{})
+	require.Equal(t, http.StatusOK, w.Code, w.Body.String())
+
+	response := struct {
+		Data EntityDiff `json:"data"`
+	}{}
+	require.NoError(t, json.Unmarshal(w.Body.Bytes(), &response))
+	require.EqualValues(t, 1, response.Data.From.Revision)
+	require.EqualValues(t, 2, response.Data.To.Revision)
+	require.Equal(t, []string{"color", "name"}, response.Data.Changes.Paths())
+
+	req = mux.SetURLVars(httptest.NewRequest(http.MethodGet, "/entity/a1/diff?from=2&to=1", nil), map[string]string{"uuid": "a1"})
+	w = httptest.NewRecorder()
+	GetEntityDiff(w, req, &article{})
+	require.Equal(t, http.StatusBadRequest, w.Code)
+}
@@ -0,0 +1,21 @@
+package endpoint
+
+import (
+	"sync/atomic"
+
+	"github.com/dchaykin/go-modules/service"
+)
+
+var services atomic.Pointer[service.Registry]
+
+// SetServices injects the registry used to call app-cloudfile and app-config, nil restores service.Default()
+func SetServices(registry *service.Registry) {
+	services.Store(registry)
+}
+
+func serviceURL(name string, path ...string) string {
+	if registry := services.Load(); registry != nil {
+		return registry.URL(name, path...)
+	}
+	return service.Default().URL(name, path...)
+}
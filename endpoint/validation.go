@@ -0,0 +1,159 @@
+package endpoint
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"sync"
+
+	"github.com/dchaykin/go-modules/database"
+	"github.com/dchaykin/go-modules/datamodel"
+	"github.com/dchaykin/go-modules/user"
+	"github.com/dchaykin/mygolib/httpcomm"
+	"github.com/dchaykin/mygolib/log"
+)
+
+// ReadonlyPolicy decides what happens to changed readonly fields on save
+type ReadonlyPolicy int
+
+const (
+	// ReadonlyReject rejects the save with the status 422
+	ReadonlyReject ReadonlyPolicy = iota
+	// ReadonlyRestore silently keeps the stored values
+	ReadonlyRestore
+)
+
+var (
+	datamodelMu       sync.RWMutex
+	datamodelRegistry = map[string]string{}
+	readonlyPolicy    = ReadonlyReject
+)
+
+// RegisterDatamodel sets the datamodel the entities of the collection are checked against on save,
+// configFile is the path passed to datamodel.LoadDataModelByRole. The masked fields of the datamodel
+// are redacted in all responses and stored as given by maskedStorage.
+func RegisterDatamodel(collectionName, configFile string, maskedStorage datamodel.MaskedStorage) error {
+	tenantConfig, err := datamodel.LoadDataModelByRole(configFile, "")
+	if err != nil {
+		return err
+	}
+	datamodel.RegisterMasking(collectionName, *tenantConfig, maskedStorage)
+
+	datamodelMu.Lock()
+	defer datamodelMu.Unlock()
+	datamodelRegistry[collectionName] = configFile
+	return nil
+}
+
+// SetReadonlyPolicy sets how changes to fields which are readonly for the role of the user are handled
+func SetReadonlyPolicy(policy ReadonlyPolicy) {
+	datamodelMu.Lock()
+	defer datamodelMu.Unlock()
+	readonlyPolicy = policy
+}
+
+func getReadonlyPolicy() ReadonlyPolicy {
+	datamodelMu.RLock()
+	defer datamodelMu.RUnlock()
+	return readonlyPolicy
+}
+
+func registeredDatamodel(collectionName string) (string, bool) {
+	datamodelMu.RLock()
+	defer datamodelMu.RUnlock()
+	configFile, ok := datamodelRegistry[collectionName]
+	return configFile, ok
+}
+
+// checkFunc checks the entity against the stored one within the save transaction, stored is nil for new entities
+type checkFunc func(stored database.DomainEntity) error
+
+// entityCheck returns the check of the entity against the datamodel of its collection resolved for the role of
+// the user. Masked fields sent as datamodel.MaskedValue keep their stored values, the values are converted to the
+// types of their fields, changes to readonly fields of a stored entity are rejected or restored according to the
+// readonly policy, then the entity is validated.
+// Entities of collections without a registered datamodel are not checked, for them nil is returned.
+func entityCheck(userIdentity user.UserIdentity, domainEntity database.DomainEntity, appName string) (checkFunc, error) {
+	configFile, ok := registeredDatamodel(domainEntity.CollectionName())
+	if !ok {
+		return nil, nil
+	}
+
+	tenantConfig, err := datamodel.LoadDataModelByRole(configFile, userIdentity.RoleByApp(appName))
+	if err != nil {
+		return nil, err
+	}
+
+	return func(stored database.DomainEntity) error {
+		datamodel.KeepMaskedValues(stored, domainEntity)
+
+		// unconvertible values are kept, the validation reports them together with the other errors
+		coerceErr := tenantConfig.CoerceEntity(domainEntity.Entity())
+		if stored != nil {
+			if err := checkReadonly(tenantConfig, stored, domainEntity); err != nil {
+				return err
+			}
+		}
+		if err := tenantConfig.ValidateEntity(domainEntity.Entity()); err != nil {
+			return err
+		}
+		return coerceErr
+	}, nil
+}
+
+// findStoredEntity reads the stored entity within the save transaction, it returns nil for new entities. A soft
+// deleted entity must be restored before it can be saved again, for it a *database.NotFoundError is returned.
+func findStoredEntity(ctx context.Context, tx database.DatabaseSession, domainEntity database.DomainEntity) (database.DomainEntity, error) {
+	if domainEntity.UUID() == "" {
+		return nil, nil
+	}
+
+	stored := domainEntity.CreateEmpty()
+	found, err := tx.GetEntityByUUID(ctx, domainEntity.UUID(), stored)
+	if err != nil || found {
+		return stored, err
+	}
+
+	// the entity is either new or soft deleted
+	_, deleted, err := database.StoredVersion(ctx, tx, domainEntity)
+	if err != nil {
+		return nil, err
+	}
+	if deleted {
+		return nil, &database.NotFoundError{UUID: domainEntity.UUID()}
+	}
+	return nil, nil
+}
+
+// checkReadonly compares the entity with the stored one, new entities are not affected by readonly fields
+func checkReadonly(tenantConfig *datamodel.TenantConfig, stored, domainEntity database.DomainEntity) error {
+	if getReadonlyPolicy() == ReadonlyRestore {
+		for _, change := range tenantConfig.RestoreReadonly(stored.Entity(), domainEntity.Entity()) {
+			log.Info("The readonly field %s of %s has been restored", change.Path, domainEntity.UUID())
+		}
+		return nil
+	}
+
+	if changes := tenantConfig.ReadonlyChanges(stored.Entity(), domainEntity.Entity()); len(changes) > 0 {
+		return &datamodel.ValidationError{Fields: changes}
+	}
+	return nil
+}
+
+// setValidationError writes the field errors with the status 422
+func setValidationError(w http.ResponseWriter, err error) {
+	validationErr := &datamodel.ValidationError{}
+	if !errors.As(err, &validationErr) {
+		httpcomm.SetResponseError(&w, "", err, http.StatusInternalServerError)
+		return
+	}
+
+	message := validationErr.Error()
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusUnprocessableEntity)
+	json.NewEncoder(w).Encode(httpcomm.ServiceResponse{
+		Data:  validationErr.Fields,
+		Error: &message,
+	})
+}
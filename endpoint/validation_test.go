@@ -0,0 +1,276 @@
+package endpoint
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/dchaykin/go-modules/database"
+	"github.com/dchaykin/go-modules/datamodel"
+	"github.com/dchaykin/go-modules/user"
+	"github.com/gorilla/mux"
+	"github.com/stretchr/testify/require"
+)
+
+// registerTestDatamodel registers the datamodel of the articles for the duration of the test
+func registerTestDatamodel(t *testing.T, pathToDatamodel string, maskedStorage datamodel.MaskedStorage) {
+	require.NoError(t, RegisterDatamodel("article", pathToDatamodel, maskedStorage))
+	t.Cleanup(func() {
+		datamodelMu.Lock()
+		delete(datamodelRegistry, "article")
+		datamodelMu.Unlock()
+		datamodel.RegisterMasking("article", datamodel.TenantConfig{}, datamodel.MaskedPlain)
+	})
+}
+
+func TestCreateEntityValidation(t *testing.T) {
+	database.UseMemoryBackend()
+	t.Cleanup(func() { database.SetBackend(nil) })
+	t.Setenv("AUTH_SECRET", "secret")
+	t.Setenv("ASSETS_PATH", "")
+
+	pathToDatamodel := t.TempDir()
+	require.NoError(t, os.WriteFile(filepath.Join(pathToDatamodel, "datamodel.json"), []byte(`{"subject":"article","datamodel":{"article":{"uuid":{},"name":{"size":10},"stock":{"type":"int"}}}}`), 0644))
+	registerTestDatamodel(t, pathToDatamodel, datamodel.MaskedPlain)
+
+	createArticle := func(payload string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(http.MethodPost, "/entity", strings.NewReader(payload))
+		req.Header.Set("X-User-Info", rebuildUserInfo)
+		w := httptest.NewRecorder()
+		CreateEntity(w, req, &article{}, "shop")
+		return w
+	}
+
+	w := createArticle(`{"entity":{"uuid":"a1","name":"A very long name","stock":"many","color":"red"}}`)
+	require.Equal(t, http.StatusUnprocessableEntity, w.Code, w.Body.String())
+	require.Equal(t, "application/json", w.Header().Get("Content-Type"))
+
+	response := struct {
+		Data  []datamodel.FieldError `json:"data"`
+		Error string                 `json:"error"`
+	}{}
+	require.NoError(t, json.Unmarshal(w.Body.Bytes(), &response))
+	require.Equal(t, []string{"color", "name", "stock"}, []string{response.Data[0].Path, response.Data[1].Path, response.Data[2].Path})
+	require.Equal(t, datamodel.FieldErrorUnknown, response.Data[0].Code)
+	require.Equal(t, datamodel.FieldErrorSize, response.Data[1].Code)
+	require.Equal(t, datamodel.FieldErrorType, response.Data[2].Code)
+	require.Contains(t, response.Error, "the entity is invalid")
+
+	err := database.GetDomainEntityByUUID(t.Context(), "a1", &article{})
+	require.True(t, database.IsNotFound(err), "%v", err)
+
+	uuid, err := datamodel.GenerateUUID()
+	require.NoError(t, err)
+	w = createArticle(fmt.Sprintf(`{"entity":{"uuid":"%s","name":"Pencil","stock":"12"}}`, uuid))
+	require.Equal(t, http.StatusCreated, w.Code, w.Body.String())
+
+	// the values are stored with the types of their fields
+	stored := &article{}
+	require.NoError(t, database.GetDomainEntityByUUID(t.Context(), uuid, stored))
+	require.Equal(t, int64(12), stored.Entity()["stock"])
+}
+
+func TestCreateEntityReadonly(t *testing.T) {
+	database.UseMemoryBackend()
+	t.Cleanup(func() { database.SetBackend(nil) })
+	t.Setenv("AUTH_SECRET", "secret")
+	t.Setenv("ASSETS_PATH", "")
+
+	pathToDatamodel := t.TempDir()
+	require.NoError(t, os.WriteFile(filepath.Join(pathToDatamodel, "datamodel.json"), []byte(`{"subject":"article","datamodel":{"article":{"uuid":{},"name":{},"stock":{"type":"int"}}},
+		"roles":{"default":{},"customer":{"field":"fields-customer.json"}}}`), 0644))
+	require.NoError(t, os.WriteFile(filepath.Join(pathToDatamodel, "fields-customer.json"), []byte(`{"article":{"name":{"readonly":true}}}`), 0644))
+	registerTestDatamodel(t, pathToDatamodel, datamodel.MaskedPlain)
+	t.Cleanup(func() { SetReadonlyPolicy(ReadonlyReject) })
+
+	saveArticle := func(payload, ifMatch string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(http.MethodPut, "/entity", strings.NewReader(payload))
+		if ifMatch != "" {
+			req.Header.Set("If-Match", ifMatch)
+		}
+		req.Header.Set("X-User-Info", `{"claims":{"userName":"jdoe","roles":{"shop":"customer"}},"currentTenant":"acme"}`)
+		w := httptest.NewRecorder()
+		CreateEntity(w, req, &article{}, "shop")
+		return w
+	}
+
+	uuid, err := datamodel.GenerateUUID()
+	require.NoError(t, err)
+
+	// readonly fields can be set on create
+	w := saveArticle(fmt.Sprintf(`{"entity":{"uuid":"%s","name":"Pencil","stock":12}}`, uuid), "")
+	require.Equal(t, http.StatusCreated, w.Code, w.Body.String())
+
+	w = saveArticle(fmt.Sprintf(`{"entity":{"uuid":"%s","name":"Pen","stock":5}}`, uuid), `"1"`)
+	require.Equal(t, http.StatusUnprocessableEntity, w.Code, w.Body.String())
+	require.Contains(t, w.Body.String(), `"path":"name","code":"readonly"`)
+
+	SetReadonlyPolicy(ReadonlyRestore)
+	w = saveArticle(fmt.Sprintf(`{"entity":{"uuid":"%s","name":"Pen","stock":5}}`, uuid), `"1"`)
+	require.Equal(t, http.StatusCreated, w.Code, w.Body.String())
+
+	stored := &article{}
+	require.NoError(t, database.GetDomainEntityByUUID(t.Context(), uuid, stored))
+	require.Equal(t, "Pencil", stored.GetValue("name"))
+	require.EqualValues(t, 5, stored.GetValue("stock"))
+
+	// the readonly fields are compared with the entity stored when the save runs, not when it has been prepared
+	SetReadonlyPolicy(ReadonlyReject)
+	userIdentity, err := user.ParseUserIdentity([]byte(`{"claims":{"userName":"jdoe","roles":{"shop":"customer"}},"currentTenant":"acme"}`))
+	require.NoError(t, err)
+	incoming := &article{}
+	incoming.SetValue("uuid", uuid)
+	incoming.SetValue("name", "Pencil")
+	incoming.SetUserIdentity(userIdentity)
+	check, err := entityCheck(userIdentity, incoming, "shop")
+	require.NoError(t, err)
+
+	stored.SetValue("name", "Marker")
+	session, err := database.OpenSession()
+	require.NoError(t, err)
+	defer session.Close()
+	require.NoError(t, session.ReplaceEntityByUUID(t.Context(), stored, false))
+
+	require.True(t, datamodel.IsValidationError(replaceEntity(t.Context(), incoming, ifMatchNone, check)))
+	require.NoError(t, database.GetDomainEntityByUUID(t.Context(), uuid, stored))
+	require.Equal(t, "Marker", stored.GetValue("name"))
+}
+
+func TestMaskedFields(t *testing.T) {
+	database.UseMemoryBackend()
+	t.Cleanup(func() { database.SetBackend(nil) })
+	t.Setenv("AUTH_SECRET", "secret")
+	t.Setenv("ASSETS_PATH", "")
+
+	pathToDatamodel := t.TempDir()
+	require.NoError(t, os.WriteFile(filepath.Join(pathToDatamodel, "datamodel.json"), []byte(`{"subject":"article","datamodel":{"article":{"uuid":{},"name":{},"apiKey":{"masked":true,"size":10}}}}`), 0644))
+	registerTestDatamodel(t, pathToDatamodel, datamodel.MaskedHashed)
+
+	uuid, err := datamodel.GenerateUUID()
+	require.NoError(t, err)
+
+	saveArticle := func(payload, ifMatch string) {
+		req := httptest.NewRequest(http.MethodPut, "/entity", strings.NewReader(fmt.Sprintf(payload, uuid)))
+		req.Header.Set("X-User-Info", rebuildUserInfo)
+		if ifMatch != "" {
+			req.Header.Set("If-Match", ifMatch)
+		}
+		w := httptest.NewRecorder()
+		CreateEntity(w, req, &article{}, "shop")
+		require.Equal(t, http.StatusCreated, w.Code, w.Body.String())
+	}
+	storedKey := func() string {
+		stored := &article{}
+		require.NoError(t, database.GetDomainEntityByUUID(t.Context(), uuid, stored))
+		return stored.GetValue("apiKey").(string)
+	}
+
+	saveArticle(`{"entity":{"uuid":"%s","name":"Pencil","apiKey":"k1"}}`, "")
+	hash := storedKey()
+	require.True(t, datamodel.VerifyMaskedValue(hash, "k1"))
+
+	req := mux.SetURLVars(httptest.NewRequest(http.MethodGet, "/entity/"+uuid, nil), map[string]string{"uuid": uuid})
+	w := httptest.NewRecorder()
+	GetDomainEntityByUUID(w, req, &article{})
+	require.Equal(t, http.StatusOK, w.Code)
+	require.Contains(t, w.Body.String(), `"apiKey":"********"`)
+	require.NotContains(t, w.Body.String(), hash)
+
+	// the masked value sent back keeps the stored one, the size of the field does not apply to its hash
+	saveArticle(`{"entity":{"uuid":"%s","name":"Pen","apiKey":"********"}}`, `"1"`)
+	require.Equal(t, hash, storedKey())
+
+	saveArticle(`{"entity":{"uuid":"%s","name":"Pen","apiKey":"k2"}}`, `"2"`)
+	require.True(t, datamodel.VerifyMaskedValue(storedKey(), "k2"))
+
+	req = mux.SetURLVars(httptest.NewRequest(http.MethodGet, "/entity/"+uuid+"/diff", nil), map[string]string{"uuid": uuid})
+	w = httptest.NewRecorder()
+	GetEntityDiff(w, req, &article{})
+	require.Equal(t, http.StatusOK, w.Code, w.Body.String())
+	require.Contains(t, w.Body.String(), `{"op":"modified","path":"apiKey","oldValue":"********","newValue":"********"}`)
+	require.NotContains(t, w.Body.String(), "$argon2id$")
+
+	// a hash sent by the client is hashed again, so that it cannot choose the secret
+	chosen, err := json.Marshal(hash)
+	require.NoError(t, err)
+	saveArticle(`{"entity":{"uuid":"%s","name":"Pen","apiKey":`+string(chosen)+`}}`, `"3"`)
+	require.NotEqual(t, hash, storedKey())
+	require.False(t, datamodel.VerifyMaskedValue(storedKey(), "k1"))
+	saveArticle(`{"entity":{"uuid":"%s","name":"Pen","apiKey":"k2"}}`, `"4"`)
+
+	// a soft deleted entity must be restored before it can be saved again, its masked values are kept
+	session, err := database.OpenSession()
+	require.NoError(t, err)
+	defer session.Close()
+	require.NoError(t, database.SoftDeleteEntity(t.Context(), session, uuid, &article{}))
+	req = httptest.NewRequest(http.MethodPut, "/entity", strings.NewReader(fmt.Sprintf(`{"entity":{"uuid":"%s","name":"Pen","apiKey":"********"}}`, uuid)))
+	req.Header.Set("X-User-Info", rebuildUserInfo)
+	w = httptest.NewRecorder()
+	CreateEntity(w, req, &article{}, "shop")
+	require.Equal(t, http.StatusNotFound, w.Code, w.Body.String())
+
+	require.NoError(t, database.RestoreDeletedEntity(t.Context(), session, uuid, &article{}))
+	require.True(t, datamodel.VerifyMaskedValue(storedKey(), "k2"))
+}
+
+func TestSaveTransactionRetry(t *testing.T) {
+	database.UseMemoryBackend()
+	t.Cleanup(func() { database.SetBackend(nil) })
+
+	pathToDatamodel := t.TempDir()
+	require.NoError(t, os.WriteFile(filepath.Join(pathToDatamodel, "datamodel.json"), []byte(`{"subject":"article","datamodel":{"article":{"uuid":{},"apiKey":{"masked":true}}}}`), 0644))
+	registerTestDatamodel(t, pathToDatamodel, datamodel.MaskedHashed)
+
+	session, err := database.OpenSession()
+	require.NoError(t, err)
+	defer session.Close()
+
+	entity := &article{}
+	entity.SetUUID("a1")
+	entity.SetValue("apiKey", "k1")
+
+	// the first attempt is rolled back like a transient error, the retry runs the same callback again
+	save := saveTransaction(entity, ifMatchNone, nil)
+	err = session.WithTransaction(t.Context(), func(ctx context.Context, tx database.DatabaseSession) error {
+		if err := save(ctx, tx); err != nil {
+			return err
+		}
+		return errors.New("transient error")
+	})
+	require.EqualError(t, err, "transient error")
+	require.NoError(t, session.WithTransaction(t.Context(), save))
+
+	stored := &article{}
+	require.NoError(t, database.GetDomainEntityByUUID(t.Context(), "a1", stored))
+	require.True(t, datamodel.VerifyMaskedValue(stored.GetValue("apiKey").(string), "k1"))
+}
+
+func TestCreateEntityMetadata(t *testing.T) {
+	database.UseMemoryBackend()
+	t.Cleanup(func() { database.SetBackend(nil) })
+	t.Setenv("AUTH_SECRET", "secret")
+
+	uuid, err := datamodel.GenerateUUID()
+	require.NoError(t, err)
+
+	// the deletion and the schema version sent by the client are ignored
+	payload := `{"Metadata":{"DeletedAt":"2025-01-01T00:00:00Z","DeletedBy":"jdoe","SchemaVersion":7},"entity":{"uuid":"%s","name":"Pencil"}}`
+	req := httptest.NewRequest(http.MethodPut, "/entity", strings.NewReader(fmt.Sprintf(payload, uuid)))
+	req.Header.Set("X-User-Info", rebuildUserInfo)
+	w := httptest.NewRecorder()
+	CreateEntity(w, req, &article{}, "shop")
+	require.Equal(t, http.StatusCreated, w.Code, w.Body.String())
+
+	stored := &article{}
+	require.NoError(t, database.GetDomainEntityByUUID(t.Context(), uuid, stored))
+	require.Nil(t, stored.Metadata.DeletedAt)
+	require.Empty(t, stored.Metadata.DeletedBy)
+	require.Zero(t, stored.SchemaVersion())
+}
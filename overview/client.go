@@ -0,0 +1,288 @@
+package overview
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"math/rand/v2"
+	"net/http"
+	"net/url"
+	"sync"
+	"time"
+
+	"github.com/dchaykin/go-modules/service"
+	"github.com/dchaykin/go-modules/user"
+	"github.com/dchaykin/mygolib/log"
+)
+
+// ResponseError is returned for a response of app-overview with an unexpected status
+type ResponseError struct {
+	Method     string
+	URL        string
+	StatusCode int
+	Body       []byte
+}
+
+func (e *ResponseError) Error() string {
+	return fmt.Sprintf("%s %s: %d %s: %s", e.Method, e.URL, e.StatusCode, http.StatusText(e.StatusCode), string(e.Body))
+}
+
+// ResponseStatus returns the status code of a ResponseError in the chain of err, 0 if there is none
+func ResponseStatus(err error) int {
+	responseErr := &ResponseError{}
+	if errors.As(err, &responseErr) {
+		return responseErr.StatusCode
+	}
+	return 0
+}
+
+// CircuitOpenError is returned without calling app-overview while the circuit breaker is open
+type CircuitOpenError struct {
+	Until time.Time
+}
+
+func (e *CircuitOpenError) Error() string {
+	return fmt.Sprintf("app-overview is unavailable, the circuit breaker is open until %s", e.Until.Format(time.RFC3339))
+}
+
+func IsCircuitOpen(err error) bool {
+	circuitOpen := &CircuitOpenError{}
+	return errors.As(err, &circuitOpen)
+}
+
+// Client calls the API of app-overview at the URL found in Services, the default registry if nil. Idempotent calls
+// are retried with an exponential backoff and jitter after network errors and 5xx responses. After BreakerThreshold
+// failures in a row the circuit breaker opens: for BreakerCooldown all calls fail immediately, then a single trial
+// call decides whether it closes again.
+type Client struct {
+	Services         *service.Registry
+	Timeout          time.Duration
+	MaxAttempts      int
+	RetryBackoff     time.Duration
+	MaxRetryBackoff  time.Duration
+	BreakerThreshold int
+	BreakerCooldown  time.Duration
+	HTTPClient       *http.Client
+
+	mu        sync.Mutex
+	failures  int
+	openUntil time.Time
+	trial     bool
+}
+
+func NewClient(services *service.Registry) *Client {
+	return &Client{
+		Services:         services,
+		Timeout:          30 * time.Second,
+		MaxAttempts:      3,
+		RetryBackoff:     200 * time.Millisecond,
+		MaxRetryBackoff:  5 * time.Second,
+		BreakerThreshold: 5,
+		BreakerCooldown:  30 * time.Second,
+		HTTPClient:       http.DefaultClient,
+	}
+}
+
+var (
+	defaultClientMu sync.Mutex
+	defaultClient   *Client
+)
+
+// DefaultClient returns the client used by the functions of this package. Unless replaced by SetDefaultClient
+// it calls app-overview as configured in service.Default().
+func DefaultClient() *Client {
+	defaultClientMu.Lock()
+	defer defaultClientMu.Unlock()
+	if defaultClient == nil {
+		defaultClient = NewClient(nil)
+	}
+	return defaultClient
+}
+
+func SetDefaultClient(client *Client) {
+	defaultClientMu.Lock()
+	defer defaultClientMu.Unlock()
+	defaultClient = client
+}
+
+func (c *Client) CreateOverview(ctx context.Context, userIdentity user.UserIdentity, tenant string, payload []byte, temporary bool) error {
+	query := url.Values{}
+	if temporary {
+		query.Set("temporary", "true")
+	}
+	_, err := c.post(ctx, userIdentity, "/create/overview/"+url.PathEscape(tenant), "", query, payload, true)
+	return err
+}
+
+// BulkInsert is not idempotent and therefore never retried
+func (c *Client) BulkInsert(ctx context.Context, userIdentity user.UserIdentity, subject string, payload []byte, temporary bool) error {
+	query := url.Values{}
+	if temporary {
+		query.Set("temporary", "true")
+	}
+	_, err := c.post(ctx, userIdentity, "/bulk-insert/"+url.PathEscape(subject), subject, query, payload, false)
+	return err
+}
+
+// CommitOverview replaces the overview by the temporary one, it is never retried
+func (c *Client) CommitOverview(ctx context.Context, userIdentity user.UserIdentity, tenant, subject string) error {
+	_, err := c.post(ctx, userIdentity, "/commit/overview/"+url.PathEscape(tenant)+"/"+url.PathEscape(subject), subject, nil, nil, false)
+	return err
+}
+
+func (c *Client) SaveRow(ctx context.Context, userIdentity user.UserIdentity, subject string, payload []byte) error {
+	_, err := c.post(ctx, userIdentity, "/save/"+url.PathEscape(subject), subject, nil, payload, true)
+	return err
+}
+
+func (c *Client) RemoveRow(ctx context.Context, userIdentity user.UserIdentity, subject, uuid string) error {
+	_, err := c.post(ctx, userIdentity, "/remove/"+url.PathEscape(subject)+"/"+url.PathEscape(uuid), subject, nil, nil, true)
+	return err
+}
+
+// post logs the payload size only, the rows contain tenant data
+func (c *Client) post(ctx context.Context, userIdentity user.UserIdentity, path, subject string, query url.Values, payload []byte, idempotent bool) ([]byte, error) {
+	endpoint := c.baseURL() + path
+	if len(query) > 0 {
+		endpoint += "?" + query.Encode()
+	}
+	log.Debug("/POST %s, subject '%s', %d bytes", endpoint, subject, len(payload))
+
+	attempts := 1
+	if idempotent {
+		attempts = max(c.MaxAttempts, 1)
+	}
+
+	var err error
+	for attempt := 1; ; attempt++ {
+		if err = c.allow(); err != nil {
+			return nil, err
+		}
+
+		var answer []byte
+		answer, err = c.send(ctx, userIdentity, endpoint, payload)
+		c.record(ctx, err)
+		if err == nil {
+			return answer, nil
+		}
+		if attempt >= attempts || !retryable(err) || ctx.Err() != nil {
+			return nil, err
+		}
+
+		log.Warn("attempt %d of %d to call %s failed: %v", attempt, attempts, endpoint, err)
+		select {
+		case <-time.After(c.backoff(attempt)):
+		case <-ctx.Done():
+			return nil, fmt.Errorf("%w, last error: %v", ctx.Err(), err)
+		}
+	}
+}
+
+func (c *Client) baseURL() string {
+	services := c.Services
+	if services == nil {
+		services = service.Default()
+	}
+	return services.URL(service.Overview, "api")
+}
+
+func (c *Client) send(ctx context.Context, userIdentity user.UserIdentity, endpoint string, payload []byte) ([]byte, error) {
+	if c.Timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, c.Timeout)
+		defer cancel()
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, endpoint, bytes.NewReader(payload))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	if userIdentity != nil {
+		if err = userIdentity.Set(req); err != nil {
+			return nil, err
+		}
+	}
+
+	resp, err := c.HTTPClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return nil, err
+	}
+	switch resp.StatusCode {
+	case http.StatusOK, http.StatusCreated, http.StatusAccepted, http.StatusNoContent:
+		return body, nil
+	}
+	return nil, &ResponseError{Method: http.MethodPost, URL: endpoint, StatusCode: resp.StatusCode, Body: body}
+}
+
+// retryable reports whether err is a network error, a timeout or a 5xx response
+func retryable(err error) bool {
+	if IsCircuitOpen(err) {
+		return false
+	}
+	status := ResponseStatus(err)
+	return status == 0 || status >= http.StatusInternalServerError
+}
+
+// backoff doubles the delay with every attempt, the actual delay is chosen randomly from its upper half
+func (c *Client) backoff(attempt int) time.Duration {
+	delay := c.RetryBackoff
+	for i := 1; i < attempt && delay < c.MaxRetryBackoff; i++ {
+		delay *= 2
+	}
+	delay = min(delay, c.MaxRetryBackoff)
+	if delay <= 1 {
+		return delay
+	}
+	return delay/2 + rand.N(delay/2)
+}
+
+// allow fails while the circuit breaker is open. After the cooldown only one trial call passes.
+func (c *Client) allow() error {
+	if c.BreakerThreshold <= 0 {
+		return nil
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.failures < c.BreakerThreshold {
+		return nil
+	}
+	if c.trial || time.Now().Before(c.openUntil) {
+		return &CircuitOpenError{Until: c.openUntil}
+	}
+	c.trial = true
+	return nil
+}
+
+// record counts the failures of app-overview, client errors like 4xx responses do not open the breaker.
+// Calls canceled or timed out by the caller's context are not counted, the client's own Timeout is.
+func (c *Client) record(ctx context.Context, err error) {
+	if c.BreakerThreshold <= 0 {
+		return
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.trial = false
+	if err != nil && ctx.Err() != nil {
+		return // canceled or timed out by the caller, says nothing about app-overview
+	}
+	if err == nil || !retryable(err) {
+		c.failures = 0
+		return
+	}
+	c.failures++
+	if c.failures >= c.BreakerThreshold {
+		c.openUntil = time.Now().Add(c.BreakerCooldown)
+		log.Warn("the circuit breaker of %s is open until %s: %v", c.baseURL(), c.openUntil.Format(time.RFC3339), err)
+	}
+}
@@ -0,0 +1,136 @@
+package overview
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/dchaykin/go-modules/service"
+	"github.com/stretchr/testify/require"
+)
+
+// testServer answers with the statuses in the given order, the last one is repeated
+func testServer(t *testing.T, statuses ...int) (*httptest.Server, *atomic.Int32) {
+	calls := &atomic.Int32{}
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		n := int(calls.Add(1))
+		status := statuses[min(n, len(statuses))-1]
+		body, _ := io.ReadAll(r.Body)
+		w.WriteHeader(status)
+		w.Write([]byte(r.URL.RequestURI() + " " + string(body)))
+	}))
+	t.Cleanup(server.Close)
+	return server, calls
+}
+
+func newTestClient(baseURL string) *Client {
+	client := NewClient(service.NewRegistry("").Set(service.Overview, baseURL))
+	client.RetryBackoff = time.Millisecond
+	client.BreakerThreshold = 0
+	return client
+}
+
+func TestClientRetries(t *testing.T) {
+	server, calls := testServer(t, http.StatusBadGateway, http.StatusServiceUnavailable, http.StatusOK)
+	client := newTestClient(server.URL)
+
+	require.NoError(t, client.SaveRow(t.Context(), nil, "contact", []byte(`{"row":{}}`)))
+	require.EqualValues(t, 3, calls.Load())
+
+	// a bulk insert is not idempotent
+	server, calls = testServer(t, http.StatusInternalServerError, http.StatusOK)
+	client = newTestClient(server.URL)
+	err := client.BulkInsert(t.Context(), nil, "contact", []byte(`[]`), true)
+	require.Equal(t, http.StatusInternalServerError, ResponseStatus(err))
+	require.EqualValues(t, 1, calls.Load())
+
+	// client errors are not retried
+	server, calls = testServer(t, http.StatusBadRequest)
+	client = newTestClient(server.URL)
+	err = client.RemoveRow(t.Context(), nil, "contact", "c1")
+	responseErr := &ResponseError{}
+	require.True(t, errors.As(err, &responseErr))
+	require.Equal(t, http.StatusBadRequest, responseErr.StatusCode)
+	require.Equal(t, "/api/remove/contact/c1 ", string(responseErr.Body))
+	require.EqualValues(t, 1, calls.Load())
+}
+
+func TestClientTimeout(t *testing.T) {
+	release := make(chan struct{})
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		select {
+		case <-release:
+		case <-r.Context().Done():
+		}
+	}))
+	t.Cleanup(server.Close)
+	t.Cleanup(func() { close(release) })
+
+	client := newTestClient(server.URL)
+	client.Timeout = 20 * time.Millisecond
+	client.MaxAttempts = 2
+
+	err := client.CreateOverview(t.Context(), nil, "acme", []byte(`{}`), true)
+	require.ErrorIs(t, err, context.DeadlineExceeded)
+	require.Zero(t, ResponseStatus(err))
+}
+
+func TestClientBreakerTimeouts(t *testing.T) {
+	release := make(chan struct{})
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		select {
+		case <-release:
+		case <-r.Context().Done():
+		}
+	}))
+	t.Cleanup(server.Close)
+	t.Cleanup(func() { close(release) })
+
+	client := newTestClient(server.URL)
+	client.Timeout = time.Second
+	client.MaxAttempts = 1
+	client.BreakerThreshold = 1
+	client.BreakerCooldown = time.Minute
+
+	// a short deadline of the caller does not open the breaker
+	for range 2 {
+		ctx, cancel := context.WithTimeout(t.Context(), 20*time.Millisecond)
+		err := client.SaveRow(ctx, nil, "contact", nil)
+		cancel()
+		require.ErrorIs(t, err, context.DeadlineExceeded)
+		require.False(t, IsCircuitOpen(err))
+	}
+
+	// the client's own timeout does
+	client.Timeout = 20 * time.Millisecond
+	require.ErrorIs(t, client.SaveRow(t.Context(), nil, "contact", nil), context.DeadlineExceeded)
+	require.True(t, IsCircuitOpen(client.SaveRow(t.Context(), nil, "contact", nil)))
+}
+
+func TestClientCircuitBreaker(t *testing.T) {
+	server, calls := testServer(t, http.StatusInternalServerError, http.StatusInternalServerError, http.StatusOK)
+	client := newTestClient(server.URL)
+	client.MaxAttempts = 1
+	client.BreakerThreshold = 2
+	client.BreakerCooldown = 50 * time.Millisecond
+
+	for range 2 {
+		require.Equal(t, http.StatusInternalServerError, ResponseStatus(client.SaveRow(t.Context(), nil, "contact", nil)))
+	}
+
+	// the breaker is open, app-overview is not called
+	err := client.SaveRow(t.Context(), nil, "contact", nil)
+	require.True(t, IsCircuitOpen(err))
+	require.EqualValues(t, 2, calls.Load())
+
+	// after the cooldown a successful trial call closes the breaker
+	time.Sleep(60 * time.Millisecond)
+	require.NoError(t, client.SaveRow(t.Context(), nil, "contact", nil))
+	require.NoError(t, client.SaveRow(t.Context(), nil, "contact", nil))
+	require.EqualValues(t, 4, calls.Load())
+}
@@ -0,0 +1,208 @@
+package overview
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/dchaykin/go-modules/database"
+	"github.com/dchaykin/mygolib/log"
+	"go.mongodb.org/mongo-driver/bson"
+)
+
+// DeliverFunc transfers an outbox entry to app-overview
+type DeliverFunc func(ctx context.Context, entry OutboxEntry) error
+
+// Dispatcher delivers the pending outbox entries of a database with Deliver, e.g. Client.Deliver of the
+// client for the environment. A failed delivery is retried with an
+// exponential backoff, after MaxAttempts the entry becomes a dead letter. The entries of an entity are
+// delivered in order, so a dead letter holds back the later entries of its entity until it is requeued
+// or discarded. Only one dispatcher may run per database, otherwise entries are delivered twice.
+type Dispatcher struct {
+	DatabaseName   string
+	PollInterval   time.Duration
+	BatchSize      int64
+	MaxAttempts    int
+	InitialBackoff time.Duration
+	MaxBackoff     time.Duration
+	Deliver        DeliverFunc
+}
+
+func NewDispatcher(databaseName string) *Dispatcher {
+	return &Dispatcher{
+		DatabaseName:   databaseName,
+		PollInterval:   2 * time.Second,
+		BatchSize:      100,
+		MaxAttempts:    10,
+		InitialBackoff: time.Second,
+		MaxBackoff:     5 * time.Minute,
+		Deliver:        DeliverEntry,
+	}
+}
+
+// DeliverEntry delivers the entry with the default client
+func DeliverEntry(ctx context.Context, entry OutboxEntry) error {
+	return DefaultClient().Deliver(ctx, entry)
+}
+
+// Deliver sends the entry to app-overview on behalf of the user who made the change
+func (c *Client) Deliver(ctx context.Context, entry OutboxEntry) error {
+	userIdentity, err := entry.UserIdentity()
+	if err != nil {
+		return fmt.Errorf("could not restore the user identity of the outbox entry %s: %w", entry.ID.Hex(), err)
+	}
+
+	switch entry.Operation {
+	case OutboxSave:
+		if entry.Record == nil {
+			return fmt.Errorf("the outbox entry %s has no overview row", entry.ID.Hex())
+		}
+		return c.saveRecord(ctx, userIdentity, entry.Subject, *entry.Record)
+	case OutboxRemove:
+		return c.RemoveRow(ctx, userIdentity, entry.Subject, entry.UUID)
+	}
+	return fmt.Errorf("unknown outbox operation %s", entry.Operation)
+}
+
+// Run dispatches the outbox every PollInterval until the context is canceled
+func (d *Dispatcher) Run(ctx context.Context) error {
+	log.Info("Dispatching the overview outbox of %s", d.DatabaseName)
+	for {
+		if err := d.dispatchRound(ctx); err != nil {
+			log.Warn("could not dispatch the overview outbox of %s: %v", d.DatabaseName, err)
+		}
+
+		select {
+		case <-ctx.Done():
+			return nil
+		case <-time.After(d.PollInterval):
+		}
+	}
+}
+
+func (d *Dispatcher) dispatchRound(ctx context.Context) error {
+	session, err := database.OpenSession()
+	if err != nil {
+		return err
+	}
+	defer session.Close()
+
+	_, err = d.DispatchPending(ctx, session)
+	return err
+}
+
+// DispatchPending delivers the due entries of one batch and returns the number of delivered entries.
+// Entries of an entity whose previous entry waits for a retry or is a dead letter are held back. They are
+// excluded from the batch query, so held back entries never crowd out the due entries of other entities.
+func (d *Dispatcher) DispatchPending(ctx context.Context, session database.DatabaseSession) (int, error) {
+	now := time.Now()
+	blocked, err := d.blockedKeys(ctx, session, now)
+	if err != nil {
+		return 0, err
+	}
+
+	match := bson.M{"status": OutboxPending, "nextAttempt": bson.M{"$lte": now}}
+	if len(blocked) > 0 {
+		held := bson.A{}
+		for _, key := range blocked {
+			held = append(held, bson.M{"subject": key.Subject, "uuid": key.UUID})
+		}
+		match["$nor"] = held
+	}
+
+	entries := []OutboxEntry{}
+	coll := session.GetCollection(d.DatabaseName, OutboxCollection)
+	err = session.AggregatePipeline(ctx, coll, database.NewPipeline().
+		Match(database.FilterFromBson(match)).
+		Sort(bson.D{{Key: "_id", Value: 1}}).
+		Limit(d.BatchSize), &entries)
+	if err != nil {
+		return 0, err
+	}
+
+	failed := map[string]bool{}
+	delivered := 0
+	for _, entry := range entries {
+		if ctx.Err() != nil {
+			return delivered, nil
+		}
+
+		key := entry.key()
+		if failed[key] {
+			continue
+		}
+
+		if err = d.Deliver(ctx, entry); err != nil {
+			failed[key] = true
+			if err = d.failed(ctx, session, entry, err); err != nil {
+				return delivered, err
+			}
+			continue
+		}
+
+		if err = session.RemoveOne(ctx, coll, bson.M{"_id": entry.ID}); err != nil {
+			return delivered, err
+		}
+		delivered++
+	}
+	return delivered, nil
+}
+
+// outboxKey identifies the entity of outbox entries
+type outboxKey struct {
+	Subject string `bson:"subject"`
+	UUID    string `bson:"uuid"`
+}
+
+// blockedKeys returns the entities with a dead letter or with a pending entry that waits for its retry
+func (d *Dispatcher) blockedKeys(ctx context.Context, session database.DatabaseSession, now time.Time) ([]outboxKey, error) {
+	groups := []struct {
+		Key outboxKey `bson:"_id"`
+	}{}
+	coll := session.GetCollection(d.DatabaseName, OutboxCollection)
+	err := session.AggregatePipeline(ctx, coll, database.NewPipeline().
+		Match(database.FilterFromBson(bson.M{"$or": bson.A{
+			bson.M{"status": OutboxDeadLetter},
+			bson.M{"status": OutboxPending, "nextAttempt": bson.M{"$gt": now}},
+		}})).
+		Group(bson.M{"subject": "$subject", "uuid": "$uuid"}, nil), &groups)
+	if err != nil {
+		return nil, err
+	}
+
+	result := make([]outboxKey, 0, len(groups))
+	for _, group := range groups {
+		result = append(result, group.Key)
+	}
+	return result, nil
+}
+
+func (d *Dispatcher) failed(ctx context.Context, session database.DatabaseSession, entry OutboxEntry, deliveryErr error) error {
+	coll := session.GetCollection(d.DatabaseName, OutboxCollection)
+
+	// an open circuit breaker is no attempt, the entry waits until the breaker lets calls pass again
+	circuitOpen := &CircuitOpenError{}
+	if errors.As(deliveryErr, &circuitOpen) {
+		update := bson.M{"nextAttempt": circuitOpen.Until, "lastError": deliveryErr.Error()}
+		return session.UpdateOne(ctx, coll, bson.M{"_id": entry.ID}, update)
+	}
+
+	attempts := entry.Attempts + 1
+	update := bson.M{"attempts": attempts, "lastError": deliveryErr.Error()}
+	if attempts >= d.MaxAttempts {
+		log.Warn("the overview %s of %s %s failed %d times and has been dead-lettered: %v", entry.Operation, entry.Subject, entry.UUID, attempts, deliveryErr)
+		update["status"] = OutboxDeadLetter
+	} else {
+		update["nextAttempt"] = time.Now().Add(d.backoff(attempts))
+	}
+	return session.UpdateOne(ctx, coll, bson.M{"_id": entry.ID}, update)
+}
+
+func (d *Dispatcher) backoff(attempts int) time.Duration {
+	delay := d.InitialBackoff
+	for i := 1; i < attempts && delay < d.MaxBackoff; i++ {
+		delay *= 2
+	}
+	return min(delay, d.MaxBackoff)
+}
@@ -1,19 +1,28 @@
 package overview
 
 import (
+	"context"
 	"encoding/json"
-	"fmt"
-	"net/http"
-	"os"
 
 	"github.com/dchaykin/go-modules/database"
 	"github.com/dchaykin/go-modules/datamodel"
 	"github.com/dchaykin/go-modules/user"
-	"github.com/dchaykin/mygolib/httpcomm"
 	"github.com/dchaykin/mygolib/log"
 )
 
 func CreateTemporaryOverview(userIdentity user.UserIdentity, pathToDatamodel string) error {
+	return DefaultClient().CreateTemporaryOverview(context.Background(), userIdentity, pathToDatamodel)
+}
+
+func BulkInsertIntoOverview(userIdentity user.UserIdentity, subject string, entityList []database.DomainEntity, isTemporary bool) error {
+	return DefaultClient().BulkInsertEntities(context.Background(), userIdentity, subject, entityList, isTemporary)
+}
+
+func CommitOverview(userIdentity user.UserIdentity, subject string) error {
+	return DefaultClient().CommitTemporaryOverview(context.Background(), userIdentity, subject)
+}
+
+func (c *Client) CreateTemporaryOverview(ctx context.Context, userIdentity user.UserIdentity, pathToDatamodel string) error {
 	tenant := userIdentity.Tenant()
 
 	log.Info("Creating overview for datamodel %s", pathToDatamodel)
@@ -28,17 +37,16 @@ func CreateTemporaryOverview(userIdentity user.UserIdentity, pathToDatamodel str
 		return err
 	}
 
-	endpoint := fmt.Sprintf("https://%s/app-overview/api/create/overview/%s?temporary=true", os.Getenv("MYHOST"), tenant)
-	resp := httpcomm.Post(endpoint, userIdentity, nil, payload)
-	if resp.StatusCode != http.StatusOK {
-		return resp.GetError()
+	err = c.CreateOverview(ctx, userIdentity, tenant, payload, true)
+	if err != nil {
+		return err
 	}
 
-	log.Info("Overview %s config for tenant %s created, version %d. Response: %s", tenantConfig.Subject, tenant, tenantConfig.Version, string(resp.Answer))
+	log.Info("Overview %s config for tenant %s created, version %d", tenantConfig.Subject, tenant, tenantConfig.Version)
 	return nil
 }
 
-func BulkInsertIntoOverview(userIdentity user.UserIdentity, subject string, entityList []database.DomainEntity, isTemporary bool) error {
+func (c *Client) BulkInsertEntities(ctx context.Context, userIdentity user.UserIdentity, subject string, entityList []database.DomainEntity, isTemporary bool) error {
 	recordList := []DataRecord{}
 	for _, entity := range entityList {
 
@@ -46,7 +54,7 @@ func BulkInsertIntoOverview(userIdentity user.UserIdentity, subject string, enti
 		entity.ApplyMapper()
 
 		record := DataRecord{
-			Row:    entity.OverviewRow(),
+			Row:    datamodel.ExportFields(entity.CollectionName(), entity.OverviewRow()),
 			Access: entity.GetAccessConfig(),
 		}
 		recordList = append(recordList, record)
@@ -59,30 +67,23 @@ func BulkInsertIntoOverview(userIdentity user.UserIdentity, subject string, enti
 		return err
 	}
 
-	params := ""
-	if isTemporary {
-		params = "temporary=true"
-	}
-
-	endpoint := fmt.Sprintf("https://%s/app-overview/api/bulk-insert/%s?%s", os.Getenv("MYHOST"), subject, params)
-	resp := httpcomm.Post(endpoint, userIdentity, nil, payload)
-	if resp.StatusCode != http.StatusOK {
-		return resp.GetError()
+	err = c.BulkInsert(ctx, userIdentity, subject, payload, isTemporary)
+	if err != nil {
+		return err
 	}
 
 	log.Info("Bulk insert into overview for subject '%s' completed successfully", subject)
 	return nil
 }
 
-func CommitOverview(userIdentity user.UserIdentity, subject string) error {
+func (c *Client) CommitTemporaryOverview(ctx context.Context, userIdentity user.UserIdentity, subject string) error {
 	tenant := userIdentity.Tenant()
 
 	log.Info("Committing overview for tenant '%s', subject '%s'", tenant, subject)
 
-	endpoint := fmt.Sprintf("https://%s/app-overview/api/commit/overview/%s/%s", os.Getenv("MYHOST"), tenant, subject)
-	resp := httpcomm.Post(endpoint, userIdentity, nil, nil)
-	if resp.StatusCode != http.StatusOK {
-		return resp.GetError()
+	err := c.CommitOverview(ctx, userIdentity, tenant, subject)
+	if err != nil {
+		return err
 	}
 
 	log.Info("Overview for tenant '%s', subject '%s' committed successfully", tenant, subject)
@@ -90,23 +91,26 @@ func CommitOverview(userIdentity user.UserIdentity, subject string) error {
 }
 
 func UpdateOverviewRow(domainEntity database.DomainEntity) error {
+	return DefaultClient().saveRecord(context.Background(), domainEntity.UserIdentity(), domainEntity.CollectionName(), newDataRecord(domainEntity))
+}
+
+func RemoveOverviewRow(domainEntity database.DomainEntity) error {
+	return DefaultClient().RemoveRow(context.Background(), domainEntity.UserIdentity(), domainEntity.CollectionName(), domainEntity.UUID())
+}
+
+func newDataRecord(domainEntity database.DomainEntity) DataRecord {
 	domainEntity.ApplyMapper()
 
-	data := DataRecord{
-		Row:    domainEntity.OverviewRow(),
+	return DataRecord{
+		Row:    datamodel.ExportFields(domainEntity.CollectionName(), domainEntity.OverviewRow()),
 		Access: domainEntity.GetAccessConfig(),
 	}
+}
 
+func (c *Client) saveRecord(ctx context.Context, userIdentity user.UserIdentity, subject string, data DataRecord) error {
 	payload, err := json.Marshal(data)
 	if err != nil {
 		return log.WrapError(err)
 	}
-
-	endpoint := fmt.Sprintf("https://%s/app-overview/api/save/%s", os.Getenv("MYHOST"), domainEntity.CollectionName())
-	resp := httpcomm.Post(endpoint, domainEntity.UserIdentity(), nil, payload)
-	if resp.StatusCode != http.StatusOK {
-		return resp.GetError()
-	}
-
-	return nil
+	return c.SaveRow(ctx, userIdentity, subject, payload)
 }
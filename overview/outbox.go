@@ -0,0 +1,128 @@
+package overview
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"time"
+
+	"github.com/dchaykin/go-modules/database"
+	"github.com/dchaykin/go-modules/user"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+// OutboxCollection holds the pending overview changes of a database
+const OutboxCollection = "overview-outbox"
+
+type OutboxOperation string
+
+const (
+	OutboxSave   OutboxOperation = "save"
+	OutboxRemove OutboxOperation = "remove"
+)
+
+type OutboxStatus string
+
+const (
+	OutboxPending    OutboxStatus = "pending"
+	OutboxDeadLetter OutboxStatus = "dead"
+)
+
+// OutboxEntry is an overview change waiting for its delivery to app-overview. Entries are ordered by ID,
+// the entries of an entity are delivered in the order they have been written.
+type OutboxEntry struct {
+	ID          primitive.ObjectID `bson:"_id"`
+	Operation   OutboxOperation    `bson:"operation"`
+	Subject     string             `bson:"subject"`
+	UUID        string             `bson:"uuid"`
+	Record      *DataRecord        `bson:"record,omitempty"`
+	Identity    string             `bson:"identity,omitempty"`
+	Status      OutboxStatus       `bson:"status"`
+	Attempts    int                `bson:"attempts"`
+	NextAttempt time.Time          `bson:"nextAttempt"`
+	LastError   string             `bson:"lastError,omitempty"`
+	CreatedAt   time.Time          `bson:"createdAt"`
+}
+
+// UserIdentity restores the identity of the user who made the change, nil if none has been recorded
+func (e OutboxEntry) UserIdentity() (user.UserIdentity, error) {
+	if e.Identity == "" {
+		return nil, nil
+	}
+	return user.ParseUserIdentity([]byte(e.Identity))
+}
+
+func (e OutboxEntry) key() string {
+	return e.Subject + "/" + e.UUID
+}
+
+// EnqueueUpdate records that the overview row of domainEntity must be created or updated. It is meant to be
+// called with the session of the transaction which saves the entity, so that both writes succeed or fail together.
+func EnqueueUpdate(ctx context.Context, tx database.DatabaseSession, domainEntity database.DomainEntity) error {
+	record := newDataRecord(domainEntity)
+	return enqueue(ctx, tx, domainEntity, OutboxSave, &record)
+}
+
+// EnqueueRemove records that the overview row of domainEntity must be removed
+func EnqueueRemove(ctx context.Context, tx database.DatabaseSession, domainEntity database.DomainEntity) error {
+	return enqueue(ctx, tx, domainEntity, OutboxRemove, nil)
+}
+
+func enqueue(ctx context.Context, tx database.DatabaseSession, domainEntity database.DomainEntity, operation OutboxOperation, record *DataRecord) error {
+	identity := ""
+	if userIdentity := domainEntity.UserIdentity(); userIdentity != nil {
+		data, err := json.Marshal(userIdentity)
+		if err != nil {
+			return fmt.Errorf("could not record the user identity of the overview change: %w", err)
+		}
+		identity = string(data)
+	}
+
+	now := time.Now()
+	entry := OutboxEntry{
+		ID:          primitive.NewObjectIDFromTimestamp(now),
+		Operation:   operation,
+		Subject:     domainEntity.CollectionName(),
+		UUID:        domainEntity.UUID(),
+		Record:      record,
+		Identity:    identity,
+		Status:      OutboxPending,
+		NextAttempt: now,
+		CreatedAt:   now,
+	}
+	coll := tx.GetCollection(domainEntity.DatabaseName(), OutboxCollection)
+	return tx.InsertOne(ctx, coll, entry)
+}
+
+// DeadLetters returns the entries which could not be delivered after the maximum number of attempts
+func DeadLetters(ctx context.Context, session database.DatabaseSession, databaseName string) ([]OutboxEntry, error) {
+	result := []OutboxEntry{}
+	coll := session.GetCollection(databaseName, OutboxCollection)
+	err := session.AggregatePipeline(ctx, coll, database.NewPipeline().
+		Match(database.FilterFromBson(bson.M{"status": OutboxDeadLetter})).
+		Sort(bson.D{{Key: "_id", Value: 1}}), &result)
+	return result, err
+}
+
+// DiscardDeadLetter removes a dead letter, which releases the later entries of its entity
+func DiscardDeadLetter(ctx context.Context, session database.DatabaseSession, databaseName string, id primitive.ObjectID) error {
+	coll := session.GetCollection(databaseName, OutboxCollection)
+	return session.RemoveOne(ctx, coll, bson.M{"_id": id, "status": OutboxDeadLetter})
+}
+
+// RequeueDeadLetters makes the dead letters pending again, e.g. after app-overview has been repaired
+func RequeueDeadLetters(ctx context.Context, session database.DatabaseSession, databaseName string) (int, error) {
+	entries, err := DeadLetters(ctx, session, databaseName)
+	if err != nil {
+		return 0, err
+	}
+	coll := session.GetCollection(databaseName, OutboxCollection)
+	for _, entry := range entries {
+		update := bson.M{"status": OutboxPending, "attempts": 0, "nextAttempt": time.Now()}
+		if err = session.UpdateOne(ctx, coll, bson.M{"_id": entry.ID}, update); err != nil {
+			return 0, err
+		}
+	}
+	return len(entries), nil
+}
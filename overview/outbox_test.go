@@ -0,0 +1,314 @@
+package overview
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/dchaykin/go-modules/database"
+	"github.com/dchaykin/go-modules/datamodel"
+	"github.com/dchaykin/go-modules/user"
+	"github.com/stretchr/testify/require"
+	"go.mongodb.org/mongo-driver/bson"
+)
+
+type contact struct {
+	datamodel.Record `bson:",inline"`
+}
+
+func (c contact) CollectionName() string {
+	return "contact"
+}
+
+func (c contact) DatabaseName() string {
+	return "outboxTest"
+}
+
+func (c contact) CreateEmpty() database.DomainEntity {
+	return &contact{}
+}
+
+func (c *contact) GetAccessConfig() []database.AccessConfig {
+	return []database.AccessConfig{{Partner: "p1"}}
+}
+
+func (c *contact) OverviewRow() map[string]any {
+	return c.Fields
+}
+
+func newContact(t *testing.T, uuid, name string) *contact {
+	userIdentity, err := user.ParseUserIdentity([]byte(`{"claims":{"userName":"jdoe"},"currentTenant":"acme"}`))
+	require.NoError(t, err)
+
+	result := &contact{}
+	result.Fields = map[string]any{"uuid": uuid, "name": name}
+	result.SetUserIdentity(userIdentity)
+	return result
+}
+
+func openOutboxSession(t *testing.T) database.DatabaseSession {
+	database.UseMemoryBackend()
+	t.Cleanup(func() { database.SetBackend(nil) })
+
+	session, err := database.OpenSession()
+	require.NoError(t, err)
+	t.Cleanup(func() { session.Close() })
+	return session
+}
+
+// recorder is a DeliverFunc which fails for the uuids in failing
+type recorder struct {
+	delivered []OutboxEntry
+	failing   map[string]bool
+}
+
+func (r *recorder) deliver(ctx context.Context, entry OutboxEntry) error {
+	if r.failing[entry.UUID] {
+		return errors.New("overview unavailable")
+	}
+	r.delivered = append(r.delivered, entry)
+	return nil
+}
+
+func newTestDispatcher(r *recorder) *Dispatcher {
+	d := NewDispatcher("outboxTest")
+	d.MaxAttempts = 3
+	d.InitialBackoff = 0
+	d.Deliver = r.deliver
+	return d
+}
+
+func TestEnqueueInTransaction(t *testing.T) {
+	session := openOutboxSession(t)
+	ctx := t.Context()
+
+	err := session.WithTransaction(ctx, func(ctx context.Context, tx database.DatabaseSession) error {
+		entity := newContact(t, "c1", "Alpha")
+		require.NoError(t, tx.ReplaceEntityByUUID(ctx, entity, true))
+		require.NoError(t, EnqueueUpdate(ctx, tx, entity))
+		return errors.New("rollback")
+	})
+	require.EqualError(t, err, "rollback")
+
+	r := &recorder{}
+	delivered, err := newTestDispatcher(r).DispatchPending(ctx, session)
+	require.NoError(t, err)
+	require.Zero(t, delivered)
+
+	err = session.WithTransaction(ctx, func(ctx context.Context, tx database.DatabaseSession) error {
+		entity := newContact(t, "c1", "Alpha")
+		require.NoError(t, tx.ReplaceEntityByUUID(ctx, entity, true))
+		return EnqueueUpdate(ctx, tx, entity)
+	})
+	require.NoError(t, err)
+	require.NoError(t, EnqueueRemove(ctx, session, newContact(t, "c1", "")))
+
+	delivered, err = newTestDispatcher(r).DispatchPending(ctx, session)
+	require.NoError(t, err)
+	require.Equal(t, 2, delivered)
+	require.Len(t, r.delivered, 2)
+
+	save := r.delivered[0]
+	require.Equal(t, OutboxSave, save.Operation)
+	require.Equal(t, "contact", save.Subject)
+	require.Equal(t, "c1", save.Record.UUID())
+	require.Equal(t, "Alpha", save.Record.Row["name"])
+	require.Equal(t, []database.AccessConfig{{Partner: "p1"}}, save.Record.Access)
+	userIdentity, err := save.UserIdentity()
+	require.NoError(t, err)
+	require.Equal(t, "jdoe", userIdentity.Username())
+	require.Equal(t, "acme", userIdentity.Tenant())
+
+	require.Equal(t, OutboxRemove, r.delivered[1].Operation)
+	require.Nil(t, r.delivered[1].Record)
+
+	// delivered entries are removed from the outbox
+	delivered, err = newTestDispatcher(r).DispatchPending(ctx, session)
+	require.NoError(t, err)
+	require.Zero(t, delivered)
+}
+
+func TestEnqueueRedactsMasked(t *testing.T) {
+	session := openOutboxSession(t)
+	datamodel.RegisterMasking("contact", datamodel.TenantConfig{
+		Subject:   "contact",
+		DataModel: map[string]datamodel.CustomFields{"contact": {"uuid": {}, "name": {}, "pin": {"masked": true}}},
+	}, datamodel.MaskedPlain)
+	t.Cleanup(func() { datamodel.RegisterMasking("contact", datamodel.TenantConfig{}, datamodel.MaskedPlain) })
+
+	entity := newContact(t, "c1", "Alpha")
+	entity.SetValue("pin", "1234")
+	require.NoError(t, EnqueueUpdate(t.Context(), session, entity))
+	require.Equal(t, "1234", entity.GetValue("pin"))
+
+	r := &recorder{}
+	_, err := newTestDispatcher(r).DispatchPending(t.Context(), session)
+	require.NoError(t, err)
+	require.Len(t, r.delivered, 1)
+	require.Equal(t, datamodel.MaskedValue, r.delivered[0].Record.Row["pin"])
+	require.Equal(t, "Alpha", r.delivered[0].Record.Row["name"])
+}
+
+func TestEnqueueStripsEncrypted(t *testing.T) {
+	session := openOutboxSession(t)
+	keys, err := datamodel.NewStaticKeys("1", map[string][]byte{"1": []byte("0123456789abcdef")})
+	require.NoError(t, err)
+	fe := datamodel.NewFieldEncryption(keys)
+	fe.Register("contact", datamodel.TenantConfig{
+		Subject:   "contact",
+		DataModel: map[string]datamodel.CustomFields{"contact": {"uuid": {}, "name": {}, "iban": {"encrypted": true}}},
+	})
+	database.SetFieldCodec(fe)
+	t.Cleanup(func() { database.SetFieldCodec(nil) })
+
+	entity := newContact(t, "c1", "Alpha")
+	entity.SetValue("iban", "DE00123")
+	require.NoError(t, EnqueueUpdate(t.Context(), session, entity))
+
+	entries := []bson.M{}
+	require.NoError(t, session.FindMany(t.Context(), session.GetCollection("outboxTest", OutboxCollection), bson.M{}, &entries))
+	require.Len(t, entries, 1)
+	require.NotContains(t, fmt.Sprintf("%v", entries[0]), "DE00123")
+
+	r := &recorder{}
+	_, err = newTestDispatcher(r).DispatchPending(t.Context(), session)
+	require.NoError(t, err)
+	require.Len(t, r.delivered, 1)
+	require.NotContains(t, r.delivered[0].Record.Row, "iban")
+	require.Equal(t, "Alpha", r.delivered[0].Record.Row["name"])
+}
+
+func TestDispatcherRetries(t *testing.T) {
+	session := openOutboxSession(t)
+	ctx := t.Context()
+
+	require.NoError(t, EnqueueUpdate(ctx, session, newContact(t, "c1", "Alpha")))
+	require.NoError(t, EnqueueUpdate(ctx, session, newContact(t, "c2", "Bravo")))
+	require.NoError(t, EnqueueRemove(ctx, session, newContact(t, "c1", "")))
+
+	r := &recorder{failing: map[string]bool{"c1": true}}
+	d := newTestDispatcher(r)
+
+	// c1 fails and holds back its removal, c2 is delivered
+	for range d.MaxAttempts - 1 {
+		_, err := d.DispatchPending(ctx, session)
+		require.NoError(t, err)
+	}
+	require.Len(t, r.delivered, 1)
+	require.Equal(t, "c2", r.delivered[0].UUID)
+	dead, err := DeadLetters(ctx, session, "outboxTest")
+	require.NoError(t, err)
+	require.Empty(t, dead)
+
+	// the last attempt moves the save of c1 into the dead letters
+	_, err = d.DispatchPending(ctx, session)
+	require.NoError(t, err)
+	dead, err = DeadLetters(ctx, session, "outboxTest")
+	require.NoError(t, err)
+	require.Len(t, dead, 1)
+	require.Equal(t, OutboxSave, dead[0].Operation)
+	require.Equal(t, 3, dead[0].Attempts)
+	require.Equal(t, "overview unavailable", dead[0].LastError)
+
+	// the dead letter holds back the removal of c1 until it is requeued
+	r.failing = nil
+	delivered, err := d.DispatchPending(ctx, session)
+	require.NoError(t, err)
+	require.Zero(t, delivered)
+
+	requeued, err := RequeueDeadLetters(ctx, session, "outboxTest")
+	require.NoError(t, err)
+	require.Equal(t, 1, requeued)
+	delivered, err = d.DispatchPending(ctx, session)
+	require.NoError(t, err)
+	require.Equal(t, 2, delivered)
+	require.Equal(t, OutboxSave, r.delivered[1].Operation)
+	require.Equal(t, OutboxRemove, r.delivered[2].Operation)
+}
+
+func TestDiscardDeadLetter(t *testing.T) {
+	session := openOutboxSession(t)
+	ctx := t.Context()
+
+	require.NoError(t, EnqueueUpdate(ctx, session, newContact(t, "c1", "Alpha")))
+	require.NoError(t, EnqueueRemove(ctx, session, newContact(t, "c1", "")))
+
+	r := &recorder{failing: map[string]bool{"c1": true}}
+	d := newTestDispatcher(r)
+	d.MaxAttempts = 1
+	_, err := d.DispatchPending(ctx, session)
+	require.NoError(t, err)
+
+	dead, err := DeadLetters(ctx, session, "outboxTest")
+	require.NoError(t, err)
+	require.Len(t, dead, 1)
+	require.NoError(t, DiscardDeadLetter(ctx, session, "outboxTest", dead[0].ID))
+
+	r.failing = nil
+	delivered, err := d.DispatchPending(ctx, session)
+	require.NoError(t, err)
+	require.Equal(t, 1, delivered)
+	require.Equal(t, OutboxRemove, r.delivered[0].Operation)
+}
+
+func TestDispatcherBackoff(t *testing.T) {
+	d := NewDispatcher("outboxTest")
+	require.Equal(t, d.InitialBackoff, d.backoff(1))
+	require.Equal(t, 4*d.InitialBackoff, d.backoff(3))
+	require.Equal(t, d.MaxBackoff, d.backoff(20))
+}
+
+func TestDispatcherCircuitOpen(t *testing.T) {
+	session := openOutboxSession(t)
+	ctx := t.Context()
+
+	require.NoError(t, EnqueueUpdate(ctx, session, newContact(t, "c1", "Alpha")))
+
+	d := newTestDispatcher(&recorder{})
+	d.MaxAttempts = 1
+	d.Deliver = func(ctx context.Context, entry OutboxEntry) error {
+		return &CircuitOpenError{Until: time.Now().Add(time.Hour)}
+	}
+	_, err := d.DispatchPending(ctx, session)
+	require.NoError(t, err)
+
+	// the entry is neither counted as attempt nor dead-lettered
+	dead, err := DeadLetters(ctx, session, "outboxTest")
+	require.NoError(t, err)
+	require.Empty(t, dead)
+
+	r := &recorder{}
+	d.Deliver = r.deliver
+	delivered, err := d.DispatchPending(ctx, session)
+	require.NoError(t, err)
+	require.Zero(t, delivered)
+}
+
+func TestDispatcherSkipsHeldBackEntries(t *testing.T) {
+	session := openOutboxSession(t)
+	ctx := t.Context()
+
+	for _, uuid := range []string{"c1", "c2", "c3"} {
+		require.NoError(t, EnqueueUpdate(ctx, session, newContact(t, uuid, "Alpha")))
+	}
+	r := &recorder{failing: map[string]bool{"c1": true, "c2": true, "c3": true}}
+	d := newTestDispatcher(r)
+	d.BatchSize = 2
+	d.InitialBackoff = time.Hour
+	_, err := d.DispatchPending(ctx, session)
+	require.NoError(t, err)
+	_, err = d.DispatchPending(ctx, session)
+	require.NoError(t, err)
+
+	// more entries wait for their retry than fit into a batch, the later entries of c1 wait behind them
+	require.NoError(t, EnqueueRemove(ctx, session, newContact(t, "c1", "")))
+	require.NoError(t, EnqueueRemove(ctx, session, newContact(t, "c1", "")))
+	require.NoError(t, EnqueueUpdate(ctx, session, newContact(t, "c4", "Delta")))
+
+	delivered, err := d.DispatchPending(ctx, session)
+	require.NoError(t, err)
+	require.Equal(t, 1, delivered)
+	require.Equal(t, "c4", r.delivered[0].UUID)
+}
@@ -0,0 +1,95 @@
+package service
+
+import (
+	"os"
+	"strings"
+	"sync"
+)
+
+const (
+	Overview  = "app-overview"
+	CloudFile = "app-cloudfile"
+	Config    = "app-config"
+)
+
+// Registry holds the base URLs of the services, e.g. "http://localhost:8080" for app-overview.
+// A service without an own URL is expected under https://<host>/<service name>.
+type Registry struct {
+	mu      sync.RWMutex
+	host    string
+	fromEnv bool
+	urls    map[string]string
+}
+
+// NewRegistry creates a registry for the services on host
+func NewRegistry(host string) *Registry {
+	return &Registry{host: host, urls: map[string]string{}}
+}
+
+// FromEnv creates a registry which reads the environment on every lookup: the base URL of a service is taken
+// from the variable named after it, e.g. APP_OVERVIEW_URL, otherwise the service is expected on MYHOST.
+// URLs set explicitly take precedence.
+func FromEnv() *Registry {
+	return &Registry{fromEnv: true, urls: map[string]string{}}
+}
+
+// EnvName returns the environment variable for the base URL of a service, e.g. APP_OVERVIEW_URL
+func EnvName(name string) string {
+	return strings.ToUpper(strings.ReplaceAll(name, "-", "_")) + "_URL"
+}
+
+// Set assigns a base URL to a service and returns the registry for chaining
+func (r *Registry) Set(name, baseURL string) *Registry {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.urls[name] = strings.TrimSuffix(baseURL, "/")
+	return r
+}
+
+func (r *Registry) BaseURL(name string) string {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	if baseURL, ok := r.urls[name]; ok {
+		return baseURL
+	}
+
+	host := r.host
+	if r.fromEnv {
+		if baseURL := os.Getenv(EnvName(name)); baseURL != "" {
+			return strings.TrimSuffix(baseURL, "/")
+		}
+		host = os.Getenv("MYHOST")
+	}
+	return "https://" + host + "/" + name
+}
+
+// URL joins the base URL of the service and the path elements, e.g. URL(Overview, "api", "save", subject)
+func (r *Registry) URL(name string, path ...string) string {
+	result := r.BaseURL(name)
+	for _, element := range path {
+		result += "/" + strings.Trim(element, "/")
+	}
+	return result
+}
+
+var (
+	defaultMu       sync.RWMutex
+	defaultRegistry = FromEnv()
+)
+
+// Default returns the registry used by the packages of this module unless another one is injected
+func Default() *Registry {
+	defaultMu.RLock()
+	defer defaultMu.RUnlock()
+	return defaultRegistry
+}
+
+// SetDefault replaces the default registry, nil restores the registry read from the environment
+func SetDefault(registry *Registry) {
+	defaultMu.Lock()
+	defer defaultMu.Unlock()
+	if registry == nil {
+		registry = FromEnv()
+	}
+	defaultRegistry = registry
+}
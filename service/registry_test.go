@@ -0,0 +1,34 @@
+package service
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestRegistry(t *testing.T) {
+	registry := NewRegistry("myhost").Set(Overview, "http://localhost:8080/")
+	require.Equal(t, "http://localhost:8080/api/save/contact", registry.URL(Overview, "api", "save", "contact"))
+	require.Equal(t, "https://myhost/app-cloudfile/api/upload", registry.URL(CloudFile, "api", "upload"))
+	require.Equal(t, "https://myhost/app-config", registry.BaseURL(Config))
+}
+
+func TestRegistryFromEnv(t *testing.T) {
+	t.Setenv("MYHOST", "example.org")
+	t.Setenv("APP_CONFIG_URL", "http://127.0.0.1:9000")
+
+	registry := FromEnv()
+	require.Equal(t, "https://example.org/app-overview/api", registry.URL(Overview, "api"))
+	require.Equal(t, "http://127.0.0.1:9000/auth", registry.URL(Config, "auth"))
+
+	// the environment is read on every lookup
+	t.Setenv("MYHOST", "other.org")
+	require.Equal(t, "https://other.org/app-overview", registry.BaseURL(Overview))
+
+	registry.Set(Overview, "http://stand-in")
+	require.Equal(t, "http://stand-in", registry.BaseURL(Overview))
+
+	SetDefault(NewRegistry("test"))
+	t.Cleanup(func() { SetDefault(nil) })
+	require.Equal(t, "https://test/app-config", Default().BaseURL(Config))
+}
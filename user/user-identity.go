@@ -89,8 +89,14 @@ func GetUserIdentityFromRequest(r http.Request) (UserIdentity, error) {
 	if userInfo == "" {
 		return nil, fmt.Errorf("no user info in the request found")
 	}
+	return ParseUserIdentity([]byte(userInfo))
+}
+
+// ParseUserIdentity restores a user identity from its JSON form, as sent in the header X-User-Info
+// or produced by json.Marshal of an identity returned by this package
+func ParseUserIdentity(data []byte) (UserIdentity, error) {
 	ui := userToken{}
-	err := json.Unmarshal([]byte(userInfo), &ui)
+	err := json.Unmarshal(data, &ui)
 	return ui, err
 }
 